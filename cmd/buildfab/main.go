@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"strings"
 	"syscall"
 	"testing"
@@ -67,6 +68,18 @@ var (
 	only          []string
 	withRequires  bool
 	envVars       []string
+	envFiles      []string
+	secretNames   []string
+	assumeYes     bool
+	reports       []string
+	tracePath     string
+	uiMode        string
+	timestamps    bool
+	ciMode        string
+	followLogs    bool
+	listRuns      bool
+	historyLimit  int
+	trendWindow  int
 	showGraph     bool
 )
 
@@ -139,8 +152,91 @@ var listStepsCmd = &cobra.Command{
 	RunE:  runListSteps,
 }
 
+// envCmd represents the env command
+var envCmd = &cobra.Command{
+	Use:   "env <action> | env <stage> <step>",
+	Short: "Print the environment an action would see",
+	Long: `Print the exact environment passed to an action process, after env_policy
+filtering, env files, scoped env sections and command line variables.
+With two arguments the action is resolved as a step of the given stage.
+Secret values are masked.`,
+	Args: cobra.RangeArgs(1, 2),
+	RunE: runEnv,
+}
+
+// doctorCmd represents the doctor command
+var doctorCmd = &cobra.Command{
+	Use:   "doctor",
+	Short: "Check the environment for required tools",
+	Long: `Check the tools declared in the tools: section of the project configuration
+and report found, missing and outdated tools with install hints. Also shows the
+detected platform and the discovered action plugins.`,
+	Args: cobra.NoArgs,
+	RunE: runDoctor,
+}
+
+// logsCmd represents the logs command
+var logsCmd = &cobra.Command{
+	Use:   "logs [run-id] [step]",
+	Short: "Show step logs of stage runs",
+	Long: `Show the step logs kept in .buildfab/runs. Without a run ID the latest run
+is shown; a single argument that is not a run ID is a step of the latest run.
+Each line has a timestamp and its stream: stdout, stderr or status.
+With --follow the logs are shown as they are written until the run ends.`,
+	Args: cobra.MaximumNArgs(2),
+	RunE: runLogs,
+}
+
+// historyCmd represents the history command
+var historyCmd = &cobra.Command{
+	Use:   "history [stage]",
+	Short: "Show recorded stage runs",
+	Long: `Show the stage runs recorded in .buildfab/history with their git commit,
+status, duration and failed steps, newest last. A commit marked + had
+uncommitted changes.`,
+	Args: cobra.MaximumNArgs(1),
+	RunE: runHistory,
+}
+
+// statsCmd represents the stats command
+var statsCmd = &cobra.Command{
+	Use:   "stats <stage>",
+	Short: "Show duration and failure statistics of a stage",
+	Long: `Show p50 and p95 durations and failure rates of a stage and its steps over
+the runs recorded in .buildfab/history. The trend is the change of the p50
+duration of the last runs compared with the same number of runs before them.`,
+	Args: cobra.ExactArgs(1),
+	RunE: runStats,
+}
+
+// flakyCmd represents the flaky command
+var flakyCmd = &cobra.Command{
+	Use:   "flaky [stage]",
+	Short: "Show steps that passed and failed on the same commit",
+	Long: `Show steps whose result flipped between pass and fail across runs on the same
+git commit, from the runs recorded in .buildfab/history. Runs with uncommitted
+changes are ignored.`,
+	Args: cobra.MaximumNArgs(1),
+	RunE: runFlaky,
+}
+
+// analyzeCmd represents the analyze command
+var analyzeCmd = &cobra.Command{
+	Use:   "analyze <trace>",
+	Short: "Analyze a trace written with --trace",
+	Long: `Analyze a Chrome trace written with --trace: the critical path through the
+step dependency graph, the parallelism and slot utilisation of the run and the
+slack of each step, the time it could take longer without delaying the stage.`,
+	Args: cobra.ExactArgs(1),
+	RunE: runAnalyze,
+}
+
 func init() {
 	listStepsCmd.Flags().BoolVarP(&showGraph, "graph", "g", false, "show steps as a dependency graph")
+	logsCmd.Flags().BoolVarP(&followLogs, "follow", "f", false, "follow the logs until the run ends")
+	logsCmd.Flags().BoolVarP(&listRuns, "list", "l", false, "list the recorded runs")
+	historyCmd.Flags().IntVarP(&historyLimit, "limit", "n", 20, "number of runs shown, 0 for all")
+	statsCmd.Flags().IntVar(&trendWindow, "last", 10, "number of recent runs compared with the runs before them, 0 for no trends")
 }
 
 func main() {
@@ -155,6 +251,14 @@ func main() {
 	rootCmd.PersistentFlags().StringSliceVar(&only, "only", []string{}, "only run steps matching these labels")
 	rootCmd.PersistentFlags().BoolVar(&withRequires, "with-requires", false, "include required dependencies when running single step")
 	rootCmd.PersistentFlags().StringSliceVar(&envVars, "env", []string{}, "export environment variables to actions")
+	rootCmd.PersistentFlags().StringSliceVar(&envFiles, "env-file", []string{}, "load variables from dotenv files, a secret: prefix masks every value (secret:.env.ci)")
+	rootCmd.PersistentFlags().StringSliceVar(&secretNames, "secret", []string{}, "mask the values of these variables in output, including --env values")
+	rootCmd.PersistentFlags().BoolVarP(&assumeYes, "yes", "y", false, "approve confirm steps without prompting")
+	rootCmd.PersistentFlags().StringArrayVar(&reports, "report", []string{}, "write a stage report as format=path (junit, markdown, html, json)")
+	rootCmd.PersistentFlags().StringVar(&tracePath, "trace", "", "write a Chrome trace of the stage run to this file")
+	rootCmd.PersistentFlags().StringVar(&uiMode, "ui", buildfab.UIOrdered, "step output renderer: ordered, tty (live display on a terminal) or prefixed")
+	rootCmd.PersistentFlags().BoolVar(&timestamps, "timestamps", false, "prefix output lines with their time (--ui=prefixed)")
+	rootCmd.PersistentFlags().StringVar(&ciMode, "ci", buildfab.CIAuto, "CI groups and annotations: auto (detected from the environment), none, github, gitlab or teamcity")
 	
 	// Add version flags
 	rootCmd.Flags().BoolP("version", "", false, "print version and module name")
@@ -167,6 +271,13 @@ func main() {
 	rootCmd.AddCommand(listStagesCmd)
 	rootCmd.AddCommand(listStepsCmd)
 	rootCmd.AddCommand(validateCmd)
+	rootCmd.AddCommand(envCmd)
+	rootCmd.AddCommand(doctorCmd)
+	rootCmd.AddCommand(analyzeCmd)
+	rootCmd.AddCommand(logsCmd)
+	rootCmd.AddCommand(historyCmd)
+	rootCmd.AddCommand(statsCmd)
+	rootCmd.AddCommand(flakyCmd)
 	
 	// Execute the root command
 	if err := rootCmd.Execute(); err != nil {
@@ -267,6 +378,17 @@ func runStageDirect(cmd *cobra.Command, args []string) error {
 	
 	stageName := args[0]
 	
+	reportSpecs, err := parseReports(reports)
+	if err != nil {
+		return err
+	}
+	if err := validateUI(uiMode); err != nil {
+		return err
+	}
+	if err := validateCI(ciMode); err != nil {
+		return err
+	}
+	
 	// Create variables map from environment variables
 	variables := make(map[string]string)
 	for _, envVar := range envVars {
@@ -295,6 +417,16 @@ func runStageDirect(cmd *cobra.Command, args []string) error {
 		ErrorOutput: os.Stderr,
 		Only:        only,
 		WithRequires: withRequires,
+		EnvFiles:    envFiles,
+		Secrets:     secretNames,
+		AssumeYes:   assumeYes,
+		Reports:     reportSpecs,
+		TracePath:   tracePath,
+		RunLogs:     true,
+		History:     true,
+		UI:          uiMode,
+		Timestamps:  timestamps,
+		CI:          ciMode,
 	}
 	
 	// Create simple runner
@@ -395,6 +527,9 @@ func runActionDirect(cmd *cobra.Command, args []string) error {
 		Output:      os.Stdout,
 		ErrorOutput: os.Stderr,
 		Only:        only,
+		EnvFiles:    envFiles,
+		Secrets:     secretNames,
+		AssumeYes:   assumeYes,
 	}
 	
 	// Create simple runner
@@ -430,11 +565,272 @@ func runStage(cmd *cobra.Command, args []string) error {
 	return runStageDirect(cmd, args)
 }
 
+// validateUI checks the --ui flag
+func validateUI(ui string) error {
+	switch ui {
+	case "", buildfab.UIOrdered, buildfab.UITTY, buildfab.UIPrefixed:
+		return nil
+	default:
+		return fmt.Errorf("invalid --ui %q: must be ordered, tty or prefixed", ui)
+	}
+}
+
+// validateCI checks the --ci flag
+func validateCI(ci string) error {
+	switch ci {
+	case "", buildfab.CIAuto, buildfab.CINone, buildfab.CIGitHub, buildfab.CIGitLab, buildfab.CITeamCity:
+		return nil
+	default:
+		return fmt.Errorf("invalid --ci %q: must be auto, none, github, gitlab or teamcity", ci)
+	}
+}
+
+// parseReports parses the --report flags
+func parseReports(values []string) ([]buildfab.ReportSpec, error) {
+	var specs []buildfab.ReportSpec
+	for _, value := range values {
+		spec, err := buildfab.ParseReportSpec(value)
+		if err != nil {
+			return nil, err
+		}
+		specs = append(specs, spec)
+	}
+	return specs, nil
+}
+
 // runAction handles the action command
 func runAction(cmd *cobra.Command, args []string) error {
 	return runActionDirect(cmd, args)
 }
 
+// runEnv handles the env command
+func runEnv(cmd *cobra.Command, args []string) error {
+	// Load configuration using library API
+	cfg, err := buildfab.LoadConfig(configPath)
+	if err != nil {
+		return handleConfigLoadError(configPath, err)
+	}
+	
+	stageName, actionName := "", args[0]
+	if len(args) == 2 {
+		stageName, actionName = args[0], args[1]
+	}
+	
+	// Create variables map from environment variables
+	variables := make(map[string]string)
+	for _, envVar := range envVars {
+		parts := strings.SplitN(envVar, "=", 2)
+		if len(parts) == 2 {
+			variables[parts[0]] = parts[1]
+		}
+	}
+	
+	opts := buildfab.DefaultRunOptions()
+	opts.Variables = buildfab.AddPlatformVariables(variables)
+	opts.EnvFiles = envFiles
+	opts.Secrets = secretNames
+	runner := buildfab.NewRunner(cfg, opts)
+	
+	env, err := runner.Environment(stageName, actionName)
+	if err != nil {
+		return err
+	}
+	for _, entry := range env {
+		fmt.Println(entry)
+	}
+	
+	return nil
+}
+
+// runDoctor handles the doctor command
+func runDoctor(cmd *cobra.Command, args []string) error {
+	// Load configuration using library API
+	cfg, err := buildfab.LoadConfig(configPath)
+	if err != nil {
+		return handleConfigLoadError(configPath, err)
+	}
+	
+	platform := buildfab.GetPlatformVariablesMap()
+	fmt.Printf("Platform: %s/%s (%s %s)\n", platform["platform"], platform["arch"], platform["os"], platform["os_version"])
+	fmt.Printf("Configuration: %s (project %s)\n", configPath, cfg.Project.Name)
+	fmt.Println()
+	
+	failed := 0
+	if len(cfg.Tools) == 0 {
+		fmt.Println("Tools: none declared in the tools: section")
+	} else {
+		runner := buildfab.NewRunner(cfg, buildfab.DefaultRunOptions())
+		statuses, err := runner.CheckTools(context.Background())
+		if err != nil {
+			return err
+		}
+		fmt.Println("Tools:")
+		buildfab.FormatToolTable(os.Stdout, statuses)
+		for _, status := range statuses {
+			if status.Failed() {
+				failed++
+			}
+			if status.State != buildfab.ToolFound && status.Tool.Install != "" {
+				fmt.Printf("  %s: install with: %s\n", status.Tool.Name, status.Tool.Install)
+			}
+		}
+	}
+	
+	plugins := buildfab.DiscoverPlugins(buildfab.PluginSearchPath(cfg))
+	if len(plugins) > 0 {
+		fmt.Println()
+		fmt.Println("Plugins:")
+		for _, plugin := range plugins {
+			fmt.Printf("  %-20s %s\n", buildfab.PluginNamespace+plugin.Name, plugin.Path)
+		}
+	}
+	
+	if failed > 0 {
+		err := fmt.Errorf("%d required tools missing or outdated", failed)
+		// In test mode, return the error instead of exiting
+		if testing.Testing() {
+			return err
+		}
+		// Report without cobra usage output, the table already explains the failure
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	return nil
+}
+
+// runLogs handles the logs command
+func runLogs(cmd *cobra.Command, args []string) error {
+	stateDir := filepath.Join(filepath.Dir(configPath), buildfab.StateDir)
+	if listRuns {
+		runs, err := buildfab.ListRuns(stateDir)
+		if err != nil {
+			return err
+		}
+		if len(runs) == 0 {
+			fmt.Println("No runs recorded")
+			return nil
+		}
+		buildfab.FormatRunTable(os.Stdout, runs)
+		return nil
+	}
+	
+	// A single argument is a run ID if such a run exists, else a step of the latest run
+	runID, stepName := "", ""
+	switch len(args) {
+	case 1:
+		if _, err := buildfab.FindRun(stateDir, args[0]); err == nil {
+			runID = args[0]
+		} else {
+			stepName = args[0]
+		}
+	case 2:
+		runID, stepName = args[0], args[1]
+	}
+	run, err := buildfab.FindRun(stateDir, runID)
+	if err != nil {
+		return err
+	}
+	
+	if followLogs {
+		ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer cancel()
+		return buildfab.FollowRunLogs(ctx, os.Stdout, run, stepName)
+	}
+	return buildfab.WriteRunLogs(os.Stdout, run, stepName)
+}
+
+// readHistory reads the run history next to the configuration file,
+// keeping the records of a stage when it is given
+func readHistory(stage string) ([]buildfab.HistoryRecord, error) {
+	records, err := buildfab.ReadHistory(filepath.Join(filepath.Dir(configPath), buildfab.StateDir))
+	if err != nil {
+		return nil, err
+	}
+	if stage == "" {
+		return records, nil
+	}
+	var filtered []buildfab.HistoryRecord
+	for _, record := range records {
+		if record.Stage == stage {
+			filtered = append(filtered, record)
+		}
+	}
+	return filtered, nil
+}
+
+// runHistory handles the history command
+func runHistory(cmd *cobra.Command, args []string) error {
+	stage := ""
+	if len(args) > 0 {
+		stage = args[0]
+	}
+	records, err := readHistory(stage)
+	if err != nil {
+		return err
+	}
+	if len(records) == 0 {
+		fmt.Println("No runs recorded")
+		return nil
+	}
+	if historyLimit > 0 && len(records) > historyLimit {
+		records = records[len(records)-historyLimit:]
+	}
+	buildfab.FormatHistoryTable(os.Stdout, records)
+	return nil
+}
+
+// runStats handles the stats command
+func runStats(cmd *cobra.Command, args []string) error {
+	records, err := readHistory(args[0])
+	if err != nil {
+		return err
+	}
+	if len(records) == 0 {
+		return fmt.Errorf("no runs of stage %s recorded", args[0])
+	}
+	buildfab.FormatStageStats(os.Stdout, buildfab.ComputeStageStats(records, args[0], trendWindow))
+	return nil
+}
+
+// runFlaky handles the flaky command
+func runFlaky(cmd *cobra.Command, args []string) error {
+	stage := ""
+	if len(args) > 0 {
+		stage = args[0]
+	}
+	records, err := readHistory(stage)
+	if err != nil {
+		return err
+	}
+	flaky := buildfab.FindFlakySteps(records)
+	if len(flaky) == 0 {
+		fmt.Printf("No flaky steps in %d recorded runs\n", len(records))
+		return nil
+	}
+	buildfab.FormatFlakyTable(os.Stdout, flaky)
+	return nil
+}
+
+// runAnalyze handles the analyze command
+func runAnalyze(cmd *cobra.Command, args []string) error {
+	file, err := os.Open(args[0])
+	if err != nil {
+		return fmt.Errorf("failed to open trace: %w", err)
+	}
+	defer file.Close()
+	
+	trace, err := buildfab.ReadTrace(file)
+	if err != nil {
+		return err
+	}
+	analyses := buildfab.AnalyzeTrace(trace)
+	if len(analyses) == 0 {
+		return fmt.Errorf("trace %s has no step events", args[0])
+	}
+	buildfab.FormatTraceAnalysis(os.Stdout, analyses)
+	return nil
+}
+
 // runListActions handles the list-actions command
 func runListActions(cmd *cobra.Command, args []string) error {
 	// Load configuration using library API
@@ -1,12 +1,16 @@
 package main
 
 import (
+	"context"
+	"io"
 	"os"
 	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/spf13/cobra"
+	"github.com/AlexBurnes/buildfab/pkg/buildfab"
 )
 
 // Test helper functions
@@ -508,6 +512,170 @@ stages:
 	}
 }
 
+func TestRunEnv(t *testing.T) {
+	// Create test configuration
+	configContent := `
+project:
+  name: test-project
+
+env_policy: allowlist
+pass_env: [BUILDFAB_ENV_TEST]
+
+actions:
+  - name: test-action
+    env:
+      ACTION_ENV: action
+    run: env
+
+stages:
+  test-stage:
+    steps:
+      - action: test-action
+        env:
+          ACTION_ENV: step
+`
+	
+	configFile := createTestConfig(t, configContent)
+	t.Setenv("BUILDFAB_ENV_TEST", "passed")
+	
+	// Set global variables for the test
+	oldConfigPath := configPath
+	configPath = configFile
+	defer func() { configPath = oldConfigPath }()
+	
+	tests := []struct {
+		name     string
+		args     []string
+		wantErr  bool
+		contains []string
+	}{
+		{
+			name:     "standalone action",
+			args:     []string{"test-action"},
+			contains: []string{"ACTION_ENV=action", "BUILDFAB_ENV_TEST=passed", "BUILDFAB_OS="},
+		},
+		{
+			name:     "stage step",
+			args:     []string{"test-stage", "test-action"},
+			contains: []string{"ACTION_ENV=step"},
+		},
+		{
+			name:    "unknown action",
+			args:    []string{"missing"},
+			wantErr: true,
+		},
+	}
+	
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cmd := &cobra.Command{}
+			
+			// Capture output
+			oldStdout := os.Stdout
+			r, w, _ := os.Pipe()
+			os.Stdout = w
+			
+			err := runEnv(cmd, tt.args)
+			
+			// Restore stdout
+			w.Close()
+			os.Stdout = oldStdout
+			
+			// Read output
+			buf := make([]byte, 4096)
+			n, _ := r.Read(buf)
+			output := string(buf[:n])
+			
+			if (err != nil) != tt.wantErr {
+				t.Errorf("runEnv() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			
+			for _, contain := range tt.contains {
+				if !strings.Contains(output, contain) {
+					t.Errorf("runEnv() output should contain %q, got: %s", contain, output)
+				}
+			}
+			if strings.Contains(output, "PATH=") {
+				t.Errorf("runEnv() output must not contain PATH with allowlist policy, got: %s", output)
+			}
+		})
+	}
+}
+
+func TestRunDoctor(t *testing.T) {
+	tests := []struct {
+		name     string
+		tools    string
+		wantErr  bool
+		contains []string
+	}{
+		{
+			name: "all tools found",
+			tools: `
+  - name: sh
+    probe: "sh -c 'echo sh 5.1.0'"
+    version: ">=5"`,
+			contains: []string{"Platform:", "TOOL", "sh", "5.1.0", "found"},
+		},
+		{
+			name: "missing tool",
+			tools: `
+  - name: buildfab-missing-tool
+    install: "apt install missing-tool"`,
+			wantErr:  true,
+			contains: []string{"missing", "install with: apt install missing-tool"},
+		},
+		{
+			name: "optional missing tool",
+			tools: `
+  - name: buildfab-missing-tool
+    optional: true`,
+			contains: []string{"missing (optional)"},
+		},
+	}
+	
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			configFile := createTestConfig(t, `
+project:
+  name: test-project
+tools:`+tt.tools+`
+actions:
+  - name: test-action
+    run: echo test
+`)
+			oldConfigPath := configPath
+			configPath = configFile
+			defer func() { configPath = oldConfigPath }()
+			
+			// Capture output
+			oldStdout := os.Stdout
+			r, w, _ := os.Pipe()
+			os.Stdout = w
+			
+			err := runDoctor(&cobra.Command{}, nil)
+			
+			// Restore stdout
+			w.Close()
+			os.Stdout = oldStdout
+			
+			// Read output
+			buf := make([]byte, 4096)
+			n, _ := r.Read(buf)
+			output := string(buf[:n])
+			
+			if (err != nil) != tt.wantErr {
+				t.Errorf("runDoctor() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			for _, contain := range tt.contains {
+				if !strings.Contains(output, contain) {
+					t.Errorf("runDoctor() output should contain %q, got: %s", contain, output)
+				}
+			}
+		})
+	}
+}
+
 func TestCommandStructure(t *testing.T) {
 	// Test that all commands are properly configured
 	commands := []*cobra.Command{
@@ -518,6 +686,13 @@ func TestCommandStructure(t *testing.T) {
 		validateCmd,
 		listStagesCmd,
 		listStepsCmd,
+		envCmd,
+		doctorCmd,
+		analyzeCmd,
+		logsCmd,
+		historyCmd,
+		statsCmd,
+		flakyCmd,
 	}
 	
 	for _, cmd := range commands {
@@ -541,6 +716,12 @@ func TestGlobalFlags(t *testing.T) {
 	rootCmd.PersistentFlags().StringSliceVar(&only, "only", []string{}, "only run steps matching these labels")
 	rootCmd.PersistentFlags().BoolVar(&withRequires, "with-requires", false, "include required dependencies when running single step")
 	rootCmd.PersistentFlags().StringSliceVar(&envVars, "env", []string{}, "export environment variables to actions")
+	rootCmd.PersistentFlags().BoolVarP(&assumeYes, "yes", "y", false, "approve confirm steps without prompting")
+	rootCmd.PersistentFlags().StringArrayVar(&reports, "report", []string{}, "write a stage report as format=path (junit, markdown, html, json)")
+	rootCmd.PersistentFlags().StringVar(&tracePath, "trace", "", "write a Chrome trace of the stage run to this file")
+	rootCmd.PersistentFlags().StringVar(&uiMode, "ui", buildfab.UIOrdered, "step output renderer: ordered, tty (live display on a terminal) or prefixed")
+	rootCmd.PersistentFlags().BoolVar(&timestamps, "timestamps", false, "prefix output lines with their time (--ui=prefixed)")
+	rootCmd.PersistentFlags().StringVar(&ciMode, "ci", buildfab.CIAuto, "CI groups and annotations: auto (detected from the environment), none, github, gitlab or teamcity")
 	
 	// Test that global flags are properly defined
 	flags := []string{
@@ -552,6 +733,12 @@ func TestGlobalFlags(t *testing.T) {
 		"only",
 		"with-requires",
 		"env",
+		"yes",
+		"report",
+		"trace",
+		"ui",
+		"timestamps",
+		"ci",
 	}
 	
 	for _, flag := range flags {
@@ -561,6 +748,209 @@ func TestGlobalFlags(t *testing.T) {
 	}
 }
 
+func TestParseReports(t *testing.T) {
+	specs, err := parseReports([]string{"junit=out/report.xml", "markdown=summary.md"})
+	if err != nil || len(specs) != 2 || specs[0].Format != "junit" || specs[1].Path != "summary.md" {
+		t.Errorf("parseReports() = %v, %v", specs, err)
+	}
+	if _, err := parseReports([]string{"pdf=report.pdf"}); err == nil {
+		t.Error("parseReports() should reject unknown formats")
+	}
+	if _, err := parseReports([]string{"junit"}); err == nil {
+		t.Error("parseReports() should require a path")
+	}
+}
+
+func TestValidateUI(t *testing.T) {
+	for _, ui := range []string{"ordered", "tty", "prefixed"} {
+		if err := validateUI(ui); err != nil {
+			t.Errorf("validateUI(%q) error = %v", ui, err)
+		}
+	}
+	if err := validateUI("fancy"); err == nil {
+		t.Error("validateUI() should reject unknown renderers")
+	}
+}
+
+func TestValidateCI(t *testing.T) {
+	for _, ci := range []string{"auto", "none", "github", "gitlab", "teamcity"} {
+		if err := validateCI(ci); err != nil {
+			t.Errorf("validateCI(%q) error = %v", ci, err)
+		}
+	}
+	if err := validateCI("jenkins"); err == nil {
+		t.Error("validateCI() should reject unknown providers")
+	}
+}
+
+func TestRunAnalyze(t *testing.T) {
+	traceFile := filepath.Join(t.TempDir(), "trace.json")
+	trace := `{"traceEvents": [
+ {"name": "process_name", "ph": "M", "ts": 0, "pid": 1, "tid": 0, "args": {"name": "stage ci"}},
+ {"name": "build", "cat": "step", "ph": "X", "ts": 0, "dur": 2000000, "pid": 1, "tid": 1},
+ {"name": "lint", "cat": "step", "ph": "X", "ts": 0, "dur": 500000, "pid": 1, "tid": 2},
+ {"name": "test", "cat": "step", "ph": "X", "ts": 2000000, "dur": 1000000, "pid": 1, "tid": 1, "args": {"requires": ["build"]}}
+]}`
+	if err := os.WriteFile(traceFile, []byte(trace), 0644); err != nil {
+		t.Fatal(err)
+	}
+	
+	// Capture output
+	oldStdout := os.Stdout
+	r, w, _ := os.Pipe()
+	os.Stdout = w
+	
+	err := runAnalyze(&cobra.Command{}, []string{traceFile})
+	
+	// Restore stdout
+	w.Close()
+	os.Stdout = oldStdout
+	
+	// Read output
+	buf := make([]byte, 4096)
+	n, _ := r.Read(buf)
+	output := string(buf[:n])
+	
+	if err != nil {
+		t.Fatalf("runAnalyze() error = %v", err)
+	}
+	for _, contain := range []string{"Stage ci: wall time 3s, critical path 3s", "Critical path: build → test", "lint"} {
+		if !strings.Contains(output, contain) {
+			t.Errorf("runAnalyze() output should contain %q, got: %s", contain, output)
+		}
+	}
+	
+	if err := runAnalyze(&cobra.Command{}, []string{filepath.Join(t.TempDir(), "missing.json")}); err == nil {
+		t.Error("runAnalyze() should fail for a missing trace")
+	}
+}
+
+func TestRunLogs(t *testing.T) {
+	configFile := createTestConfig(t, `
+project:
+  name: test-project
+actions:
+  - name: build
+    run: echo compiled
+stages:
+  ci:
+    steps:
+      - action: build
+`)
+	oldConfigPath := configPath
+	configPath = configFile
+	defer func() { configPath = oldConfigPath }()
+	
+	cfg, err := buildfab.LoadConfig(configFile)
+	if err != nil {
+		t.Fatalf("LoadConfig() error = %v", err)
+	}
+	opts := buildfab.DefaultSimpleRunOptions()
+	opts.Output = io.Discard
+	opts.ErrorOutput = io.Discard
+	opts.RunLogs = true
+	if err := buildfab.NewSimpleRunner(cfg, opts).RunStage(context.Background(), "ci"); err != nil {
+		t.Fatalf("RunStage() error = %v", err)
+	}
+	
+	capture := func(args []string) (string, error) {
+		oldStdout := os.Stdout
+		r, w, _ := os.Pipe()
+		os.Stdout = w
+		err := runLogs(&cobra.Command{}, args)
+		w.Close()
+		os.Stdout = oldStdout
+		buf := make([]byte, 4096)
+		n, _ := r.Read(buf)
+		return string(buf[:n]), err
+	}
+	
+	output, err := capture([]string{"build"})
+	if err != nil || !strings.Contains(output, "stdout compiled") {
+		t.Errorf("logs build = %q, %v", output, err)
+	}
+	
+	listRuns = true
+	output, err = capture(nil)
+	listRuns = false
+	if err != nil || !strings.Contains(output, "RUN") || !strings.Contains(output, "ci") {
+		t.Errorf("logs --list = %q, %v", output, err)
+	}
+	
+	if _, err := capture([]string{"20000101-000000.000", "build"}); err == nil {
+		t.Error("runLogs() should fail for an unknown run")
+	}
+}
+
+func TestRunHistoryCommands(t *testing.T) {
+	configFile := createTestConfig(t, `
+project:
+  name: test-project
+actions:
+  - name: build
+    run: echo build
+`)
+	oldConfigPath := configPath
+	configPath = configFile
+	defer func() { configPath = oldConfigPath }()
+	
+	stateDir := filepath.Join(filepath.Dir(configFile), buildfab.StateDir)
+	for i, status := range []string{"ok", "error", "ok"} {
+		record := buildfab.HistoryRecord{
+			Stage:      "ci",
+			Commit:     "0123456789abcdef",
+			Start:      time.Date(2025, 1, 1, 12, i, 0, 0, time.UTC),
+			DurationMS: int64(100 * (i + 1)),
+			Success:    status == "ok",
+			Steps:      []buildfab.HistoryStep{{Name: "test", Status: status, DurationMS: int64(100 * (i + 1))}},
+		}
+		if err := buildfab.AppendHistory(stateDir, record); err != nil {
+			t.Fatal(err)
+		}
+	}
+	
+	capture := func(run func(*cobra.Command, []string) error, args []string) (string, error) {
+		oldStdout := os.Stdout
+		r, w, _ := os.Pipe()
+		os.Stdout = w
+		err := run(&cobra.Command{}, args)
+		w.Close()
+		os.Stdout = oldStdout
+		buf := make([]byte, 4096)
+		n, _ := r.Read(buf)
+		return string(buf[:n]), err
+	}
+	
+	tests := []struct {
+		name     string
+		run      func(*cobra.Command, []string) error
+		args     []string
+		contains []string
+	}{
+		{"history", runHistory, nil, []string{"0123456789", "failed", "test"}},
+		{"history other stage", runHistory, []string{"release"}, []string{"No runs recorded"}},
+		{"stats", runStats, []string{"ci"}, []string{"Stage ci: 3 runs, 1 failed (33%)", "p50 200ms", "test"}},
+		{"flaky", runFlaky, nil, []string{"test", "0123456789", "2"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			output, err := capture(tt.run, tt.args)
+			if err != nil {
+				t.Fatalf("error = %v", err)
+			}
+			for _, contain := range tt.contains {
+				if !strings.Contains(output, contain) {
+					t.Errorf("output should contain %q, got: %s", contain, output)
+				}
+			}
+		})
+	}
+	
+	if _, err := capture(runStats, []string{"release"}); err == nil {
+		t.Error("runStats() should fail for a stage without runs")
+	}
+}
+
 func TestVersionFlags(t *testing.T) {
 	// Initialize version flags
 	rootCmd.Flags().BoolP("version", "", false, "print version and module name")
@@ -15,6 +15,7 @@ type UI struct {
 	verbose bool
 	debug   bool
 	quiet   bool
+	masker  *buildfab.Masker
 }
 
 // New creates a new UI instance
@@ -35,6 +36,11 @@ func NewWithQuiet(verbose, debug, quiet bool) *UI {
 	}
 }
 
+// SetMasker sets the masker used to hide secret values in printed output
+func (u *UI) SetMasker(masker *buildfab.Masker) {
+	u.masker = masker
+}
+
 // PrintCLIHeader prints the CLI header
 func (u *UI) PrintCLIHeader(name, version string) {
 	// Handle version that already has 'v' prefix
@@ -61,6 +67,7 @@ func (u *UI) PrintStageHeader(stageName string) {
 
 // PrintStepStatus prints step status
 func (u *UI) PrintStepStatus(stepName string, status buildfab.Status, message string) {
+	message = u.masker.Mask(message)
 	var icon string
 	var color string
 	
@@ -153,6 +160,7 @@ func (u *UI) PrintStepName(stepName string) {
 
 // PrintCommandOutput prints command output
 func (u *UI) PrintCommandOutput(output string) {
+	output = u.masker.Mask(output)
 	if u.verbose && output != "" {
 		lines := strings.Split(strings.TrimRight(output, "\n"), "\n")
 		for _, line := range lines {
@@ -163,6 +171,7 @@ func (u *UI) PrintCommandOutput(output string) {
 
 // PrintRepro prints reproduction instructions
 func (u *UI) PrintRepro(stepName, repro string) {
+	repro = u.masker.Mask(repro)
 	fmt.Fprintf(os.Stderr, "\n")
 	fmt.Fprintf(os.Stderr, "🔧 To reproduce %s:\n", stepName)
 	
@@ -178,6 +187,7 @@ func (u *UI) PrintRepro(stepName, repro string) {
 
 // PrintReproInline prints inline reproduction instructions
 func (u *UI) PrintReproInline(stepName, repro string) {
+	repro = u.masker.Mask(repro)
 	fmt.Fprintf(os.Stderr, "   💡 %s\n", repro)
 }
 
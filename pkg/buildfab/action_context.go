@@ -0,0 +1,365 @@
+package buildfab
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ActionContext carries everything a built-in action needs to run: its with:
+// inputs, the directory and environment to run in, resolved variables,
+// output writers and a sink for outputs
+type ActionContext struct {
+	Name       string            // Name of the action in the configuration
+	Inputs     map[string]string // with: inputs, interpolated with Variables
+	WorkingDir string            // Directory to run in
+	Env        map[string]string // Complete environment for processes started by the action
+	Variables  map[string]string // Resolved interpolation variables
+	Stdout     io.Writer         // Writer for regular output
+	Stderr     io.Writer         // Writer for diagnostic output
+	Outputs    *ActionOutputs    // Sink for values produced by the action
+	Config     *Config           // Project configuration, nil outside of a runner
+}
+
+// NewActionContext returns a context for running an action outside of a
+// runner: the current directory, the process environment and discarded output
+func NewActionContext(inputs map[string]string) *ActionContext {
+	env := make(map[string]string)
+	for _, entry := range os.Environ() {
+		if name, value, ok := strings.Cut(entry, "="); ok {
+			env[name] = value
+		}
+	}
+	if inputs == nil {
+		inputs = make(map[string]string)
+	}
+	return &ActionContext{
+		Inputs:     inputs,
+		WorkingDir: ".",
+		Env:        env,
+		Variables:  make(map[string]string),
+		Stdout:     io.Discard,
+		Stderr:     io.Discard,
+		Outputs:    NewActionOutputs(),
+	}
+}
+
+// Input returns an input value or def when it is not set
+func (c *ActionContext) Input(name, def string) string {
+	if value, ok := c.Inputs[name]; ok && value != "" {
+		return value
+	}
+	return def
+}
+
+// InputBool returns a boolean input or def when it is not set or invalid
+func (c *ActionContext) InputBool(name string, def bool) bool {
+	value, err := strconv.ParseBool(c.Input(name, ""))
+	if err != nil {
+		return def
+	}
+	return value
+}
+
+// InputInt returns an integer input or def when it is not set or invalid
+func (c *ActionContext) InputInt(name string, def int) int {
+	value, err := strconv.Atoi(c.Input(name, ""))
+	if err != nil {
+		return def
+	}
+	return value
+}
+
+// InputList returns an input split on newlines and commas, with empty entries removed
+func (c *ActionContext) InputList(name string) []string {
+	var list []string
+	for _, line := range strings.Split(c.Input(name, ""), "\n") {
+		for _, item := range strings.Split(line, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				list = append(list, item)
+			}
+		}
+	}
+	return list
+}
+
+// Path resolves a path relative to the working directory
+func (c *ActionContext) Path(p string) string {
+	if filepath.IsAbs(p) || c.WorkingDir == "" {
+		return p
+	}
+	return filepath.Join(c.WorkingDir, p)
+}
+
+// Command creates a command that runs in the action's directory and environment
+func (c *ActionContext) Command(ctx context.Context, name string, args ...string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Dir = c.WorkingDir
+	if c.Env != nil {
+		names := make([]string, 0, len(c.Env))
+		for k := range c.Env {
+			names = append(names, k)
+		}
+		sort.Strings(names)
+		cmd.Env = make([]string, 0, len(names))
+		for _, k := range names {
+			cmd.Env = append(cmd.Env, k+"="+c.Env[k])
+		}
+	}
+	return cmd
+}
+
+// ActionOutputs collects named values produced by an action. It is safe for
+// concurrent use.
+type ActionOutputs struct {
+	mu     sync.Mutex
+	values map[string]string
+}
+
+// NewActionOutputs creates an empty outputs sink
+func NewActionOutputs() *ActionOutputs {
+	return &ActionOutputs{values: make(map[string]string)}
+}
+
+// Set records an output value
+func (o *ActionOutputs) Set(name, value string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.values[name] = value
+}
+
+// Get returns an output value
+func (o *ActionOutputs) Get(name string) (string, bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	value, ok := o.values[name]
+	return value, ok
+}
+
+// All returns a copy of all output values
+func (o *ActionOutputs) All() map[string]string {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	values := make(map[string]string, len(o.values))
+	for k, v := range o.values {
+		values[k] = v
+	}
+	return values
+}
+
+// ContextActionRunner is implemented by built-in actions that accept inputs
+// and an execution context
+type ContextActionRunner interface {
+	RunWithContext(ctx context.Context, actx *ActionContext) (Result, error)
+	Description() string
+}
+
+// AdaptActionRunner returns a ContextActionRunner for any ActionRunner. Runners
+// that only implement Run(ctx) are wrapped and ignore the action context.
+func AdaptActionRunner(runner ActionRunner) ContextActionRunner {
+	if contextRunner, ok := runner.(ContextActionRunner); ok {
+		return contextRunner
+	}
+	return &legacyActionRunner{runner: runner}
+}
+
+// legacyActionRunner adapts an ActionRunner without context support
+type legacyActionRunner struct {
+	runner ActionRunner
+}
+
+func (a *legacyActionRunner) RunWithContext(ctx context.Context, actx *ActionContext) (Result, error) {
+	return a.runner.Run(ctx)
+}
+
+func (a *legacyActionRunner) Description() string {
+	return a.runner.Description()
+}
+
+// mergeInputs merges with: inputs, later layers override earlier ones
+func mergeInputs(layers ...map[string]string) map[string]string {
+	var merged map[string]string
+	for _, layer := range layers {
+		for k, v := range layer {
+			if merged == nil {
+				merged = make(map[string]string)
+			}
+			merged[k] = v
+		}
+	}
+	return merged
+}
+
+// matchesAnyPattern reports whether a slash separated file path matches one of
+// the patterns. A pattern matches the path itself, any parent directory, or
+// the base name.
+func matchesAnyPattern(file string, patterns []string) bool {
+	file = strings.TrimSuffix(filepath.ToSlash(file), "/")
+	for _, pattern := range patterns {
+		pattern = strings.TrimSuffix(filepath.ToSlash(pattern), "/")
+		if matched, _ := path.Match(pattern, path.Base(file)); matched {
+			return true
+		}
+		for p := file; p != "." && p != "/" && p != ""; p = path.Dir(p) {
+			if matched, _ := path.Match(pattern, p); matched {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// newActionContext builds the context for a built-in action run by the runner
+func (r *Runner) newActionContext(action Action, scope *stepScope) (*ActionContext, error) {
+	if scope == nil {
+		scope = &stepScope{Variables: r.opts.Variables}
+	}
+
+	inputs := make(map[string]string)
+	for name, value := range mergeInputs(action.With, scope.Inputs) {
+		interpolated, err := InterpolateVariables(value, scope.Variables)
+		if err != nil {
+			return nil, err
+		}
+		inputs[name] = interpolated
+	}
+
+	env := make(map[string]string)
+	for _, entry := range buildProcessEnv(r.config, scope, r.opts.Variables) {
+		if name, value, ok := strings.Cut(entry, "="); ok {
+			env[name] = value
+		}
+	}
+
+	return &ActionContext{
+		Name:       action.Name,
+		Inputs:     inputs,
+		WorkingDir: r.actionDir(scope),
+		Env:        env,
+		Variables:  scope.Variables,
+		Stdout:     io.Discard,
+		Stderr:     io.Discard,
+		Outputs:    r.stepOutputs(action.Name),
+		Config:     r.config,
+	}, nil
+}
+
+// runBuiltInRunner runs a registered built-in action with its context. What
+// the action writes is captured in the result's Output and the step log, and
+// passed to the step callback line by line when stream is set.
+func (r *Runner) runBuiltInRunner(ctx context.Context, runner ActionRunner, action Action, scope *stepScope, stream bool) (Result, error) {
+	actx, err := r.newActionContext(action, scope)
+	if err != nil {
+		return Result{
+			Status:  StatusError,
+			Message: err.Error(),
+		}, err
+	}
+	var output strings.Builder
+	var outputMu sync.Mutex
+	stdout := r.newStepWriter(ctx, action.Name, StreamStdout, &output, &outputMu, stream)
+	stderr := r.newStepWriter(ctx, action.Name, StreamStderr, &output, &outputMu, stream)
+	actx.Stdout, actx.Stderr = stdout, stderr
+	result, err := AdaptActionRunner(runner).RunWithContext(ctx, actx)
+	stdout.flush()
+	stderr.flush()
+	if result.Output == "" {
+		result.Output = output.String()
+	}
+	return result, err
+}
+
+// stepOutputs returns the outputs sink of a step, creating it on first use
+func (r *Runner) stepOutputs(stepName string) *ActionOutputs {
+	r.outputsMu.Lock()
+	defer r.outputsMu.Unlock()
+	if r.outputs == nil {
+		r.outputs = make(map[string]*ActionOutputs)
+	}
+	outputs, exists := r.outputs[stepName]
+	if !exists {
+		outputs = NewActionOutputs()
+		r.outputs[stepName] = outputs
+	}
+	return outputs
+}
+
+// StepOutputs returns the outputs set by a built-in action during the last run
+func (r *Runner) StepOutputs(stepName string) map[string]string {
+	return r.stepOutputs(stepName).All()
+}
+
+// stepWriter handles the complete lines written by a built-in action like
+// the output of a run command: each line goes to the step log, masked to the
+// captured output and, when streaming, to the step callback
+type stepWriter struct {
+	mu       sync.Mutex
+	ctx      context.Context
+	runner   *Runner
+	stepName string
+	stream   string           // StreamStdout or StreamStderr in the step log
+	output   *strings.Builder // Captured output shared by stdout and stderr
+	outputMu *sync.Mutex
+	callback bool // Pass lines to the step callback
+	buf      bytes.Buffer
+}
+
+// newStepWriter returns a writer for the output of a built-in action
+func (r *Runner) newStepWriter(ctx context.Context, stepName, stream string, output *strings.Builder, outputMu *sync.Mutex, callback bool) *stepWriter {
+	return &stepWriter{
+		ctx:      ctx,
+		runner:   r,
+		stepName: stepName,
+		stream:   stream,
+		output:   output,
+		outputMu: outputMu,
+		callback: callback && r.stepCallback != nil,
+	}
+}
+
+func (w *stepWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.buf.Write(p)
+	for {
+		line, err := w.buf.ReadString('\n')
+		if err != nil {
+			// Keep the incomplete line for the next write
+			w.buf.Reset()
+			w.buf.WriteString(line)
+			break
+		}
+		w.emit(strings.TrimRight(line, "\r\n"))
+	}
+	return len(p), nil
+}
+
+// flush emits a trailing incomplete line
+func (w *stepWriter) flush() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.buf.Len() > 0 {
+		w.emit(w.buf.String())
+		w.buf.Reset()
+	}
+}
+
+// emit handles a line without its line ending
+func (w *stepWriter) emit(line string) {
+	w.runner.opts.RunLog.Step(w.stepName).Line(w.stream, line)
+	line = w.runner.masker.Mask(line)
+	w.outputMu.Lock()
+	w.output.WriteString(line + "\n")
+	w.outputMu.Unlock()
+	if w.callback {
+		w.runner.stepCallback.OnStepOutput(w.ctx, w.stepName, line)
+	}
+}
@@ -0,0 +1,243 @@
+package buildfab
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// contextProbeAction records the context it was run with
+type contextProbeAction struct {
+	actx *ActionContext
+}
+
+func (a *contextProbeAction) Run(ctx context.Context) (Result, error) {
+	return a.RunWithContext(ctx, NewActionContext(nil))
+}
+
+func (a *contextProbeAction) RunWithContext(ctx context.Context, actx *ActionContext) (Result, error) {
+	a.actx = actx
+	actx.Stdout.Write([]byte("hello " + actx.Input("who", "nobody") + "\npartial"))
+	actx.Outputs.Set("greeted", actx.Input("who", "nobody"))
+	return Result{Status: StatusOK, Message: "probed"}, nil
+}
+
+func (a *contextProbeAction) Description() string {
+	return "Record the action context"
+}
+
+// legacyProbeAction only implements ActionRunner
+type legacyProbeAction struct {
+	called bool
+}
+
+func (a *legacyProbeAction) Run(ctx context.Context) (Result, error) {
+	a.called = true
+	return Result{Status: StatusOK, Message: "legacy"}, nil
+}
+
+func (a *legacyProbeAction) Description() string {
+	return "Legacy action"
+}
+
+func TestActionContextInputs(t *testing.T) {
+	actx := NewActionContext(map[string]string{
+		"name":    "value",
+		"empty":   "",
+		"enabled": "true",
+		"count":   "3",
+		"bad":     "x",
+		"list":    "a, b\nc,,\n d",
+	})
+
+	if got := actx.Input("name", "def"); got != "value" {
+		t.Errorf("Input(name) = %q, want value", got)
+	}
+	if got := actx.Input("empty", "def"); got != "def" {
+		t.Errorf("Input(empty) = %q, want def", got)
+	}
+	if got := actx.Input("missing", "def"); got != "def" {
+		t.Errorf("Input(missing) = %q, want def", got)
+	}
+	if !actx.InputBool("enabled", false) {
+		t.Error("InputBool(enabled) = false, want true")
+	}
+	if !actx.InputBool("bad", true) {
+		t.Error("InputBool(bad) should fall back to default")
+	}
+	if got := actx.InputInt("count", 0); got != 3 {
+		t.Errorf("InputInt(count) = %d, want 3", got)
+	}
+	if got := actx.InputInt("bad", 7); got != 7 {
+		t.Errorf("InputInt(bad) = %d, want 7", got)
+	}
+	if got := actx.InputList("list"); !reflect.DeepEqual(got, []string{"a", "b", "c", "d"}) {
+		t.Errorf("InputList(list) = %v", got)
+	}
+	if got := actx.InputList("missing"); len(got) != 0 {
+		t.Errorf("InputList(missing) = %v, want empty", got)
+	}
+
+	actx.WorkingDir = "sub"
+	if got := actx.Path("VERSION"); got != filepath.Join("sub", "VERSION") {
+		t.Errorf("Path(VERSION) = %q", got)
+	}
+	abs := filepath.Join(t.TempDir(), "VERSION")
+	if got := actx.Path(abs); got != abs {
+		t.Errorf("Path(abs) = %q, want %q", got, abs)
+	}
+}
+
+func TestAdaptActionRunner(t *testing.T) {
+	legacy := &legacyProbeAction{}
+	result, err := AdaptActionRunner(legacy).RunWithContext(context.Background(), NewActionContext(nil))
+	if err != nil || result.Message != "legacy" || !legacy.called {
+		t.Errorf("adapted legacy runner = %+v, %v, called %v", result, err, legacy.called)
+	}
+	if got := AdaptActionRunner(legacy).Description(); got != "Legacy action" {
+		t.Errorf("Description() = %q", got)
+	}
+
+	probe := &contextProbeAction{}
+	if AdaptActionRunner(probe) != ContextActionRunner(probe) {
+		t.Error("context runners should not be wrapped")
+	}
+}
+
+func TestMatchesAnyPattern(t *testing.T) {
+	tests := []struct {
+		file     string
+		patterns []string
+		want     bool
+	}{
+		{"notes.tmp", []string{"*.tmp"}, true},
+		{"dir/notes.tmp", []string{"*.tmp"}, true},
+		{"vendor/pkg/file.go", []string{"vendor"}, true},
+		{"vendor/pkg/file.go", []string{"vendor/"}, true},
+		{"src/main.go", []string{"vendor", "*.tmp"}, false},
+		{"src/main.go", nil, false},
+	}
+	for _, tt := range tests {
+		if got := matchesAnyPattern(tt.file, tt.patterns); got != tt.want {
+			t.Errorf("matchesAnyPattern(%q, %v) = %v, want %v", tt.file, tt.patterns, got, tt.want)
+		}
+	}
+}
+
+func TestRunStageBuiltInActionContext(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "sub"), 0755); err != nil {
+		t.Fatalf("failed to create dir: %v", err)
+	}
+	configPath := filepath.Join(dir, ".project.yml")
+	content := `
+project:
+  name: test
+vars:
+  team: builders
+actions:
+  - name: probe
+    uses: test@probe
+    working_dir: sub
+    with:
+      who: action
+      mode: fast
+stages:
+  test:
+    steps:
+      - action: probe
+        with:
+          who: ${{ team }}
+`
+	if err := os.WriteFile(configPath, []byte(content), 0644); err != nil {
+		t.Fatalf("failed to write config: %v", err)
+	}
+	config, err := LoadConfig(configPath)
+	if err != nil {
+		t.Fatalf("LoadConfig() error = %v", err)
+	}
+
+	probe := &contextProbeAction{}
+	registry := NewDefaultActionRegistry()
+	registry.Register("test@probe", probe)
+
+	callback := &MockStepCallback{}
+	opts := DefaultRunOptions()
+	opts.StepCallback = callback
+	runner := NewRunnerWithRegistry(config, opts, registry)
+	if err := runner.RunStage(context.Background(), "test"); err != nil {
+		t.Fatalf("RunStage() error = %v", err)
+	}
+
+	if probe.actx == nil {
+		t.Fatal("probe action was not run with a context")
+	}
+	if got := probe.actx.Inputs; !reflect.DeepEqual(got, map[string]string{"who": "builders", "mode": "fast"}) {
+		t.Errorf("Inputs = %v, want step inputs over action inputs", got)
+	}
+	if got := probe.actx.WorkingDir; got != filepath.Join(dir, "sub") {
+		t.Errorf("WorkingDir = %q, want %q", got, filepath.Join(dir, "sub"))
+	}
+	if got := runner.StepOutputs("probe"); got["greeted"] != "builders" {
+		t.Errorf("StepOutputs(probe) = %v", got)
+	}
+
+	var output []string
+	for _, call := range callback.OnStepOutputCalls {
+		if call.StepName == "probe" {
+			output = append(output, call.Output)
+		}
+	}
+	if got := strings.Join(output, "|"); !strings.Contains(got, "hello builders|partial") {
+		t.Errorf("step output = %q, want action output forwarded line by line", got)
+	}
+
+	// Without verbose output the action output is only captured, like the
+	// output of run commands
+	runLog, err := NewRunLog(t.TempDir(), "test", nil)
+	if err != nil {
+		t.Fatalf("NewRunLog() error = %v", err)
+	}
+	callback = &MockStepCallback{}
+	opts.StepCallback = callback
+	opts.Verbose = false
+	opts.RunLog = runLog
+	runner = NewRunnerWithRegistry(config, opts, registry)
+	if err := runner.RunStage(context.Background(), "test"); err != nil {
+		t.Fatalf("RunStage() error = %v", err)
+	}
+	runLog.Close(true)
+	for _, call := range callback.OnStepOutputCalls {
+		if call.StepName == "probe" {
+			t.Errorf("output should not be streamed without verbose output, got %q", call.Output)
+		}
+	}
+	for _, result := range runner.Results() {
+		if result.Name == "probe" && result.Output != "hello builders\npartial\n" {
+			t.Errorf("Output = %q, want the action output", result.Output)
+		}
+	}
+	if lines := readStepLog(t, runLog.Dir(), "probe"); len(lines) < 3 || lines[1] != "stdout hello builders" || lines[2] != "stdout partial" {
+		t.Errorf("log lines = %q, want the action output", lines)
+	}
+}
+
+func TestVersionCheckActionFileInput(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "RELEASE"), []byte("v1.2.3\n"), 0644); err != nil {
+		t.Fatalf("failed to write version file: %v", err)
+	}
+
+	actx := NewActionContext(map[string]string{"file": "RELEASE"})
+	actx.WorkingDir = dir
+	result, err := (&VersionCheckAction{}).RunWithContext(context.Background(), actx)
+	if err != nil {
+		t.Fatalf("RunWithContext() error = %v", err)
+	}
+	if result.Status != StatusOK {
+		t.Errorf("Status = %v, want ok: %s", result.Status, result.Message)
+	}
+}
@@ -4,14 +4,19 @@ import (
 	"context"
 	"fmt"
 	"os"
-	"os/exec"
 	"strings"
+	"sync"
 )
 
 // DefaultActionRegistry provides a default implementation of ActionRegistry
 // that includes common built-in actions
 type DefaultActionRegistry struct {
 	actions map[string]ActionRunner
+
+	// Plugins found in pluginDirs on first use, see DiscoverPluginsOnUse
+	pluginDirs  []string
+	pluginsOnce sync.Once
+	plugins     map[string]ActionRunner
 }
 
 // NewDefaultActionRegistry creates a new default action registry with built-in actions
@@ -24,8 +29,27 @@ func NewDefaultActionRegistry() *DefaultActionRegistry {
 	registry.Register("git@untracked", &GitUntrackedAction{})
 	registry.Register("git@uncommitted", &GitUncommittedAction{})
 	registry.Register("git@modified", &GitModifiedAction{})
+	registry.Register("git@branch", &GitBranchAction{})
+	registry.Register("git@up-to-date", &GitUpToDateAction{})
+	registry.Register("git@tag-exists", &GitTagExistsAction{})
+	registry.Register("git@signed-commits", &GitSignedCommitsAction{})
+	registry.Register("git@no-conflict-markers", &GitNoConflictMarkersAction{})
+	registry.Register("git@large-files", &GitLargeFilesAction{})
+	registry.Register("git@commit-message", &GitCommitMessageAction{})
 	registry.Register("version@check", &VersionCheckAction{})
 	registry.Register("version@check-greatest", &VersionCheckGreatestAction{})
+	registry.Register("version@bump", &VersionBumpAction{})
+	registry.Register("version@tag", &VersionTagAction{})
+	registry.Register("version@changelog", &VersionChangelogAction{})
+	registry.Register("tool@require", &ToolRequireAction{})
+	registry.Register("fs@checksum", &FsChecksumAction{})
+	registry.Register("fs@archive", &FsArchiveAction{})
+	registry.Register("fs@copy", &FsCopyAction{})
+	registry.Register("fs@clean", &FsCleanAction{})
+	registry.Register("go@test", &GoTestAction{})
+	registry.Register("go@mod-tidy-check", &GoModTidyCheckAction{})
+	registry.Register("go@vet", &GoVetAction{})
+	registry.Register("go@build", &GoBuildAction{})
 	
 	return registry
 }
@@ -37,24 +61,39 @@ func (r *DefaultActionRegistry) Register(name string, runner ActionRunner) {
 
 // GetRunner returns the runner for a built-in action
 func (r *DefaultActionRegistry) GetRunner(name string) (ActionRunner, bool) {
-	runner, exists := r.actions[name]
+	if runner, exists := r.actions[name]; exists {
+		return runner, true
+	}
+	if !strings.HasPrefix(name, PluginNamespace) {
+		return nil, false
+	}
+	runner, exists := r.discoveredPlugins()[name]
 	return runner, exists
 }
 
 // ListActions returns all available built-in actions
 func (r *DefaultActionRegistry) ListActions() map[string]string {
 	actions := make(map[string]string)
+	for name, runner := range r.discoveredPlugins() {
+		actions[name] = runner.Description()
+	}
 	for name, runner := range r.actions {
 		actions[name] = runner.Description()
 	}
 	return actions
 }
 
-// GitUntrackedAction checks for untracked files
+// GitUntrackedAction checks for untracked files.
+// Inputs: ignore - path patterns to ignore.
 type GitUntrackedAction struct{}
 
 func (a *GitUntrackedAction) Run(ctx context.Context) (Result, error) {
-	cmd := exec.CommandContext(ctx, "git", "status", "--porcelain")
+	return a.RunWithContext(ctx, NewActionContext(nil))
+}
+
+func (a *GitUntrackedAction) RunWithContext(ctx context.Context, actx *ActionContext) (Result, error) {
+	ignore := actx.InputList("ignore")
+	cmd := actx.Command(ctx, "git", "status", "--porcelain")
 	output, err := cmd.Output()
 	if err != nil {
 		return Result{
@@ -68,14 +107,17 @@ func (a *GitUntrackedAction) Run(ctx context.Context) (Result, error) {
 	
 	for _, line := range lines {
 		if len(line) >= 2 && line[:2] == "??" {
-			untracked = append(untracked, strings.TrimSpace(line[2:]))
+			file := strings.TrimSpace(line[2:])
+			if !matchesAnyPattern(file, ignore) {
+				untracked = append(untracked, file)
+			}
 		}
 	}
 	
 	if len(untracked) > 0 {
 		return Result{
 			Status:  StatusError,
-			Message: "Untracked files found, to check run:\n      git status",
+			Message: failureMessage("Untracked files found", untracked, "git status"),
 		}, fmt.Errorf("untracked files found")
 	}
 	
@@ -89,11 +131,17 @@ func (a *GitUntrackedAction) Description() string {
 	return "Check for untracked files"
 }
 
-// GitUncommittedAction checks for uncommitted changes
+// GitUncommittedAction checks for uncommitted changes.
+// Inputs: ignore - path patterns to ignore.
 type GitUncommittedAction struct{}
 
 func (a *GitUncommittedAction) Run(ctx context.Context) (Result, error) {
-	cmd := exec.CommandContext(ctx, "git", "status", "--porcelain")
+	return a.RunWithContext(ctx, NewActionContext(nil))
+}
+
+func (a *GitUncommittedAction) RunWithContext(ctx context.Context, actx *ActionContext) (Result, error) {
+	ignore := actx.InputList("ignore")
+	cmd := actx.Command(ctx, "git", "status", "--porcelain")
 	output, err := cmd.Output()
 	if err != nil {
 		return Result{
@@ -107,14 +155,17 @@ func (a *GitUncommittedAction) Run(ctx context.Context) (Result, error) {
 	
 	for _, line := range lines {
 		if len(line) >= 2 && (line[:2] == "M " || line[:2] == "A " || line[:2] == "D " || line[:2] == "R " || line[:2] == "C ") {
-			uncommitted = append(uncommitted, strings.TrimSpace(line[2:]))
+			file := strings.TrimSpace(line[2:])
+			if !matchesAnyPattern(file, ignore) {
+				uncommitted = append(uncommitted, file)
+			}
 		}
 	}
 	
 	if len(uncommitted) > 0 {
 		return Result{
 			Status:  StatusError,
-			Message: "Uncommitted changes found, to check run:\n      git status",
+			Message: failureMessage("Uncommitted changes found", uncommitted, "git status"),
 		}, fmt.Errorf("uncommitted changes found")
 	}
 	
@@ -128,11 +179,17 @@ func (a *GitUncommittedAction) Description() string {
 	return "Check for uncommitted changes"
 }
 
-// GitModifiedAction checks for modified files
+// GitModifiedAction checks for modified files.
+// Inputs: ignore - path patterns to ignore.
 type GitModifiedAction struct{}
 
 func (a *GitModifiedAction) Run(ctx context.Context) (Result, error) {
-	cmd := exec.CommandContext(ctx, "git", "diff", "--name-only")
+	return a.RunWithContext(ctx, NewActionContext(nil))
+}
+
+func (a *GitModifiedAction) RunWithContext(ctx context.Context, actx *ActionContext) (Result, error) {
+	ignore := actx.InputList("ignore")
+	cmd := actx.Command(ctx, "git", "diff", "--name-only")
 	output, err := cmd.Output()
 	if err != nil {
 		return Result{
@@ -145,7 +202,7 @@ func (a *GitModifiedAction) Run(ctx context.Context) (Result, error) {
 	modified := []string{}
 	
 	for _, line := range lines {
-		if line != "" {
+		if line != "" && !matchesAnyPattern(line, ignore) {
 			modified = append(modified, line)
 		}
 	}
@@ -153,7 +210,7 @@ func (a *GitModifiedAction) Run(ctx context.Context) (Result, error) {
 	if len(modified) > 0 {
 		return Result{
 			Status:  StatusError,
-			Message: "There are modified files, to check run:\n      git status",
+			Message: failureMessage("There are modified files", modified, "git status"),
 		}, fmt.Errorf("modified files found")
 	}
 	
@@ -167,12 +224,17 @@ func (a *GitModifiedAction) Description() string {
 	return "Check for modified files"
 }
 
-// VersionCheckAction validates version format
+// VersionCheckAction validates version format.
+// Inputs: file - version file (default: VERSION).
 type VersionCheckAction struct{}
 
 func (a *VersionCheckAction) Run(ctx context.Context) (Result, error) {
+	return a.RunWithContext(ctx, NewActionContext(nil))
+}
+
+func (a *VersionCheckAction) RunWithContext(ctx context.Context, actx *ActionContext) (Result, error) {
 	// Read VERSION file
-	data, err := os.ReadFile("VERSION")
+	data, err := os.ReadFile(actx.Path(actx.Input("file", "VERSION")))
 	if err != nil {
 		return Result{
 			Status:  StatusError,
@@ -206,12 +268,17 @@ func (a *VersionCheckAction) Description() string {
 	return "Validate version format"
 }
 
-// VersionCheckGreatestAction checks if current version is the greatest
+// VersionCheckGreatestAction checks if current version is the greatest.
+// Inputs: file - version file (default: VERSION).
 type VersionCheckGreatestAction struct{}
 
 func (a *VersionCheckGreatestAction) Run(ctx context.Context) (Result, error) {
+	return a.RunWithContext(ctx, NewActionContext(nil))
+}
+
+func (a *VersionCheckGreatestAction) RunWithContext(ctx context.Context, actx *ActionContext) (Result, error) {
 	// Read current version
-	data, err := os.ReadFile("VERSION")
+	data, err := os.ReadFile(actx.Path(actx.Input("file", "VERSION")))
 	if err != nil {
 		return Result{
 			Status:  StatusError,
@@ -222,7 +289,7 @@ func (a *VersionCheckGreatestAction) Run(ctx context.Context) (Result, error) {
 	currentVersion := strings.TrimSpace(string(data))
 	
 	// Get all git tags
-	cmd := exec.CommandContext(ctx, "git", "tag", "--sort=-version:refname")
+	cmd := actx.Command(ctx, "git", "tag", "--sort=-version:refname")
 	output, err := cmd.Output()
 	if err != nil {
 		return Result{
@@ -14,8 +14,27 @@ func TestDefaultActionRegistry(t *testing.T) {
 		"git@untracked",
 		"git@uncommitted", 
 		"git@modified",
+		"git@branch",
+		"git@up-to-date",
+		"git@tag-exists",
+		"git@signed-commits",
+		"git@no-conflict-markers",
+		"git@large-files",
+		"git@commit-message",
 		"version@check",
 		"version@check-greatest",
+		"version@bump",
+		"version@tag",
+		"version@changelog",
+		"tool@require",
+		"fs@checksum",
+		"fs@archive",
+		"fs@copy",
+		"fs@clean",
+		"go@test",
+		"go@mod-tidy-check",
+		"go@vet",
+		"go@build",
 	}
 	
 	for _, action := range expectedActions {
@@ -39,7 +58,7 @@ func TestDefaultActionRegistry_ListActions(t *testing.T) {
 	registry := NewDefaultActionRegistry()
 	actions := registry.ListActions()
 	
-	expectedCount := 5
+	expectedCount := 24
 	if len(actions) != expectedCount {
 		t.Errorf("Expected %d actions, got %d", expectedCount, len(actions))
 	}
@@ -224,7 +243,7 @@ func TestRunner_ListBuiltInActions(t *testing.T) {
 	runner := NewRunner(config, nil)
 	actions := runner.ListBuiltInActions()
 	
-	expectedCount := 5
+	expectedCount := 24
 	if len(actions) != expectedCount {
 		t.Errorf("Expected %d built-in actions, got %d", expectedCount, len(actions))
 	}
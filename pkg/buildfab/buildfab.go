@@ -3,13 +3,16 @@ package buildfab
 import (
 	"bufio"
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"runtime"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -32,8 +35,20 @@ type Config struct {
 	} `yaml:"project"`
 	
 	Include []string          `yaml:"include,omitempty"` // File patterns to include
+	Vars    map[string]string `yaml:"vars,omitempty"`    // Project interpolation variables
+	Env     map[string]string `yaml:"env,omitempty"`     // Project environment exported to actions
+	EnvFile EnvFiles          `yaml:"env_file,omitempty"` // Project dotenv files
+	Secrets []string          `yaml:"secrets,omitempty"` // Names of vars and env entries to mask in output
+	Defaults Defaults         `yaml:"defaults,omitempty"` // Project defaults for actions
+	EnvPolicy string          `yaml:"env_policy,omitempty"` // Host environment policy: inherit, clean or allowlist
+	PassEnv []string          `yaml:"pass_env,omitempty"` // Host variable patterns passed with the allowlist policy
+	Tools   []ToolRequirement `yaml:"tools,omitempty"`   // Tools required by the project
+	Logs    LogPolicy         `yaml:"logs,omitempty"`    // Retention of step logs in .buildfab/runs
+	ProblemMatchers []ProblemMatcher `yaml:"problem_matchers,omitempty"` // Diagnostics extracted from failed step output
 	Actions []Action          `yaml:"actions"`
 	Stages  map[string]Stage  `yaml:"stages"`
+	
+	baseDir string // Directory of the configuration file, used to resolve relative paths
 }
 
 // Action represents a single action that can be executed
@@ -42,7 +57,14 @@ type Action struct {
 	Run      string          `yaml:"run,omitempty"`
 	Uses     string          `yaml:"uses,omitempty"`
 	Shell    string          `yaml:"shell,omitempty"` // Optional shell specification
+	WorkingDir string        `yaml:"working_dir,omitempty"` // Directory to run in, relative to the config file
+	With     map[string]string `yaml:"with,omitempty"`   // Inputs for built-in actions
 	Variants []ActionVariant `yaml:"variants,omitempty"` // Optional variants for conditional execution
+	Vars     map[string]string `yaml:"vars,omitempty"`   // Action interpolation variables
+	Env      map[string]string `yaml:"env,omitempty"`    // Action environment variables
+	EnvFile  EnvFiles          `yaml:"env_file,omitempty"` // Action dotenv files
+	Secrets  []string          `yaml:"secrets,omitempty"` // Names of vars and env entries to mask in output
+	ProblemMatchers []string   `yaml:"problem_matchers,omitempty"` // Matchers applied to the output (default: all)
 }
 
 // ActionVariant represents a conditional variant of an action
@@ -51,11 +73,24 @@ type ActionVariant struct {
 	Run   string `yaml:"run,omitempty"`
 	Uses  string `yaml:"uses,omitempty"`
 	Shell string `yaml:"shell,omitempty"`
+	With  map[string]string `yaml:"with,omitempty"` // Inputs merged over the action's inputs
 }
 
 // Stage represents a collection of steps to execute
 type Stage struct {
-	Steps []Step `yaml:"steps"`
+	Steps []Step            `yaml:"steps"`
+	Defaults Defaults       `yaml:"defaults,omitempty"` // Stage defaults for actions
+	WorkingDir string       `yaml:"working_dir,omitempty"` // Directory for the stage's actions, relative to the config file
+	Vars  map[string]string `yaml:"vars,omitempty"` // Stage interpolation variables
+	Env   map[string]string `yaml:"env,omitempty"`  // Stage environment variables
+	EnvFile EnvFiles        `yaml:"env_file,omitempty"` // Stage dotenv files
+	Secrets []string        `yaml:"secrets,omitempty"` // Names of vars and env entries to mask in output
+}
+
+// Defaults holds default settings applied to the actions of a project or stage
+type Defaults struct {
+	Shell      string `yaml:"shell,omitempty"`       // Shell used when an action does not set one
+	WorkingDir string `yaml:"working_dir,omitempty"` // Working directory relative to the config file
 }
 
 // Step represents a single step in a stage
@@ -65,6 +100,16 @@ type Step struct {
 	OnError string   `yaml:"onerror,omitempty"`
 	If      string   `yaml:"if,omitempty"`
 	Only    []string `yaml:"only,omitempty"`
+	WorkingDir string `yaml:"working_dir,omitempty"` // Directory to run in, relative to the config file
+	With    map[string]string `yaml:"with,omitempty"` // Inputs merged over the action's inputs
+	Vars    map[string]string `yaml:"vars,omitempty"` // Step interpolation variables
+	Env     map[string]string `yaml:"env,omitempty"`  // Step environment variables
+	Secrets []string `yaml:"secrets,omitempty"` // Names of vars and env entries to mask in output
+	Background bool  `yaml:"background,omitempty"` // Keep running until the end of the stage
+	Ready   *ReadyProbe `yaml:"ready,omitempty"` // When a background step is ready for its dependents
+	Interactive bool `yaml:"interactive,omitempty"` // Run with exclusive access to the terminal
+	Confirm string   `yaml:"confirm,omitempty"` // Question to approve before the step runs
+	ConfirmText string `yaml:"confirm_text,omitempty"` // Text to type to approve, instead of y/N
 }
 
 // Result represents the result of executing a step
@@ -74,6 +119,11 @@ type Result struct {
 	Message string
 	Error   error
 	Duration time.Duration
+	Start   time.Time // When the step started
+	Variant string // Condition of the variant that ran
+	Output  string // Captured output of run commands
+	ExitCode int   // Exit code of a failed run command, 0 otherwise
+	Diagnostics []Diagnostic // Problems extracted from the output of a failed step
 }
 
 // Status represents the execution status of a step
@@ -122,6 +172,16 @@ type RunOptions struct {
 	Only        []string          // Only run steps matching these labels
 	WithRequires bool             // Include required dependencies when running single step
 	StepCallback StepCallback     // Optional callback for step execution events
+	EnvFiles    []string          // Additional dotenv files loaded with the highest precedence, masked with the secret: prefix
+	Secrets     []string          // Names of vars and env entries masked in output, including Variables
+	AssumeYes   bool              // Approve confirm steps without prompting
+	Prompter    Prompter          // Asks confirm questions (default: the terminal)
+	Stdin       io.Reader         // Input of interactive steps (default: os.Stdin when it is a terminal)
+	RunLog      *RunLog           // Step logs of the run, see NewRunLog (default: none)
+	StepDurations map[string]time.Duration // Expected step durations ordering ready steps, see HistoryDurations
+	StreamOutput bool             // Stream command output lines to StepCallback also when not verbose
+	
+	masker *Masker // Shared secret masker, set by SimpleRunner
 }
 
 // DefaultRunOptions returns default run options
@@ -161,11 +221,40 @@ type Runner struct {
 	config   *Config
 	opts     *RunOptions
 	registry ActionRegistry
+	masker   *Masker
+	
+	// Output destinations wrapped with the masker
+	output       io.Writer
+	errorOutput  io.Writer
+	stepCallback StepCallback
+	
+	// Outputs set by built-in actions, keyed by step name
+	outputs   map[string]*ActionOutputs
+	outputsMu sync.Mutex
+	
+	// Background steps running until the end of the stage
+	services   []*service
+	servicesMu sync.Mutex
+	
+	// Results of the last stage run, see Results
+	results []Result
+	
+	// Output is held back by the gate while a confirm or interactive step
+	// uses the terminal, which is held with terminalMu
+	gate       *outputGate
+	terminalMu sync.Mutex
+	// Steps waiting for a confirmation or for terminalMu, they don't take
+	// one of the MaxParallel slots
+	terminalWaiting atomic.Int32
 }
 
-// NewRunner creates a new buildfab runner with default built-in actions
+// NewRunner creates a new buildfab runner with default built-in actions and
+// the action plugins found in the project plugins directory and on PATH when
+// a plugin@ action is first used
 func NewRunner(config *Config, opts *RunOptions) *Runner {
-	return NewRunnerWithRegistry(config, opts, NewDefaultActionRegistry())
+	registry := NewDefaultActionRegistry()
+	registry.DiscoverPluginsOnUse(PluginSearchPath(config))
+	return NewRunnerWithRegistry(config, opts, registry)
 }
 
 // NewRunnerWithRegistry creates a new buildfab runner with a custom action registry
@@ -173,10 +262,31 @@ func NewRunnerWithRegistry(config *Config, opts *RunOptions, registry ActionRegi
 	if opts == nil {
 		opts = DefaultRunOptions()
 	}
+	
+	// Secrets are registered as scopes resolve, so every output path goes
+	// through the same masker
+	masker := opts.masker
+	if masker == nil {
+		masker = NewMasker()
+	}
+	gate := &outputGate{}
+	if terminal, ok := opts.StepCallback.(terminalUser); ok {
+		gate.terminal = terminal
+	}
+	var stepCallback StepCallback
+	if opts.StepCallback != nil {
+		stepCallback = &gatedStepCallback{next: &maskingStepCallback{next: opts.StepCallback, masker: masker}, gate: gate}
+	}
+	
 	return &Runner{
-		config:   config,
-		opts:     opts,
-		registry: registry,
+		config:       config,
+		opts:         opts,
+		registry:     registry,
+		masker:       masker,
+		output:       gatedOutput(NewMaskingWriter(opts.Output, masker), gate),
+		errorOutput:  gatedOutput(NewMaskingWriter(opts.ErrorOutput, masker), gate),
+		stepCallback: stepCallback,
+		gate:         gate,
 	}
 }
 
@@ -190,7 +300,7 @@ func (r *Runner) RunStage(ctx context.Context, stageName string) error {
 	// Use the internal executor for actual execution
 	// We need to import the internal packages, but since this is a public API,
 	// we'll create a simple implementation that works with the existing structure
-	return r.runStageInternal(ctx, stageName)
+	return r.masker.MaskError(r.runStageInternal(ctx, stageName))
 }
 
 // RunAction executes a specific action
@@ -198,25 +308,30 @@ func (r *Runner) RunAction(ctx context.Context, actionName string) error {
 	// Check if it's a built-in action first
 	if runner, exists := r.registry.GetRunner(actionName); exists {
 		// Call step start callback if provided
-		if r.opts.StepCallback != nil {
-			r.opts.StepCallback.OnStepStart(ctx, actionName)
+		if r.stepCallback != nil {
+			r.stepCallback.OnStepStart(ctx, actionName)
 		}
 
 		// Handle dry-run mode for built-in actions
 		if r.opts.DryRun {
 			description := runner.Description()
-			if r.opts.StepCallback != nil {
-				r.opts.StepCallback.OnStepComplete(ctx, actionName, StepStatusOK, fmt.Sprintf("would execute built-in action: %s", description), 0)
+			if r.stepCallback != nil {
+				r.stepCallback.OnStepComplete(ctx, actionName, StepStatusOK, fmt.Sprintf("would execute built-in action: %s", description), 0)
 			}
 			return nil
 		}
 
+		scope, err := r.resolveScope(nil, nil, nil)
+		if err != nil {
+			return fmt.Errorf("failed to resolve variables for action %s: %w", actionName, err)
+		}
+		
 		start := time.Now()
-		result, err := runner.Run(ctx)
+		result, err := r.runBuiltInRunner(ctx, runner, Action{Name: actionName, Uses: actionName}, scope, r.opts.Verbose)
 		duration := time.Since(start)
 
 		// Call step complete callback if provided
-		if r.opts.StepCallback != nil {
+		if r.stepCallback != nil {
 			status := StepStatusOK
 			message := "executed successfully"
 			
@@ -225,7 +340,7 @@ func (r *Runner) RunAction(ctx context.Context, actionName string) error {
 				status = StepStatusError
 				message = result.Message
 				if err != nil {
-					r.opts.StepCallback.OnStepError(ctx, actionName, err)
+					r.stepCallback.OnStepError(ctx, actionName, err)
 				}
 			} else if result.Status == StatusWarn {
 				status = StepStatusWarn
@@ -236,10 +351,10 @@ func (r *Runner) RunAction(ctx context.Context, actionName string) error {
 			} else if err != nil {
 				status = StepStatusError
 				message = err.Error()
-				r.opts.StepCallback.OnStepError(ctx, actionName, err)
+				r.stepCallback.OnStepError(ctx, actionName, err)
 			}
 			
-			r.opts.StepCallback.OnStepComplete(ctx, actionName, status, message, duration)
+			r.stepCallback.OnStepComplete(ctx, actionName, status, message, duration)
 		}
 
 		return err
@@ -251,45 +366,51 @@ func (r *Runner) RunAction(ctx context.Context, actionName string) error {
 		return fmt.Errorf("action not found: %s", actionName)
 	}
 
+	// Resolve project and action scoped variables
+	scope, err := r.resolveScope(nil, nil, &action)
+	if err != nil {
+		return fmt.Errorf("failed to resolve variables for action %s: %w", actionName, err)
+	}
+
 	// Call step start callback if provided
-	if r.opts.StepCallback != nil {
-		r.opts.StepCallback.OnStepStart(ctx, actionName)
+	if r.stepCallback != nil {
+		r.stepCallback.OnStepStart(ctx, actionName)
 	}
 
 		// Handle dry-run mode for custom actions
 		if r.opts.DryRun {
-			err := r.runActionInternalDryRun(ctx, action)
-			if r.opts.StepCallback != nil {
+			err := r.runActionInternalDryRun(ctx, action, scope)
+			if r.stepCallback != nil {
 				status := StepStatusOK
 				message := "would execute action"
 				if err != nil {
 					status = StepStatusError
 					message = err.Error()
 				}
-				r.opts.StepCallback.OnStepComplete(ctx, actionName, status, message, 0)
+				r.stepCallback.OnStepComplete(ctx, actionName, status, message, 0)
 			}
-			return err
+			return r.masker.MaskError(err)
 		}
 
 	start := time.Now()
-	err := r.runActionInternal(ctx, action)
+	err = r.runActionInternal(ctx, action, scope)
 	duration := time.Since(start)
 
 	// Call step complete callback if provided
-	if r.opts.StepCallback != nil {
+	if r.stepCallback != nil {
 		status := StepStatusOK
 		message := "executed successfully"
 		
 		if err != nil {
 			status = StepStatusError
 			message = err.Error()
-			r.opts.StepCallback.OnStepError(ctx, actionName, err)
+			r.stepCallback.OnStepError(ctx, actionName, err)
 		}
 		
-		r.opts.StepCallback.OnStepComplete(ctx, actionName, status, message, duration)
+		r.stepCallback.OnStepComplete(ctx, actionName, status, message, duration)
 	}
 
-	return err
+	return r.masker.MaskError(err)
 }
 
 // RunStageStep executes a specific step within a stage
@@ -318,30 +439,36 @@ func (r *Runner) RunStageStep(ctx context.Context, stageName, stepName string) e
 		return fmt.Errorf("action not found: %s", targetStep.Action)
 	}
 
+	// Resolve variables for the step within its stage
+	scope, err := r.resolveScope(&stage, targetStep, &action)
+	if err != nil {
+		return fmt.Errorf("failed to resolve variables for step %s: %w", stepName, err)
+	}
+
 	// Call step start callback if provided
-	if r.opts.StepCallback != nil {
-		r.opts.StepCallback.OnStepStart(ctx, stepName)
+	if r.stepCallback != nil {
+		r.stepCallback.OnStepStart(ctx, stepName)
 	}
 
 	start := time.Now()
-	err := r.runActionInternal(ctx, action)
+	err = r.runActionInternal(ctx, action, scope)
 	duration := time.Since(start)
 
 	// Call step complete callback if provided
-	if r.opts.StepCallback != nil {
+	if r.stepCallback != nil {
 		status := StepStatusOK
 		message := "executed successfully"
 		
 		if err != nil {
 			status = StepStatusError
 			message = err.Error()
-			r.opts.StepCallback.OnStepError(ctx, stepName, err)
+			r.stepCallback.OnStepError(ctx, stepName, err)
 		}
 		
-		r.opts.StepCallback.OnStepComplete(ctx, stepName, status, message, duration)
+		r.stepCallback.OnStepComplete(ctx, stepName, status, message, duration)
 	}
 
-	return err
+	return r.masker.MaskError(err)
 }
 
 // RunCLI executes the buildfab CLI with the given arguments
@@ -461,13 +588,18 @@ func evaluateCondition(condition string, variables map[string]string) (bool, err
 
 // shouldExecuteStepByCondition determines if a step should be executed based on its if condition
 func (r *Runner) shouldExecuteStepByCondition(ctx context.Context, step Step) (bool, error) {
+	return r.shouldExecuteStepInScope(ctx, step, r.opts.Variables)
+}
+
+// shouldExecuteStepInScope evaluates a step's if condition against scoped variables
+func (r *Runner) shouldExecuteStepInScope(ctx context.Context, step Step, variables map[string]string) (bool, error) {
 	// If no if condition is specified, execute the step
 	if step.If == "" {
 		return true, nil
 	}
 	
 	// Evaluate the if condition using the expression evaluator
-	shouldExecute, err := evaluateCondition(step.If, r.opts.Variables)
+	shouldExecute, err := evaluateCondition(step.If, variables)
 	if err != nil {
 		return false, fmt.Errorf("failed to evaluate if condition for step %s: %w", step.Action, err)
 	}
@@ -558,6 +690,32 @@ func (c *Config) Validate() error {
 				return fmt.Errorf("step %d in stage %s has invalid onerror value: %s (must be 'stop' or 'warn')", i+1, stageName, step.OnError)
 			}
 			
+			if step.ConfirmText != "" && step.Confirm == "" {
+				return fmt.Errorf("step %d in stage %s has confirm_text without confirm", i+1, stageName)
+			}
+			
+			if step.Ready != nil && !step.Background {
+				return fmt.Errorf("step %d in stage %s has ready without background: true", i+1, stageName)
+			}
+			if step.Background && step.Interactive {
+				return fmt.Errorf("step %d in stage %s cannot be both background and interactive", i+1, stageName)
+			}
+			if step.Interactive {
+				if action, _ := c.GetAction(step.Action); action.Uses != "" {
+					return fmt.Errorf("step %d in stage %s: interactive step requires a run action, %s uses %s", i+1, stageName, step.Action, action.Uses)
+				}
+			}
+			if step.Background {
+				if action, _ := c.GetAction(step.Action); action.Uses != "" {
+					return fmt.Errorf("step %d in stage %s: background step requires a run action, %s uses %s", i+1, stageName, step.Action, action.Uses)
+				}
+				if step.Ready != nil {
+					if err := step.Ready.validate(); err != nil {
+						return fmt.Errorf("step %d in stage %s: %w", i+1, stageName, err)
+					}
+				}
+			}
+			
 			// Validate only field contains valid values
 			for _, onlyValue := range step.Only {
 				if onlyValue != "release" && onlyValue != "prerelease" && onlyValue != "patch" && onlyValue != "minor" && onlyValue != "major" {
@@ -567,31 +725,64 @@ func (c *Config) Validate() error {
 		}
 	}
 	
+	// Validate vars definitions resolve without cycles
+	if err := c.validateScopes(); err != nil {
+		return err
+	}
+	
+	if err := c.validateEnvPolicy(); err != nil {
+		return err
+	}
+	
+	if err := c.validateTools(); err != nil {
+		return err
+	}
+	
+	if err := c.Logs.validate(); err != nil {
+		return err
+	}
+	
+	if err := c.validateProblemMatchers(); err != nil {
+		return err
+	}
+	
 	return nil
 }
 
+// Results returns the step results of the last stage run, in completion order
+func (r *Runner) Results() []Result {
+	return append([]Result(nil), r.results...)
+}
+
 // runStageInternal executes a stage using parallel execution with ordered streaming output
 func (r *Runner) runStageInternal(ctx context.Context, stageName string) error {
 	stage, _ := r.config.GetStage(stageName)
 	
 	// Handle dry-run mode for stages
 	if r.opts.DryRun {
-		return r.executeStageDryRun(ctx, stageName, stage.Steps)
+		return r.executeStageDryRun(ctx, stageName, &stage)
 	}
 	
+	// Background steps are torn down at the end of the stage
+	defer r.stopServices()
+	
 	// If we have a step callback, use it for execution
-	if r.opts.StepCallback != nil {
-		return r.executeStageWithCallback(ctx, stage.Steps)
+	if r.stepCallback != nil {
+		return r.executeStageWithCallback(ctx, &stage)
 	}
 	
 	// Build execution DAG
-	dag, err := r.buildDAG(stage.Steps)
+	dag, err := r.buildDAG(&stage)
 	if err != nil {
 		return fmt.Errorf("failed to build execution DAG: %w", err)
 	}
+	if err := r.checkConfirmations(ctx, dag); err != nil {
+		return err
+	}
 	
 	// Execute DAG with parallel execution but ordered streaming output
 	results, err := r.executeDAGWithOrderedStreaming(ctx, dag, stage.Steps)
+	r.results = results
 	
 	// Check if execution was terminated due to context cancellation
 	terminated := ctx.Err() != nil
@@ -605,7 +796,7 @@ func (r *Runner) runStageInternal(ctx context.Context, stageName string) error {
 					if step.OnError == "warn" {
 						// Log warning but continue
 						if r.opts.Verbose {
-							fmt.Fprintf(r.opts.ErrorOutput, "Warning: step %s failed: %v\n", step.Action, result.Error)
+							fmt.Fprintf(r.errorOutput, "Warning: step %s failed: %v\n", step.Action, result.Error)
 						}
 						continue
 					}
@@ -629,9 +820,11 @@ func (r *Runner) runStageInternal(ctx context.Context, stageName string) error {
 }
 
 // executeStageDryRun simulates stage execution for dry-run mode
-func (r *Runner) executeStageDryRun(ctx context.Context, stageName string, steps []Step) error {
+func (r *Runner) executeStageDryRun(ctx context.Context, stageName string, stage *Stage) error {
+	steps := stage.Steps
+	
 	// Print stage header
-	fmt.Fprintf(r.opts.Output, "▶️  Dry run stage: %s\n\n", stageName)
+	fmt.Fprintf(r.output, "▶️  Dry run stage: %s\n\n", stageName)
 	
 	// Count total steps
 	totalSteps := len(steps)
@@ -640,8 +833,15 @@ func (r *Runner) executeStageDryRun(ctx context.Context, stageName string, steps
 	
 	// Process each step
 	for _, step := range steps {
+		// Resolve variables visible to this step
+		action, _ := r.config.GetAction(step.Action)
+		scope, err := r.resolveScope(stage, &step, &action)
+		if err != nil {
+			return fmt.Errorf("failed to resolve variables for step %s: %w", step.Action, err)
+		}
+		
 		// Check if step should be executed based on conditions
-		shouldExecute, err := r.shouldExecuteStepByCondition(ctx, step)
+		shouldExecute, err := r.shouldExecuteStepInScope(ctx, step, scope.Variables)
 		if err != nil {
 			return fmt.Errorf("failed to evaluate step condition: %w", err)
 		}
@@ -649,7 +849,7 @@ func (r *Runner) executeStageDryRun(ctx context.Context, stageName string, steps
 		if !shouldExecute {
 			skippedSteps++
 			if r.opts.Verbose {
-				fmt.Fprintf(r.opts.Output, "→ %s: would skip (condition not met)\n", step.Action)
+				fmt.Fprintf(r.output, "→ %s: would skip (condition not met)\n", step.Action)
 			}
 			continue
 		}
@@ -668,7 +868,7 @@ func (r *Runner) executeStageDryRun(ctx context.Context, stageName string, steps
 			if !stepMatches {
 				skippedSteps++
 				if r.opts.Verbose {
-					fmt.Fprintf(r.opts.Output, "→ %s: would skip (not in only filter)\n", step.Action)
+					fmt.Fprintf(r.output, "→ %s: would skip (not in only filter)\n", step.Action)
 				}
 				continue
 			}
@@ -683,47 +883,53 @@ func (r *Runner) executeStageDryRun(ctx context.Context, stageName string, steps
 			if runner, exists := r.registry.GetRunner(step.Action); exists {
 				description := runner.Description()
 				if r.opts.Verbose {
-					fmt.Fprintf(r.opts.Output, "✓ %s: would execute built-in action: %s\n", step.Action, description)
+					fmt.Fprintf(r.output, "✓ %s: would execute built-in action: %s\n", step.Action, description)
 				}
 			} else {
 				if r.opts.Verbose {
-					fmt.Fprintf(r.opts.Output, "✗ %s: would fail (action not found)\n", step.Action)
+					fmt.Fprintf(r.output, "✗ %s: would fail (action not found)\n", step.Action)
 				}
 			}
 		} else {
 			// Simulate custom action execution
-			err := r.runActionInternalDryRun(ctx, action)
+			err := r.runActionInternalDryRun(ctx, action, scope)
 			if err != nil {
 				if r.opts.Verbose {
-					fmt.Fprintf(r.opts.Output, "✗ %s: would fail (%v)\n", step.Action, err)
+					fmt.Fprintf(r.output, "✗ %s: would fail (%v)\n", step.Action, err)
 				}
 			}
 		}
 	}
 	
 	// Print summary
-	fmt.Fprintf(r.opts.Output, "\n")
-	fmt.Fprintf(r.opts.Output, "━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━\n")
-	fmt.Fprintf(r.opts.Output, "🔍 %s%s%s - %s\n", colorCyan, "DRY RUN", colorReset, stageName)
-	fmt.Fprintf(r.opts.Output, "\n")
-	fmt.Fprintf(r.opts.Output, "📊 Summary:\n")
-	fmt.Fprintf(r.opts.Output, "   %s%s%s %s%-8s %3d%s\n", colorGreen, "✓", colorReset, colorGreen, "would run", executedSteps, colorReset)
-	fmt.Fprintf(r.opts.Output, "   %s%s%s %s%-8s %3d%s\n", colorGray, "→", colorReset, colorGray, "skipped", skippedSteps, colorReset)
-	fmt.Fprintf(r.opts.Output, "   %s%s%s %s%-8s %3d%s\n", colorGray, "?", colorReset, colorGray, "total", totalSteps, colorReset)
+	fmt.Fprintf(r.output, "\n")
+	fmt.Fprintf(r.output, "━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━\n")
+	fmt.Fprintf(r.output, "🔍 %s%s%s - %s\n", colorCyan, "DRY RUN", colorReset, stageName)
+	fmt.Fprintf(r.output, "\n")
+	fmt.Fprintf(r.output, "📊 Summary:\n")
+	fmt.Fprintf(r.output, "   %s%s%s %s%-8s %3d%s\n", colorGreen, "✓", colorReset, colorGreen, "would run", executedSteps, colorReset)
+	fmt.Fprintf(r.output, "   %s%s%s %s%-8s %3d%s\n", colorGray, "→", colorReset, colorGray, "skipped", skippedSteps, colorReset)
+	fmt.Fprintf(r.output, "   %s%s%s %s%-8s %3d%s\n", colorGray, "?", colorReset, colorGray, "total", totalSteps, colorReset)
 	
 	return nil
 }
 
 // executeStageWithCallback executes a stage using the step callback for output management
-func (r *Runner) executeStageWithCallback(ctx context.Context, steps []Step) error {
+func (r *Runner) executeStageWithCallback(ctx context.Context, stage *Stage) error {
+	steps := stage.Steps
+	
 	// Build execution DAG
-	dag, err := r.buildDAG(steps)
+	dag, err := r.buildDAG(stage)
 	if err != nil {
 		return fmt.Errorf("failed to build execution DAG: %w", err)
 	}
+	if err := r.checkConfirmations(ctx, dag); err != nil {
+		return err
+	}
 	
 	// Execute DAG with step callback
 	results, err := r.executeDAGWithCallback(ctx, dag, steps)
+	r.results = results
 	
 	// Check if execution was terminated due to context cancellation
 	terminated := ctx.Err() != nil
@@ -737,7 +943,7 @@ func (r *Runner) executeStageWithCallback(ctx context.Context, steps []Step) err
 					if step.OnError == "warn" {
 						// Log warning but continue
 						if r.opts.Verbose {
-							fmt.Fprintf(r.opts.ErrorOutput, "Warning: step %s failed: %v\n", step.Action, result.Error)
+							fmt.Fprintf(r.errorOutput, "Warning: step %s failed: %v\n", step.Action, result.Error)
 						}
 						continue
 					}
@@ -827,24 +1033,8 @@ func (r *Runner) executeDAGWithCallback(ctx context.Context, dag map[string]*DAG
 			}
 			
 			// Find ready steps
-			var readySteps []string
 			mu.Lock()
-			for nodeName, node := range dag {
-				if !completed[nodeName] && !executing[nodeName] && !failed[nodeName] {
-					// Check if all dependencies are completed
-					allDepsCompleted := true
-					for _, dep := range node.Dependencies {
-						if !completed[dep] {
-							allDepsCompleted = false
-							break
-						}
-					}
-					
-					if allDepsCompleted {
-						readySteps = append(readySteps, nodeName)
-					}
-				}
-			}
+			readySteps := r.getReadyStepsLocked(dag, completed, failed, executing)
 			mu.Unlock()
 			
 			// If no ready steps, we're done
@@ -906,8 +1096,8 @@ func (r *Runner) executeDAGWithCallback(ctx context.Context, dag map[string]*DAG
 					}
 					
 					// Call step callback for skipped step
-					if r.opts.StepCallback != nil {
-						r.opts.StepCallback.OnStepComplete(ctx, nodeName, StepStatusSkipped, "skipped (condition not met)", 0)
+					if r.stepCallback != nil {
+						r.stepCallback.OnStepComplete(ctx, nodeName, StepStatusSkipped, "skipped (condition not met)", 0)
 					}
 					
 					resultChan <- result
@@ -916,16 +1106,7 @@ func (r *Runner) executeDAGWithCallback(ctx context.Context, dag map[string]*DAG
 				
 				// Execute the node in parallel
 				go func(nodeName string, node *DAGNode) {
-					// Find the step configuration
-					var stepConfig *Step
-					for _, step := range steps {
-						if step.Action == nodeName {
-							stepConfig = &step
-							break
-						}
-					}
-					
-					result, _ := r.executeActionForDAGWithCallback(ctx, node.Action, stepConfig)
+					result, _ := r.executeActionForDAGWithCallback(ctx, node)
 					result.Name = nodeName
 					// Check if context was cancelled during execution
 					if ctx.Err() != nil {
@@ -946,20 +1127,25 @@ func (r *Runner) executeDAGWithCallback(ctx context.Context, dag map[string]*DAG
 }
 
 // executeActionForDAGWithCallback executes a single action for DAG execution using step callbacks
-func (r *Runner) executeActionForDAGWithCallback(ctx context.Context, action Action, stepConfig *Step) (Result, error) {
+func (r *Runner) executeActionForDAGWithCallback(ctx context.Context, node *DAGNode) (Result, error) {
+	action := node.Action
+	stepConfig := &node.Step
+	
 	// Call step start callback if provided
-	if r.opts.StepCallback != nil {
-		r.opts.StepCallback.OnStepStart(ctx, action.Name)
+	if r.stepCallback != nil {
+		r.stepCallback.OnStepStart(ctx, action.Name)
 	}
 
 	var result Result
 	var err error
+	r.startStepLog(action.Name)
+	defer func() { r.finishStepLog(action.Name, result, err) }()
 
 	// Measure execution time from when the action actually starts to when it finishes
 	start := time.Now()
 	
 	// Handle variants - select appropriate variant or skip if no match
-	variant, variantErr := action.SelectVariant(r.opts.Variables)
+	variant, variantErr := action.SelectVariant(node.scope.Variables)
 	if variantErr != nil {
 		result = Result{
 			Status:  StatusError,
@@ -967,11 +1153,12 @@ func (r *Runner) executeActionForDAGWithCallback(ctx context.Context, action Act
 			Error:   variantErr,
 		}
 		duration := time.Since(start)
+		result.Start = start
 		result.Duration = duration
 		
 		// Call step complete callback if provided
-		if r.opts.StepCallback != nil {
-			r.opts.StepCallback.OnStepComplete(ctx, action.Name, StepStatusError, variantErr.Error(), duration)
+		if r.stepCallback != nil {
+			r.stepCallback.OnStepComplete(ctx, action.Name, StepStatusError, variantErr.Error(), duration)
 		}
 		
 		return result, variantErr
@@ -984,11 +1171,12 @@ func (r *Runner) executeActionForDAGWithCallback(ctx context.Context, action Act
 			Message: "no matching variant",
 		}
 		duration := time.Since(start)
+		result.Start = start
 		result.Duration = duration
 		
 		// Call step complete callback if provided
-		if r.opts.StepCallback != nil {
-			r.opts.StepCallback.OnStepComplete(ctx, action.Name, StepStatusSkipped, "no matching variant", duration)
+		if r.stepCallback != nil {
+			r.stepCallback.OnStepComplete(ctx, action.Name, StepStatusSkipped, "no matching variant", duration)
 		}
 		
 		return result, nil // Not an error, just skipped
@@ -1002,18 +1190,27 @@ func (r *Runner) executeActionForDAGWithCallback(ctx context.Context, action Act
 			Run:   variant.Run,
 			Uses:  variant.Uses,
 			Shell: variant.Shell,
+			With:  mergeInputs(action.With, variant.With),
 		}
 	}
 	
-	if effectiveAction.Uses != "" {
-		result, err = r.runBuiltInActionForDAG(ctx, effectiveAction)
+	if stepResult, handled, stepErr := r.runStepModes(ctx, effectiveAction, node); handled {
+		result, err = stepResult, stepErr
+	} else if effectiveAction.Uses != "" {
+		result, err = r.runBuiltInActionForDAG(ctx, effectiveAction, node.scope, r.opts.Verbose || r.opts.StreamOutput)
 	} else {
-		result, err = r.runCustomActionForDAG(ctx, effectiveAction)
+		result, err = r.runCustomActionForDAG(ctx, effectiveAction, node.scope)
 	}
 	duration := time.Since(start)
 	
 	// Set the duration in the result
+	result.Start = start
 	result.Duration = duration
+	result.ExitCode = commandExitCode(err)
+	result.Diagnostics = r.stepDiagnostics(action, node.scope, result)
+	if variant != nil {
+		result.Variant = variant.When
+	}
 
 	// Apply onerror policy if step has one
 	if result.Status == StatusError && stepConfig != nil && stepConfig.OnError == "warn" {
@@ -1023,7 +1220,7 @@ func (r *Runner) executeActionForDAGWithCallback(ctx context.Context, action Act
 	}
 
 	// Call step complete callback if provided
-	if r.opts.StepCallback != nil {
+	if r.stepCallback != nil {
 		status := StepStatusOK
 		message := "executed successfully"
 		
@@ -1032,7 +1229,7 @@ func (r *Runner) executeActionForDAGWithCallback(ctx context.Context, action Act
 			status = StepStatusError
 			message = result.Message
 			if err != nil {
-				r.opts.StepCallback.OnStepError(ctx, action.Name, err)
+				r.stepCallback.OnStepError(ctx, action.Name, err)
 			}
 		} else if result.Status == StatusWarn {
 			status = StepStatusWarn
@@ -1043,10 +1240,11 @@ func (r *Runner) executeActionForDAGWithCallback(ctx context.Context, action Act
 		} else if err != nil {
 			status = StepStatusError
 			message = err.Error()
-			r.opts.StepCallback.OnStepError(ctx, action.Name, err)
+			r.stepCallback.OnStepError(ctx, action.Name, err)
 		}
 		
-		r.opts.StepCallback.OnStepComplete(ctx, action.Name, status, message, duration)
+		r.notifyDiagnostics(ctx, action.Name, result.Diagnostics)
+		r.stepCallback.OnStepComplete(ctx, action.Name, status, message, duration)
 	}
 
 	return result, err
@@ -1055,11 +1253,11 @@ func (r *Runner) executeActionForDAGWithCallback(ctx context.Context, action Act
 // shouldExecuteStep checks if a step should be executed based on conditions
 func (r *Runner) shouldExecuteStep(ctx context.Context, node *DAGNode) bool {
 	// Check if step should be executed based on its if condition
-	shouldExecute, err := r.shouldExecuteStepByCondition(ctx, node.Step)
+	shouldExecute, err := r.shouldExecuteStepInScope(ctx, node.Step, node.scope.Variables)
 	if err != nil {
 		// If there's an error evaluating the condition, log it and skip the step
 		if r.opts.Verbose {
-			fmt.Fprintf(r.opts.ErrorOutput, "Warning: failed to evaluate if condition for step %s: %v\n", node.Step.Action, err)
+			fmt.Fprintf(r.errorOutput, "Warning: failed to evaluate if condition for step %s: %v\n", node.Step.Action, err)
 		}
 		return false
 	}
@@ -1072,6 +1270,10 @@ type DAGNode struct {
 	Action       Action
 	Dependencies []string
 	Dependents   []string
+	
+	scope    *stepScope    // Variables and environment resolved for this step
+	order    int           // Position in the stage, breaks priority ties
+	priority time.Duration // Expected time from the node's start to the end of the stage
 }
 
 // StreamingOutputManager manages which step's output should be streamed
@@ -1152,21 +1354,28 @@ func (s *StreamingOutputManager) MarkStepStarted(stepName string) {
 }
 
 // buildDAG builds the execution DAG from stage steps
-func (r *Runner) buildDAG(steps []Step) (map[string]*DAGNode, error) {
+func (r *Runner) buildDAG(stage *Stage) (map[string]*DAGNode, error) {
 	dag := make(map[string]*DAGNode)
 	
 	// Create nodes for each step
-	for _, step := range steps {
+	for i, step := range stage.Steps {
 		action, exists := r.config.GetAction(step.Action)
 		if !exists {
 			return nil, fmt.Errorf("action not found: %s", step.Action)
 		}
 		
+		scope, err := r.resolveScope(stage, &step, &action)
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve variables for step %s: %w", step.Action, err)
+		}
+		
 		node := &DAGNode{
 			Step:         step,
 			Action:       action,
 			Dependencies: step.Require,
 			Dependents:   []string{},
+			scope:        scope,
+			order:        i,
 		}
 		
 		dag[step.Action] = node
@@ -1188,6 +1397,7 @@ func (r *Runner) buildDAG(steps []Step) (map[string]*DAGNode, error) {
 		return nil, fmt.Errorf("circular dependency detected: %w", err)
 	}
 	
+	r.prioritizeDAG(dag)
 	return dag, nil
 }
 
@@ -1271,13 +1481,13 @@ func (r *Runner) executeDAGWithOrderedStreaming(ctx context.Context, dag map[str
 			if result.Status == StatusError {
 				failed[result.Name] = true
 			}
-			mu.Unlock()
 			
 			// Display immediately if it's ready in declaration order
 			r.displayStepInOrder(ctx, result.Name, steps, resultMap, displayed, completed)
 			
 			// Check if we can now display the next step
 			r.checkAndDisplayNextStep(ctx, steps, resultMap, displayed, completed, started)
+			mu.Unlock()
 		}
 	}()
 	
@@ -1392,8 +1602,8 @@ func (r *Runner) executeDAGWithOrderedStreaming(ctx context.Context, dag map[str
 					}
 					
 					// Call step callback for skipped step
-					if r.opts.StepCallback != nil {
-						r.opts.StepCallback.OnStepComplete(ctx, nodeName, StepStatusSkipped, "skipped (condition not met)", 0)
+					if r.stepCallback != nil {
+						r.stepCallback.OnStepComplete(ctx, nodeName, StepStatusSkipped, "skipped (condition not met)", 0)
 					}
 					
 					select {
@@ -1406,12 +1616,12 @@ func (r *Runner) executeDAGWithOrderedStreaming(ctx context.Context, dag map[str
 				
 				// Execute the node in parallel with streaming output control
 				go func(nodeName string, node *DAGNode) {
-					result, err := r.executeActionForDAGWithStreamingControl(ctx, node.Action, streamingManager)
+					result, err := r.executeActionForDAGWithStreamingControl(ctx, node, streamingManager)
 					result.Name = nodeName
 					
 					// Call OnStepError immediately if the step failed
-					if err != nil && r.opts.StepCallback != nil {
-						r.opts.StepCallback.OnStepError(ctx, nodeName, err)
+					if err != nil && r.stepCallback != nil {
+						r.stepCallback.OnStepError(ctx, nodeName, err)
 					}
 					
 					select {
@@ -1422,7 +1632,9 @@ func (r *Runner) executeDAGWithOrderedStreaming(ctx context.Context, dag map[str
 				}(nodeName, node)
 				
 				// Check if we can display the first step immediately after starting execution
+				mu.Lock()
 				r.checkAndDisplayNextStep(ctx, steps, resultMap, displayed, completed, started)
+				mu.Unlock()
 			}
 		}
 	}()
@@ -1443,8 +1655,8 @@ func (r *Runner) checkAndDisplayNextStep(ctx context.Context, steps []Step, resu
 			// Check if we can display this step (either completed or currently executing)
 			if r.canDisplayStepInOrder(step, steps, displayed) {
 				// Show step start message if not already shown
-				if r.opts.StepCallback != nil && !started[step.Action] {
-					r.opts.StepCallback.OnStepStart(ctx, step.Action)
+				if r.stepCallback != nil && !started[step.Action] {
+					r.stepCallback.OnStepStart(ctx, step.Action)
 					started[step.Action] = true
 				}
 				
@@ -1469,11 +1681,11 @@ func (r *Runner) displayStepInOrder(ctx context.Context, stepName string, steps
 				// Only show completion message if the step is actually completed
 				if result, exists := resultMap[stepName]; exists && completed[stepName] {
 					// Display any buffered output for this step
-					if r.opts.StepCallback != nil && r.opts.Verbose && result.Message != "" {
-						r.opts.StepCallback.OnStepOutput(ctx, stepName, result.Message)
+					if r.stepCallback != nil && r.opts.Verbose && result.Message != "" {
+						r.stepCallback.OnStepOutput(ctx, stepName, result.Message)
 					}
 					
-					if r.opts.StepCallback != nil {
+					if r.stepCallback != nil {
 						status := StepStatusOK
 						message := "executed successfully"
 						
@@ -1488,7 +1700,8 @@ func (r *Runner) displayStepInOrder(ctx context.Context, stepName string, steps
 							message = result.Message
 						}
 						
-						r.opts.StepCallback.OnStepComplete(ctx, stepName, status, message, result.Duration)
+						r.notifyDiagnostics(ctx, stepName, result.Diagnostics)
+						r.stepCallback.OnStepComplete(ctx, stepName, status, message, result.Duration)
 					}
 					displayed[stepName] = true
 				}
@@ -1528,7 +1741,7 @@ func (r *Runner) displayRemainingSteps(ctx context.Context, steps []Step, result
 	for _, step := range steps {
 		if !displayed[step.Action] {
 			if result, exists := resultMap[step.Action]; exists {
-				if r.opts.StepCallback != nil {
+				if r.stepCallback != nil {
 					status := StepStatusOK
 					message := "executed successfully"
 					
@@ -1543,7 +1756,8 @@ func (r *Runner) displayRemainingSteps(ctx context.Context, steps []Step, result
 						message = result.Message
 					}
 					
-					r.opts.StepCallback.OnStepComplete(ctx, step.Action, status, message, result.Duration)
+					r.notifyDiagnostics(ctx, step.Action, result.Diagnostics)
+					r.stepCallback.OnStepComplete(ctx, step.Action, status, message, result.Duration)
 				}
 				displayed[step.Action] = true
 			}
@@ -1697,8 +1911,8 @@ func (r *Runner) executeDAGWithParallel(ctx context.Context, dag map[string]*DAG
 					}
 					
 					// Call step callback for skipped step
-					if r.opts.StepCallback != nil {
-						r.opts.StepCallback.OnStepComplete(ctx, nodeName, StepStatusSkipped, "skipped (condition not met)", 0)
+					if r.stepCallback != nil {
+						r.stepCallback.OnStepComplete(ctx, nodeName, StepStatusSkipped, "skipped (condition not met)", 0)
 					}
 					
 					select {
@@ -1711,7 +1925,7 @@ func (r *Runner) executeDAGWithParallel(ctx context.Context, dag map[string]*DAG
 				
 				// Execute the node in parallel
 				go func(nodeName string, node *DAGNode) {
-					result, _ := r.executeActionForDAG(ctx, node.Action)
+					result, _ := r.executeActionForDAG(ctx, node)
 					result.Name = nodeName
 					
 					select {
@@ -1729,19 +1943,48 @@ func (r *Runner) executeDAGWithParallel(ctx context.Context, dag map[string]*DAG
 	return results, nil
 }
 
-// getReadyStepsLocked returns steps that are ready to execute (thread-safe version)
+// getReadyStepsLocked returns steps that are ready to execute (thread-safe version),
+// highest priority first and no more than the free slots. Steps that will be
+// skipped for a failed dependency don't need a slot. Only one interactive step
+// runs at a time.
 func (r *Runner) getReadyStepsLocked(dag map[string]*DAGNode, completed map[string]bool, failed map[string]bool, executing map[string]bool) []string {
-	var ready []string
-	
+	var candidates []string
+	running := 0
 	for nodeName, node := range dag {
-		if completed[nodeName] || executing[nodeName] {
+		if executing[nodeName] && !completed[nodeName] {
+			running++
+		}
+		if completed[nodeName] || executing[nodeName] || failed[nodeName] {
 			continue
 		}
 		
 		// Check if all dependencies are completed
 		if r.allDependenciesCompleted(node, completed) {
+			candidates = append(candidates, nodeName)
+		}
+	}
+	sortByPriority(dag, candidates)
+	
+	var ready []string
+	free := r.slots() - running + int(r.terminalWaiting.Load())
+	interactiveBusy := interactiveRunningLocked(dag, completed, executing)
+	for _, nodeName := range candidates {
+		node := dag[nodeName]
+		if r.hasFailedDependency(node, failed) {
 			ready = append(ready, nodeName)
+			continue
+		}
+		if free <= 0 {
+			continue
+		}
+		if node.Step.Interactive {
+			if interactiveBusy {
+				continue
+			}
+			interactiveBusy = true
 		}
+		ready = append(ready, nodeName)
+		free--
 	}
 	
 	return ready
@@ -1778,69 +2021,33 @@ func (r *Runner) getFailedDependencyNames(node *DAGNode, failed map[string]bool)
 	return failedDeps
 }
 
-// getShellCommand returns the appropriate shell command and arguments
-// If userShell is specified, use that; otherwise use platform defaults
-func getShellCommand(userShell string) (string, []string, error) {
-	// If user specified a shell, use it
-	if userShell != "" {
-		// For Windows, automatically add .exe if not present
-		if runtime.GOOS == "windows" && !strings.HasSuffix(userShell, ".exe") {
-			userShell = userShell + ".exe"
-		}
-		
-		// Check if the specified shell is available
-		if _, err := exec.LookPath(userShell); err != nil {
-			return "", nil, fmt.Errorf("shell '%s' not found in PATH. Please install it or use a different shell", userShell)
-		}
-		
-		// Return appropriate arguments based on shell type
-		switch {
-		case strings.Contains(userShell, "bash"):
-			return userShell, []string{"-euc"}, nil
-		case strings.Contains(userShell, "powershell") || strings.Contains(userShell, "pwsh"):
-			return userShell, []string{"-NoProfile", "-Command"}, nil
-		case strings.Contains(userShell, "cmd"):
-			return userShell, []string{"/C"}, nil
-		case strings.Contains(userShell, "sh") || strings.Contains(userShell, "zsh") || strings.Contains(userShell, "fish"):
-			return userShell, []string{"-euc"}, nil
-		default:
-			// For unknown shells, try bash-style arguments first
-			return userShell, []string{"-euc"}, nil
-		}
-	}
-	
-	// No user shell specified - use platform defaults
-	if runtime.GOOS == "windows" {
-		// Default Windows shell: bash (Git Bash)
-		if _, err := exec.LookPath("bash.exe"); err == nil {
-			return "bash.exe", []string{"-euc"}, nil
-		}
-		// Fallback to cmd
-		return "cmd.exe", []string{"/C"}, nil
-	}
-	
-	// Default Unix shell: sh
-	return "sh", []string{"-euc"}, nil
-}
-
 // executeActionForDAGWithStreamingControl executes a single action for DAG execution with streaming control
-func (r *Runner) executeActionForDAGWithStreamingControl(ctx context.Context, action Action, streamingManager *StreamingOutputManager) (Result, error) {
+func (r *Runner) executeActionForDAGWithStreamingControl(ctx context.Context, node *DAGNode, streamingManager *StreamingOutputManager) (Result, error) {
+	action := node.Action
+	
 	// Step start callback will be handled by displayStepInOrder when the step becomes current
 
 	var result Result
 	var err error
+	r.startStepLog(action.Name)
+	defer func() { r.finishStepLog(action.Name, result, err) }()
 
 	// Measure execution time from when the action actually starts to when it finishes
 	start := time.Now()
-	if action.Uses != "" {
-		result, err = r.runBuiltInActionForDAG(ctx, action)
+	if stepResult, handled, stepErr := r.runStepModes(ctx, action, node); handled {
+		result, err = stepResult, stepErr
+	} else if action.Uses != "" {
+		result, err = r.runBuiltInActionForDAG(ctx, action, node.scope, r.opts.Verbose && streamingManager.ShouldStreamOutput(action.Name))
 	} else {
-		result, err = r.runCustomActionForDAGWithStreamingControl(ctx, action, streamingManager)
+		result, err = r.runCustomActionForDAGWithStreamingControl(ctx, action, node.scope, streamingManager)
 	}
 	duration := time.Since(start)
 	
 	// Set the duration in the result
+	result.Start = start
 	result.Duration = duration
+	result.ExitCode = commandExitCode(err)
+	result.Diagnostics = r.stepDiagnostics(action, node.scope, result)
 
 	// Step completion callback will be handled by displayStepInOrder when the step completes
 
@@ -1848,32 +2055,42 @@ func (r *Runner) executeActionForDAGWithStreamingControl(ctx context.Context, ac
 }
 
 // executeActionForDAG executes a single action for DAG execution
-func (r *Runner) executeActionForDAG(ctx context.Context, action Action) (Result, error) {
+func (r *Runner) executeActionForDAG(ctx context.Context, node *DAGNode) (Result, error) {
+	action := node.Action
+	
 		// Call step start callback if provided
-		if r.opts.StepCallback != nil {
-		r.opts.StepCallback.OnStepStart(ctx, action.Name)
+		if r.stepCallback != nil {
+		r.stepCallback.OnStepStart(ctx, action.Name)
 	}
 
 	var result Result
 	var err error
+	r.startStepLog(action.Name)
+	defer func() { r.finishStepLog(action.Name, result, err) }()
 
 	// Measure execution time from when the action actually starts to when it finishes
 	start := time.Now()
-	if action.Uses != "" {
-		result, err = r.runBuiltInActionForDAG(ctx, action)
+	if stepResult, handled, stepErr := r.runStepModes(ctx, action, node); handled {
+		result, err = stepResult, stepErr
+	} else if action.Uses != "" {
+		result, err = r.runBuiltInActionForDAG(ctx, action, node.scope, r.opts.Verbose || r.opts.StreamOutput)
 	} else {
-		result, err = r.runCustomActionForDAG(ctx, action)
+		result, err = r.runCustomActionForDAG(ctx, action, node.scope)
 	}
 	duration := time.Since(start)
 	
 	// Set the duration in the result
+	result.Start = start
 	result.Duration = duration
+	result.ExitCode = commandExitCode(err)
+	result.Diagnostics = r.stepDiagnostics(action, node.scope, result)
 
 	return result, err
 }
 
-// runBuiltInActionForDAG executes a built-in action for DAG execution
-func (r *Runner) runBuiltInActionForDAG(ctx context.Context, action Action) (Result, error) {
+// runBuiltInActionForDAG executes a built-in action for DAG execution, passing
+// its output lines to the step callback when stream is set
+func (r *Runner) runBuiltInActionForDAG(ctx context.Context, action Action, scope *stepScope, stream bool) (Result, error) {
 	if r.registry == nil {
 		return Result{
 			Status:  StatusError,
@@ -1889,11 +2106,19 @@ func (r *Runner) runBuiltInActionForDAG(ctx context.Context, action Action) (Res
 		}, fmt.Errorf("unknown built-in action: %s", action.Uses)
 	}
 	
-	result, err := runner.Run(ctx)
+	result, err := r.runBuiltInRunner(ctx, runner, action, scope, stream)
+	
+	// The message of a built-in action is its report, logged after its output
+	if result.Message != "" {
+		stepLog := r.opts.RunLog.Step(action.Name)
+		for _, line := range strings.Split(strings.TrimRight(result.Message, "\n"), "\n") {
+			stepLog.Line(StreamStdout, line)
+		}
+	}
 	
 	// Call step output callback if provided and verbose mode is enabled
-	if r.opts.StepCallback != nil && r.opts.Verbose && result.Message != "" {
-		r.opts.StepCallback.OnStepOutput(ctx, action.Name, result.Message)
+	if r.stepCallback != nil && r.opts.Verbose && result.Message != "" {
+		r.stepCallback.OnStepOutput(ctx, action.Name, result.Message)
 	}
 	
 	// Return error if action failed
@@ -1905,7 +2130,7 @@ func (r *Runner) runBuiltInActionForDAG(ctx context.Context, action Action) (Res
 }
 
 // runCustomActionForDAGWithStreamingControl executes a custom action for DAG execution with streaming control
-func (r *Runner) runCustomActionForDAGWithStreamingControl(ctx context.Context, action Action, streamingManager *StreamingOutputManager) (Result, error) {
+func (r *Runner) runCustomActionForDAGWithStreamingControl(ctx context.Context, action Action, scope *stepScope, streamingManager *StreamingOutputManager) (Result, error) {
 	if action.Run == "" {
 		return Result{
 			Status:  StatusError,
@@ -1913,42 +2138,29 @@ func (r *Runner) runCustomActionForDAGWithStreamingControl(ctx context.Context,
 		}, fmt.Errorf("action %s has no run command", action.Name)
 	}
 	
-	// Interpolate variables in the action
-	interpolatedAction, err := InterpolateAction(action, r.opts.Variables)
-	if err != nil {
-		return Result{
-			Status:  StatusError,
-			Message: fmt.Sprintf("failed to interpolate variables: %v", err),
-		}, fmt.Errorf("failed to interpolate variables in action %s: %w", action.Name, err)
-	}
-	
-	// Create command with error handling flags
-	shell, shellArgs, err := getShellCommand(action.Shell)
+	// Create command with interpolated run, shell flags and environment
+	cmd, cleanup, err := r.newActionCommand(ctx, action, scope)
 	if err != nil {
 		return Result{
 			Name:    action.Name,
 			Status:  StatusError,
-			Message: fmt.Sprintf("shell configuration error: %v", err),
-		}, fmt.Errorf("shell configuration error: %w", err)
+			Message: err.Error(),
+		}, err
 	}
-	cmd := exec.CommandContext(ctx, shell, append(shellArgs, interpolatedAction.Run)...)
-	cmd.Dir = r.opts.WorkingDir
+	defer cleanup()
 	
-	// Set environment variables
-	cmd.Env = os.Environ()
-	for k, v := range r.opts.Variables {
-		cmd.Env = append(cmd.Env, fmt.Sprintf("%s=%s", k, v))
-	}
-	
-	var bufferedOutput string
+	var bufferedOutput, output string
 	if r.opts.Verbose && streamingManager.ShouldStreamOutput(action.Name) {
 		// Use streaming output for verbose mode and if this step should stream
-		err = r.executeCommandWithStreaming(ctx, cmd, action.Name)
+		var captured strings.Builder
+		err = r.executeCommandWithStreaming(ctx, cmd, action.Name, &captured)
+		output = captured.String()
 	} else {
 		// Use buffered output for non-verbose mode or if this step shouldn't stream
 		var stdout, stderr strings.Builder
-		cmd.Stdout = &stdout
-		cmd.Stderr = &stderr
+		stepLog := r.opts.RunLog.Step(action.Name)
+		cmd.Stdout = io.MultiWriter(&stdout, stepLog.Writer(StreamStdout))
+		cmd.Stderr = io.MultiWriter(&stderr, stepLog.Writer(StreamStderr))
 		
 		// Execute command
 		err = cmd.Run()
@@ -1963,24 +2175,27 @@ func (r *Runner) runCustomActionForDAGWithStreamingControl(ctx context.Context,
 			}
 			bufferedOutput += stderr.String()
 		}
+		output = r.masker.Mask(bufferedOutput)
 		}
 		
 		if err != nil {
 		// Provide better error message with reproduction instructions
 		return Result{
 			Status:  StatusError,
-			Message: fmt.Sprintf("failed, to check run:\n  %s", action.Run),
+			Message: r.reproMessage(action, scope),
+			Output:  output,
 		}, fmt.Errorf("command failed: %w", err)
 	}
 	
 	return Result{
 		Status:  StatusOK,
-		Message: bufferedOutput, // Store buffered output in the result message
+		Message: r.masker.Mask(bufferedOutput), // Store buffered output in the result message
+		Output:  output,
 	}, nil
 }
 
 // runCustomActionForDAG executes a custom action for DAG execution
-func (r *Runner) runCustomActionForDAG(ctx context.Context, action Action) (Result, error) {
+func (r *Runner) runCustomActionForDAG(ctx context.Context, action Action, scope *stepScope) (Result, error) {
 	if action.Run == "" {
 		return Result{
 			Status:  StatusError,
@@ -1988,55 +2203,33 @@ func (r *Runner) runCustomActionForDAG(ctx context.Context, action Action) (Resu
 		}, fmt.Errorf("action %s has no run command", action.Name)
 	}
 	
-	// Interpolate variables in the action
-	interpolatedAction, err := InterpolateAction(action, r.opts.Variables)
-	if err != nil {
-		return Result{
-			Status:  StatusError,
-			Message: fmt.Sprintf("failed to interpolate variables: %v", err),
-		}, fmt.Errorf("failed to interpolate variables in action %s: %w", action.Name, err)
-	}
-	
-	// Create command with error handling flags
-	shell, shellArgs, err := getShellCommand(action.Shell)
+	// Create command with interpolated run, shell flags and environment
+	cmd, cleanup, err := r.newActionCommand(ctx, action, scope)
 	if err != nil {
 		return Result{
 			Name:    action.Name,
 			Status:  StatusError,
-			Message: fmt.Sprintf("shell configuration error: %v", err),
-		}, fmt.Errorf("shell configuration error: %w", err)
-	}
-	cmd := exec.CommandContext(ctx, shell, append(shellArgs, interpolatedAction.Run)...)
-	cmd.Dir = r.opts.WorkingDir
-	
-	// Set environment variables
-	cmd.Env = os.Environ()
-	for k, v := range r.opts.Variables {
-		cmd.Env = append(cmd.Env, fmt.Sprintf("%s=%s", k, v))
+			Message: err.Error(),
+		}, err
 	}
+	defer cleanup()
 	
-	if r.opts.Verbose {
-		// Use streaming output for verbose mode
-		err = r.executeCommandWithStreaming(ctx, cmd, action.Name)
+	// Output is captured for reports in both modes
+	var output strings.Builder
+	if r.opts.Verbose || r.opts.StreamOutput {
+		// Use streaming output for verbose mode and live displays
+		err = r.executeCommandWithStreaming(ctx, cmd, action.Name, &output)
 	} else {
-		// Use buffered output for non-verbose mode
-		var stdout, stderr strings.Builder
-		cmd.Stdout = &stdout
-		cmd.Stderr = &stderr
+		// Use buffered output for non-verbose mode, stdout and stderr
+		// interleaved as written
+		stepLog := r.opts.RunLog.Step(action.Name)
+		captured := &lockedWriter{w: &output}
+		cmd.Stdout = io.MultiWriter(captured, stepLog.Writer(StreamStdout))
+		cmd.Stderr = io.MultiWriter(captured, stepLog.Writer(StreamStderr))
 		
 		// Execute command
 		err = cmd.Run()
 		
-		// Call step output callback if provided and verbose mode is enabled
-		if r.opts.StepCallback != nil && r.opts.Verbose {
-			if stdout.Len() > 0 {
-				r.opts.StepCallback.OnStepOutput(ctx, action.Name, stdout.String())
-			}
-			if stderr.Len() > 0 {
-				r.opts.StepCallback.OnStepOutput(ctx, action.Name, stderr.String())
-			}
-		}
-		
 		// Don't print output here - it's already handled by the step callback
 	}
 	
@@ -2044,20 +2237,35 @@ func (r *Runner) runCustomActionForDAG(ctx context.Context, action Action) (Resu
 		// Provide better error message with reproduction instructions
 		return Result{
 			Status:  StatusError,
-			Message: fmt.Sprintf("failed, to check run:\n  %s", action.Run),
+			Message: r.reproMessage(action, scope),
+			Output:  r.masker.Mask(output.String()),
 		}, fmt.Errorf("command failed: %w", err)
 	}
 	
 	return Result{
 		Status:  StatusOK,
 		Message: "command executed successfully",
+		Output:  r.masker.Mask(output.String()),
 	}, nil
 }
 
+// lockedWriter serialises writes to w. os/exec copies stdout and stderr on
+// separate goroutines when they are different writers.
+type lockedWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (l *lockedWriter) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.w.Write(p)
+}
+
 // runActionInternal executes a single action
-func (r *Runner) runActionInternal(ctx context.Context, action Action) error {
+func (r *Runner) runActionInternal(ctx context.Context, action Action, scope *stepScope) error {
 	// Select variant if action has variants
-	variant, err := action.SelectVariant(r.opts.Variables)
+	variant, err := action.SelectVariant(scope.Variables)
 	if err != nil {
 		return err
 	}
@@ -2065,13 +2273,13 @@ func (r *Runner) runActionInternal(ctx context.Context, action Action) error {
 	// If variant is nil and action has variants, it means no variant matched - skip
 	if variant == nil && len(action.Variants) > 0 {
 		// Call step complete callback with skipped status if provided
-		if r.opts.StepCallback != nil {
-			r.opts.StepCallback.OnStepComplete(ctx, action.Name, StepStatusSkipped, "no matching variant", 0)
+		if r.stepCallback != nil {
+			r.stepCallback.OnStepComplete(ctx, action.Name, StepStatusSkipped, "no matching variant", 0)
 		}
 		
 		// Print skip message if verbose mode is enabled
 		if r.opts.Verbose {
-			fmt.Fprintf(r.opts.Output, "→ %s: skipped (no matching variant)\n", action.Name)
+			fmt.Fprintf(r.output, "→ %s: skipped (no matching variant)\n", action.Name)
 		}
 		
 		return nil // Not an error, just skipped
@@ -2085,20 +2293,21 @@ func (r *Runner) runActionInternal(ctx context.Context, action Action) error {
 			Run:   variant.Run,
 			Uses:  variant.Uses,
 			Shell: variant.Shell,
+			With:  mergeInputs(action.With, variant.With),
 		}
 	}
 	
 	if effectiveAction.Uses != "" {
-		return r.runBuiltInAction(ctx, effectiveAction)
+		return r.runBuiltInAction(ctx, effectiveAction, scope)
 	}
 	
-	return r.runCustomAction(ctx, effectiveAction)
+	return r.runCustomAction(ctx, effectiveAction, scope)
 }
 
 // runActionInternalDryRun simulates action execution for dry-run mode
-func (r *Runner) runActionInternalDryRun(ctx context.Context, action Action) error {
+func (r *Runner) runActionInternalDryRun(ctx context.Context, action Action, scope *stepScope) error {
 	// Select variant if action has variants
-	variant, err := action.SelectVariant(r.opts.Variables)
+	variant, err := action.SelectVariant(scope.Variables)
 	if err != nil {
 		return err
 	}
@@ -2107,7 +2316,7 @@ func (r *Runner) runActionInternalDryRun(ctx context.Context, action Action) err
 	if variant == nil && len(action.Variants) > 0 {
 		// Print skip message if verbose mode is enabled
 		if r.opts.Verbose {
-			fmt.Fprintf(r.opts.Output, "→ %s: would skip (no matching variant)\n", action.Name)
+			fmt.Fprintf(r.output, "→ %s: would skip (no matching variant)\n", action.Name)
 		}
 		return nil // Not an error, just skipped
 	}
@@ -2120,6 +2329,7 @@ func (r *Runner) runActionInternalDryRun(ctx context.Context, action Action) err
 			Run:   variant.Run,
 			Uses:  variant.Uses,
 			Shell: variant.Shell,
+			With:  mergeInputs(action.With, variant.With),
 		}
 	}
 	
@@ -2127,7 +2337,7 @@ func (r *Runner) runActionInternalDryRun(ctx context.Context, action Action) err
 		return r.runBuiltInActionDryRun(ctx, effectiveAction)
 	}
 	
-	return r.runCustomActionDryRun(ctx, effectiveAction)
+	return r.runCustomActionDryRun(ctx, effectiveAction, scope)
 }
 
 // runBuiltInActionDryRun simulates built-in action execution for dry-run mode
@@ -2145,44 +2355,43 @@ func (r *Runner) runBuiltInActionDryRun(ctx context.Context, action Action) erro
 	
 	// Print what would be executed if verbose mode is enabled
 	if r.opts.Verbose {
-		fmt.Fprintf(r.opts.Output, "✓ %s: would execute built-in action: %s\n", action.Name, description)
+		fmt.Fprintf(r.output, "✓ %s: would execute built-in action: %s\n", action.Name, description)
 	}
 	
 	return nil
 }
 
 // runCustomActionDryRun simulates custom action execution for dry-run mode
-func (r *Runner) runCustomActionDryRun(ctx context.Context, action Action) error {
+func (r *Runner) runCustomActionDryRun(ctx context.Context, action Action, scope *stepScope) error {
 	if action.Run == "" {
 		return fmt.Errorf("action %s has no run command", action.Name)
 	}
 	
 	// Interpolate variables in the action
-	interpolatedAction, err := InterpolateAction(action, r.opts.Variables)
+	interpolatedAction, err := InterpolateAction(action, scope.Variables)
 	if err != nil {
 		return fmt.Errorf("failed to interpolate variables in action %s: %w", action.Name, err)
 	}
 	
-	// Get shell command info
-	shell, shellArgs, err := getShellCommand(action.Shell)
+	// Build the full command
+	commandStr, err := describeShellCommand(actionShell(action, scope), interpolatedAction.Run)
 	if err != nil {
 		return fmt.Errorf("shell configuration error for action %s: %w", action.Name, err)
 	}
-	
-	// Build the full command
-	fullCommand := append(shellArgs, interpolatedAction.Run)
-	commandStr := shell + " " + strings.Join(fullCommand, " ")
+	if scope.WorkingDir != "" {
+		commandStr = fmt.Sprintf("cd %s && %s", displayPath(r.actionDir(scope)), commandStr)
+	}
 	
 	// Print what would be executed if verbose mode is enabled
 	if r.opts.Verbose {
-		fmt.Fprintf(r.opts.Output, "✓ %s: would execute command: %s\n", action.Name, commandStr)
+		fmt.Fprintf(r.output, "✓ %s: would execute command: %s\n", action.Name, commandStr)
 	}
 	
 	return nil
 }
 
 // runBuiltInAction executes a built-in action
-func (r *Runner) runBuiltInAction(ctx context.Context, action Action) error {
+func (r *Runner) runBuiltInAction(ctx context.Context, action Action, scope *stepScope) error {
 	if r.registry == nil {
 		return fmt.Errorf("built-in action %s not supported: no action registry provided", action.Uses)
 	}
@@ -2192,24 +2401,24 @@ func (r *Runner) runBuiltInAction(ctx context.Context, action Action) error {
 		return fmt.Errorf("unknown built-in action: %s", action.Uses)
 	}
 	
-	result, err := runner.Run(ctx)
+	result, err := r.runBuiltInRunner(ctx, runner, action, scope, r.opts.Verbose)
 	if err != nil {
 		return err
 	}
 	
 	// Call step output callback if provided and verbose mode is enabled
-	if r.opts.StepCallback != nil && r.opts.Verbose && result.Message != "" {
-		r.opts.StepCallback.OnStepOutput(ctx, action.Name, result.Message)
+	if r.stepCallback != nil && r.opts.Verbose && result.Message != "" {
+		r.stepCallback.OnStepOutput(ctx, action.Name, result.Message)
 	}
 	
 	// Print result if verbose mode is enabled
 	if r.opts.Verbose {
 		if result.Status == StatusOK {
-			fmt.Fprintf(r.opts.Output, "✓ %s: %s\n", action.Name, result.Message)
+			fmt.Fprintf(r.output, "✓ %s: %s\n", action.Name, result.Message)
 		} else if result.Status == StatusWarn {
-			fmt.Fprintf(r.opts.Output, "! %s: %s\n", action.Name, result.Message)
+			fmt.Fprintf(r.output, "! %s: %s\n", action.Name, result.Message)
 		} else if result.Status == StatusError {
-			fmt.Fprintf(r.opts.ErrorOutput, "✗ %s: %s\n", action.Name, result.Message)
+			fmt.Fprintf(r.errorOutput, "✗ %s: %s\n", action.Name, result.Message)
 		}
 	}
 	
@@ -2222,34 +2431,21 @@ func (r *Runner) runBuiltInAction(ctx context.Context, action Action) error {
 }
 
 // runCustomAction executes a custom action with run command
-func (r *Runner) runCustomAction(ctx context.Context, action Action) error {
+func (r *Runner) runCustomAction(ctx context.Context, action Action, scope *stepScope) error {
 	if action.Run == "" {
 		return fmt.Errorf("action %s has no run command", action.Name)
 	}
 	
-	// Interpolate variables in the action
-	interpolatedAction, err := InterpolateAction(action, r.opts.Variables)
-	if err != nil {
-		return fmt.Errorf("failed to interpolate variables in action %s: %w", action.Name, err)
-	}
-	
-	// Create command with error handling flags
-	shell, shellArgs, err := getShellCommand(action.Shell)
+	// Create command with interpolated run, shell flags and environment
+	cmd, cleanup, err := r.newActionCommand(ctx, action, scope)
 	if err != nil {
-		return fmt.Errorf("shell configuration error for action %s: %w", action.Name, err)
-	}
-	cmd := exec.CommandContext(ctx, shell, append(shellArgs, interpolatedAction.Run)...)
-	cmd.Dir = r.opts.WorkingDir
-	
-	// Set environment variables
-	cmd.Env = os.Environ()
-	for k, v := range r.opts.Variables {
-		cmd.Env = append(cmd.Env, fmt.Sprintf("%s=%s", k, v))
+		return fmt.Errorf("action %s: %w", action.Name, err)
 	}
+	defer cleanup()
 	
 	if r.opts.Verbose {
 		// Use streaming output for verbose mode
-		err = r.executeCommandWithStreaming(ctx, cmd, action.Name)
+		err = r.executeCommandWithStreaming(ctx, cmd, action.Name, nil)
 	} else {
 		// Use buffered output for non-verbose mode
 	var stdout, stderr strings.Builder
@@ -2260,12 +2456,12 @@ func (r *Runner) runCustomAction(ctx context.Context, action Action) error {
 		err = cmd.Run()
 	
 	// Call step output callback if provided and verbose mode is enabled
-	if r.opts.StepCallback != nil && r.opts.Verbose {
+	if r.stepCallback != nil && r.opts.Verbose {
 		if stdout.Len() > 0 {
-			r.opts.StepCallback.OnStepOutput(ctx, action.Name, stdout.String())
+			r.stepCallback.OnStepOutput(ctx, action.Name, stdout.String())
 		}
 		if stderr.Len() > 0 {
-			r.opts.StepCallback.OnStepOutput(ctx, action.Name, stderr.String())
+			r.stepCallback.OnStepOutput(ctx, action.Name, stderr.String())
 		}
 	}
 	
@@ -2274,14 +2470,80 @@ func (r *Runner) runCustomAction(ctx context.Context, action Action) error {
 	
 	if err != nil {
 		// Provide better error message with reproduction instructions
-		return fmt.Errorf("failed, to check run:\n  %s", action.Run)
+		return fmt.Errorf("%s", r.reproMessage(action, scope))
 	}
 	
 	return nil
 }
 
-// executeCommandWithStreaming executes a command with real-time output streaming
-func (r *Runner) executeCommandWithStreaming(ctx context.Context, cmd *exec.Cmd, actionName string) error {
+// newActionCommand builds the process for a custom action: it interpolates the
+// run command with the scope variables, applies the shell preset or template
+// and exports the scope environment. The returned cleanup removes the script
+// file, if any, and must be called once the command has finished.
+func (r *Runner) newActionCommand(ctx context.Context, action Action, scope *stepScope) (*exec.Cmd, func(), error) {
+	// Interpolate variables in the action
+	interpolatedAction, err := InterpolateAction(action, scope.Variables)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to interpolate variables: %w", err)
+	}
+	
+	// Create command with error handling flags
+	shell, shellArgs, cleanup, err := prepareShellCommand(actionShell(action, scope), interpolatedAction.Run)
+	if err != nil {
+		return nil, nil, fmt.Errorf("shell configuration error: %w", err)
+	}
+	cmd := exec.CommandContext(ctx, shell, shellArgs...)
+	cmd.Dir = r.actionDir(scope)
+	
+	// Only resolved env sections reach the process; vars are interpolation-only.
+	// The host environment is filtered by env_policy.
+	cmd.Env = buildProcessEnv(r.config, scope, r.opts.Variables)
+	
+	return cmd, cleanup, nil
+}
+
+// actionDir returns the directory an action runs in. Relative scope
+// directories only occur for configurations loaded without a file path.
+func (r *Runner) actionDir(scope *stepScope) string {
+	if scope == nil || scope.WorkingDir == "" {
+		return r.opts.WorkingDir
+	}
+	if filepath.IsAbs(scope.WorkingDir) || r.opts.WorkingDir == "" {
+		return scope.WorkingDir
+	}
+	return filepath.Join(r.opts.WorkingDir, scope.WorkingDir)
+}
+
+// actionShell returns the shell of an action, falling back to the defaults of its scope
+func actionShell(action Action, scope *stepScope) string {
+	if action.Shell == "" && scope != nil {
+		return scope.Shell
+	}
+	return action.Shell
+}
+
+// reproMessage returns the failure message with reproduction instructions,
+// including the directory when the action does not run in the current one
+func (r *Runner) reproMessage(action Action, scope *stepScope) string {
+	if scope != nil && scope.WorkingDir != "" {
+		return fmt.Sprintf("failed, to check run:\n  cd %s\n  %s", displayPath(r.actionDir(scope)), action.Run)
+	}
+	return fmt.Sprintf("failed, to check run:\n  %s", action.Run)
+}
+
+// commandExitCode returns the exit code of a failed command, 0 for other errors
+func commandExitCode(err error) int {
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitCode()
+	}
+	return 0
+}
+
+// executeCommandWithStreaming executes a command with real-time output streaming.
+// Masked lines are also written to capture when it is not nil, and to the
+// step log tagged with their stream.
+func (r *Runner) executeCommandWithStreaming(ctx context.Context, cmd *exec.Cmd, actionName string, capture io.Writer) error {
 	// Create pipes for stdout and stderr
 	stdout, err := cmd.StdoutPipe()
 	if err != nil {
@@ -2301,34 +2563,45 @@ func (r *Runner) executeCommandWithStreaming(ctx context.Context, cmd *exec.Cmd,
 	// Create channels for goroutine communication
 	done := make(chan error, 1)
 	
+	// Readers must drain both pipes before cmd.Wait closes them
+	var readers sync.WaitGroup
+	readers.Add(2)
+	var captureMu sync.Mutex
+	emit := func(line string) {
+		if capture != nil {
+			captureMu.Lock()
+			io.WriteString(capture, line+"\n")
+			captureMu.Unlock()
+		}
+		// Call step output callback if provided - this handles the printing
+		if r.stepCallback != nil {
+			r.stepCallback.OnStepOutput(ctx, actionName, line)
+		}
+	}
+	
+	stepLog := r.opts.RunLog.Step(actionName)
+	
 	// Stream stdout
 	go func() {
-		scanner := bufio.NewScanner(stdout)
-		for scanner.Scan() {
-			line := scanner.Text()
-			
-			// Call step output callback if provided - this handles the printing
-			if r.opts.StepCallback != nil {
-				r.opts.StepCallback.OnStepOutput(ctx, actionName, line)
-			}
-		}
+		defer readers.Done()
+		streamLines(stdout, func(line string) {
+			stepLog.Line(StreamStdout, line)
+			emit(r.masker.Mask(line))
+		})
 	}()
 	
 	// Stream stderr
 	go func() {
-		scanner := bufio.NewScanner(stderr)
-		for scanner.Scan() {
-			line := scanner.Text()
-			
-			// Call step output callback if provided - this handles the printing
-			if r.opts.StepCallback != nil {
-				r.opts.StepCallback.OnStepOutput(ctx, actionName, line)
-			}
-		}
+		defer readers.Done()
+		streamLines(stderr, func(line string) {
+			stepLog.Line(StreamStderr, line)
+			emit(r.masker.Mask(line))
+		})
 	}()
 	
 	// Wait for command completion
 	go func() {
+		readers.Wait()
 		done <- cmd.Wait()
 	}()
 	
@@ -2341,4 +2614,38 @@ func (r *Runner) executeCommandWithStreaming(ctx context.Context, cmd *exec.Cmd,
 		cmd.Process.Kill()
 		return ctx.Err()
 	}
+}
+
+// maxStreamLine is the longest part of a line streamed at once
+const maxStreamLine = 1024 * 1024
+
+// streamLines calls emit with each line read from r, without its line ending,
+// until r is drained. A last line without a newline is emitted too, and lines
+// longer than maxStreamLine are emitted in parts instead of stopping the read,
+// which would block the command on a full pipe.
+func streamLines(r io.Reader, emit func(line string)) error {
+	reader := bufio.NewReaderSize(r, 64*1024)
+	var line []byte
+	for {
+		chunk, err := reader.ReadSlice('\n')
+		line = append(line, chunk...)
+		if err == bufio.ErrBufferFull {
+			if len(line) >= maxStreamLine {
+				emit(string(line))
+				line = line[:0]
+			}
+			continue
+		}
+		if len(line) > 0 {
+			text := strings.TrimSuffix(string(line), "\n")
+			emit(strings.TrimSuffix(text, "\r"))
+			line = line[:0]
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
 }
\ No newline at end of file
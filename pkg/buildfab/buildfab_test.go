@@ -3,6 +3,7 @@ package buildfab
 import (
 	"context"
 	"fmt"
+	"io"
 	"os"
 	"runtime"
 	"strings"
@@ -510,6 +511,41 @@ func TestRunner_RunStageStep(t *testing.T) {
 	}
 }
 
+func TestRunner_CapturedStdoutAndStderr(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("output tests use a POSIX shell")
+	}
+	config, err := LoadConfigFromBytes([]byte(`project:
+  name: test
+actions:
+  - name: noisy
+    run: for i in $(seq 200); do echo "out $i"; echo "err $i" >&2; done
+stages:
+  ci:
+    steps:
+      - action: noisy
+`))
+	if err != nil {
+		t.Fatalf("LoadConfigFromBytes() error = %v", err)
+	}
+	// Quiet runs capture both streams into one buffer, run with -race to
+	// check the writes are serialised. Without a run log nothing else
+	// synchronises the two copying goroutines.
+	opts := &RunOptions{WorkingDir: t.TempDir(), StepCallback: &MockStepCallback{}, Output: io.Discard, ErrorOutput: io.Discard}
+	runner := NewRunner(config, opts)
+	if err := runner.RunStage(context.Background(), "ci"); err != nil {
+		t.Fatalf("RunStage() error = %v", err)
+	}
+	results := runner.Results()
+	if len(results) != 1 {
+		t.Fatalf("results = %+v", results)
+	}
+	output := results[0].Output
+	if strings.Count(output, "out ") != 200 || strings.Count(output, "err ") != 200 || !strings.Contains(output, "err 200\n") {
+		t.Errorf("output should hold every line of both streams, got %d bytes:\n%s", len(output), output)
+	}
+}
+
 func TestRunCLI(t *testing.T) {
 	// Test CLI function with no arguments (should return error)
 	err := RunCLI(context.Background(), []string{})
@@ -0,0 +1,377 @@
+package buildfab
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CI providers of output annotations, see SimpleRunOptions.CI
+const (
+	CINone     = "none"
+	CIAuto     = "auto" // Detected from the environment
+	CIGitHub   = "github"
+	CIGitLab   = "gitlab"
+	CITeamCity = "teamcity"
+)
+
+// DetectCI returns the CI provider of the environment read with getenv, or
+// CINone outside a known provider
+func DetectCI(getenv func(string) string) string {
+	switch {
+	case getenv("GITHUB_ACTIONS") == "true":
+		return CIGitHub
+	case getenv("GITLAB_CI") == "true":
+		return CIGitLab
+	case getenv("TEAMCITY_VERSION") != "":
+		return CITeamCity
+	default:
+		return CINone
+	}
+}
+
+// ResolveCI returns the CI provider for ci: CIAuto detects the provider
+// from the environment, empty and unknown values are CINone
+func ResolveCI(ci string) string {
+	switch ci {
+	case CIAuto:
+		return DetectCI(os.Getenv)
+	case CIGitHub, CIGitLab, CITeamCity:
+		return ci
+	default:
+		return CINone
+	}
+}
+
+// ciDiagnostics is the number of diagnostics of a step annotated in CI,
+// GitHub shows at most 10 annotations of each kind per step
+const ciDiagnostics = 10
+
+// ciAnnotation is an error or warning attached to a file in the CI interface
+type ciAnnotation struct {
+	Level   StepStatus // StepStatusError or StepStatusWarn
+	File    string
+	Line    int
+	Col     int
+	Title   string
+	Message string
+}
+
+// ciFormat writes the markers of a CI provider
+type ciFormat interface {
+	// groupStart opens a collapsible group of lines; collapsed groups are
+	// folded by providers that choose per group
+	groupStart(b *strings.Builder, name, title string, collapsed bool)
+	groupEnd(b *strings.Builder, name string)
+	annotate(b *strings.Builder, a ciAnnotation)
+}
+
+// CIStepCallback decorates a StepCallback with the groups and annotations of
+// a CI provider. The output of each step is collected and written inside
+// its group when the step completes, so the groups of parallel steps don't
+// overlap; other events are passed to the decorated callback.
+//
+// The trade-off is that the output of a long step only shows up in the CI
+// log when it ends. Steps that never complete, because the stage was
+// cancelled, keep their output until Flush writes it.
+type CIStepCallback struct {
+	next        StepCallback
+	out         io.Writer
+	format      ciFormat
+	configFile  string // Annotated for failed steps without a file of their own
+	mu          sync.Mutex
+	output      map[string][]string
+	diagnostics map[string][]Diagnostic
+}
+
+// NewCIStepCallback decorates next with the markers of a CI provider written
+// to out. Failed steps are annotated on the action in configFile, when set.
+// It returns next itself for CINone and unknown providers.
+func NewCIStepCallback(provider string, next StepCallback, out io.Writer, configFile string) StepCallback {
+	var format ciFormat
+	switch provider {
+	case CIGitHub:
+		format = githubFormat{}
+	case CIGitLab:
+		format = gitlabFormat{now: time.Now}
+	case CITeamCity:
+		format = teamcityFormat{}
+	default:
+		return next
+	}
+	return &CIStepCallback{
+		next:        next,
+		out:         out,
+		format:      format,
+		configFile:  configFile,
+		output:      make(map[string][]string),
+		diagnostics: make(map[string][]Diagnostic),
+	}
+}
+
+// OnStepStart passes the event to the decorated callback
+func (c *CIStepCallback) OnStepStart(ctx context.Context, stepName string) {
+	c.next.OnStepStart(ctx, stepName)
+}
+
+// OnStepOutput collects the output of the step for its group
+func (c *CIStepCallback) OnStepOutput(ctx context.Context, stepName string, output string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.output[stepName] = append(c.output[stepName], strings.Split(strings.TrimSuffix(output, "\n"), "\n")...)
+}
+
+// OnStepDiagnostics collects the diagnostics of the step for its annotations
+func (c *CIStepCallback) OnStepDiagnostics(ctx context.Context, stepName string, diagnostics []Diagnostic) {
+	c.mu.Lock()
+	c.diagnostics[stepName] = diagnostics
+	c.mu.Unlock()
+	if next, ok := c.next.(StepDiagnosticsCallback); ok {
+		next.OnStepDiagnostics(ctx, stepName, diagnostics)
+	}
+}
+
+// OnStepError passes the event to the decorated callback
+func (c *CIStepCallback) OnStepError(ctx context.Context, stepName string, err error) {
+	c.next.OnStepError(ctx, stepName, err)
+}
+
+// OnStepComplete writes the group of the step with its output, the
+// annotations of its diagnostics and of a failure or warning, then passes
+// the event on
+func (c *CIStepCallback) OnStepComplete(ctx context.Context, stepName string, status StepStatus, message string, duration time.Duration) {
+	c.mu.Lock()
+	output := c.output[stepName]
+	diagnostics := c.diagnostics[stepName]
+	delete(c.output, stepName)
+	delete(c.diagnostics, stepName)
+	c.mu.Unlock()
+
+	var b strings.Builder
+	if len(output) > 0 {
+		icon, _ := statusIcon(status)
+		c.format.groupStart(&b, stepName, fmt.Sprintf("%s %s (%s)", icon, stepName, formatReportDuration(duration)), status != StepStatusError)
+		for _, line := range output {
+			b.WriteString(line + "\n")
+		}
+		c.format.groupEnd(&b, stepName)
+	}
+	if len(diagnostics) > ciDiagnostics {
+		diagnostics = diagnostics[:ciDiagnostics]
+	}
+	for _, diagnostic := range diagnostics {
+		level, title := StepStatusError, stepName
+		if diagnostic.Severity == DiagnosticWarning {
+			level = StepStatusWarn
+		}
+		if diagnostic.Code != "" {
+			title += " (" + diagnostic.Code + ")"
+		}
+		c.format.annotate(&b, ciAnnotation{Level: level, File: diagnostic.File, Line: diagnostic.Line, Col: diagnostic.Col, Title: title, Message: diagnostic.Message})
+	}
+	if status == StepStatusError || status == StepStatusWarn {
+		annotation := ciAnnotation{Level: status, Title: fmt.Sprintf("%s %s", stepName, status), Message: message}
+		if c.configFile != "" {
+			annotation.File = filepath.ToSlash(c.configFile)
+			annotation.Line = actionLine(c.configFile, stepName)
+		}
+		c.format.annotate(&b, annotation)
+	}
+	io.WriteString(c.out, b.String())
+
+	c.next.OnStepComplete(ctx, stepName, status, message, duration)
+}
+
+// Flush writes the groups of the steps that have output but didn't complete,
+// for example because the stage was cancelled, in step name order
+func (c *CIStepCallback) Flush() {
+	c.mu.Lock()
+	output := c.output
+	c.output = make(map[string][]string)
+	c.diagnostics = make(map[string][]Diagnostic)
+	c.mu.Unlock()
+
+	names := make([]string, 0, len(output))
+	for name := range output {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var b strings.Builder
+	for _, name := range names {
+		c.format.groupStart(&b, name, fmt.Sprintf("⏹️ %s (interrupted)", name), false)
+		for _, line := range output[name] {
+			b.WriteString(line + "\n")
+		}
+		c.format.groupEnd(&b, name)
+	}
+	io.WriteString(c.out, b.String())
+}
+
+// GetResults returns the results collected by the decorated callback
+func (c *CIStepCallback) GetResults() []StepResult {
+	if results, ok := c.next.(interface{ GetResults() []StepResult }); ok {
+		return results.GetResults()
+	}
+	return nil
+}
+
+// suspendTerminal passes the terminal to a prompt for a decorated live display
+func (c *CIStepCallback) suspendTerminal() {
+	if terminal, ok := c.next.(terminalUser); ok {
+		terminal.suspendTerminal()
+	}
+}
+
+// resumeTerminal gives the terminal back to a decorated live display
+func (c *CIStepCallback) resumeTerminal() {
+	if terminal, ok := c.next.(terminalUser); ok {
+		terminal.resumeTerminal()
+	}
+}
+
+// actionLine returns the line defining an action in a configuration file,
+// 0 when it is not found, for example when the action comes from an include
+func actionLine(path, name string) int {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0
+	}
+	defer file.Close()
+	pattern := regexp.MustCompile(`^\s*(-\s+)?name:\s*["']?` + regexp.QuoteMeta(name) + `["']?\s*(#.*)?$`)
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		if pattern.MatchString(scanner.Text()) {
+			return line
+		}
+	}
+	return 0
+}
+
+// githubFormat writes GitHub Actions workflow commands
+type githubFormat struct{}
+
+func (githubFormat) groupStart(b *strings.Builder, name, title string, collapsed bool) {
+	b.WriteString("::group::" + githubEscapeData(title) + "\n")
+}
+
+func (githubFormat) groupEnd(b *strings.Builder, name string) {
+	b.WriteString("::endgroup::\n")
+}
+
+func (githubFormat) annotate(b *strings.Builder, a ciAnnotation) {
+	command := "error"
+	if a.Level == StepStatusWarn {
+		command = "warning"
+	}
+	var properties []string
+	if a.File != "" {
+		properties = append(properties, "file="+githubEscapeProperty(a.File))
+		if a.Line > 0 {
+			properties = append(properties, fmt.Sprintf("line=%d", a.Line))
+		}
+		if a.Col > 0 {
+			properties = append(properties, fmt.Sprintf("col=%d", a.Col))
+		}
+	}
+	if a.Title != "" {
+		properties = append(properties, "title="+githubEscapeProperty(a.Title))
+	}
+	fmt.Fprintf(b, "::%s %s::%s\n", command, strings.Join(properties, ","), githubEscapeData(a.Message))
+}
+
+// githubEscapeData escapes the message of a workflow command
+func githubEscapeData(s string) string {
+	return strings.NewReplacer("%", "%25", "\r", "%0D", "\n", "%0A").Replace(s)
+}
+
+// githubEscapeProperty escapes a property value of a workflow command
+func githubEscapeProperty(s string) string {
+	return strings.NewReplacer("%", "%25", "\r", "%0D", "\n", "%0A", ":", "%3A", ",", "%2C").Replace(s)
+}
+
+// gitlabFormat writes GitLab CI collapsible sections. GitLab has no log
+// annotations, failures are written as red lines.
+type gitlabFormat struct {
+	now func() time.Time
+}
+
+// gitlabSectionName matches the characters GitLab allows in section names
+var gitlabSectionName = regexp.MustCompile(`[^a-zA-Z0-9_.-]+`)
+
+func (f gitlabFormat) groupStart(b *strings.Builder, name, title string, collapsed bool) {
+	options := ""
+	if collapsed {
+		options = "[collapsed=true]"
+	}
+	fmt.Fprintf(b, "\033[0Ksection_start:%d:%s%s\r\033[0K%s\n", f.now().Unix(), gitlabSection(name), options, title)
+}
+
+func (f gitlabFormat) groupEnd(b *strings.Builder, name string) {
+	fmt.Fprintf(b, "\033[0Ksection_end:%d:%s\r\033[0K\n", f.now().Unix(), gitlabSection(name))
+}
+
+func (gitlabFormat) annotate(b *strings.Builder, a ciAnnotation) {
+	color := colorRed
+	if a.Level == StepStatusWarn {
+		color = colorYellow
+	}
+	location := a.File
+	if location != "" && a.Line > 0 {
+		location += fmt.Sprintf(":%d", a.Line)
+		if a.Col > 0 {
+			location += fmt.Sprintf(":%d", a.Col)
+		}
+	}
+	if location != "" {
+		location += ": "
+	}
+	fmt.Fprintf(b, "%s%s: %s%s%s\n", color, a.Title, location, a.Message, colorReset)
+}
+
+// gitlabSection returns the section name of a step
+func gitlabSection(name string) string {
+	return "buildfab_" + gitlabSectionName.ReplaceAllString(name, "_")
+}
+
+// teamcityFormat writes TeamCity service messages
+type teamcityFormat struct{}
+
+func (teamcityFormat) groupStart(b *strings.Builder, name, title string, collapsed bool) {
+	fmt.Fprintf(b, "##teamcity[blockOpened name='%s' description='%s']\n", teamcityEscape(name), teamcityEscape(title))
+}
+
+func (teamcityFormat) groupEnd(b *strings.Builder, name string) {
+	fmt.Fprintf(b, "##teamcity[blockClosed name='%s']\n", teamcityEscape(name))
+}
+
+func (teamcityFormat) annotate(b *strings.Builder, a ciAnnotation) {
+	status := "ERROR"
+	if a.Level == StepStatusWarn {
+		status = "WARNING"
+	}
+	text := a.Title
+	if a.File != "" {
+		text = fmt.Sprintf("%s (%s", text, a.File)
+		if a.Line > 0 {
+			text += fmt.Sprintf(":%d", a.Line)
+			if a.Col > 0 {
+				text += fmt.Sprintf(":%d", a.Col)
+			}
+		}
+		text += ")"
+	}
+	fmt.Fprintf(b, "##teamcity[message text='%s' errorDetails='%s' status='%s']\n", teamcityEscape(text), teamcityEscape(a.Message), status)
+}
+
+// teamcityEscape escapes a value of a service message
+func teamcityEscape(s string) string {
+	return strings.NewReplacer("|", "||", "'", "|'", "\n", "|n", "\r", "|r", "[", "|[", "]", "|]").Replace(s)
+}
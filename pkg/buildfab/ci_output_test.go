@@ -0,0 +1,178 @@
+package buildfab
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDetectCI(t *testing.T) {
+	for _, tt := range []struct {
+		env  map[string]string
+		want string
+	}{
+		{map[string]string{}, CINone},
+		{map[string]string{"GITHUB_ACTIONS": "true"}, CIGitHub},
+		{map[string]string{"GITLAB_CI": "true"}, CIGitLab},
+		{map[string]string{"TEAMCITY_VERSION": "2024.1"}, CITeamCity},
+		{map[string]string{"GITHUB_ACTIONS": "false"}, CINone},
+	} {
+		if got := DetectCI(func(key string) string { return tt.env[key] }); got != tt.want {
+			t.Errorf("DetectCI(%v) = %q, want %q", tt.env, got, tt.want)
+		}
+	}
+	if got := ResolveCI(""); got != CINone {
+		t.Errorf("ResolveCI(\"\") = %q, want none", got)
+	}
+	t.Setenv("GITHUB_ACTIONS", "true")
+	if got := ResolveCI(CIAuto); got != CIGitHub {
+		t.Errorf("ResolveCI(auto) = %q, want github", got)
+	}
+	if got := ResolveCI(CINone); got != CINone {
+		t.Errorf("ResolveCI(none) = %q, want none", got)
+	}
+}
+
+func TestCIStepCallback_GitHub(t *testing.T) {
+	config := filepath.Join(t.TempDir(), ".project.yml")
+	if err := os.WriteFile(config, []byte("actions:\n  - name: build\n    run: make\n  - name: \"lint\"\n    run: lint\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	inner := &MockStepCallback{}
+	c := NewCIStepCallback(CIGitHub, inner, &out, config)
+	ctx := context.Background()
+
+	c.OnStepStart(ctx, "build")
+	c.OnStepStart(ctx, "lint")
+	c.OnStepOutput(ctx, "build", "compiling")
+	c.OnStepOutput(ctx, "lint", "main.go: 50% bad\n")
+	c.OnStepOutput(ctx, "build", "linking")
+	c.OnStepComplete(ctx, "build", StepStatusOK, "executed successfully", 2*time.Second)
+	c.OnStepComplete(ctx, "lint", StepStatusError, "command failed:\nexit status 1", time.Second)
+
+	file := filepath.ToSlash(config)
+	want := "::group::✓ build (2s)\ncompiling\nlinking\n::endgroup::\n" +
+		"::group::✗ lint (1s)\nmain.go: 50% bad\n::endgroup::\n" +
+		"::error file=" + strings.ReplaceAll(file, ":", "%3A") + ",line=4,title=lint error::command failed:%0Aexit status 1\n"
+	if out.String() != want {
+		t.Errorf("output =\n%s\nwant\n%s", out.String(), want)
+	}
+	// Output is held for the groups, other events reach the decorated callback
+	if len(inner.OnStepOutputCalls) != 0 || len(inner.OnStepStartCalls) != 2 || len(inner.OnStepCompleteCalls) != 2 {
+		t.Errorf("decorated callback got %d output, %d start and %d complete calls",
+			len(inner.OnStepOutputCalls), len(inner.OnStepStartCalls), len(inner.OnStepCompleteCalls))
+	}
+}
+
+func TestCIStepCallback_Flush(t *testing.T) {
+	var out bytes.Buffer
+	c := NewCIStepCallback(CIGitHub, &MockStepCallback{}, &out, "").(*CIStepCallback)
+	ctx := context.Background()
+	c.OnStepOutput(ctx, "test", "running")
+	c.OnStepOutput(ctx, "build", "compiling")
+	c.OnStepOutput(ctx, "lint", "done")
+	c.OnStepComplete(ctx, "lint", StepStatusOK, "executed successfully", time.Second)
+	out.Reset()
+
+	// Steps that didn't complete, as after a cancelled stage
+	c.Flush()
+	want := "::group::⏹️ build (interrupted)\ncompiling\n::endgroup::\n" +
+		"::group::⏹️ test (interrupted)\nrunning\n::endgroup::\n"
+	if out.String() != want {
+		t.Errorf("output =\n%s\nwant\n%s", out.String(), want)
+	}
+	out.Reset()
+	if c.Flush(); out.Len() != 0 {
+		t.Errorf("second Flush() wrote %q", out.String())
+	}
+}
+
+func TestCIStepCallback_GitLab(t *testing.T) {
+	var out bytes.Buffer
+	c := NewCIStepCallback(CIGitLab, &MockStepCallback{}, &out, "").(*CIStepCallback)
+	c.format = gitlabFormat{now: func() time.Time { return time.Unix(1700000000, 0) }}
+	ctx := context.Background()
+
+	c.OnStepOutput(ctx, "go test", "ok")
+	c.OnStepComplete(ctx, "go test", StepStatusOK, "executed successfully", time.Second)
+	c.OnStepOutput(ctx, "lint", "bad")
+	c.OnStepComplete(ctx, "lint", StepStatusWarn, "2 issues", time.Second)
+
+	want := "\033[0Ksection_start:1700000000:buildfab_go_test[collapsed=true]\r\033[0K✓ go test (1s)\nok\n" +
+		"\033[0Ksection_end:1700000000:buildfab_go_test\r\033[0K\n" +
+		"\033[0Ksection_start:1700000000:buildfab_lint[collapsed=true]\r\033[0K! lint (1s)\nbad\n" +
+		"\033[0Ksection_end:1700000000:buildfab_lint\r\033[0K\n" +
+		colorYellow + "lint warn: 2 issues" + colorReset + "\n"
+	if out.String() != want {
+		t.Errorf("output = %q, want %q", out.String(), want)
+	}
+}
+
+func TestCIStepCallback_TeamCity(t *testing.T) {
+	var out bytes.Buffer
+	c := NewCIStepCallback(CITeamCity, &MockStepCallback{}, &out, "")
+	ctx := context.Background()
+
+	c.OnStepOutput(ctx, "test", "it's [ok]")
+	c.OnStepComplete(ctx, "test", StepStatusError, "failed|1\n", time.Second)
+
+	want := "##teamcity[blockOpened name='test' description='✗ test (1s)']\nit's [ok]\n##teamcity[blockClosed name='test']\n" +
+		"##teamcity[message text='test error' errorDetails='failed||1|n' status='ERROR']\n"
+	if out.String() != want {
+		t.Errorf("output = %q, want %q", out.String(), want)
+	}
+}
+
+func TestNewCIStepCallback_None(t *testing.T) {
+	inner := &MockStepCallback{}
+	if c := NewCIStepCallback(CINone, inner, &bytes.Buffer{}, ""); c != StepCallback(inner) {
+		t.Errorf("NewCIStepCallback(none) = %T, want the callback itself", c)
+	}
+}
+
+func TestSimpleRunner_CI(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("CI output tests use a POSIX shell")
+	}
+	config, err := LoadConfigFromBytes([]byte(`project:
+  name: test
+actions:
+  - name: build
+    run: echo building
+  - name: test
+    run: echo testing; exit 1
+stages:
+  ci:
+    steps:
+      - action: build
+      - action: test
+`))
+	if err != nil {
+		t.Fatalf("LoadConfigFromBytes() error = %v", err)
+	}
+	var out, errOut bytes.Buffer
+	opts := DefaultSimpleRunOptions()
+	opts.WorkingDir = t.TempDir()
+	opts.Output = &out
+	opts.ErrorOutput = &errOut
+	opts.CI = CIGitHub
+	if err := NewSimpleRunner(config, opts).RunStage(context.Background(), "ci"); err == nil {
+		t.Fatal("RunStage() should fail")
+	}
+	for _, want := range []string{"::group::✓ build", "building\n::endgroup::", "::group::✗ test", "testing\n::endgroup::", "::error title=test error::"} {
+		if !strings.Contains(errOut.String(), want) {
+			t.Errorf("error output missing %q:\n%s", want, errOut.String())
+		}
+	}
+	// Markers go with the step results of the ordered output, the stage
+	// summary stays on the output
+	if !strings.Contains(errOut.String(), "✓\033[0m build") || strings.Contains(out.String(), "::group::") {
+		t.Errorf("output = %q\nerror output = %q", out.String(), errOut.String())
+	}
+}
@@ -46,6 +46,9 @@ func LoadConfig(path string) (*Config, error) {
 	if config.Project.BinDir == "" {
 		config.Project.BinDir = filepath.Dir(path)
 	}
+	if baseDir, err := filepath.Abs(filepath.Dir(path)); err == nil {
+		config.baseDir = baseDir
+	}
 	
 	// Process includes if present
 	if len(config.Include) > 0 {
@@ -180,8 +183,14 @@ func loadAndMergeFile(config *Config, path string, visited map[string]bool) erro
 		}
 	}
 	
+	// Env file and working directory paths in an included file are relative
+	// to that file's directory
+	includeDir := filepath.Dir(path)
+	
 	// Merge actions (later actions override earlier ones with same name)
 	for _, action := range includedConfig.Actions {
+		action.EnvFile = action.EnvFile.resolvePaths(includeDir)
+		action.WorkingDir = resolveConfigPath(includeDir, action.WorkingDir)
 		found := false
 		for i, existing := range config.Actions {
 			if existing.Name == action.Name {
@@ -195,11 +204,81 @@ func loadAndMergeFile(config *Config, path string, visited map[string]bool) erro
 		}
 	}
 	
+	// Merge project vars and env (later definitions override earlier ones)
+	if len(includedConfig.Vars) > 0 && config.Vars == nil {
+		config.Vars = make(map[string]string)
+	}
+	for k, v := range includedConfig.Vars {
+		config.Vars[k] = v
+	}
+	if len(includedConfig.Env) > 0 && config.Env == nil {
+		config.Env = make(map[string]string)
+	}
+	for k, v := range includedConfig.Env {
+		config.Env[k] = v
+	}
+	config.EnvFile = append(config.EnvFile, includedConfig.EnvFile.resolvePaths(includeDir)...)
+	config.Secrets = append(config.Secrets, includedConfig.Secrets...)
+	if includedConfig.EnvPolicy != "" {
+		config.EnvPolicy = includedConfig.EnvPolicy
+	}
+	config.PassEnv = append(config.PassEnv, includedConfig.PassEnv...)
+	
+	// Merge project defaults and log retention (later values override earlier ones)
+	if includedConfig.Defaults.Shell != "" {
+		config.Defaults.Shell = includedConfig.Defaults.Shell
+	}
+	if includedConfig.Defaults.WorkingDir != "" {
+		config.Defaults.WorkingDir = resolveConfigPath(includeDir, includedConfig.Defaults.WorkingDir)
+	}
+	if includedConfig.Logs.KeepRuns != 0 {
+		config.Logs.KeepRuns = includedConfig.Logs.KeepRuns
+	}
+	if includedConfig.Logs.MaxAge != "" {
+		config.Logs.MaxAge = includedConfig.Logs.MaxAge
+	}
+	
+	// Merge tools (later tools override earlier ones with same name)
+	for _, tool := range includedConfig.Tools {
+		found := false
+		for i, existing := range config.Tools {
+			if existing.Name == tool.Name {
+				config.Tools[i] = tool
+				found = true
+				break
+			}
+		}
+		if !found {
+			config.Tools = append(config.Tools, tool)
+		}
+	}
+	
+	// Merge problem matchers (later matchers override earlier ones with same name)
+	for _, matcher := range includedConfig.ProblemMatchers {
+		found := false
+		for i, existing := range config.ProblemMatchers {
+			if existing.Name == matcher.Name {
+				config.ProblemMatchers[i] = matcher
+				found = true
+				break
+			}
+		}
+		if !found {
+			config.ProblemMatchers = append(config.ProblemMatchers, matcher)
+		}
+	}
+	
 	// Merge stages (later stages override earlier ones)
 	if config.Stages == nil {
 		config.Stages = make(map[string]Stage)
 	}
 	for name, stage := range includedConfig.Stages {
+		stage.EnvFile = stage.EnvFile.resolvePaths(includeDir)
+		stage.WorkingDir = resolveConfigPath(includeDir, stage.WorkingDir)
+		stage.Defaults.WorkingDir = resolveConfigPath(includeDir, stage.Defaults.WorkingDir)
+		for i := range stage.Steps {
+			stage.Steps[i].WorkingDir = resolveConfigPath(includeDir, stage.Steps[i].WorkingDir)
+		}
 		config.Stages[name] = stage
 	}
 	
@@ -388,3 +388,50 @@ actions:
 	}
 }
 
+
+func TestLoadConfig_IncludeDefaultsAndLogs(t *testing.T) {
+	tempDir := t.TempDir()
+	mainConfig := filepath.Join(tempDir, "project.yml")
+	mainConfigContent := `
+project:
+  name: test-project
+include:
+  - ci/defaults.yml
+defaults:
+  shell: bash
+logs:
+  keep_runs: 5
+  max_age: 24h
+actions:
+  - name: main-action
+    run: echo "main action"
+`
+	includedContent := `
+defaults:
+  working_dir: build
+logs:
+  keep_runs: 10
+`
+	if err := os.MkdirAll(filepath.Join(tempDir, "ci"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(mainConfig, []byte(mainConfigContent), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(tempDir, "ci", "defaults.yml"), []byte(includedContent), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	config, err := LoadConfig(mainConfig)
+	if err != nil {
+		t.Fatalf("LoadConfig() error = %v", err)
+	}
+	// Included values override the main file, unset ones keep it, and the
+	// working directory is relative to the included file
+	if config.Defaults.Shell != "bash" || config.Defaults.WorkingDir != filepath.Join(tempDir, "ci", "build") {
+		t.Errorf("defaults = %+v", config.Defaults)
+	}
+	if config.Logs.KeepRuns != 10 || config.Logs.MaxAge != "24h" {
+		t.Errorf("logs = %+v", config.Logs)
+	}
+}
@@ -0,0 +1,285 @@
+package buildfab
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Prompter asks the user a question and returns the answer
+type Prompter interface {
+	Prompt(ctx context.Context, question string) (string, error)
+}
+
+// TerminalPrompter prompts on a terminal: the question is written to Output
+// and the answer read from Input. Input is read through its input pump, the
+// same one interactive steps use, so they never compete for keystrokes.
+type TerminalPrompter struct {
+	Input  io.Reader
+	Output io.Writer
+
+	mu      sync.Mutex
+	pending []byte        // Input received but not yet returned as an answer
+	ready   chan struct{} // Signalled when input is received
+}
+
+// NewTerminalPrompter creates a prompter on the process's stdin and stderr
+func NewTerminalPrompter() *TerminalPrompter {
+	return &TerminalPrompter{Input: os.Stdin, Output: os.Stderr}
+}
+
+// Prompt writes the question and reads one line. It returns the context error
+// if the context is cancelled while waiting.
+func (p *TerminalPrompter) Prompt(ctx context.Context, question string) (string, error) {
+	p.mu.Lock()
+	if p.ready == nil {
+		p.ready = make(chan struct{}, 1)
+	}
+	p.mu.Unlock()
+	fmt.Fprint(p.Output, question)
+
+	pump := inputPumpFor(p.Input)
+	detach := pump.attach(promptInput{p})
+	defer detach()
+	for {
+		if line, ok := p.nextLine(false); ok {
+			return line, nil
+		}
+		select {
+		case <-p.ready:
+		case <-pump.done:
+			// The last line may not end with a newline
+			if line, ok := p.nextLine(true); ok {
+				return line, nil
+			}
+			return "", fmt.Errorf("no answer: %w", io.EOF)
+		case <-ctx.Done():
+			fmt.Fprintln(p.Output)
+			return "", ctx.Err()
+		}
+	}
+}
+
+// nextLine takes the first received line, or everything received at the end
+// of input. Input after the line is kept for the next prompt.
+func (p *TerminalPrompter) nextLine(eof bool) (string, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	i := bytes.IndexByte(p.pending, '\n')
+	if i < 0 {
+		if !eof || len(p.pending) == 0 {
+			return "", false
+		}
+		i = len(p.pending)
+	}
+	line := strings.TrimSpace(string(p.pending[:i]))
+	p.pending = p.pending[min(i+1, len(p.pending)):]
+	return line, true
+}
+
+// promptInput is the input pump sink of a prompter while it waits for an answer
+type promptInput struct {
+	p *TerminalPrompter
+}
+
+func (w promptInput) Write(data []byte) (int, error) {
+	w.p.mu.Lock()
+	w.p.pending = append(w.p.pending, data...)
+	w.p.mu.Unlock()
+	select {
+	case w.p.ready <- struct{}{}:
+	default:
+	}
+	return len(data), nil
+}
+
+// terminalPrompter is shared by runners so input received after an answer is
+// kept for the next prompt
+var terminalPrompter = sync.OnceValue(func() Prompter { return NewTerminalPrompter() })
+
+// isInteractive reports whether confirmations can be asked: stdin is a
+// terminal and the run is not in CI
+func isInteractive() bool {
+	if os.Getenv("CI") != "" {
+		return false
+	}
+	info, err := os.Stdin.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// checkConfirmations fails before a stage starts when steps that will run
+// need a confirmation that cannot be asked: without --yes, a Prompter or a
+// terminal, so no step runs only to stop at the first confirmation
+func (r *Runner) checkConfirmations(ctx context.Context, dag map[string]*DAGNode) error {
+	if r.opts.AssumeYes || r.opts.Prompter != nil || isInteractive() {
+		return nil
+	}
+	var steps []string
+	for name, node := range dag {
+		if node.Step.Confirm != "" && r.shouldExecuteStep(ctx, node) {
+			steps = append(steps, name)
+		}
+	}
+	if len(steps) == 0 {
+		return nil
+	}
+	sort.Strings(steps)
+	return fmt.Errorf("confirmation required for %s, run with --yes to approve in non-interactive mode", strings.Join(steps, ", "))
+}
+
+// confirmStep asks for the confirmation of a step with confirm: set. It is
+// approved by --yes, fails without a terminal, and otherwise prompts while
+// the output of other steps is held back.
+func (r *Runner) confirmStep(ctx context.Context, node *DAGNode) error {
+	step := node.Step
+	if step.Confirm == "" {
+		return nil
+	}
+	question, err := InterpolateVariables(step.Confirm, node.scope.Variables)
+	if err != nil {
+		return fmt.Errorf("failed to interpolate confirm: %w", err)
+	}
+	expected, err := InterpolateVariables(step.ConfirmText, node.scope.Variables)
+	if err != nil {
+		return fmt.Errorf("failed to interpolate confirm_text: %w", err)
+	}
+
+	if r.opts.AssumeYes {
+		return nil
+	}
+	prompter := r.opts.Prompter
+	if prompter == nil {
+		if !isInteractive() {
+			return fmt.Errorf("confirmation required (%s), run with --yes to approve in non-interactive mode", question)
+		}
+		prompter = terminalPrompter()
+	}
+
+	// One prompt at a time; other steps keep running and their output is
+	// shown once the prompt is answered
+	r.terminalWaiting.Add(1)
+	defer r.terminalWaiting.Add(-1)
+	r.terminalMu.Lock()
+	defer r.terminalMu.Unlock()
+	r.gate.pause()
+	defer r.gate.resume()
+
+	prompt := fmt.Sprintf("\n❓ %s [y/N] ", question)
+	if expected != "" {
+		prompt = fmt.Sprintf("\n❓ %s Type %q to confirm: ", question, expected)
+	}
+	answer, err := prompter.Prompt(ctx, prompt)
+	if err != nil {
+		return fmt.Errorf("confirmation failed: %w", err)
+	}
+	if expected != "" {
+		if answer != expected {
+			return fmt.Errorf("not confirmed: expected %q, got %q", expected, answer)
+		}
+		return nil
+	}
+	switch strings.ToLower(answer) {
+	case "y", "yes":
+		return nil
+	default:
+		return fmt.Errorf("not confirmed")
+	}
+}
+
+// outputGate holds back output while a prompt is shown and replays it in
+// order afterwards
+type outputGate struct {
+	mu       sync.Mutex
+	paused   bool
+	queue    []func()
+	terminal terminalUser // Step callback drawing on the terminal, suspended while paused
+}
+
+// do runs f, or queues it while the gate is paused
+func (g *outputGate) do(f func()) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.paused {
+		g.queue = append(g.queue, f)
+		return
+	}
+	f()
+}
+
+// pause waits for output in progress and holds back new output
+func (g *outputGate) pause() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.paused = true
+	if g.terminal != nil {
+		g.terminal.suspendTerminal()
+	}
+}
+
+// resume replays the held back output
+func (g *outputGate) resume() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for _, f := range g.queue {
+		f()
+	}
+	g.queue = nil
+	g.paused = false
+	if g.terminal != nil {
+		g.terminal.resumeTerminal()
+	}
+}
+
+// gatedOutput wraps w so it writes through the gate
+func gatedOutput(w io.Writer, gate *outputGate) io.Writer {
+	if w == nil {
+		return nil
+	}
+	return &gatedWriter{w: w, gate: gate}
+}
+
+// gatedWriter writes through an outputGate
+type gatedWriter struct {
+	w    io.Writer
+	gate *outputGate
+}
+
+func (w *gatedWriter) Write(p []byte) (int, error) {
+	data := append([]byte(nil), p...)
+	w.gate.do(func() { w.w.Write(data) })
+	return len(p), nil
+}
+
+// gatedStepCallback passes step events through an outputGate
+type gatedStepCallback struct {
+	next StepCallback
+	gate *outputGate
+}
+
+func (c *gatedStepCallback) OnStepStart(ctx context.Context, stepName string) {
+	c.gate.do(func() { c.next.OnStepStart(ctx, stepName) })
+}
+
+func (c *gatedStepCallback) OnStepComplete(ctx context.Context, stepName string, status StepStatus, message string, duration time.Duration) {
+	c.gate.do(func() { c.next.OnStepComplete(ctx, stepName, status, message, duration) })
+}
+
+func (c *gatedStepCallback) OnStepOutput(ctx context.Context, stepName string, output string) {
+	c.gate.do(func() { c.next.OnStepOutput(ctx, stepName, output) })
+}
+
+func (c *gatedStepCallback) OnStepError(ctx context.Context, stepName string, err error) {
+	c.gate.do(func() { c.next.OnStepError(ctx, stepName, err) })
+}
+
+func (c *gatedStepCallback) OnStepDiagnostics(ctx context.Context, stepName string, diagnostics []Diagnostic) {
+	if next, ok := c.next.(StepDiagnosticsCallback); ok {
+		c.gate.do(func() { next.OnStepDiagnostics(ctx, stepName, diagnostics) })
+	}
+}
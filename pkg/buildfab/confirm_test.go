@@ -0,0 +1,220 @@
+package buildfab
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakePrompter answers prompts, optionally waiting for a condition first
+type fakePrompter struct {
+	mu        sync.Mutex
+	answer    string
+	questions []string
+	before    func()
+}
+
+func (p *fakePrompter) Prompt(ctx context.Context, question string) (string, error) {
+	if p.before != nil {
+		p.before()
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.questions = append(p.questions, question)
+	return p.answer, nil
+}
+
+const confirmConfig = `project:
+  name: test
+vars:
+  release: v1.2.3
+actions:
+  - name: build
+    run: touch build.done
+  - name: publish
+    run: touch publish.done
+  - name: announce
+    run: touch announce.done
+stages:
+  test:
+    steps:
+      - action: build
+      - action: publish
+        confirm: "Publish ${{ release }}?"
+        confirm_text: "CONFIRM_TEXT"
+      - action: announce
+        require: [publish]
+`
+
+// runConfirmStage runs the test stage of confirmConfig in a temporary directory
+func runConfirmStage(t *testing.T, confirmText string, configure func(*RunOptions)) (string, *MockStepCallback, error) {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		t.Skip("confirm tests use a POSIX shell")
+	}
+	config, err := LoadConfigFromBytes([]byte(strings.Replace(confirmConfig, "CONFIRM_TEXT", confirmText, 1)))
+	if err != nil {
+		t.Fatalf("LoadConfigFromBytes() error = %v", err)
+	}
+	dir := t.TempDir()
+	callback := &MockStepCallback{}
+	opts := DefaultRunOptions()
+	opts.WorkingDir = dir
+	opts.StepCallback = callback
+	configure(opts)
+	return dir, callback, NewRunner(config, opts).RunStage(context.Background(), "test")
+}
+
+func exists(dir, name string) bool {
+	_, err := os.Stat(filepath.Join(dir, name))
+	return err == nil
+}
+
+func TestConfirmStep_Answers(t *testing.T) {
+	tests := []struct {
+		name        string
+		confirmText string
+		answer      string
+		approved    bool
+	}{
+		{"yes", "", "y", true},
+		{"yes word", "", "YES", true},
+		{"no", "", "n", false},
+		{"empty", "", "", false},
+		{"typed version", "${{ release }}", "v1.2.3", true},
+		{"wrong version", "${{ release }}", "y", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			prompter := &fakePrompter{answer: tt.answer}
+			dir, _, err := runConfirmStage(t, tt.confirmText, func(opts *RunOptions) { opts.Prompter = prompter })
+			if (err == nil) != tt.approved {
+				t.Errorf("RunStage() error = %v, approved %v", err, tt.approved)
+			}
+			if exists(dir, "publish.done") != tt.approved || exists(dir, "announce.done") != tt.approved {
+				t.Errorf("publish and announce should run only when approved")
+			}
+			if !exists(dir, "build.done") {
+				t.Error("independent step should run")
+			}
+			if len(prompter.questions) != 1 || !strings.Contains(prompter.questions[0], "Publish v1.2.3?") {
+				t.Errorf("questions = %q", prompter.questions)
+			}
+			if tt.confirmText != "" && !strings.Contains(prompter.questions[0], `Type "v1.2.3"`) {
+				t.Errorf("question should ask to type the version, got %q", prompter.questions[0])
+			}
+		})
+	}
+}
+
+func TestConfirmStep_AssumeYes(t *testing.T) {
+	prompter := &fakePrompter{answer: "n"}
+	dir, _, err := runConfirmStage(t, "", func(opts *RunOptions) {
+		opts.AssumeYes = true
+		opts.Prompter = prompter
+	})
+	if err != nil || !exists(dir, "publish.done") {
+		t.Fatalf("RunStage() error = %v, publish should run with --yes", err)
+	}
+	if len(prompter.questions) != 0 {
+		t.Errorf("--yes should not prompt, got %q", prompter.questions)
+	}
+}
+
+func TestConfirmStep_NonInteractive(t *testing.T) {
+	t.Setenv("CI", "true")
+	dir, _, err := runConfirmStage(t, "", func(opts *RunOptions) {})
+	if err == nil || !strings.Contains(err.Error(), "for publish,") || !strings.Contains(err.Error(), "--yes") {
+		t.Fatalf("RunStage() error = %v, want the step and a hint to use --yes", err)
+	}
+	if exists(dir, "publish.done") || exists(dir, "build.done") {
+		t.Error("the stage should fail before running any step")
+	}
+}
+
+func TestConfirmStep_HoldsBackOutputWhilePrompting(t *testing.T) {
+	var dir string
+	var completedWhilePrompting []StepCompleteCall
+	var callback *MockStepCallback
+	prompter := &fakePrompter{answer: "y"}
+	prompter.before = func() {
+		// The independent branch keeps running while the prompt waits
+		deadline := time.Now().Add(5 * time.Second)
+		for !exists(dir, "build.done") && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+		time.Sleep(100 * time.Millisecond)
+		callback.mu.Lock()
+		completedWhilePrompting = append(completedWhilePrompting, callback.OnStepCompleteCalls...)
+		callback.mu.Unlock()
+	}
+
+	config, err := LoadConfigFromBytes([]byte(strings.Replace(confirmConfig, "CONFIRM_TEXT", "", 1)))
+	if err != nil {
+		t.Fatalf("LoadConfigFromBytes() error = %v", err)
+	}
+	dir = t.TempDir()
+	callback = &MockStepCallback{}
+	opts := DefaultRunOptions()
+	opts.WorkingDir = dir
+	opts.StepCallback = callback
+	opts.Prompter = prompter
+	// Delay build until the prompt is shown
+	config.Actions[0].Run = "sleep 0.2; touch build.done"
+
+	if err := NewRunner(config, opts).RunStage(context.Background(), "test"); err != nil {
+		t.Fatalf("RunStage() error = %v", err)
+	}
+	if !exists(dir, "build.done") {
+		t.Fatal("independent step did not run while prompting")
+	}
+	for _, call := range completedWhilePrompting {
+		if call.StepName == "build" {
+			t.Error("step output should be held back while the prompt is shown")
+		}
+	}
+	found := false
+	for _, call := range callback.OnStepCompleteCalls {
+		found = found || call.StepName == "build"
+	}
+	if !found {
+		t.Error("held back output should be shown after the prompt")
+	}
+}
+
+func TestValidate_ConfirmText(t *testing.T) {
+	config, err := LoadConfigFromBytes([]byte(`project:
+  name: test
+actions:
+  - name: publish
+    run: "true"
+stages:
+  test:
+    steps:
+      - action: publish
+        confirm_text: v1.0.0
+`))
+	if err != nil {
+		t.Fatalf("LoadConfigFromBytes() error = %v", err)
+	}
+	if err := config.Validate(); err == nil || !strings.Contains(err.Error(), "confirm_text without confirm") {
+		t.Errorf("Validate() error = %v", err)
+	}
+}
+
+func TestTerminalPrompter(t *testing.T) {
+	var output strings.Builder
+	prompter := &TerminalPrompter{Input: strings.NewReader("  yes \nsecond\n"), Output: &output}
+	answer, err := prompter.Prompt(context.Background(), "Continue? ")
+	if err != nil || answer != "yes" || output.String() != "Continue? " {
+		t.Errorf("Prompt() = %q, %v, output %q", answer, err, output.String())
+	}
+	if answer, _ := prompter.Prompt(context.Background(), ""); answer != "second" {
+		t.Errorf("second Prompt() = %q", answer)
+	}
+}
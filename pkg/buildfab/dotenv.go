@@ -0,0 +1,304 @@
+package buildfab
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// EnvFile references a dotenv file to load variables from
+type EnvFile struct {
+	Path     string `yaml:"path"`
+	Secret   bool   `yaml:"secret,omitempty"`   // Mask every value loaded from the file
+	Optional bool   `yaml:"optional,omitempty"` // Ignore the file if it does not exist
+}
+
+// EnvFiles is a list of dotenv files. In YAML it accepts a single path, a list
+// of paths, or a list of mappings with path, secret and optional keys.
+type EnvFiles []EnvFile
+
+// UnmarshalYAML implements yaml.Unmarshaler for EnvFile
+func (f *EnvFile) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		f.Path = value.Value
+		return nil
+	}
+	type plain EnvFile
+	return value.Decode((*plain)(f))
+}
+
+// UnmarshalYAML implements yaml.Unmarshaler for EnvFiles
+func (f *EnvFiles) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode || value.Kind == yaml.MappingNode {
+		var file EnvFile
+		if err := value.Decode(&file); err != nil {
+			return err
+		}
+		*f = EnvFiles{file}
+		return nil
+	}
+	var files []EnvFile
+	if err := value.Decode(&files); err != nil {
+		return err
+	}
+	*f = files
+	return nil
+}
+
+// secretEnvFilePrefix marks an env file given on the command line as secret
+const secretEnvFilePrefix = "secret:"
+
+// cliEnvFiles returns the env files given on the command line. Every value
+// of a file whose path has the secret: prefix is masked.
+func cliEnvFiles(paths []string) EnvFiles {
+	files := make(EnvFiles, len(paths))
+	for i, path := range paths {
+		if strings.HasPrefix(path, secretEnvFilePrefix) {
+			files[i] = EnvFile{Path: strings.TrimPrefix(path, secretEnvFilePrefix), Secret: true}
+		} else {
+			files[i] = EnvFile{Path: path}
+		}
+	}
+	return files
+}
+
+// secretValue is a vars or env entry written as a mapping to mark it secret:
+//
+//	API_TOKEN:
+//	  value: "${{ token }}"
+//	  secret: true
+type secretValue struct {
+	Value  string `yaml:"value"`
+	Secret bool   `yaml:"secret"`
+}
+
+// liftSecretValues replaces the vars and env entries of a project, stage,
+// action or step node written as secretValue mappings with their plain
+// values, and returns the names of the entries marked secret
+func liftSecretValues(node *yaml.Node) ([]string, error) {
+	if node.Kind != yaml.MappingNode {
+		return nil, nil
+	}
+	var secrets []string
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if key := node.Content[i].Value; key != "vars" && key != "env" {
+			continue
+		}
+		entries := node.Content[i+1]
+		if entries.Kind != yaml.MappingNode {
+			continue
+		}
+		for j := 0; j+1 < len(entries.Content); j += 2 {
+			name, value := entries.Content[j].Value, entries.Content[j+1]
+			if value.Kind != yaml.MappingNode {
+				continue
+			}
+			for k := 0; k < len(value.Content); k += 2 {
+				if field := value.Content[k].Value; field != "value" && field != "secret" {
+					return nil, fmt.Errorf("line %d: %s: unknown key %q (expected value and secret)", value.Content[k].Line, name, field)
+				}
+			}
+			var entry secretValue
+			if err := value.Decode(&entry); err != nil {
+				return nil, err
+			}
+			if entry.Secret {
+				secrets = append(secrets, name)
+			}
+			*value = yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: entry.Value, Line: value.Line, Column: value.Column}
+		}
+	}
+	return secrets, nil
+}
+
+// UnmarshalYAML implements yaml.Unmarshaler for Config
+func (c *Config) UnmarshalYAML(value *yaml.Node) error {
+	secrets, err := liftSecretValues(value)
+	if err != nil {
+		return err
+	}
+	type plain Config
+	if err := value.Decode((*plain)(c)); err != nil {
+		return err
+	}
+	c.Secrets = append(c.Secrets, secrets...)
+	return nil
+}
+
+// UnmarshalYAML implements yaml.Unmarshaler for Stage
+func (s *Stage) UnmarshalYAML(value *yaml.Node) error {
+	secrets, err := liftSecretValues(value)
+	if err != nil {
+		return err
+	}
+	type plain Stage
+	if err := value.Decode((*plain)(s)); err != nil {
+		return err
+	}
+	s.Secrets = append(s.Secrets, secrets...)
+	return nil
+}
+
+// UnmarshalYAML implements yaml.Unmarshaler for Action
+func (a *Action) UnmarshalYAML(value *yaml.Node) error {
+	secrets, err := liftSecretValues(value)
+	if err != nil {
+		return err
+	}
+	type plain Action
+	if err := value.Decode((*plain)(a)); err != nil {
+		return err
+	}
+	a.Secrets = append(a.Secrets, secrets...)
+	return nil
+}
+
+// UnmarshalYAML implements yaml.Unmarshaler for Step
+func (s *Step) UnmarshalYAML(value *yaml.Node) error {
+	secrets, err := liftSecretValues(value)
+	if err != nil {
+		return err
+	}
+	type plain Step
+	if err := value.Decode((*plain)(s)); err != nil {
+		return err
+	}
+	s.Secrets = append(s.Secrets, secrets...)
+	return nil
+}
+
+// resolvePaths makes relative env file paths absolute against baseDir
+func (f EnvFiles) resolvePaths(baseDir string) EnvFiles {
+	if baseDir == "" {
+		return f
+	}
+	resolved := make(EnvFiles, len(f))
+	for i, file := range f {
+		file.Path = resolveConfigPath(baseDir, file.Path)
+		resolved[i] = file
+	}
+	return resolved
+}
+
+// load reads all files and returns the merged values plus the values that
+// came from files marked secret
+func (f EnvFiles) load(baseDir string) (map[string]string, []string, error) {
+	values := make(map[string]string)
+	var secrets []string
+	for _, file := range f.resolvePaths(baseDir) {
+		loaded, err := LoadDotenvFile(file.Path)
+		if err != nil {
+			if file.Optional && os.IsNotExist(err) {
+				continue
+			}
+			return nil, nil, err
+		}
+		for k, v := range loaded {
+			values[k] = v
+			if file.Secret {
+				secrets = append(secrets, v)
+			}
+		}
+	}
+	return values, secrets, nil
+}
+
+// LoadDotenvFile loads variables from a dotenv file
+func LoadDotenvFile(path string) (map[string]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	values, err := ParseDotenv(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse env file %s: %w", path, err)
+	}
+	return values, nil
+}
+
+// ParseDotenv parses dotenv formatted content.
+//
+// Supported syntax: KEY=value, optional "export " prefix, # comments, blank
+// lines, single-quoted literal values and double-quoted values with \n, \t,
+// \" and \\ escapes. Unquoted values are trimmed and may end with a " #" comment.
+func ParseDotenv(r io.Reader) (map[string]string, error) {
+	values := make(map[string]string)
+	scanner := bufio.NewScanner(r)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimPrefix(line, "export ")
+
+		eq := strings.Index(line, "=")
+		if eq <= 0 {
+			return nil, fmt.Errorf("line %d: expected KEY=value", lineNum)
+		}
+		key := strings.TrimSpace(line[:eq])
+		if strings.ContainsAny(key, " \t") {
+			return nil, fmt.Errorf("line %d: invalid key %q", lineNum, key)
+		}
+
+		value, err := parseDotenvValue(strings.TrimSpace(line[eq+1:]))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineNum, err)
+		}
+		values[key] = value
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return values, nil
+}
+
+// parseDotenvValue parses the value part of a dotenv line
+func parseDotenvValue(raw string) (string, error) {
+	if raw == "" {
+		return "", nil
+	}
+
+	switch raw[0] {
+	case '\'':
+		end := strings.Index(raw[1:], "'")
+		if end < 0 {
+			return "", fmt.Errorf("unterminated single-quoted value")
+		}
+		return raw[1 : end+1], nil
+	case '"':
+		var b strings.Builder
+		for i := 1; i < len(raw); i++ {
+			c := raw[i]
+			if c == '"' {
+				return b.String(), nil
+			}
+			if c == '\\' && i+1 < len(raw) {
+				i++
+				switch raw[i] {
+				case 'n':
+					b.WriteByte('\n')
+				case 't':
+					b.WriteByte('\t')
+				default:
+					b.WriteByte(raw[i])
+				}
+				continue
+			}
+			b.WriteByte(c)
+		}
+		return "", fmt.Errorf("unterminated double-quoted value")
+	}
+
+	if idx := strings.Index(raw, " #"); idx >= 0 {
+		raw = raw[:idx]
+	}
+	return strings.TrimSpace(raw), nil
+}
@@ -0,0 +1,203 @@
+package buildfab
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+func TestParseDotenv(t *testing.T) {
+	content := `# comment
+PLAIN=value
+export EXPORTED=yes
+SPACED = trimmed  # trailing comment
+SINGLE='literal ${{ x }} # kept'
+DOUBLE="line1\nline2 \"quoted\""
+EMPTY=
+`
+	values, err := ParseDotenv(strings.NewReader(content))
+	if err != nil {
+		t.Fatalf("ParseDotenv() error = %v", err)
+	}
+
+	expected := map[string]string{
+		"PLAIN":    "value",
+		"EXPORTED": "yes",
+		"SPACED":   "trimmed",
+		"SINGLE":   "literal ${{ x }} # kept",
+		"DOUBLE":   "line1\nline2 \"quoted\"",
+		"EMPTY":    "",
+	}
+	if len(values) != len(expected) {
+		t.Errorf("ParseDotenv() returned %d values, want %d", len(values), len(expected))
+	}
+	for k, want := range expected {
+		if got := values[k]; got != want {
+			t.Errorf("%s = %q, want %q", k, got, want)
+		}
+	}
+}
+
+func TestParseDotenvErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+	}{
+		{name: "missing equals", content: "NOVALUE"},
+		{name: "empty key", content: "=value"},
+		{name: "unterminated double quote", content: `KEY="value`},
+		{name: "unterminated single quote", content: `KEY='value`},
+		{name: "space in key", content: "BAD KEY=value"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := ParseDotenv(strings.NewReader(tt.content)); err == nil {
+				t.Errorf("ParseDotenv(%q) expected error", tt.content)
+			}
+		})
+	}
+}
+
+func TestEnvFilesUnmarshal(t *testing.T) {
+	tests := []struct {
+		name     string
+		yaml     string
+		expected EnvFiles
+	}{
+		{name: "single path", yaml: `.env`, expected: EnvFiles{{Path: ".env"}}},
+		{name: "list of paths", yaml: `[a.env, b.env]`, expected: EnvFiles{{Path: "a.env"}, {Path: "b.env"}}},
+		{
+			name:     "mapping entries",
+			yaml:     "- .env\n- path: secrets.env\n  secret: true\n  optional: true\n",
+			expected: EnvFiles{{Path: ".env"}, {Path: "secrets.env", Secret: true, Optional: true}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var files EnvFiles
+			if err := yaml.Unmarshal([]byte(tt.yaml), &files); err != nil {
+				t.Fatalf("Unmarshal() error = %v", err)
+			}
+			if len(files) != len(tt.expected) {
+				t.Fatalf("got %d files, want %d", len(files), len(tt.expected))
+			}
+			for i := range files {
+				if files[i] != tt.expected[i] {
+					t.Errorf("files[%d] = %+v, want %+v", i, files[i], tt.expected[i])
+				}
+			}
+		})
+	}
+}
+
+func TestResolveStepScopeEnvFiles(t *testing.T) {
+	dir := t.TempDir()
+	writeFile := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatalf("failed to write %s: %v", name, err)
+		}
+		return path
+	}
+	writeFile("project.env", "LEVEL=project-file\nFROM_FILE=project\nINLINE=file\n")
+	writeFile("secret.env", "TOKEN=s3cr3t-token\n")
+	cliFile := writeFile("cli.env", "LEVEL=cli-file\n")
+
+	config := &Config{
+		EnvFile: EnvFiles{
+			{Path: "project.env"},
+			{Path: "secret.env", Secret: true},
+			{Path: "missing.env", Optional: true},
+		},
+		Vars:    map[string]string{"INLINE": "inline"},
+		Secrets: []string{"PASSWORD"},
+		Env:     map[string]string{"PASSWORD": "hunter22"},
+		baseDir: dir,
+	}
+
+	scope, err := resolveStepScope(config, nil, nil, nil, nil, nil, nil)
+	if err != nil {
+		t.Fatalf("resolveStepScope() error = %v", err)
+	}
+	if scope.Variables["FROM_FILE"] != "project" || scope.Env["FROM_FILE"] != "project" {
+		t.Errorf("env file values must be available as vars and env, got var %q env %q", scope.Variables["FROM_FILE"], scope.Env["FROM_FILE"])
+	}
+	if scope.Variables["INLINE"] != "inline" {
+		t.Errorf("inline vars must override env files, got %q", scope.Variables["INLINE"])
+	}
+	masker := NewMasker(scope.Secrets...)
+	if got := masker.Mask("token=s3cr3t-token password=hunter22"); got != "token=*** password=***" {
+		t.Errorf("secrets not collected, masked output = %q", got)
+	}
+
+	scope, err = resolveStepScope(config, nil, nil, nil, nil, []string{cliFile}, nil)
+	if err != nil {
+		t.Fatalf("resolveStepScope() error = %v", err)
+	}
+	if scope.Env["LEVEL"] != "cli-file" {
+		t.Errorf("CLI env file must have the highest precedence, got %q", scope.Env["LEVEL"])
+	}
+	if got := NewMasker(scope.Secrets...).Mask("level=cli-file"); got != "level=cli-file" {
+		t.Errorf("plain CLI env file must not be masked, got %q", got)
+	}
+
+	// A secret: prefix masks a CLI env file, and CLI secrets name values of any level
+	scope, err = resolveStepScope(config, nil, nil, nil, map[string]string{"DEPLOY_KEY": "k3y-value"}, []string{"secret:" + cliFile}, []string{"DEPLOY_KEY", "INLINE"})
+	if err != nil {
+		t.Fatalf("resolveStepScope() error = %v", err)
+	}
+	if got := NewMasker(scope.Secrets...).Mask("cli-file k3y-value inline"); got != "*** *** ***" {
+		t.Errorf("CLI secrets not collected, masked output = %q", got)
+	}
+
+	config.EnvFile = EnvFiles{{Path: "missing.env"}}
+	if _, err := resolveStepScope(config, nil, nil, nil, nil, nil, nil); err == nil {
+		t.Error("expected error for missing required env file")
+	}
+}
+
+func TestSecretValues(t *testing.T) {
+	config, err := LoadConfigFromBytes([]byte(`project:
+  name: test
+vars:
+  user: deploy
+  token:
+    value: "t0ken-value"
+    secret: true
+actions:
+  - name: publish
+    env:
+      API_KEY: {value: "${{ token }}-key", secret: true}
+    run: publish
+stages:
+  release:
+    steps:
+      - action: publish
+        env:
+          PLAIN: {value: "visible"}
+`))
+	if err != nil {
+		t.Fatalf("LoadConfigFromBytes() error = %v", err)
+	}
+	action, _ := config.GetAction("publish")
+	stage := config.Stages["release"]
+	scope, err := resolveStepScope(config, &stage, &stage.Steps[0], &action, nil, nil, nil)
+	if err != nil {
+		t.Fatalf("resolveStepScope() error = %v", err)
+	}
+	if scope.Variables["token"] != "t0ken-value" || scope.Env["API_KEY"] != "t0ken-value-key" || scope.Env["PLAIN"] != "visible" {
+		t.Errorf("variables = %v, env = %v", scope.Variables, scope.Env)
+	}
+	if got := NewMasker(scope.Secrets...).Mask("deploy t0ken-value-key visible"); got != "deploy *** visible" {
+		t.Errorf("masked output = %q", got)
+	}
+
+	if _, err := LoadConfigFromBytes([]byte("project:\n  name: test\nvars:\n  token: {value: x, masked: true}\n")); err == nil || !strings.Contains(err.Error(), "masked") {
+		t.Errorf("unknown key should fail, got %v", err)
+	}
+}
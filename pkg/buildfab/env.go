@@ -0,0 +1,150 @@
+package buildfab
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+)
+
+// Environment policies controlling which host variables reach action processes
+const (
+	EnvPolicyInherit   = "inherit"   // Pass the full host environment (default)
+	EnvPolicyClean     = "clean"     // Pass no host variables
+	EnvPolicyAllowlist = "allowlist" // Pass only host variables matching pass_env
+)
+
+// PlatformEnvPrefix prefixes platform variables exported to action processes
+const PlatformEnvPrefix = "BUILDFAB_"
+
+// validateEnvPolicy checks env_policy and pass_env settings
+func (c *Config) validateEnvPolicy() error {
+	switch c.EnvPolicy {
+	case "", EnvPolicyInherit, EnvPolicyClean, EnvPolicyAllowlist:
+	default:
+		return fmt.Errorf("invalid env_policy %q: must be one of %s, %s, %s", c.EnvPolicy, EnvPolicyInherit, EnvPolicyClean, EnvPolicyAllowlist)
+	}
+	for _, pattern := range c.PassEnv {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid pass_env pattern %q: %w", pattern, err)
+		}
+	}
+	return nil
+}
+
+// hostEnv returns the host environment entries allowed by the policy
+func hostEnv(policy string, passEnv []string, environ []string) []string {
+	switch policy {
+	case EnvPolicyClean:
+		return nil
+	case EnvPolicyAllowlist:
+		var allowed []string
+		for _, entry := range environ {
+			name, _, _ := strings.Cut(entry, "=")
+			for _, pattern := range passEnv {
+				if matched, _ := path.Match(pattern, name); matched {
+					allowed = append(allowed, entry)
+					break
+				}
+			}
+		}
+		return allowed
+	default:
+		return environ
+	}
+}
+
+// PlatformEnv returns platform variables as BUILDFAB_ prefixed environment variables
+func PlatformEnv() map[string]string {
+	env := make(map[string]string)
+	for k, v := range GetPlatformVariablesMap() {
+		env[PlatformEnvPrefix+strings.ToUpper(k)] = v
+	}
+	return env
+}
+
+// buildProcessEnv builds the environment of an action process.
+//
+// Layers (later wins): host environment filtered by env_policy, BUILDFAB_
+// platform variables, resolved env sections, command line variables. The
+// result is sorted by name.
+func buildProcessEnv(config *Config, scope *stepScope, cliVariables map[string]string) []string {
+	policy, passEnv := EnvPolicyInherit, []string(nil)
+	if config != nil {
+		if config.EnvPolicy != "" {
+			policy = config.EnvPolicy
+		}
+		passEnv = config.PassEnv
+	}
+
+	env := make(map[string]string)
+	for _, entry := range hostEnv(policy, passEnv, os.Environ()) {
+		if name, value, ok := strings.Cut(entry, "="); ok {
+			env[name] = value
+		}
+	}
+	for k, v := range PlatformEnv() {
+		env[k] = v
+	}
+	if scope != nil {
+		for k, v := range scope.Env {
+			env[k] = v
+		}
+	}
+	for k, v := range cliOverrides(cliVariables) {
+		env[k] = v
+	}
+
+	names := make([]string, 0, len(env))
+	for name := range env {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	result := make([]string, 0, len(names))
+	for _, name := range names {
+		result = append(result, name+"="+env[name])
+	}
+	return result
+}
+
+// Environment returns the environment an action process would see, sorted by
+// name and with secret values masked. With an empty stageName the action is
+// resolved standalone, otherwise as the step of that stage.
+func (r *Runner) Environment(stageName, actionName string) ([]string, error) {
+	action, exists := r.config.GetAction(actionName)
+	if !exists {
+		return nil, fmt.Errorf("action not found: %s", actionName)
+	}
+
+	var stage *Stage
+	var step *Step
+	if stageName != "" {
+		s, exists := r.config.GetStage(stageName)
+		if !exists {
+			return nil, fmt.Errorf("stage not found: %s", stageName)
+		}
+		stage = &s
+		for i := range s.Steps {
+			if s.Steps[i].Action == actionName {
+				step = &s.Steps[i]
+				break
+			}
+		}
+		if step == nil {
+			return nil, fmt.Errorf("step not found: %s in stage %s", actionName, stageName)
+		}
+	}
+
+	scope, err := r.resolveScope(stage, step, &action)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve variables for action %s: %w", actionName, err)
+	}
+
+	env := buildProcessEnv(r.config, scope, r.opts.Variables)
+	for i, entry := range env {
+		env[i] = r.masker.Mask(entry)
+	}
+	return env, nil
+}
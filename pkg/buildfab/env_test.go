@@ -0,0 +1,152 @@
+package buildfab
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestHostEnv(t *testing.T) {
+	environ := []string{"HOME=/home/user", "PATH=/usr/bin", "GOPATH=/go", "GOFLAGS=-mod=mod", "SECRET=x"}
+
+	tests := []struct {
+		name     string
+		policy   string
+		passEnv  []string
+		expected []string
+	}{
+		{name: "default inherits", policy: "", expected: environ},
+		{name: "inherit", policy: EnvPolicyInherit, passEnv: []string{"HOME"}, expected: environ},
+		{name: "clean", policy: EnvPolicyClean, passEnv: []string{"HOME"}, expected: nil},
+		{name: "allowlist exact", policy: EnvPolicyAllowlist, passEnv: []string{"HOME", "PATH"}, expected: []string{"HOME=/home/user", "PATH=/usr/bin"}},
+		{name: "allowlist pattern", policy: EnvPolicyAllowlist, passEnv: []string{"GO*"}, expected: []string{"GOPATH=/go", "GOFLAGS=-mod=mod"}},
+		{name: "allowlist empty", policy: EnvPolicyAllowlist, expected: nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := hostEnv(tt.policy, tt.passEnv, environ)
+			if strings.Join(got, ",") != strings.Join(tt.expected, ",") {
+				t.Errorf("hostEnv() = %v, want %v", got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestBuildProcessEnv(t *testing.T) {
+	t.Setenv("BUILDFAB_TEST_HOST", "host")
+
+	config := &Config{EnvPolicy: EnvPolicyAllowlist, PassEnv: []string{"BUILDFAB_TEST_*"}}
+	scope := &stepScope{Env: map[string]string{"STEP": "step", "BUILDFAB_TEST_HOST": "scope"}}
+	cli := AddPlatformVariables(map[string]string{"STEP": "cli"})
+
+	env := buildProcessEnv(config, scope, cli)
+	values := make(map[string]string)
+	for _, entry := range env {
+		name, value, _ := strings.Cut(entry, "=")
+		values[name] = value
+	}
+
+	if values["BUILDFAB_TEST_HOST"] != "scope" {
+		t.Errorf("env sections must override host values, got %q", values["BUILDFAB_TEST_HOST"])
+	}
+	if values["STEP"] != "cli" {
+		t.Errorf("command line variables must override env sections, got %q", values["STEP"])
+	}
+	if _, ok := values["PATH"]; ok {
+		t.Error("PATH must not pass the allowlist")
+	}
+	platform := GetPlatformVariablesMap()
+	if values["BUILDFAB_ARCH"] != platform["arch"] || values["BUILDFAB_OS_VERSION"] != platform["os_version"] {
+		t.Errorf("platform variables must be exported with the BUILDFAB_ prefix, got %v", env)
+	}
+	for _, bare := range []string{"os", "arch", "platform", "os_version", "cpu"} {
+		if _, ok := values[bare]; ok {
+			t.Errorf("platform variable %q must not be exported under its bare name", bare)
+		}
+	}
+	for i := 1; i < len(env); i++ {
+		if env[i-1] > env[i] {
+			t.Fatalf("environment is not sorted: %q before %q", env[i-1], env[i])
+		}
+	}
+}
+
+func TestValidateEnvPolicy(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  string
+		passEnv []string
+		wantErr bool
+	}{
+		{name: "empty", policy: ""},
+		{name: "clean", policy: EnvPolicyClean},
+		{name: "allowlist", policy: EnvPolicyAllowlist, passEnv: []string{"GO*"}},
+		{name: "unknown policy", policy: "strict", wantErr: true},
+		{name: "bad pattern", policy: EnvPolicyAllowlist, passEnv: []string{"[GO"}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := &Config{EnvPolicy: tt.policy, PassEnv: tt.passEnv}
+			if err := config.validateEnvPolicy(); (err != nil) != tt.wantErr {
+				t.Errorf("validateEnvPolicy() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestRunnerEnvironment(t *testing.T) {
+	config, err := LoadConfigFromBytes([]byte(`
+project:
+  name: test
+env_policy: clean
+secrets: [TOKEN]
+env:
+  TOKEN: tok-12345
+actions:
+  - name: show
+    env:
+      LEVEL: action
+    run: env
+stages:
+  test:
+    steps:
+      - action: show
+        env:
+          LEVEL: step
+`))
+	if err != nil {
+		t.Fatalf("LoadConfigFromBytes() error = %v", err)
+	}
+	runner := NewRunner(config, DefaultRunOptions())
+
+	env, err := runner.Environment("", "show")
+	if err != nil {
+		t.Fatalf("Environment() error = %v", err)
+	}
+	joined := strings.Join(env, "\n")
+	if !strings.Contains(joined, "LEVEL=action") {
+		t.Errorf("standalone action environment = %v", env)
+	}
+	if !strings.Contains(joined, "TOKEN=***") || strings.Contains(joined, "tok-12345") {
+		t.Errorf("secret must be masked, got %v", env)
+	}
+	if strings.Contains(joined, "PATH=") {
+		t.Errorf("clean policy must not pass host variables, got %v", env)
+	}
+
+	env, err = runner.Environment("test", "show")
+	if err != nil {
+		t.Fatalf("Environment() error = %v", err)
+	}
+	if !strings.Contains(strings.Join(env, "\n"), "LEVEL=step") {
+		t.Errorf("step environment = %v", env)
+	}
+
+	if _, err := runner.Environment("", "missing"); err == nil {
+		t.Error("expected error for unknown action")
+	}
+	if _, err := runner.Environment("missing", "show"); err == nil {
+		t.Error("expected error for unknown stage")
+	}
+}
@@ -0,0 +1,642 @@
+package buildfab
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultArchiveTime is the modification time stored in archives when
+// SOURCE_DATE_EPOCH is not set, the earliest time zip can represent
+var defaultArchiveTime = time.Date(1980, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// matchGlob matches a slash separated path against a pattern where ** matches
+// any number of directories and other segments use path.Match
+func matchGlob(pattern, name string) bool {
+	return matchGlobSegments(strings.Split(pattern, "/"), strings.Split(name, "/"))
+}
+
+func matchGlobSegments(pattern, name []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := 0; i <= len(name); i++ {
+				if matchGlobSegments(pattern[1:], name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(name) == 0 {
+			return false
+		}
+		if matched, err := path.Match(pattern[0], name[0]); err != nil || !matched {
+			return false
+		}
+		pattern, name = pattern[1:], name[1:]
+	}
+	return len(name) == 0
+}
+
+// excluded reports whether rel matches one of the exclude patterns, either as
+// a name or parent directory pattern or as a ** glob
+func excluded(rel string, exclude []string) bool {
+	if matchesAnyPattern(rel, exclude) {
+		return true
+	}
+	for _, pattern := range exclude {
+		if matchGlob(path.Clean(filepath.ToSlash(pattern)), rel) {
+			return true
+		}
+	}
+	return false
+}
+
+// expandGlobs returns the paths relative to the working directory matched by
+// patterns, sorted and without those matching exclude. Matched directories are
+// returned as is, without their contents.
+func expandGlobs(actx *ActionContext, patterns, exclude []string) ([]string, error) {
+	seen := make(map[string]bool)
+	var matches []string
+	add := func(rel string) {
+		if !seen[rel] && !excluded(rel, exclude) {
+			seen[rel] = true
+			matches = append(matches, rel)
+		}
+	}
+
+	for _, pattern := range patterns {
+		pattern = path.Clean(filepath.ToSlash(pattern))
+		if path.IsAbs(pattern) || pattern == ".." || strings.HasPrefix(pattern, "../") {
+			return nil, fmt.Errorf("pattern %s must be relative to the working directory", pattern)
+		}
+		if !strings.ContainsAny(pattern, "*?[") {
+			if _, err := os.Lstat(actx.Path(pattern)); err == nil {
+				add(pattern)
+			}
+			continue
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid pattern %s: %w", pattern, err)
+		}
+
+		// Walk from the longest literal prefix of the pattern
+		segments := strings.Split(pattern, "/")
+		literal := 0
+		for literal < len(segments) && !strings.ContainsAny(segments[literal], "*?[") {
+			literal++
+		}
+		root := "."
+		if literal > 0 {
+			root = path.Join(segments[:literal]...)
+		}
+		err := filepath.WalkDir(actx.Path(root), func(p string, d fs.DirEntry, err error) error {
+			if err != nil {
+				if os.IsNotExist(err) {
+					return nil
+				}
+				return err
+			}
+			rel, err := filepath.Rel(actx.Path("."), p)
+			if err != nil {
+				return err
+			}
+			rel = filepath.ToSlash(rel)
+			if rel != "." && matchGlob(pattern, rel) {
+				add(rel)
+				if d.IsDir() {
+					return filepath.SkipDir
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	sort.Strings(matches)
+	return matches, nil
+}
+
+// expandFiles expands matched directories to the regular files they contain
+func expandFiles(actx *ActionContext, matches, exclude []string) ([]string, error) {
+	seen := make(map[string]bool)
+	var files []string
+	for _, match := range matches {
+		err := filepath.WalkDir(actx.Path(match), func(p string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if !d.Type().IsRegular() {
+				return nil
+			}
+			rel, err := filepath.Rel(actx.Path("."), p)
+			if err != nil {
+				return err
+			}
+			rel = filepath.ToSlash(rel)
+			if !seen[rel] && !excluded(rel, exclude) {
+				seen[rel] = true
+				files = append(files, rel)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// inputFiles resolves the files and exclude inputs to regular files, leaving
+// out skip (typically the action's own output file)
+func inputFiles(actx *ActionContext, skip string) ([]string, error) {
+	patterns := actx.InputList("files")
+	if len(patterns) == 0 {
+		return nil, fmt.Errorf("files input is required")
+	}
+	exclude := actx.InputList("exclude")
+	matches, err := expandGlobs(actx, patterns, exclude)
+	if err != nil {
+		return nil, err
+	}
+	files, err := expandFiles(actx, matches, exclude)
+	if err != nil {
+		return nil, err
+	}
+	if skip == "" {
+		return files, nil
+	}
+	kept := files[:0]
+	for _, file := range files {
+		if abs, err := filepath.Abs(actx.Path(file)); err != nil || abs != skip {
+			kept = append(kept, file)
+		}
+	}
+	return kept, nil
+}
+
+// absPath resolves a path input to an absolute path
+func absPath(actx *ActionContext, p string) (string, error) {
+	return filepath.Abs(actx.Path(p))
+}
+
+// sha256File returns the hex SHA-256 digest of a file
+func sha256File(name string) (string, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// FsChecksumAction writes SHA-256 checksums of files in sha256sum format.
+// Inputs: files - glob patterns (** matches directories), exclude - patterns
+// to leave out, output - checksum file (default: SHA256SUMS). Paths are
+// written relative to the checksum file's directory.
+type FsChecksumAction struct{}
+
+func (a *FsChecksumAction) Run(ctx context.Context) (Result, error) {
+	return a.RunWithContext(ctx, NewActionContext(nil))
+}
+
+func (a *FsChecksumAction) RunWithContext(ctx context.Context, actx *ActionContext) (Result, error) {
+	output := actx.Input("output", "SHA256SUMS")
+	outputPath, err := absPath(actx, output)
+	if err != nil {
+		return errorResult(err)
+	}
+	files, err := inputFiles(actx, outputPath)
+	if err != nil {
+		return errorResult(err)
+	}
+	if len(files) == 0 {
+		return errorResult(fmt.Errorf("no files matched %s", strings.Join(actx.InputList("files"), ", ")))
+	}
+
+	var b strings.Builder
+	for _, file := range files {
+		sum, err := sha256File(actx.Path(file))
+		if err != nil {
+			return errorResult(fmt.Errorf("failed to hash %s: %w", file, err))
+		}
+		name := file
+		if abs, err := absPath(actx, file); err == nil {
+			if rel, err := filepath.Rel(filepath.Dir(outputPath), abs); err == nil && !strings.HasPrefix(rel, "..") {
+				name = filepath.ToSlash(rel)
+			}
+		}
+		line := fmt.Sprintf("%s  %s\n", sum, name)
+		b.WriteString(line)
+		fmt.Fprint(actx.Stdout, line)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(outputPath), 0755); err != nil {
+		return errorResult(err)
+	}
+	if err := os.WriteFile(outputPath, []byte(b.String()), 0644); err != nil {
+		return errorResult(fmt.Errorf("failed to write %s: %w", output, err))
+	}
+
+	actx.Outputs.Set("output", output)
+	return Result{
+		Status:  StatusOK,
+		Message: fmt.Sprintf("Wrote checksums of %d files to %s", len(files), output),
+	}, nil
+}
+
+func (a *FsChecksumAction) Description() string {
+	return "Write SHA-256 checksums of files"
+}
+
+// FsArchiveAction creates a reproducible tar.gz or zip archive.
+// Inputs: files - glob patterns, exclude - patterns to leave out, output -
+// archive path (required), format - tar.gz or zip (default: from extension),
+// base - directory archive names are relative to (default: working directory),
+// prefix - directory prepended to names in the archive. Entries are sorted,
+// owners cleared and times set to SOURCE_DATE_EPOCH or 1980-01-01.
+type FsArchiveAction struct{}
+
+func (a *FsArchiveAction) Run(ctx context.Context) (Result, error) {
+	return a.RunWithContext(ctx, NewActionContext(nil))
+}
+
+func (a *FsArchiveAction) RunWithContext(ctx context.Context, actx *ActionContext) (Result, error) {
+	output := actx.Input("output", "")
+	if output == "" {
+		return errorResult(fmt.Errorf("output input is required"))
+	}
+	format := actx.Input("format", "")
+	if format == "" {
+		switch {
+		case strings.HasSuffix(output, ".tar.gz"), strings.HasSuffix(output, ".tgz"):
+			format = "tar.gz"
+		case strings.HasSuffix(output, ".zip"):
+			format = "zip"
+		default:
+			return errorResult(fmt.Errorf("cannot detect archive format of %s, set format to tar.gz or zip", output))
+		}
+	}
+	if format != "tar.gz" && format != "zip" {
+		return errorResult(fmt.Errorf("invalid archive format %q: must be tar.gz or zip", format))
+	}
+
+	outputPath, err := absPath(actx, output)
+	if err != nil {
+		return errorResult(err)
+	}
+	files, err := inputFiles(actx, outputPath)
+	if err != nil {
+		return errorResult(err)
+	}
+	if len(files) == 0 {
+		return errorResult(fmt.Errorf("no files matched %s", strings.Join(actx.InputList("files"), ", ")))
+	}
+
+	base, err := absPath(actx, actx.Input("base", "."))
+	if err != nil {
+		return errorResult(err)
+	}
+	prefix := strings.Trim(filepath.ToSlash(actx.Input("prefix", "")), "/")
+	entries := make([]archiveEntry, 0, len(files))
+	for _, file := range files {
+		abs, err := absPath(actx, file)
+		if err != nil {
+			return errorResult(err)
+		}
+		name, err := filepath.Rel(base, abs)
+		if err != nil || strings.HasPrefix(name, "..") {
+			return errorResult(fmt.Errorf("%s is outside of base %s", file, actx.Input("base", ".")))
+		}
+		name = filepath.ToSlash(name)
+		if prefix != "" {
+			name = prefix + "/" + name
+		}
+		entries = append(entries, archiveEntry{name: name, path: abs})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].name < entries[j].name })
+
+	if err := os.MkdirAll(filepath.Dir(outputPath), 0755); err != nil {
+		return errorResult(err)
+	}
+	mtime := archiveTime(actx)
+	if format == "zip" {
+		err = writeZipArchive(outputPath, entries, mtime)
+	} else {
+		err = writeTarGzArchive(outputPath, entries, mtime)
+	}
+	if err != nil {
+		os.Remove(outputPath)
+		return errorResult(fmt.Errorf("failed to write %s: %w", output, err))
+	}
+
+	for _, entry := range entries {
+		fmt.Fprintln(actx.Stdout, entry.name)
+	}
+	actx.Outputs.Set("archive", output)
+	return Result{
+		Status:  StatusOK,
+		Message: fmt.Sprintf("Archived %d files to %s", len(entries), output),
+	}, nil
+}
+
+func (a *FsArchiveAction) Description() string {
+	return "Create a reproducible tar.gz or zip archive"
+}
+
+// archiveEntry is a file stored in an archive
+type archiveEntry struct {
+	name string // Slash separated name in the archive
+	path string // Absolute path on disk
+}
+
+// archiveTime returns SOURCE_DATE_EPOCH from the action environment, or the default archive time
+func archiveTime(actx *ActionContext) time.Time {
+	if epoch, err := strconv.ParseInt(actx.Env["SOURCE_DATE_EPOCH"], 10, 64); err == nil && epoch >= defaultArchiveTime.Unix() {
+		return time.Unix(epoch, 0).UTC()
+	}
+	return defaultArchiveTime
+}
+
+// archiveMode normalizes file permissions so archives do not depend on the umask
+func archiveMode(info os.FileInfo) os.FileMode {
+	if info.Mode().Perm()&0111 != 0 {
+		return 0755
+	}
+	return 0644
+}
+
+// writeTarGzArchive writes entries to a gzip compressed tar file
+func writeTarGzArchive(output string, entries []archiveEntry, mtime time.Time) error {
+	file, err := os.Create(output)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	gz := gzip.NewWriter(file)
+	gz.ModTime = mtime
+	tw := tar.NewWriter(gz)
+	for _, entry := range entries {
+		info, err := os.Stat(entry.path)
+		if err != nil {
+			return err
+		}
+		header := &tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     entry.name,
+			Size:     info.Size(),
+			Mode:     int64(archiveMode(info)),
+			ModTime:  mtime,
+			Format:   tar.FormatPAX,
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		if err := copyFileTo(tw, entry.path); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		return err
+	}
+	return file.Close()
+}
+
+// writeZipArchive writes entries to a zip file
+func writeZipArchive(output string, entries []archiveEntry, mtime time.Time) error {
+	file, err := os.Create(output)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	zw := zip.NewWriter(file)
+	for _, entry := range entries {
+		info, err := os.Stat(entry.path)
+		if err != nil {
+			return err
+		}
+		header := &zip.FileHeader{
+			Name:     entry.name,
+			Method:   zip.Deflate,
+			Modified: mtime,
+		}
+		header.SetMode(archiveMode(info))
+		w, err := zw.CreateHeader(header)
+		if err != nil {
+			return err
+		}
+		if err := copyFileTo(w, entry.path); err != nil {
+			return err
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	return file.Close()
+}
+
+// copyFileTo copies a file's content to w
+func copyFileTo(w io.Writer, name string) error {
+	file, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = io.Copy(w, file)
+	return err
+}
+
+// FsCopyAction copies files into a directory.
+// Inputs: files - glob patterns, exclude - patterns to leave out, to -
+// destination directory (required), base - directory the copied structure is
+// relative to (default: working directory), flatten - copy by file name only
+// (default: false), overwrite - replace existing files (default: true).
+type FsCopyAction struct{}
+
+func (a *FsCopyAction) Run(ctx context.Context) (Result, error) {
+	return a.RunWithContext(ctx, NewActionContext(nil))
+}
+
+func (a *FsCopyAction) RunWithContext(ctx context.Context, actx *ActionContext) (Result, error) {
+	to := actx.Input("to", "")
+	if to == "" {
+		return errorResult(fmt.Errorf("to input is required"))
+	}
+	dest, err := absPath(actx, to)
+	if err != nil {
+		return errorResult(err)
+	}
+	files, err := inputFiles(actx, "")
+	if err != nil {
+		return errorResult(err)
+	}
+	base, err := absPath(actx, actx.Input("base", "."))
+	if err != nil {
+		return errorResult(err)
+	}
+	flatten := actx.InputBool("flatten", false)
+	overwrite := actx.InputBool("overwrite", true)
+
+	copied := 0
+	for _, file := range files {
+		src, err := absPath(actx, file)
+		if err != nil {
+			return errorResult(err)
+		}
+		if strings.HasPrefix(src, dest+string(filepath.Separator)) {
+			// Already inside the destination, e.g. with files: "**"
+			continue
+		}
+		name := filepath.Base(src)
+		if !flatten {
+			if name, err = filepath.Rel(base, src); err != nil || strings.HasPrefix(name, "..") {
+				return errorResult(fmt.Errorf("%s is outside of base %s", file, actx.Input("base", ".")))
+			}
+		}
+		target := filepath.Join(dest, name)
+		if _, err := os.Stat(target); err == nil && !overwrite {
+			fmt.Fprintf(actx.Stdout, "%s exists, skipped\n", displayPath(target))
+			continue
+		}
+		if err := copyFile(src, target); err != nil {
+			return errorResult(fmt.Errorf("failed to copy %s: %w", file, err))
+		}
+		fmt.Fprintf(actx.Stdout, "%s -> %s\n", file, displayPath(target))
+		copied++
+	}
+
+	actx.Outputs.Set("count", strconv.Itoa(copied))
+	return Result{
+		Status:  StatusOK,
+		Message: fmt.Sprintf("Copied %d files to %s", copied, to),
+	}, nil
+}
+
+func (a *FsCopyAction) Description() string {
+	return "Copy files into a directory"
+}
+
+// copyFile copies src to dst, creating parent directories and keeping the mode
+func copyFile(src, dst string) error {
+	info, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	if err := copyFileTo(out, src); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// FsCleanAction removes files and directories.
+// Inputs: paths - glob patterns of files and directories to remove,
+// exclude - patterns to keep. Only paths inside the working directory are
+// removed, never the working directory itself, its parents or .git.
+type FsCleanAction struct{}
+
+func (a *FsCleanAction) Run(ctx context.Context) (Result, error) {
+	return a.RunWithContext(ctx, NewActionContext(nil))
+}
+
+func (a *FsCleanAction) RunWithContext(ctx context.Context, actx *ActionContext) (Result, error) {
+	patterns := actx.InputList("paths")
+	if len(patterns) == 0 {
+		return errorResult(fmt.Errorf("paths input is required"))
+	}
+	matches, err := expandGlobs(actx, patterns, actx.InputList("exclude"))
+	if err != nil {
+		return errorResult(err)
+	}
+	if len(matches) == 0 {
+		return Result{Status: StatusOK, Message: "Nothing to clean"}, nil
+	}
+	for _, match := range matches {
+		if err := checkRemovable(actx, match); err != nil {
+			return errorResult(err)
+		}
+	}
+
+	for _, match := range matches {
+		if err := os.RemoveAll(actx.Path(match)); err != nil {
+			return errorResult(fmt.Errorf("failed to remove %s: %w", match, err))
+		}
+		fmt.Fprintf(actx.Stdout, "removed %s\n", match)
+	}
+	actx.Outputs.Set("count", strconv.Itoa(len(matches)))
+	return Result{
+		Status:  StatusOK,
+		Message: fmt.Sprintf("Removed %d paths", len(matches)),
+	}, nil
+}
+
+func (a *FsCleanAction) Description() string {
+	return "Remove files and directories"
+}
+
+// checkRemovable refuses a match that is the working directory or one of its
+// parents, such as . or a path through a symlink, or that is in .git
+func checkRemovable(actx *ActionContext, match string) error {
+	if match == "." {
+		return fmt.Errorf("refusing to remove the working directory")
+	}
+	for _, segment := range strings.Split(match, "/") {
+		if segment == ".git" {
+			return fmt.Errorf("refusing to remove %s: it is in .git", match)
+		}
+	}
+	dir, err := resolvedPath(actx.Path("."))
+	if err != nil {
+		return err
+	}
+	// Symlinks in the parent directories are followed, the match itself is
+	// removed as a link
+	parent, err := resolvedPath(filepath.Dir(actx.Path(match)))
+	if err != nil {
+		return err
+	}
+	target := filepath.Join(parent, filepath.Base(actx.Path(match)))
+	if rel, err := filepath.Rel(target, dir); err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return fmt.Errorf("refusing to remove %s: it contains the working directory", match)
+	}
+	return nil
+}
+
+// resolvedPath returns the absolute path of p with symlinks resolved
+func resolvedPath(p string) (string, error) {
+	abs, err := filepath.Abs(p)
+	if err != nil {
+		return "", err
+	}
+	return filepath.EvalSymlinks(abs)
+}
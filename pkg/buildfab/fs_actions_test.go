@@ -0,0 +1,320 @@
+package buildfab
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestTree creates files with their content under a temporary directory
+func newTestTree(t *testing.T, files map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, content := range files {
+		writeRepoFile(t, dir, name, content)
+	}
+	return dir
+}
+
+func TestMatchGlob(t *testing.T) {
+	tests := []struct {
+		pattern string
+		name    string
+		want    bool
+	}{
+		{"*.go", "main.go", true},
+		{"*.go", "pkg/main.go", false},
+		{"**/*.go", "main.go", true},
+		{"**/*.go", "pkg/a/main.go", true},
+		{"dist/**", "dist/a/b.txt", true},
+		{"dist/**", "build/a.txt", false},
+		{"pkg/**/test_*.go", "pkg/x/y/test_a.go", true},
+		{"bin/?", "bin/a", true},
+	}
+	for _, tt := range tests {
+		if got := matchGlob(tt.pattern, tt.name); got != tt.want {
+			t.Errorf("matchGlob(%q, %q) = %v, want %v", tt.pattern, tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestExpandGlobs(t *testing.T) {
+	dir := newTestTree(t, map[string]string{
+		"a.txt":         "a",
+		"b.log":         "b",
+		"dist/x.bin":    "x",
+		"dist/sub/y.go": "y",
+	})
+	actx := NewActionContext(nil)
+	actx.WorkingDir = dir
+
+	matches, err := expandGlobs(actx, []string{"*.txt", "dist", "missing"}, nil)
+	if err != nil || !reflect.DeepEqual(matches, []string{"a.txt", "dist"}) {
+		t.Errorf("expandGlobs() = %v, %v", matches, err)
+	}
+	files, err := expandFiles(actx, matches, []string{"*.bin"})
+	if err != nil || !reflect.DeepEqual(files, []string{"a.txt", "dist/sub/y.go"}) {
+		t.Errorf("expandFiles() = %v, %v", files, err)
+	}
+	matches, err = expandGlobs(actx, []string{"**/*.go"}, nil)
+	if err != nil || !reflect.DeepEqual(matches, []string{"dist/sub/y.go"}) {
+		t.Errorf("expandGlobs(**) = %v, %v", matches, err)
+	}
+	if _, err := expandGlobs(actx, []string{"../*"}, nil); err == nil {
+		t.Error("patterns outside the working directory should fail")
+	}
+}
+
+func TestFsChecksumAction(t *testing.T) {
+	dir := newTestTree(t, map[string]string{
+		"dist/app":     "hello\n",
+		"dist/app.txt": "",
+	})
+
+	result, actx, err := runInRepo(t, &FsChecksumAction{}, dir, map[string]string{
+		"files":  "dist/*",
+		"output": "dist/SHA256SUMS",
+	})
+	if err != nil || result.Status != StatusOK {
+		t.Fatalf("RunWithContext() = %+v, %v", result, err)
+	}
+	data, _ := os.ReadFile(filepath.Join(dir, "dist", "SHA256SUMS"))
+	want := "5891b5b522d5df086d0ff0b110fbd9d21bb4fc7163af34d08286a2e846f6be03  app\n" +
+		"e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855  app.txt\n"
+	if string(data) != want {
+		t.Errorf("SHA256SUMS =\n%s\nwant\n%s", data, want)
+	}
+	if output, _ := actx.Outputs.Get("output"); output != "dist/SHA256SUMS" {
+		t.Errorf("output = %q", output)
+	}
+
+	// A second run must not checksum the previous SHA256SUMS
+	if _, _, err := runInRepo(t, &FsChecksumAction{}, dir, map[string]string{"files": "dist/*", "output": "dist/SHA256SUMS"}); err != nil {
+		t.Fatalf("second run: %v", err)
+	}
+	if again, _ := os.ReadFile(filepath.Join(dir, "dist", "SHA256SUMS")); string(again) != want {
+		t.Errorf("second run SHA256SUMS =\n%s", again)
+	}
+
+	if _, _, err := runInRepo(t, &FsChecksumAction{}, dir, map[string]string{"files": "*.none"}); err == nil {
+		t.Error("no matches should fail")
+	}
+}
+
+func TestFsArchiveAction_TarGz(t *testing.T) {
+	dir := newTestTree(t, map[string]string{
+		"dist/b.txt":     "b",
+		"dist/a/one.txt": "one",
+		"dist/skip.log":  "skip",
+	})
+	inputs := map[string]string{
+		"files":   "dist",
+		"exclude": "*.log",
+		"output":  "out/app.tar.gz",
+		"base":    "dist",
+		"prefix":  "app-1.0",
+	}
+
+	result, actx, err := runInRepo(t, &FsArchiveAction{}, dir, inputs)
+	if err != nil || result.Status != StatusOK {
+		t.Fatalf("RunWithContext() = %+v, %v", result, err)
+	}
+	first, _ := os.ReadFile(filepath.Join(dir, "out", "app.tar.gz"))
+	if archive, _ := actx.Outputs.Get("archive"); archive != "out/app.tar.gz" {
+		t.Errorf("archive output = %q", archive)
+	}
+
+	gz, err := gzip.NewReader(bytes.NewReader(first))
+	if err != nil {
+		t.Fatalf("gzip.NewReader() error = %v", err)
+	}
+	tr := tar.NewReader(gz)
+	var names []string
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("tar Next() error = %v", err)
+		}
+		names = append(names, header.Name)
+		if !header.ModTime.Equal(defaultArchiveTime) || header.Uid != 0 || header.Mode != 0644 {
+			t.Errorf("%s header not normalized: %v %d %o", header.Name, header.ModTime, header.Uid, header.Mode)
+		}
+	}
+	if want := []string{"app-1.0/a/one.txt", "app-1.0/b.txt"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("archive entries = %v, want %v", names, want)
+	}
+
+	// Rebuilding after touching the files must give the same bytes
+	later := time.Now().Add(time.Hour)
+	os.Chtimes(filepath.Join(dir, "dist", "b.txt"), later, later)
+	if _, _, err := runInRepo(t, &FsArchiveAction{}, dir, inputs); err != nil {
+		t.Fatalf("second run: %v", err)
+	}
+	if second, _ := os.ReadFile(filepath.Join(dir, "out", "app.tar.gz")); !bytes.Equal(first, second) {
+		t.Error("archive is not reproducible")
+	}
+}
+
+func TestFsArchiveAction_Zip(t *testing.T) {
+	dir := newTestTree(t, map[string]string{"z.txt": "z", "a.txt": "a"})
+	actx := NewActionContext(map[string]string{"files": "*.txt", "output": "app.zip"})
+	actx.WorkingDir = dir
+	actx.Env = map[string]string{"SOURCE_DATE_EPOCH": "1700000000"}
+
+	if result, err := (&FsArchiveAction{}).RunWithContext(context.Background(), actx); err != nil || result.Status != StatusOK {
+		t.Fatalf("RunWithContext() = %+v, %v", result, err)
+	}
+	zr, err := zip.OpenReader(filepath.Join(dir, "app.zip"))
+	if err != nil {
+		t.Fatalf("zip.OpenReader() error = %v", err)
+	}
+	defer zr.Close()
+	var names []string
+	for _, file := range zr.File {
+		names = append(names, file.Name)
+		if !file.Modified.Equal(time.Unix(1700000000, 0)) {
+			t.Errorf("%s modified = %v, want SOURCE_DATE_EPOCH", file.Name, file.Modified)
+		}
+	}
+	if want := []string{"a.txt", "z.txt"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("archive entries = %v, want %v", names, want)
+	}
+
+	if _, _, err := runInRepo(t, &FsArchiveAction{}, dir, map[string]string{"files": "*.txt", "output": "app.rar"}); err == nil {
+		t.Error("unknown format should fail")
+	}
+}
+
+func TestFsCopyAction(t *testing.T) {
+	dir := newTestTree(t, map[string]string{
+		"build/bin/app":  "app",
+		"build/lib/l.so": "lib",
+		"README.md":      "readme",
+	})
+	os.Chmod(filepath.Join(dir, "build", "bin", "app"), 0755)
+
+	result, actx, err := runInRepo(t, &FsCopyAction{}, dir, map[string]string{
+		"files": "build/**",
+		"to":    "dist",
+		"base":  "build",
+	})
+	if err != nil || result.Status != StatusOK {
+		t.Fatalf("RunWithContext() = %+v, %v", result, err)
+	}
+	info, err := os.Stat(filepath.Join(dir, "dist", "bin", "app"))
+	if err != nil || info.Mode().Perm() != 0755 {
+		t.Errorf("dist/bin/app = %v, %v, want executable copy", info, err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "dist", "lib", "l.so")); err != nil {
+		t.Errorf("dist/lib/l.so not copied: %v", err)
+	}
+	if count, _ := actx.Outputs.Get("count"); count != "2" {
+		t.Errorf("count = %q, want 2", count)
+	}
+
+	writeRepoFile(t, dir, "flat/README.md", "keep")
+	var out bytes.Buffer
+	actx = NewActionContext(map[string]string{
+		"files":     "README.md, build/bin/app",
+		"to":        "flat",
+		"flatten":   "true",
+		"overwrite": "false",
+	})
+	actx.WorkingDir = dir
+	actx.Stdout = &out
+	if _, err := (&FsCopyAction{}).RunWithContext(context.Background(), actx); err != nil {
+		t.Fatalf("flatten copy: %v", err)
+	}
+	if data, _ := os.ReadFile(filepath.Join(dir, "flat", "README.md")); string(data) != "keep" {
+		t.Errorf("existing file overwritten: %q", data)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "flat", "app")); err != nil {
+		t.Errorf("flat/app not copied: %v", err)
+	}
+	if !strings.Contains(out.String(), "exists, skipped") {
+		t.Errorf("output should report skipped files, got %q", out.String())
+	}
+}
+
+func TestFsCleanAction(t *testing.T) {
+	dir := newTestTree(t, map[string]string{
+		"dist/app":        "app",
+		"coverage.out":    "c",
+		"pkg/a/cover.out": "c",
+		"keep.out":        "k",
+		"main.go":         "m",
+	})
+
+	result, actx, err := runInRepo(t, &FsCleanAction{}, dir, map[string]string{
+		"paths":   "dist, **/*.out",
+		"exclude": "keep.out",
+	})
+	if err != nil || result.Status != StatusOK {
+		t.Fatalf("RunWithContext() = %+v, %v", result, err)
+	}
+	for _, gone := range []string{"dist", "coverage.out", "pkg/a/cover.out"} {
+		if _, err := os.Stat(filepath.Join(dir, gone)); !os.IsNotExist(err) {
+			t.Errorf("%s should be removed", gone)
+		}
+	}
+	for _, kept := range []string{"keep.out", "main.go"} {
+		if _, err := os.Stat(filepath.Join(dir, kept)); err != nil {
+			t.Errorf("%s should be kept: %v", kept, err)
+		}
+	}
+	if count, _ := actx.Outputs.Get("count"); count != "3" {
+		t.Errorf("count = %q, want 3", count)
+	}
+
+	result, _, err = runInRepo(t, &FsCleanAction{}, dir, map[string]string{"paths": "dist"})
+	if err != nil || result.Message != "Nothing to clean" {
+		t.Errorf("second run = %+v, %v", result, err)
+	}
+}
+
+func TestFsCleanAction_RefusesWorkingDir(t *testing.T) {
+	dir := newTestTree(t, map[string]string{
+		"main.go":     "m",
+		".git/HEAD":   "ref",
+		"sub/file.go": "f",
+	})
+	if err := os.Symlink("..", filepath.Join(dir, "sub", "up")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("../..", filepath.Join(dir, "sub", "parent")); err != nil {
+		t.Fatal(err)
+	}
+	// sub/parent/<dir> is the working directory through a symlink
+	self := "sub/parent/" + filepath.Base(dir)
+	for _, paths := range []string{".", "./", "sub/..", self, ".git", ".git/HEAD", "main.go, ."} {
+		result, _, err := runInRepo(t, &FsCleanAction{}, dir, map[string]string{"paths": paths})
+		if err == nil || result.Status != StatusError {
+			t.Errorf("paths %q: RunWithContext() = %+v, %v, want an error", paths, result, err)
+		}
+	}
+	for _, kept := range []string{"main.go", ".git/HEAD", "sub/file.go"} {
+		if _, err := os.Stat(filepath.Join(dir, kept)); err != nil {
+			t.Errorf("%s should be kept: %v", kept, err)
+		}
+	}
+	// A symlink is removed as a link, not the directory it points to
+	result, _, err := runInRepo(t, &FsCleanAction{}, dir, map[string]string{"paths": "sub/up"})
+	if err != nil || result.Status != StatusOK {
+		t.Errorf("removing a symlink = %+v, %v", result, err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "main.go")); err != nil {
+		t.Errorf("main.go should be kept: %v", err)
+	}
+}
@@ -0,0 +1,558 @@
+package buildfab
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// maxListedItems limits how many files or commits a failure message lists
+const maxListedItems = 20
+
+// conventionalTypes are the commit types accepted by git@commit-message by default
+var conventionalTypes = []string{"feat", "fix", "docs", "style", "refactor", "perf", "test", "build", "ci", "chore", "revert"}
+
+// failureMessage formats a summary followed by the offending items and an
+// optional command to reproduce the check
+func failureMessage(summary string, items []string, hint string) string {
+	var b strings.Builder
+	b.WriteString(summary)
+	if len(items) > 0 {
+		b.WriteString(":")
+		for i, item := range items {
+			if i == maxListedItems {
+				fmt.Fprintf(&b, "\n      ... and %d more", len(items)-maxListedItems)
+				break
+			}
+			b.WriteString("\n      " + item)
+		}
+	}
+	if hint != "" {
+		b.WriteString("\n    to check run:\n      " + hint)
+	}
+	return b.String()
+}
+
+// runGit runs git in the action's directory and returns its trimmed stdout.
+// Errors include git's stderr.
+func runGit(ctx context.Context, actx *ActionContext, args ...string) (string, error) {
+	cmd := actx.Command(ctx, "git", args...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return "", fmt.Errorf("git %s failed: %s", args[0], msg)
+		}
+		return "", fmt.Errorf("git %s failed: %w", args[0], err)
+	}
+	return strings.TrimRight(string(output), "\n"), nil
+}
+
+// gitUpstream returns the upstream of the current branch, if it has one
+func gitUpstream(ctx context.Context, actx *ActionContext) (string, bool) {
+	upstream, err := runGit(ctx, actx, "rev-parse", "--abbrev-ref", "--symbolic-full-name", "@{u}")
+	if err != nil || upstream == "" {
+		return "", false
+	}
+	return upstream, true
+}
+
+// gitCommitRange returns the git log arguments selecting the commits to check:
+// the range input, the commits not yet pushed to upstream, or the last
+// max_count commits (default 1)
+func gitCommitRange(ctx context.Context, actx *ActionContext) []string {
+	if commitRange := actx.Input("range", ""); commitRange != "" {
+		return []string{commitRange}
+	}
+	if upstream, ok := gitUpstream(ctx, actx); ok {
+		return []string{upstream + "..HEAD"}
+	}
+	return []string{"-n", strconv.Itoa(actx.InputInt("max_count", 1)), "HEAD"}
+}
+
+// errorResult converts an error into a failed action result
+func errorResult(err error) (Result, error) {
+	return Result{
+		Status:  StatusError,
+		Message: err.Error(),
+	}, err
+}
+
+// gitCurrentBranch returns the short name of the current branch. With -q,
+// git symbolic-ref exits with status 1 only when HEAD is detached, any other
+// failure (not a repository, git missing) is returned as an error.
+func gitCurrentBranch(ctx context.Context, actx *ActionContext) (string, bool, error) {
+	cmd := actx.Command(ctx, "git", "symbolic-ref", "--short", "-q", "HEAD")
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) && exitErr.ExitCode() == 1 {
+			return "", true, nil
+		}
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return "", false, fmt.Errorf("git symbolic-ref failed: %s", msg)
+		}
+		return "", false, fmt.Errorf("git symbolic-ref failed: %w", err)
+	}
+	branch := strings.TrimSpace(string(output))
+	return branch, branch == "", nil
+}
+
+// GitBranchAction checks the current branch name.
+// Inputs: pattern - branch name patterns (glob), regex - branch name regular
+// expression, allow_detached - accept a detached HEAD (default: false).
+type GitBranchAction struct{}
+
+func (a *GitBranchAction) Run(ctx context.Context) (Result, error) {
+	return a.RunWithContext(ctx, NewActionContext(nil))
+}
+
+func (a *GitBranchAction) RunWithContext(ctx context.Context, actx *ActionContext) (Result, error) {
+	branch, detached, err := gitCurrentBranch(ctx, actx)
+	if err != nil {
+		return errorResult(err)
+	}
+	if detached {
+		if actx.InputBool("allow_detached", false) {
+			return Result{Status: StatusOK, Message: "Detached HEAD allowed"}, nil
+		}
+		return Result{
+			Status:  StatusError,
+			Message: "HEAD is detached, to check run:\n      git status",
+		}, fmt.Errorf("HEAD is detached")
+	}
+	actx.Outputs.Set("branch", branch)
+
+	patterns := actx.InputList("pattern")
+	expr := actx.Input("regex", "")
+	if len(patterns) == 0 && expr == "" {
+		return Result{Status: StatusOK, Message: fmt.Sprintf("On branch %s", branch)}, nil
+	}
+
+	for _, pattern := range patterns {
+		matched, err := path.Match(pattern, branch)
+		if err != nil {
+			return errorResult(fmt.Errorf("invalid branch pattern %q: %w", pattern, err))
+		}
+		if matched {
+			return Result{Status: StatusOK, Message: fmt.Sprintf("Branch %s matches %s", branch, pattern)}, nil
+		}
+	}
+	if expr != "" {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return errorResult(fmt.Errorf("invalid branch regex %q: %w", expr, err))
+		}
+		if re.MatchString(branch) {
+			return Result{Status: StatusOK, Message: fmt.Sprintf("Branch %s matches %s", branch, expr)}, nil
+		}
+	}
+
+	allowed := append([]string{}, patterns...)
+	if expr != "" {
+		allowed = append(allowed, expr)
+	}
+	return Result{
+		Status:  StatusError,
+		Message: fmt.Sprintf("Branch %s does not match %s", branch, strings.Join(allowed, ", ")),
+	}, fmt.Errorf("branch %s does not match %s", branch, strings.Join(allowed, ", "))
+}
+
+func (a *GitBranchAction) Description() string {
+	return "Check the current branch name"
+}
+
+// GitUpToDateAction compares the current branch with its upstream using local
+// refs only, so run git fetch first for fresh results.
+// Inputs: upstream - ref to compare with (default: the branch upstream),
+// allow_ahead - accept unpushed commits (default: true).
+type GitUpToDateAction struct{}
+
+func (a *GitUpToDateAction) Run(ctx context.Context) (Result, error) {
+	return a.RunWithContext(ctx, NewActionContext(nil))
+}
+
+func (a *GitUpToDateAction) RunWithContext(ctx context.Context, actx *ActionContext) (Result, error) {
+	upstream := actx.Input("upstream", "")
+	if upstream == "" {
+		var ok bool
+		if upstream, ok = gitUpstream(ctx, actx); !ok {
+			return Result{
+				Status:  StatusWarn,
+				Message: "Current branch has no upstream, to check run:\n      git branch -vv",
+			}, nil
+		}
+	}
+
+	behind, err := runGit(ctx, actx, "log", "--format=%h %s", "HEAD.."+upstream)
+	if err != nil {
+		return errorResult(err)
+	}
+	ahead, err := runGit(ctx, actx, "log", "--format=%h %s", upstream+"..HEAD")
+	if err != nil {
+		return errorResult(err)
+	}
+	behindCommits := splitLines(behind)
+	aheadCommits := splitLines(ahead)
+	actx.Outputs.Set("behind", strconv.Itoa(len(behindCommits)))
+	actx.Outputs.Set("ahead", strconv.Itoa(len(aheadCommits)))
+
+	if len(behindCommits) > 0 {
+		summary := fmt.Sprintf("Branch is %d commits behind %s", len(behindCommits), upstream)
+		return Result{
+			Status:  StatusError,
+			Message: failureMessage(summary, behindCommits, "git log HEAD.."+upstream),
+		}, fmt.Errorf("branch is %d commits behind %s", len(behindCommits), upstream)
+	}
+	if len(aheadCommits) > 0 && !actx.InputBool("allow_ahead", true) {
+		summary := fmt.Sprintf("Branch is %d commits ahead of %s", len(aheadCommits), upstream)
+		return Result{
+			Status:  StatusError,
+			Message: failureMessage(summary, aheadCommits, "git log "+upstream+"..HEAD"),
+		}, fmt.Errorf("branch is %d commits ahead of %s", len(aheadCommits), upstream)
+	}
+
+	return Result{
+		Status:  StatusOK,
+		Message: fmt.Sprintf("Branch is up to date with %s", upstream),
+	}, nil
+}
+
+func (a *GitUpToDateAction) Description() string {
+	return "Check the branch is not behind its upstream"
+}
+
+// GitTagExistsAction checks whether a tag exists.
+// Inputs: tag - tag name (default: v<version> from file), file - version file
+// (default: VERSION), exists - whether the tag must exist (default: true).
+type GitTagExistsAction struct{}
+
+func (a *GitTagExistsAction) Run(ctx context.Context) (Result, error) {
+	return a.RunWithContext(ctx, NewActionContext(nil))
+}
+
+func (a *GitTagExistsAction) RunWithContext(ctx context.Context, actx *ActionContext) (Result, error) {
+	tag := actx.Input("tag", "")
+	if tag == "" {
+		file := actx.Input("file", "VERSION")
+		data, err := os.ReadFile(actx.Path(file))
+		if err != nil {
+			return Result{
+				Status:  StatusError,
+				Message: fmt.Sprintf("No tag given and failed to read %s", file),
+			}, fmt.Errorf("failed to read %s: %w", file, err)
+		}
+		tag = strings.TrimSpace(string(data))
+		if !strings.HasPrefix(tag, "v") {
+			tag = "v" + tag
+		}
+	}
+	actx.Outputs.Set("tag", tag)
+
+	_, err := runGit(ctx, actx, "rev-parse", "-q", "--verify", "refs/tags/"+tag)
+	found := err == nil
+	want := actx.InputBool("exists", true)
+
+	switch {
+	case found && want:
+		return Result{Status: StatusOK, Message: fmt.Sprintf("Tag %s exists", tag)}, nil
+	case !found && !want:
+		return Result{Status: StatusOK, Message: fmt.Sprintf("Tag %s does not exist", tag)}, nil
+	case found:
+		return Result{
+			Status:  StatusError,
+			Message: fmt.Sprintf("Tag %s already exists, to check run:\n      git show %s", tag, tag),
+		}, fmt.Errorf("tag %s already exists", tag)
+	default:
+		return Result{
+			Status:  StatusError,
+			Message: fmt.Sprintf("Tag %s not found, to check run:\n      git tag --list", tag),
+		}, fmt.Errorf("tag %s not found", tag)
+	}
+}
+
+func (a *GitTagExistsAction) Description() string {
+	return "Check a git tag exists"
+}
+
+// GitSignedCommitsAction checks commits carry a signature.
+// Inputs: range - commit range (default: commits not on upstream, or HEAD),
+// max_count - commits to check without range or upstream (default: 1),
+// require_verified - reject signatures that cannot be verified (default: false).
+type GitSignedCommitsAction struct{}
+
+func (a *GitSignedCommitsAction) Run(ctx context.Context) (Result, error) {
+	return a.RunWithContext(ctx, NewActionContext(nil))
+}
+
+func (a *GitSignedCommitsAction) RunWithContext(ctx context.Context, actx *ActionContext) (Result, error) {
+	commitRange := gitCommitRange(ctx, actx)
+	output, err := runGit(ctx, actx, append([]string{"log", "--format=%h %G? %s"}, commitRange...)...)
+	if err != nil {
+		return errorResult(err)
+	}
+
+	// %G? is G (good), U (good, unknown validity), E (cannot be checked),
+	// X/Y (expired signature/key), R (revoked key), B (bad) or N (none)
+	accepted := "GUE"
+	if actx.InputBool("require_verified", false) {
+		accepted = "G"
+	}
+	var unsigned []string
+	for _, line := range splitLines(output) {
+		fields := strings.SplitN(line, " ", 3)
+		if len(fields) < 2 || !strings.Contains(accepted, fields[1]) {
+			unsigned = append(unsigned, fmt.Sprintf("%s %s (%s)", fields[0], strings.Join(fields[2:], ""), signatureStatus(fields[1])))
+		}
+	}
+
+	if len(unsigned) > 0 {
+		return Result{
+			Status:  StatusError,
+			Message: failureMessage("Commits without a valid signature found", unsigned, "git log --show-signature "+strings.Join(commitRange, " ")),
+		}, fmt.Errorf("%d commits without a valid signature", len(unsigned))
+	}
+	return Result{Status: StatusOK, Message: "All commits are signed"}, nil
+}
+
+func (a *GitSignedCommitsAction) Description() string {
+	return "Check commits are signed"
+}
+
+// signatureStatus describes a git %G? signature status
+func signatureStatus(code string) string {
+	switch code {
+	case "N":
+		return "unsigned"
+	case "B":
+		return "bad signature"
+	case "E":
+		return "signature cannot be checked"
+	case "U":
+		return "unknown validity"
+	case "X":
+		return "expired signature"
+	case "Y":
+		return "expired key"
+	case "R":
+		return "revoked key"
+	default:
+		return "unverified"
+	}
+}
+
+// GitNoConflictMarkersAction checks tracked files for merge conflict markers.
+// Inputs: ignore - path patterns to ignore.
+type GitNoConflictMarkersAction struct{}
+
+func (a *GitNoConflictMarkersAction) Run(ctx context.Context) (Result, error) {
+	return a.RunWithContext(ctx, NewActionContext(nil))
+}
+
+func (a *GitNoConflictMarkersAction) RunWithContext(ctx context.Context, actx *ActionContext) (Result, error) {
+	ignore := actx.InputList("ignore")
+	cmd := actx.Command(ctx, "git", "grep", "-n", "-I", "-E", "^(<<<<<<<|>>>>>>>)( |$)")
+	output, err := cmd.Output()
+	if err != nil {
+		// git grep exits with 1 when nothing matches
+		var exitErr *exec.ExitError
+		if !errors.As(err, &exitErr) || exitErr.ExitCode() != 1 {
+			return errorResult(fmt.Errorf("git grep failed: %w", err))
+		}
+	}
+
+	var markers []string
+	for _, line := range splitLines(string(output)) {
+		parts := strings.SplitN(line, ":", 3)
+		if len(parts) < 3 || matchesAnyPattern(parts[0], ignore) {
+			continue
+		}
+		markers = append(markers, parts[0]+":"+parts[1])
+	}
+
+	if len(markers) > 0 {
+		return Result{
+			Status:  StatusError,
+			Message: failureMessage("Conflict markers found", markers, "git diff --check"),
+		}, fmt.Errorf("conflict markers found in %d places", len(markers))
+	}
+	return Result{Status: StatusOK, Message: "No conflict markers found"}, nil
+}
+
+func (a *GitNoConflictMarkersAction) Description() string {
+	return "Check for merge conflict markers"
+}
+
+// GitLargeFilesAction checks tracked and new files against a size limit.
+// Inputs: max_size - size limit such as 500K or 2MB (default: 1MB),
+// ignore - path patterns to ignore.
+type GitLargeFilesAction struct{}
+
+func (a *GitLargeFilesAction) Run(ctx context.Context) (Result, error) {
+	return a.RunWithContext(ctx, NewActionContext(nil))
+}
+
+func (a *GitLargeFilesAction) RunWithContext(ctx context.Context, actx *ActionContext) (Result, error) {
+	maxSize, err := parseSize(actx.Input("max_size", "1MB"))
+	if err != nil {
+		return errorResult(err)
+	}
+	ignore := actx.InputList("ignore")
+
+	output, err := runGit(ctx, actx, "ls-files", "-z", "--cached", "--others", "--exclude-standard")
+	if err != nil {
+		return errorResult(err)
+	}
+
+	var large []string
+	seen := make(map[string]bool)
+	for _, file := range strings.Split(output, "\x00") {
+		if file == "" || seen[file] || matchesAnyPattern(file, ignore) {
+			continue
+		}
+		seen[file] = true
+		info, err := os.Stat(actx.Path(file))
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		if info.Size() > maxSize {
+			large = append(large, fmt.Sprintf("%s (%s)", file, formatSize(info.Size())))
+		}
+	}
+
+	if len(large) > 0 {
+		return Result{
+			Status:  StatusError,
+			Message: failureMessage(fmt.Sprintf("Files larger than %s found", formatSize(maxSize)), large, ""),
+		}, fmt.Errorf("%d files larger than %s", len(large), formatSize(maxSize))
+	}
+	return Result{
+		Status:  StatusOK,
+		Message: fmt.Sprintf("No files larger than %s", formatSize(maxSize)),
+	}, nil
+}
+
+func (a *GitLargeFilesAction) Description() string {
+	return "Check for files over a size limit"
+}
+
+// GitCommitMessageAction checks commit subjects.
+// Inputs: pattern - regular expression the subject must match (default:
+// conventional commits), types - conventional commit types, max_length -
+// subject length limit, range and max_count as for git@signed-commits.
+// Merge commits are not checked.
+type GitCommitMessageAction struct{}
+
+func (a *GitCommitMessageAction) Run(ctx context.Context) (Result, error) {
+	return a.RunWithContext(ctx, NewActionContext(nil))
+}
+
+func (a *GitCommitMessageAction) RunWithContext(ctx context.Context, actx *ActionContext) (Result, error) {
+	expr := actx.Input("pattern", "")
+	if expr == "" {
+		types := actx.InputList("types")
+		if len(types) == 0 {
+			types = conventionalTypes
+		}
+		quoted := make([]string, len(types))
+		for i, t := range types {
+			quoted[i] = regexp.QuoteMeta(t)
+		}
+		expr = `^(` + strings.Join(quoted, "|") + `)(\([^()]+\))?!?: \S`
+	}
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return errorResult(fmt.Errorf("invalid commit message pattern %q: %w", expr, err))
+	}
+	maxLength := actx.InputInt("max_length", 0)
+
+	commitRange := gitCommitRange(ctx, actx)
+	output, err := runGit(ctx, actx, append([]string{"log", "--no-merges", "--format=%h %s"}, commitRange...)...)
+	if err != nil {
+		return errorResult(err)
+	}
+
+	var invalid []string
+	for _, line := range splitLines(output) {
+		hash, subject, _ := strings.Cut(line, " ")
+		switch {
+		case !re.MatchString(subject):
+			invalid = append(invalid, fmt.Sprintf("%s %s", hash, subject))
+		case maxLength > 0 && len(subject) > maxLength:
+			invalid = append(invalid, fmt.Sprintf("%s %s (longer than %d)", hash, subject, maxLength))
+		}
+	}
+
+	if len(invalid) > 0 {
+		return Result{
+			Status:  StatusError,
+			Message: failureMessage(fmt.Sprintf("Commit messages not matching %s found", expr), invalid, "git log --format='%h %s' "+strings.Join(commitRange, " ")),
+		}, fmt.Errorf("%d commit messages do not match %s", len(invalid), expr)
+	}
+	return Result{Status: StatusOK, Message: "All commit messages are valid"}, nil
+}
+
+func (a *GitCommitMessageAction) Description() string {
+	return "Check commit messages"
+}
+
+// splitLines splits output into non-empty lines
+func splitLines(output string) []string {
+	var lines []string
+	for _, line := range strings.Split(output, "\n") {
+		if line = strings.TrimRight(line, "\r"); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+// parseSize parses a size such as 512, 100K, 1.5MB or 2GiB. Units are
+// powers of 1024.
+func parseSize(s string) (int64, error) {
+	value := strings.ToUpper(strings.TrimSpace(s))
+	multiplier := int64(1)
+	for _, unit := range []struct {
+		suffix string
+		size   int64
+	}{
+		{"GIB", 1 << 30}, {"MIB", 1 << 20}, {"KIB", 1 << 10},
+		{"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10},
+		{"G", 1 << 30}, {"M", 1 << 20}, {"K", 1 << 10}, {"B", 1},
+	} {
+		if strings.HasSuffix(value, unit.suffix) {
+			value = strings.TrimSpace(strings.TrimSuffix(value, unit.suffix))
+			multiplier = unit.size
+			break
+		}
+	}
+	number, err := strconv.ParseFloat(value, 64)
+	if err != nil || number < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return int64(number * float64(multiplier)), nil
+}
+
+// formatSize formats a byte count for messages
+func formatSize(size int64) string {
+	switch {
+	case size >= 1<<30:
+		return fmt.Sprintf("%.1fGB", float64(size)/(1<<30))
+	case size >= 1<<20:
+		return fmt.Sprintf("%.1fMB", float64(size)/(1<<20))
+	case size >= 1<<10:
+		return fmt.Sprintf("%.1fKB", float64(size)/(1<<10))
+	default:
+		return fmt.Sprintf("%dB", size)
+	}
+}
@@ -0,0 +1,278 @@
+package buildfab
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// newTestRepo creates a git repository with one commit and returns its path
+func newTestRepo(t *testing.T) string {
+	t.Helper()
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not available")
+	}
+	t.Setenv("GIT_CONFIG_GLOBAL", os.DevNull)
+	t.Setenv("GIT_CONFIG_NOSYSTEM", "1")
+	t.Setenv("GIT_AUTHOR_NAME", "Test")
+	t.Setenv("GIT_AUTHOR_EMAIL", "test@example.com")
+	t.Setenv("GIT_COMMITTER_NAME", "Test")
+	t.Setenv("GIT_COMMITTER_EMAIL", "test@example.com")
+
+	dir := t.TempDir()
+	gitCmd(t, dir, "init", "-q", "-b", "main")
+	writeRepoFile(t, dir, "README.md", "# test\n")
+	gitCmd(t, dir, "add", ".")
+	gitCmd(t, dir, "commit", "-q", "-m", "chore: initial commit")
+	return dir
+}
+
+// gitCmd runs git in dir and fails the test on error
+func gitCmd(t *testing.T, dir string, args ...string) string {
+	t.Helper()
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("git %s failed: %v\n%s", strings.Join(args, " "), err, output)
+	}
+	return strings.TrimSpace(string(output))
+}
+
+// writeRepoFile writes a file relative to the repository root
+func writeRepoFile(t *testing.T, dir, name, content string) {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatalf("failed to create dir: %v", err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatalf("failed to write %s: %v", name, err)
+	}
+}
+
+// runInRepo runs an action in dir with the given inputs
+func runInRepo(t *testing.T, runner ContextActionRunner, dir string, inputs map[string]string) (Result, *ActionContext, error) {
+	t.Helper()
+	actx := NewActionContext(inputs)
+	actx.WorkingDir = dir
+	result, err := runner.RunWithContext(context.Background(), actx)
+	return result, actx, err
+}
+
+func TestFailureMessage(t *testing.T) {
+	got := failureMessage("Untracked files found", []string{"a.txt", "b.txt"}, "git status")
+	want := "Untracked files found:\n      a.txt\n      b.txt\n    to check run:\n      git status"
+	if got != want {
+		t.Errorf("failureMessage() = %q, want %q", got, want)
+	}
+
+	items := make([]string, maxListedItems+3)
+	for i := range items {
+		items[i] = "file"
+	}
+	if got := failureMessage("Too many", items, ""); !strings.HasSuffix(got, "... and 3 more") {
+		t.Errorf("failureMessage() should truncate long lists, got %q", got)
+	}
+}
+
+func TestGitUntrackedActionListsFiles(t *testing.T) {
+	dir := newTestRepo(t)
+	writeRepoFile(t, dir, "new.txt", "new\n")
+	writeRepoFile(t, dir, "notes.log", "log\n")
+
+	result, _, err := runInRepo(t, &GitUntrackedAction{}, dir, map[string]string{"ignore": "*.log"})
+	if err == nil || result.Status != StatusError {
+		t.Fatalf("expected untracked files error, got %+v", result)
+	}
+	if !strings.Contains(result.Message, "new.txt") || strings.Contains(result.Message, "notes.log") {
+		t.Errorf("message = %q, want new.txt listed and notes.log ignored", result.Message)
+	}
+}
+
+func TestGitBranchAction(t *testing.T) {
+	dir := newTestRepo(t)
+
+	result, actx, err := runInRepo(t, &GitBranchAction{}, dir, map[string]string{"pattern": "main, release/*"})
+	if err != nil || result.Status != StatusOK {
+		t.Errorf("main should match, got %+v, %v", result, err)
+	}
+	if branch, _ := actx.Outputs.Get("branch"); branch != "main" {
+		t.Errorf("output branch = %q, want main", branch)
+	}
+
+	gitCmd(t, dir, "checkout", "-q", "-b", "feature/x")
+	result, _, err = runInRepo(t, &GitBranchAction{}, dir, map[string]string{"pattern": "main, release/*"})
+	if err == nil || !strings.Contains(result.Message, "feature/x") {
+		t.Errorf("feature/x should not match, got %+v", result)
+	}
+	result, _, err = runInRepo(t, &GitBranchAction{}, dir, map[string]string{"regex": "^feature/"})
+	if err != nil || result.Status != StatusOK {
+		t.Errorf("regex should match, got %+v, %v", result, err)
+	}
+
+	gitCmd(t, dir, "checkout", "-q", "--detach")
+	if _, _, err := runInRepo(t, &GitBranchAction{}, dir, nil); err == nil {
+		t.Error("detached HEAD should fail")
+	}
+	if result, _, err := runInRepo(t, &GitBranchAction{}, dir, map[string]string{"allow_detached": "true"}); err != nil || result.Status != StatusOK {
+		t.Errorf("allow_detached should accept detached HEAD, got %+v, %v", result, err)
+	}
+
+	// Other git failures are not reported as a detached HEAD
+	result, _, err = runInRepo(t, &GitBranchAction{}, t.TempDir(), map[string]string{"allow_detached": "true"})
+	if err == nil || strings.Contains(result.Message, "detached") || !strings.Contains(result.Message, "not a git repository") {
+		t.Errorf("outside a repository should fail with git's error, got %+v, %v", result, err)
+	}
+}
+
+func TestGitUpToDateAction(t *testing.T) {
+	dir := newTestRepo(t)
+
+	result, _, err := runInRepo(t, &GitUpToDateAction{}, dir, nil)
+	if err != nil || result.Status != StatusWarn {
+		t.Errorf("no upstream should warn, got %+v, %v", result, err)
+	}
+
+	gitCmd(t, dir, "branch", "upstream")
+	gitCmd(t, dir, "branch", "--set-upstream-to=upstream")
+	gitCmd(t, dir, "commit", "-q", "--allow-empty", "-m", "feat: local change")
+
+	result, actx, err := runInRepo(t, &GitUpToDateAction{}, dir, nil)
+	if err != nil || result.Status != StatusOK {
+		t.Errorf("ahead branch should pass by default, got %+v, %v", result, err)
+	}
+	if ahead, _ := actx.Outputs.Get("ahead"); ahead != "1" {
+		t.Errorf("output ahead = %q, want 1", ahead)
+	}
+	result, _, err = runInRepo(t, &GitUpToDateAction{}, dir, map[string]string{"allow_ahead": "false"})
+	if err == nil || !strings.Contains(result.Message, "feat: local change") {
+		t.Errorf("allow_ahead=false should list the commit, got %+v", result)
+	}
+
+	gitCmd(t, dir, "checkout", "-q", "upstream")
+	gitCmd(t, dir, "commit", "-q", "--allow-empty", "-m", "fix: remote change")
+	gitCmd(t, dir, "checkout", "-q", "main")
+	result, _, err = runInRepo(t, &GitUpToDateAction{}, dir, nil)
+	if err == nil || !strings.Contains(result.Message, "fix: remote change") {
+		t.Errorf("behind branch should fail listing the commit, got %+v", result)
+	}
+}
+
+func TestGitTagExistsAction(t *testing.T) {
+	dir := newTestRepo(t)
+	gitCmd(t, dir, "tag", "v1.0.0")
+	writeRepoFile(t, dir, "VERSION", "1.0.0\n")
+
+	if result, _, err := runInRepo(t, &GitTagExistsAction{}, dir, nil); err != nil || result.Status != StatusOK {
+		t.Errorf("tag from VERSION should exist, got %+v, %v", result, err)
+	}
+	if _, _, err := runInRepo(t, &GitTagExistsAction{}, dir, map[string]string{"tag": "v2.0.0"}); err == nil {
+		t.Error("missing tag should fail")
+	}
+	if result, _, err := runInRepo(t, &GitTagExistsAction{}, dir, map[string]string{"tag": "v2.0.0", "exists": "false"}); err != nil || result.Status != StatusOK {
+		t.Errorf("exists=false should accept a missing tag, got %+v, %v", result, err)
+	}
+	if _, _, err := runInRepo(t, &GitTagExistsAction{}, dir, map[string]string{"exists": "false"}); err == nil {
+		t.Error("exists=false should fail for an existing tag")
+	}
+}
+
+func TestGitSignedCommitsAction(t *testing.T) {
+	dir := newTestRepo(t)
+
+	result, _, err := runInRepo(t, &GitSignedCommitsAction{}, dir, nil)
+	if err == nil || result.Status != StatusError {
+		t.Fatalf("unsigned commit should fail, got %+v", result)
+	}
+	if !strings.Contains(result.Message, "chore: initial commit (unsigned)") {
+		t.Errorf("message = %q, want the unsigned commit listed", result.Message)
+	}
+}
+
+func TestGitNoConflictMarkersAction(t *testing.T) {
+	dir := newTestRepo(t)
+	if result, _, err := runInRepo(t, &GitNoConflictMarkersAction{}, dir, nil); err != nil || result.Status != StatusOK {
+		t.Errorf("clean repo should pass, got %+v, %v", result, err)
+	}
+
+	writeRepoFile(t, dir, "src/main.go", "package main\n<<<<<<< HEAD\nours\n=======\ntheirs\n>>>>>>> branch\n")
+	writeRepoFile(t, dir, "docs/merge.md", "<<<<<<< example\n")
+	gitCmd(t, dir, "add", ".")
+
+	result, _, err := runInRepo(t, &GitNoConflictMarkersAction{}, dir, map[string]string{"ignore": "docs"})
+	if err == nil {
+		t.Fatal("conflict markers should fail")
+	}
+	if !strings.Contains(result.Message, "src/main.go:2") || !strings.Contains(result.Message, "src/main.go:6") {
+		t.Errorf("message = %q, want marker locations", result.Message)
+	}
+	if strings.Contains(result.Message, "docs/merge.md") {
+		t.Errorf("message = %q, ignored path should not be listed", result.Message)
+	}
+}
+
+func TestGitLargeFilesAction(t *testing.T) {
+	dir := newTestRepo(t)
+	writeRepoFile(t, dir, "big.bin", strings.Repeat("x", 2048))
+
+	result, _, err := runInRepo(t, &GitLargeFilesAction{}, dir, map[string]string{"max_size": "1K"})
+	if err == nil || !strings.Contains(result.Message, "big.bin (2.0KB)") {
+		t.Errorf("big.bin should be reported, got %+v", result)
+	}
+	if result, _, err := runInRepo(t, &GitLargeFilesAction{}, dir, map[string]string{"max_size": "1K", "ignore": "*.bin"}); err != nil || result.Status != StatusOK {
+		t.Errorf("ignored file should pass, got %+v, %v", result, err)
+	}
+	if _, _, err := runInRepo(t, &GitLargeFilesAction{}, dir, map[string]string{"max_size": "lots"}); err == nil {
+		t.Error("invalid max_size should fail")
+	}
+}
+
+func TestGitCommitMessageAction(t *testing.T) {
+	dir := newTestRepo(t)
+	gitCmd(t, dir, "commit", "-q", "--allow-empty", "-m", "feat(api): add endpoint")
+	gitCmd(t, dir, "commit", "-q", "--allow-empty", "-m", "Fixed stuff")
+
+	result, _, err := runInRepo(t, &GitCommitMessageAction{}, dir, map[string]string{"max_count": "3"})
+	if err == nil {
+		t.Fatal("non-conventional commit should fail")
+	}
+	if !strings.Contains(result.Message, "Fixed stuff") || strings.Contains(result.Message, "add endpoint") {
+		t.Errorf("message = %q, want only the invalid commit listed", result.Message)
+	}
+
+	if result, _, err := runInRepo(t, &GitCommitMessageAction{}, dir, map[string]string{"range": "HEAD~2..HEAD~1"}); err != nil || result.Status != StatusOK {
+		t.Errorf("conventional commit should pass, got %+v, %v", result, err)
+	}
+	if result, _, err := runInRepo(t, &GitCommitMessageAction{}, dir, map[string]string{"pattern": "^[A-Z]"}); err != nil || result.Status != StatusOK {
+		t.Errorf("custom pattern should pass, got %+v, %v", result, err)
+	}
+	if _, _, err := runInRepo(t, &GitCommitMessageAction{}, dir, map[string]string{"range": "HEAD~2..HEAD~1", "max_length": "10"}); err == nil {
+		t.Error("max_length should reject long subjects")
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	tests := []struct {
+		input string
+		want  int64
+		err   bool
+	}{
+		{"512", 512, false},
+		{"1K", 1024, false},
+		{"1.5MB", 1536 * 1024, false},
+		{"2GiB", 2 << 30, false},
+		{"10 kb", 10240, false},
+		{"big", 0, true},
+		{"-1K", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := parseSize(tt.input)
+		if (err != nil) != tt.err || got != tt.want {
+			t.Errorf("parseSize(%q) = %d, %v, want %d (error %v)", tt.input, got, err, tt.want, tt.err)
+		}
+	}
+}
@@ -0,0 +1,564 @@
+package buildfab
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// goTestEvent is one event of go test -json, see go doc test2json
+type goTestEvent struct {
+	Time    time.Time `json:"Time"`
+	Action  string    `json:"Action"`
+	Package string    `json:"Package"`
+	Test    string    `json:"Test"`
+	Elapsed float64   `json:"Elapsed"`
+	Output  string    `json:"Output"`
+}
+
+// GoTestPackage is the parsed result of one package
+type GoTestPackage struct {
+	Name     string
+	Status   string // pass, fail or skip
+	Elapsed  float64
+	Coverage string   // Percentage reported by -cover, empty when not reported
+	Output   []string // Package level output, such as build failures
+}
+
+// GoTestFailure is a failed test with its output
+type GoTestFailure struct {
+	Package string
+	Test    string
+	Output  []string
+}
+
+// GoTestReport is the parsed result of go test -json
+type GoTestReport struct {
+	Packages []*GoTestPackage
+	Failures []GoTestFailure
+	Output   []string // Lines that are not events, such as build errors
+	Passed   int
+	Failed   int
+	Skipped  int
+}
+
+// FailedPackages returns the packages that failed
+func (r *GoTestReport) FailedPackages() []*GoTestPackage {
+	var failed []*GoTestPackage
+	for _, pkg := range r.Packages {
+		if pkg.Status == "fail" {
+			failed = append(failed, pkg)
+		}
+	}
+	return failed
+}
+
+// ParseGoTestEvents reads go test -json events. Lines that are not JSON
+// events, such as build errors on older Go versions, are kept in the report's Output.
+func ParseGoTestEvents(r io.Reader) (*GoTestReport, error) {
+	report := &GoTestReport{}
+	packages := make(map[string]*GoTestPackage)
+	testOutput := make(map[string][]string)
+
+	pkgFor := func(name string) *GoTestPackage {
+		pkg, ok := packages[name]
+		if !ok {
+			pkg = &GoTestPackage{Name: name}
+			packages[name] = pkg
+			report.Packages = append(report.Packages, pkg)
+		}
+		return pkg
+	}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		var event goTestEvent
+		if len(line) == 0 || line[0] != '{' || json.Unmarshal(line, &event) != nil {
+			if len(line) > 0 {
+				report.Output = append(report.Output, string(line))
+			}
+			continue
+		}
+		if event.Package == "" {
+			continue
+		}
+		pkg := pkgFor(event.Package)
+		key := event.Package + " " + event.Test
+
+		switch event.Action {
+		case "output", "build-output":
+			text := strings.TrimRight(event.Output, "\n")
+			if event.Test != "" {
+				testOutput[key] = append(testOutput[key], text)
+				continue
+			}
+			if coverage, ok := parseCoverageLine(text); ok {
+				pkg.Coverage = coverage
+				continue
+			}
+			pkg.Output = append(pkg.Output, text)
+		case "pass", "fail", "skip":
+			if event.Test == "" {
+				pkg.Status = event.Action
+				pkg.Elapsed = event.Elapsed
+				continue
+			}
+			switch event.Action {
+			case "pass":
+				report.Passed++
+			case "skip":
+				report.Skipped++
+			case "fail":
+				report.Failed++
+				report.Failures = append(report.Failures, GoTestFailure{
+					Package: event.Package,
+					Test:    event.Test,
+					Output:  testOutput[key],
+				})
+			}
+			delete(testOutput, key)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return report, err
+	}
+	return report, nil
+}
+
+// parseCoverageLine extracts the percentage from a "coverage: 80.0% of statements" line
+func parseCoverageLine(line string) (string, bool) {
+	_, rest, ok := strings.Cut(line, "coverage: ")
+	if !ok {
+		return "", false
+	}
+	percent, _, ok := strings.Cut(rest, "%")
+	if !ok {
+		return "", false
+	}
+	if _, err := strconv.ParseFloat(percent, 64); err != nil {
+		return "", false
+	}
+	return percent, true
+}
+
+// coverageProfileTotal returns the percentage of statements covered in a
+// coverage profile. Blocks reported by several packages are counted once.
+func coverageProfileTotal(r io.Reader) (float64, bool, error) {
+	type block struct {
+		statements int
+		covered    bool
+	}
+	blocks := make(map[string]*block)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "mode:") || line == "" {
+			continue
+		}
+		// file.go:1.2,3.4 statements count
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			return 0, false, fmt.Errorf("invalid coverage profile line %q", line)
+		}
+		statements, err := strconv.Atoi(fields[1])
+		if err != nil {
+			return 0, false, fmt.Errorf("invalid coverage profile line %q", line)
+		}
+		count, err := strconv.Atoi(fields[2])
+		if err != nil {
+			return 0, false, fmt.Errorf("invalid coverage profile line %q", line)
+		}
+		b, ok := blocks[fields[0]]
+		if !ok {
+			b = &block{statements: statements}
+			blocks[fields[0]] = b
+		}
+		b.covered = b.covered || count > 0
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, false, err
+	}
+
+	total, covered := 0, 0
+	for _, b := range blocks {
+		total += b.statements
+		if b.covered {
+			covered += b.statements
+		}
+	}
+	if total == 0 {
+		return 0, false, nil
+	}
+	return float64(covered) * 100 / float64(total), true, nil
+}
+
+// goArgs appends the common build flags from inputs: tags, and flags split like a shell
+func goArgs(actx *ActionContext, args []string) ([]string, error) {
+	if tags := actx.Input("tags", ""); tags != "" {
+		args = append(args, "-tags", tags)
+	}
+	if flags := actx.Input("flags", ""); flags != "" {
+		extra, err := splitShellTemplate(flags)
+		if err != nil {
+			return nil, fmt.Errorf("invalid flags input: %w", err)
+		}
+		args = append(args, extra...)
+	}
+	return args, nil
+}
+
+// goPackages returns the packages input (default ./...)
+func goPackages(actx *ActionContext) []string {
+	packages := actx.InputList("packages")
+	if len(packages) == 0 {
+		return []string{"./..."}
+	}
+	return packages
+}
+
+// goCommandLine formats a go command for reproduction hints
+func goCommandLine(args []string) string {
+	quoted := make([]string, 0, len(args)+1)
+	quoted = append(quoted, "go")
+	for _, arg := range args {
+		if arg == "" || strings.ContainsAny(arg, " \t'\"$*?") {
+			arg = "'" + strings.ReplaceAll(arg, "'", `'\''`) + "'"
+		}
+		quoted = append(quoted, arg)
+	}
+	return strings.Join(quoted, " ")
+}
+
+// goDiagnostics returns the lines of go vet or go build output without the
+// "# package" headers
+func goDiagnostics(output string) []string {
+	var lines []string
+	for _, line := range splitLines(output) {
+		if !strings.HasPrefix(line, "#") {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+// GoTestAction runs go test -json and reports the result of each package.
+// Only the output of failing tests is included in the step message.
+// Inputs: packages - packages to test (default: ./...), race - enable the race
+// detector (default: false), run - test name pattern, short - pass -short
+// (default: false), timeout - test timeout, cover - measure coverage
+// (default: true), tags - build tags, flags - extra go test flags.
+type GoTestAction struct{}
+
+func (a *GoTestAction) Run(ctx context.Context) (Result, error) {
+	return a.RunWithContext(ctx, NewActionContext(nil))
+}
+
+func (a *GoTestAction) RunWithContext(ctx context.Context, actx *ActionContext) (Result, error) {
+	args := []string{"test"}
+	if actx.InputBool("race", false) {
+		args = append(args, "-race")
+	}
+	if actx.InputBool("short", false) {
+		args = append(args, "-short")
+	}
+	if run := actx.Input("run", ""); run != "" {
+		args = append(args, "-run", run)
+	}
+	if timeout := actx.Input("timeout", ""); timeout != "" {
+		args = append(args, "-timeout", timeout)
+	}
+	args, err := goArgs(actx, args)
+	if err != nil {
+		return errorResult(err)
+	}
+	hintArgs := append(append([]string{}, args...), goPackages(actx)...)
+
+	var profile string
+	if actx.InputBool("cover", true) {
+		file, err := os.CreateTemp("", "buildfab-cover-*.out")
+		if err != nil {
+			return errorResult(err)
+		}
+		file.Close()
+		profile = file.Name()
+		defer os.Remove(profile)
+		args = append(args, "-coverprofile", profile)
+	}
+	args = append(args, "-json")
+	args = append(args, goPackages(actx)...)
+
+	cmd := actx.Command(ctx, "go", args...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return errorResult(err)
+	}
+	if err := cmd.Start(); err != nil {
+		return errorResult(fmt.Errorf("failed to run go test: %w", err))
+	}
+	report, parseErr := ParseGoTestEvents(stdout)
+	waitErr := cmd.Wait()
+	if parseErr != nil {
+		return errorResult(fmt.Errorf("failed to read go test output: %w", parseErr))
+	}
+
+	for _, pkg := range report.Packages {
+		line := fmt.Sprintf("%-4s %s %.3fs", strings.ToUpper(pkg.Status), pkg.Name, pkg.Elapsed)
+		if pkg.Status == "pass" {
+			line = fmt.Sprintf("ok   %s %.3fs", pkg.Name, pkg.Elapsed)
+		}
+		if pkg.Coverage != "" {
+			line += fmt.Sprintf(" coverage %s%%", pkg.Coverage)
+		}
+		fmt.Fprintln(actx.Stdout, line)
+	}
+
+	actx.Outputs.Set("passed", strconv.Itoa(report.Passed))
+	actx.Outputs.Set("failed", strconv.Itoa(report.Failed))
+	actx.Outputs.Set("skipped", strconv.Itoa(report.Skipped))
+	coverage := ""
+	if profile != "" && waitErr == nil {
+		if file, err := os.Open(profile); err == nil {
+			if total, ok, err := coverageProfileTotal(file); err == nil && ok {
+				coverage = fmt.Sprintf("%.1f", total)
+				actx.Outputs.Set("coverage", coverage)
+			}
+			file.Close()
+		}
+	}
+
+	failedPackages := report.FailedPackages()
+	if waitErr == nil && len(failedPackages) == 0 {
+		message := fmt.Sprintf("%d tests passed in %d packages", report.Passed, len(report.Packages))
+		if report.Skipped > 0 {
+			message += fmt.Sprintf(", %d skipped", report.Skipped)
+		}
+		if coverage != "" {
+			message += fmt.Sprintf(", coverage %s%%", coverage)
+		}
+		return Result{Status: StatusOK, Message: message}, nil
+	}
+
+	message := goTestFailureMessage(report, failedPackages, strings.TrimSpace(stderr.String()), goCommandLine(hintArgs))
+	summary := fmt.Sprintf("%d tests failed in %d packages", report.Failed, len(failedPackages))
+	if report.Failed == 0 {
+		summary = fmt.Sprintf("go test failed in %d packages", len(failedPackages))
+		if len(failedPackages) == 0 {
+			summary = "go test failed"
+		}
+	}
+	return Result{Status: StatusError, Message: summary + message}, fmt.Errorf("%s", summary)
+}
+
+func (a *GoTestAction) Description() string {
+	return "Run go test and report failing tests"
+}
+
+// goTestFailureMessage lists the failing tests with their output, and the
+// output of packages that failed without a failing test, such as build failures
+func goTestFailureMessage(report *GoTestReport, failedPackages []*GoTestPackage, stderr, hint string) string {
+	var b strings.Builder
+	b.WriteString(":")
+	failedTests := make(map[string]bool)
+	for _, failure := range report.Failures {
+		failedTests[failure.Package] = true
+		// Parent tests fail with their subtests, whose output is already listed
+		if hasFailedSubtest(report.Failures, failure) {
+			continue
+		}
+		fmt.Fprintf(&b, "\n      --- FAIL: %s (%s)", failure.Test, failure.Package)
+		for _, line := range failure.Output {
+			trimmed := strings.TrimSpace(line)
+			if trimmed == "" || strings.HasPrefix(trimmed, "=== ") || strings.HasPrefix(trimmed, "--- FAIL") {
+				continue
+			}
+			b.WriteString("\n        " + trimmed)
+		}
+	}
+	for _, pkg := range failedPackages {
+		if failedTests[pkg.Name] {
+			continue
+		}
+		fmt.Fprintf(&b, "\n      FAIL %s", pkg.Name)
+		for _, line := range pkg.Output {
+			if trimmed := strings.TrimSpace(line); trimmed != "" && trimmed != "FAIL" && !strings.HasPrefix(trimmed, "FAIL\t") {
+				b.WriteString("\n        " + trimmed)
+			}
+		}
+	}
+	for _, line := range append(report.Output, splitLines(stderr)...) {
+		b.WriteString("\n      " + line)
+	}
+	b.WriteString("\n    to check run:\n      " + hint)
+	return b.String()
+}
+
+// hasFailedSubtest reports whether a failed test has a failed subtest
+func hasFailedSubtest(failures []GoTestFailure, parent GoTestFailure) bool {
+	for _, failure := range failures {
+		if failure.Package == parent.Package && strings.HasPrefix(failure.Test, parent.Test+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// GoModTidyCheckAction fails when go mod tidy would change go.mod or go.sum.
+// It runs go mod tidy -diff, which leaves the files untouched.
+type GoModTidyCheckAction struct{}
+
+func (a *GoModTidyCheckAction) Run(ctx context.Context) (Result, error) {
+	return a.RunWithContext(ctx, NewActionContext(nil))
+}
+
+func (a *GoModTidyCheckAction) RunWithContext(ctx context.Context, actx *ActionContext) (Result, error) {
+	cmd := actx.Command(ctx, "go", "mod", "tidy", "-diff")
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if err == nil {
+		return Result{Status: StatusOK, Message: "go.mod and go.sum are tidy"}, nil
+	}
+
+	// The diff is written to stdout, other failures only to stderr
+	var changed []string
+	for _, line := range strings.Split(string(output), "\n") {
+		if strings.HasPrefix(line, "diff current/") {
+			changed = append(changed, strings.Fields(strings.TrimPrefix(line, "diff current/"))[0])
+		}
+	}
+	if len(changed) == 0 {
+		return errorResult(fmt.Errorf("go mod tidy failed: %s", strings.TrimSpace(stderr.String())))
+	}
+	actx.Stdout.Write(output)
+	return Result{
+		Status:  StatusError,
+		Message: failureMessage("go mod tidy changes", changed, "go mod tidy -diff"),
+	}, fmt.Errorf("go.mod or go.sum is not tidy")
+}
+
+func (a *GoModTidyCheckAction) Description() string {
+	return "Check that go mod tidy does not change go.mod or go.sum"
+}
+
+// GoVetAction runs go vet and lists the reported problems.
+// Inputs: packages - packages to check (default: ./...), tags - build tags,
+// flags - extra go vet flags.
+type GoVetAction struct{}
+
+func (a *GoVetAction) Run(ctx context.Context) (Result, error) {
+	return a.RunWithContext(ctx, NewActionContext(nil))
+}
+
+func (a *GoVetAction) RunWithContext(ctx context.Context, actx *ActionContext) (Result, error) {
+	args, err := goArgs(actx, []string{"vet"})
+	if err != nil {
+		return errorResult(err)
+	}
+	args = append(args, goPackages(actx)...)
+
+	output, err := actx.Command(ctx, "go", args...).CombinedOutput()
+	if err != nil {
+		problems := goDiagnostics(string(output))
+		if len(problems) == 0 {
+			return errorResult(fmt.Errorf("go vet failed: %w", err))
+		}
+		return Result{
+			Status:  StatusError,
+			Message: failureMessage(fmt.Sprintf("go vet found %d problems", len(problems)), problems, goCommandLine(args)),
+		}, fmt.Errorf("go vet found %d problems", len(problems))
+	}
+	return Result{Status: StatusOK, Message: "go vet found no problems"}, nil
+}
+
+func (a *GoVetAction) Description() string {
+	return "Run go vet"
+}
+
+// GoBuildAction runs go build, optionally cross compiling.
+// Inputs: packages - packages to build (default: ./...), output - output file
+// or directory (-o), goos, goarch - target platform, cgo - set CGO_ENABLED,
+// ldflags - linker flags, trimpath - pass -trimpath (default: false), tags -
+// build tags, flags - extra go build flags.
+type GoBuildAction struct{}
+
+func (a *GoBuildAction) Run(ctx context.Context) (Result, error) {
+	return a.RunWithContext(ctx, NewActionContext(nil))
+}
+
+func (a *GoBuildAction) RunWithContext(ctx context.Context, actx *ActionContext) (Result, error) {
+	args := []string{"build"}
+	output := actx.Input("output", "")
+	if output != "" {
+		args = append(args, "-o", output)
+	}
+	if actx.InputBool("trimpath", false) {
+		args = append(args, "-trimpath")
+	}
+	if ldflags := actx.Input("ldflags", ""); ldflags != "" {
+		args = append(args, "-ldflags", ldflags)
+	}
+	args, err := goArgs(actx, args)
+	if err != nil {
+		return errorResult(err)
+	}
+	args = append(args, goPackages(actx)...)
+
+	cmd := actx.Command(ctx, "go", args...)
+	var platform []string
+	for _, env := range []struct{ input, name string }{
+		{"goos", "GOOS"}, {"goarch", "GOARCH"}, {"cgo", "CGO_ENABLED"},
+	} {
+		value := actx.Input(env.input, "")
+		if value == "" {
+			continue
+		}
+		if env.input == "cgo" {
+			value = "0"
+			if actx.InputBool("cgo", false) {
+				value = "1"
+			}
+		}
+		cmd.Env = append(cmd.Environ(), env.name+"="+value)
+		platform = append(platform, env.name+"="+value)
+	}
+	sort.Strings(platform)
+
+	hint := strings.TrimSpace(strings.Join(platform, " ") + " " + goCommandLine(args))
+	if out, err := cmd.CombinedOutput(); err != nil {
+		problems := goDiagnostics(string(out))
+		if len(problems) == 0 {
+			return errorResult(fmt.Errorf("go build failed: %w", err))
+		}
+		return Result{
+			Status:  StatusError,
+			Message: failureMessage("go build failed", problems, hint),
+		}, fmt.Errorf("go build failed")
+	}
+
+	target := "host platform"
+	if len(platform) > 0 {
+		target = strings.Join(platform, " ")
+	}
+	message := fmt.Sprintf("Built %s for %s", strings.Join(goPackages(actx), " "), target)
+	if output != "" {
+		actx.Outputs.Set("output", output)
+		message += " to " + output
+	}
+	return Result{Status: StatusOK, Message: message}, nil
+}
+
+func (a *GoBuildAction) Description() string {
+	return "Build Go packages"
+}
@@ -0,0 +1,164 @@
+package buildfab
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// newTestModule creates a Go module with the given files and returns an
+// action context running in it, independent of any workspace
+func newTestModule(t *testing.T, files map[string]string) *ActionContext {
+	t.Helper()
+	if _, err := exec.LookPath("go"); err != nil {
+		t.Skip("go not available")
+	}
+	files["go.mod"] = "module example.com/m\n\ngo 1.21\n"
+	dir := newTestTree(t, files)
+	actx := NewActionContext(nil)
+	actx.WorkingDir = dir
+	actx.Env["GOWORK"] = "off"
+	actx.Env["GOFLAGS"] = "-mod=mod"
+	actx.Env["GOPROXY"] = "off"
+	return actx
+}
+
+func TestParseGoTestEvents(t *testing.T) {
+	events := `{"Action":"start","Package":"example.com/a"}
+{"Action":"run","Package":"example.com/a","Test":"TestOK"}
+{"Action":"output","Package":"example.com/a","Test":"TestOK","Output":"=== RUN   TestOK\n"}
+{"Action":"pass","Package":"example.com/a","Test":"TestOK","Elapsed":0.01}
+{"Action":"run","Package":"example.com/a","Test":"TestBad"}
+{"Action":"output","Package":"example.com/a","Test":"TestBad","Output":"    a_test.go:9: got 1, want 2\n"}
+{"Action":"fail","Package":"example.com/a","Test":"TestBad","Elapsed":0.02}
+{"Action":"skip","Package":"example.com/a","Test":"TestSkip"}
+{"Action":"output","Package":"example.com/a","Output":"coverage: 75.0% of statements\n"}
+{"Action":"fail","Package":"example.com/a","Elapsed":0.5}
+# example.com/b
+b/b.go:3:1: syntax error
+{"Action":"output","Package":"example.com/b","Output":"FAIL\texample.com/b [build failed]\n"}
+{"Action":"fail","Package":"example.com/b","Elapsed":0}
+`
+	report, err := ParseGoTestEvents(strings.NewReader(events))
+	if err != nil {
+		t.Fatalf("ParseGoTestEvents() error = %v", err)
+	}
+	if report.Passed != 1 || report.Failed != 1 || report.Skipped != 1 {
+		t.Errorf("counts = %d passed, %d failed, %d skipped", report.Passed, report.Failed, report.Skipped)
+	}
+	if len(report.Packages) != 2 || report.Packages[0].Coverage != "75.0" || report.Packages[0].Status != "fail" {
+		t.Fatalf("packages = %+v", report.Packages)
+	}
+	if len(report.Failures) != 1 || report.Failures[0].Test != "TestBad" || !strings.Contains(strings.Join(report.Failures[0].Output, "\n"), "got 1, want 2") {
+		t.Errorf("failures = %+v", report.Failures)
+	}
+
+	message := goTestFailureMessage(report, report.FailedPackages(), "", "go test ./...")
+	for _, want := range []string{"--- FAIL: TestBad (example.com/a)", "got 1, want 2", "FAIL example.com/b", "syntax error", "to check run:"} {
+		if !strings.Contains(message, want) {
+			t.Errorf("failure message missing %q:\n%s", want, message)
+		}
+	}
+	if strings.Contains(message, "=== RUN") {
+		t.Errorf("failure message should not include passing output:\n%s", message)
+	}
+}
+
+func TestCoverageProfileTotal(t *testing.T) {
+	profile := `mode: set
+a.go:1.1,2.2 3 1
+a.go:3.1,4.2 1 0
+a.go:3.1,4.2 1 1
+b.go:1.1,2.2 4 0
+`
+	total, ok, err := coverageProfileTotal(strings.NewReader(profile))
+	if err != nil || !ok || total != 50 {
+		t.Errorf("coverageProfileTotal() = %v, %v, %v, want 50", total, ok, err)
+	}
+	if _, ok, _ := coverageProfileTotal(strings.NewReader("mode: set\n")); ok {
+		t.Error("empty profile should report no coverage")
+	}
+}
+
+func TestGoTestAction(t *testing.T) {
+	actx := newTestModule(t, map[string]string{
+		"calc.go":      "package m\n\nfunc Add(a, b int) int { return a + b }\n\nfunc Sub(a, b int) int { return a - b }\n",
+		"calc_test.go": "package m\n\nimport \"testing\"\n\nfunc TestAdd(t *testing.T) {\n\tif Add(1, 2) != 3 {\n\t\tt.Fatal(\"bad\")\n\t}\n}\n",
+	})
+
+	result, err := (&GoTestAction{}).RunWithContext(context.Background(), actx)
+	if err != nil || result.Status != StatusOK {
+		t.Fatalf("RunWithContext() = %+v, %v", result, err)
+	}
+	if coverage, _ := actx.Outputs.Get("coverage"); coverage != "50.0" {
+		t.Errorf("coverage = %q, want 50.0", coverage)
+	}
+	if passed, _ := actx.Outputs.Get("passed"); passed != "1" {
+		t.Errorf("passed = %q, want 1", passed)
+	}
+
+	writeRepoFile(t, actx.WorkingDir, "sub_test.go", "package m\n\nimport \"testing\"\n\nfunc TestSub(t *testing.T) {\n\tt.Log(\"noise\")\n\tif got := Sub(3, 1); got != 1 {\n\t\tt.Errorf(\"Sub(3, 1) = %d\", got)\n\t}\n}\n")
+	result, err = (&GoTestAction{}).RunWithContext(context.Background(), actx)
+	if err == nil || result.Status != StatusError {
+		t.Fatalf("failing test should fail the step, got %+v", result)
+	}
+	if !strings.HasPrefix(result.Message, "1 tests failed in 1 packages") || !strings.Contains(result.Message, "Sub(3, 1) = 2") {
+		t.Errorf("message = %s", result.Message)
+	}
+	if strings.Contains(result.Message, "TestAdd") {
+		t.Errorf("message should only include failing tests:\n%s", result.Message)
+	}
+}
+
+func TestGoModTidyCheckAction(t *testing.T) {
+	actx := newTestModule(t, map[string]string{"m.go": "package m\n"})
+	result, err := (&GoModTidyCheckAction{}).RunWithContext(context.Background(), actx)
+	if err != nil || result.Status != StatusOK {
+		t.Fatalf("tidy module = %+v, %v", result, err)
+	}
+
+	untidy := "module example.com/m\n\ngo 1.21\n\nrequire golang.org/x/text v0.3.0\n"
+	writeRepoFile(t, actx.WorkingDir, "go.mod", untidy)
+	result, err = (&GoModTidyCheckAction{}).RunWithContext(context.Background(), actx)
+	if err == nil || !strings.Contains(result.Message, "go.mod") {
+		t.Errorf("untidy module = %+v, %v", result, err)
+	}
+	if data, _ := os.ReadFile(filepath.Join(actx.WorkingDir, "go.mod")); string(data) != untidy {
+		t.Errorf("go.mod should be left unchanged, got %q", data)
+	}
+}
+
+func TestGoVetAndBuildActions(t *testing.T) {
+	actx := newTestModule(t, map[string]string{
+		"main.go": "package main\n\nimport \"fmt\"\n\nfunc main() { fmt.Println(\"hi\") }\n",
+	})
+	if result, err := (&GoVetAction{}).RunWithContext(context.Background(), actx); err != nil {
+		t.Fatalf("go vet = %+v, %v", result, err)
+	}
+
+	actx.Inputs = map[string]string{"output": "bin/app.exe", "goos": "windows", "goarch": "amd64", "cgo": "false"}
+	result, err := (&GoBuildAction{}).RunWithContext(context.Background(), actx)
+	if err != nil || result.Status != StatusOK {
+		t.Fatalf("go build = %+v, %v", result, err)
+	}
+	data, err := os.ReadFile(filepath.Join(actx.WorkingDir, "bin", "app.exe"))
+	if err != nil || !strings.HasPrefix(string(data), "MZ") {
+		t.Errorf("bin/app.exe should be a windows binary: %v", err)
+	}
+
+	writeRepoFile(t, actx.WorkingDir, "main.go", "package main\n\nimport \"fmt\"\n\nfunc main() { fmt.Printf(\"%d\", \"x\") }\n")
+	actx.Inputs = nil
+	result, err = (&GoVetAction{}).RunWithContext(context.Background(), actx)
+	if err == nil || !strings.Contains(result.Message, "main.go:5") || !strings.Contains(result.Message, "go vet ./...") {
+		t.Errorf("go vet on bad code = %+v, %v", result, err)
+	}
+
+	writeRepoFile(t, actx.WorkingDir, "main.go", "package main\n\nfunc main() { undefined() }\n")
+	result, err = (&GoBuildAction{}).RunWithContext(context.Background(), actx)
+	if err == nil || !strings.Contains(result.Message, "undefined") {
+		t.Errorf("go build on bad code = %+v, %v", result, err)
+	}
+}
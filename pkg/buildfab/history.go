@@ -0,0 +1,445 @@
+package buildfab
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// HistoryDir is the directory in the state directory holding the run history
+const HistoryDir = "history"
+
+// historyFile is the append-only run history, one JSON record per line
+const historyFile = "runs.jsonl"
+
+// historyKeep is the number of records kept in the history. The file is
+// pruned to it once it has grown a quarter larger, so it is rarely rewritten.
+const historyKeep = 1000
+
+// HistoryRecord is a stage run in the history
+type HistoryRecord struct {
+	RunID      string        `json:"run_id,omitempty"`
+	Stage      string        `json:"stage"`
+	Commit     string        `json:"commit,omitempty"`
+	Dirty      bool          `json:"dirty,omitempty"` // Uncommitted changes in the working tree
+	Start      time.Time     `json:"start"`
+	DurationMS int64         `json:"duration_ms"`
+	Success    bool          `json:"success"`
+	Steps      []HistoryStep `json:"steps"`
+}
+
+// HistoryStep is a step of a stage run in the history
+type HistoryStep struct {
+	Name       string `json:"name"`
+	Status     string `json:"status"`
+	DurationMS int64  `json:"duration_ms"`
+	Variant    string `json:"variant,omitempty"`
+	ExitCode   int    `json:"exit_code,omitempty"`
+}
+
+// Duration returns the duration of the run
+func (r HistoryRecord) Duration() time.Duration {
+	return time.Duration(r.DurationMS) * time.Millisecond
+}
+
+// Duration returns the duration of the step
+func (s HistoryStep) Duration() time.Duration {
+	return time.Duration(s.DurationMS) * time.Millisecond
+}
+
+// ran reports whether the step ran to a result that counts for statistics
+func (s HistoryStep) ran() bool {
+	return s.Status == StepStatusOK.String() || s.Status == StepStatusWarn.String() || s.Status == StepStatusError.String()
+}
+
+// NewHistoryRecord builds the history record of a stage run
+func NewHistoryRecord(stage StageResult, runID string, commit GitCommit) HistoryRecord {
+	record := HistoryRecord{
+		RunID:      runID,
+		Stage:      stage.StageName,
+		Commit:     commit.Hash,
+		Dirty:      commit.Dirty,
+		Start:      stage.Start,
+		DurationMS: stage.Duration.Milliseconds(),
+		Success:    stage.Success,
+		Steps:      []HistoryStep{},
+	}
+	for _, step := range stage.Steps {
+		record.Steps = append(record.Steps, HistoryStep{
+			Name:       step.StepName,
+			Status:     step.Status.String(),
+			DurationMS: step.Duration.Milliseconds(),
+			Variant:    step.Variant,
+			ExitCode:   step.ExitCode,
+		})
+	}
+	return record
+}
+
+// GitCommit identifies the code a run was made on
+type GitCommit struct {
+	Hash  string
+	Dirty bool
+}
+
+// CurrentGitCommit returns the commit checked out in dir, or an empty commit
+// outside a git repository
+func CurrentGitCommit(ctx context.Context, dir string) GitCommit {
+	git := func(args ...string) (string, error) {
+		cmd := exec.CommandContext(ctx, "git", args...)
+		cmd.Dir = dir
+		output, err := cmd.Output()
+		return strings.TrimSpace(string(output)), err
+	}
+	hash, err := git("rev-parse", "HEAD")
+	if err != nil {
+		return GitCommit{}
+	}
+	status, err := git("status", "--porcelain", "--untracked-files=no")
+	return GitCommit{Hash: hash, Dirty: err == nil && status != ""}
+}
+
+// AppendHistory appends a record to the run history in the state directory
+func AppendHistory(stateDir string, record HistoryRecord) error {
+	dir := filepath.Join(stateDir, HistoryDir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create history directory: %w", err)
+	}
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(dir, historyFile)
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open history: %w", err)
+	}
+	// A single write keeps concurrent runs from interleaving records
+	_, err = file.Write(append(data, '\n'))
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write history: %w", err)
+	}
+	if err := pruneHistory(path, historyKeep); err != nil {
+		return fmt.Errorf("failed to prune history: %w", err)
+	}
+	return nil
+}
+
+// pruneHistory removes the oldest records of the history file when it holds
+// more than keep records and a quarter. The file is replaced by rename, a
+// record appended by a concurrent run while pruning may be lost.
+func pruneHistory(path string, keep int) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	records := bytes.Count(data, []byte("\n"))
+	if records <= keep+keep/4 {
+		return nil
+	}
+	offset := 0
+	for i := 0; i < records-keep; i++ {
+		offset += bytes.IndexByte(data[offset:], '\n') + 1
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data[offset:], 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// ReadHistory reads the run history in the state directory, oldest first.
+// Lines that are not valid records, such as a line cut short by a crash,
+// are skipped.
+func ReadHistory(stateDir string) ([]HistoryRecord, error) {
+	file, err := os.Open(filepath.Join(stateDir, HistoryDir, historyFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var records []HistoryRecord
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var record HistoryRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil || record.Stage == "" {
+			continue
+		}
+		records = append(records, record)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read history: %w", err)
+	}
+	return records, nil
+}
+
+// StepStats are the statistics of a step over the history of a stage
+type StepStats struct {
+	Name     string
+	Runs     int // Runs where the step ran
+	Failures int
+	P50, P95 time.Duration
+	Trend    Trend
+}
+
+// Trend compares the p50 duration of the latest runs with the runs before them
+type Trend struct {
+	Recent   time.Duration // p50 of the last window runs
+	Previous time.Duration // p50 of up to window runs before them
+	Runs     int           // Runs before the window, 0 when there are too few runs for a trend
+}
+
+// Change returns the relative change of the p50 duration, 0.1 for 10% slower
+func (t Trend) Change() float64 {
+	if t.Runs == 0 || t.Previous == 0 {
+		return 0
+	}
+	return float64(t.Recent-t.Previous) / float64(t.Previous)
+}
+
+// String formats the change in percent, or - without a trend
+func (t Trend) String() string {
+	if t.Runs == 0 || t.Previous == 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%+.0f%%", t.Change()*100)
+}
+
+// computeTrend compares the last window durations with the window before them
+func computeTrend(durations []time.Duration, window int) Trend {
+	if window <= 0 || len(durations) <= window {
+		return Trend{}
+	}
+	recent := durations[len(durations)-window:]
+	previous := durations[max(0, len(durations)-2*window) : len(durations)-window]
+	return Trend{Recent: percentile(recent, 50), Previous: percentile(previous, 50), Runs: len(previous)}
+}
+
+// FailureRate returns the share of runs where the step failed
+func (s StepStats) FailureRate() float64 {
+	if s.Runs == 0 {
+		return 0
+	}
+	return float64(s.Failures) / float64(s.Runs)
+}
+
+// StageStats are the statistics of a stage over the history
+type StageStats struct {
+	Stage    string
+	Runs     int
+	Failures int
+	P50, P95 time.Duration
+	Trend    Trend
+	Window   int         // Runs compared by the trends
+	Steps    []StepStats // In order of first appearance
+}
+
+// ComputeStageStats computes duration percentiles and failure rates of a
+// stage and its steps. Only steps that ran count, skipped steps don't. With
+// a window, the trends compare the p50 of the last window runs with the
+// window runs before them.
+func ComputeStageStats(records []HistoryRecord, stage string, window int) StageStats {
+	stats := StageStats{Stage: stage, Window: window}
+	var stageDurations []time.Duration
+	stepDurations := map[string][]time.Duration{}
+	index := map[string]int{}
+	for _, record := range records {
+		if record.Stage != stage {
+			continue
+		}
+		stats.Runs++
+		if !record.Success {
+			stats.Failures++
+		}
+		stageDurations = append(stageDurations, record.Duration())
+		for _, step := range record.Steps {
+			if !step.ran() {
+				continue
+			}
+			i, ok := index[step.Name]
+			if !ok {
+				i = len(stats.Steps)
+				index[step.Name] = i
+				stats.Steps = append(stats.Steps, StepStats{Name: step.Name})
+			}
+			stats.Steps[i].Runs++
+			if step.Status == StepStatusError.String() {
+				stats.Steps[i].Failures++
+			}
+			stepDurations[step.Name] = append(stepDurations[step.Name], step.Duration())
+		}
+	}
+	stats.P50, stats.P95 = percentile(stageDurations, 50), percentile(stageDurations, 95)
+	stats.Trend = computeTrend(stageDurations, window)
+	for i, step := range stats.Steps {
+		stats.Steps[i].P50 = percentile(stepDurations[step.Name], 50)
+		stats.Steps[i].P95 = percentile(stepDurations[step.Name], 95)
+		stats.Steps[i].Trend = computeTrend(stepDurations[step.Name], window)
+	}
+	return stats
+}
+
+// percentile returns the nearest-rank percentile of durations
+func percentile(durations []time.Duration, p int) time.Duration {
+	if len(durations) == 0 {
+		return 0
+	}
+	sorted := append([]time.Duration(nil), durations...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	rank := (p*len(sorted) + 99) / 100
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
+
+// FlakyStep is a step that both passed and failed on the same commit
+type FlakyStep struct {
+	Stage    string
+	Step     string
+	Commit   string
+	Passes   int
+	Failures int
+	Flips    int // Changes between pass and fail, in run order
+}
+
+// FindFlakySteps returns the steps whose result flipped between pass and
+// fail across runs on the same commit, most flips first. Runs on a dirty
+// working tree are ignored as their code may differ.
+func FindFlakySteps(records []HistoryRecord) []FlakyStep {
+	type key struct{ stage, step, commit string }
+	type outcome struct {
+		flaky FlakyStep
+		last  string
+	}
+	outcomes := map[key]*outcome{}
+	var order []key
+	for _, record := range records {
+		if record.Commit == "" || record.Dirty {
+			continue
+		}
+		for _, step := range record.Steps {
+			if !step.ran() {
+				continue
+			}
+			k := key{record.Stage, step.Name, record.Commit}
+			o, ok := outcomes[k]
+			if !ok {
+				o = &outcome{flaky: FlakyStep{Stage: record.Stage, Step: step.Name, Commit: record.Commit}}
+				outcomes[k] = o
+				order = append(order, k)
+			}
+			result := "pass"
+			if step.Status == StepStatusError.String() {
+				result = "fail"
+				o.flaky.Failures++
+			} else {
+				o.flaky.Passes++
+			}
+			if o.last != "" && o.last != result {
+				o.flaky.Flips++
+			}
+			o.last = result
+		}
+	}
+
+	var flaky []FlakyStep
+	for _, k := range order {
+		if o := outcomes[k]; o.flaky.Flips > 0 {
+			flaky = append(flaky, o.flaky)
+		}
+	}
+	sort.SliceStable(flaky, func(i, j int) bool { return flaky[i].Flips > flaky[j].Flips })
+	return flaky
+}
+
+// shortCommit abbreviates a commit hash for display
+func shortCommit(commit string) string {
+	if len(commit) > 10 {
+		return commit[:10]
+	}
+	return commit
+}
+
+// FormatHistoryTable prints history records as a table, with the failed
+// steps of each run
+func FormatHistoryTable(w io.Writer, records []HistoryRecord) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "STARTED\tSTAGE\tCOMMIT\tSTATUS\tDURATION\tFAILED STEPS")
+	for _, record := range records {
+		commit := shortCommit(record.Commit)
+		if commit == "" {
+			commit = "-"
+		} else if record.Dirty {
+			commit += "+"
+		}
+		status := "ok"
+		if !record.Success {
+			status = "failed"
+		}
+		var failed []string
+		for _, step := range record.Steps {
+			if step.Status == StepStatusError.String() {
+				failed = append(failed, step.Name)
+			}
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", record.Start.Local().Format("2006-01-02 15:04:05"), record.Stage,
+			commit, status, formatReportDuration(record.Duration()), strings.Join(failed, ", "))
+	}
+	tw.Flush()
+}
+
+// FormatStageStats prints the statistics of a stage with a table of steps.
+// The TREND column is the change of the p50 of the last window runs.
+func FormatStageStats(w io.Writer, stats StageStats) {
+	fmt.Fprintf(w, "Stage %s: %d runs, %d failed (%.0f%%), p50 %s, p95 %s\n", stats.Stage, stats.Runs, stats.Failures,
+		percent(stats.Failures, stats.Runs), formatReportDuration(stats.P50), formatReportDuration(stats.P95))
+	if stats.Trend.Runs > 0 {
+		fmt.Fprintf(w, "Trend: p50 %s over the last %d runs, %s over the %d before (%s)\n", formatReportDuration(stats.Trend.Recent),
+			stats.Window, formatReportDuration(stats.Trend.Previous), stats.Trend.Runs, stats.Trend)
+	}
+	fmt.Fprintln(w)
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "STEP\tRUNS\tFAILED\tFAILURE RATE\tP50\tP95\tTREND")
+	for _, step := range stats.Steps {
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%.0f%%\t%s\t%s\t%s\n", step.Name, step.Runs, step.Failures, step.FailureRate()*100,
+			formatReportDuration(step.P50), formatReportDuration(step.P95), step.Trend)
+	}
+	tw.Flush()
+}
+
+// FormatFlakyTable prints flaky steps as a table
+func FormatFlakyTable(w io.Writer, flaky []FlakyStep) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "STAGE\tSTEP\tCOMMIT\tPASSED\tFAILED\tFLIPS")
+	for _, step := range flaky {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%d\t%d\n", step.Stage, step.Step, shortCommit(step.Commit), step.Passes, step.Failures, step.Flips)
+	}
+	tw.Flush()
+}
+
+// percent returns part of total in percent
+func percent(part, total int) float64 {
+	if total == 0 {
+		return 0
+	}
+	return float64(part) / float64(total) * 100
+}
@@ -0,0 +1,255 @@
+package buildfab
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+// historyRecord returns a record of a stage run with steps given as
+// name=status:milliseconds
+func historyRecord(stage, commit string, steps ...string) HistoryRecord {
+	record := HistoryRecord{Stage: stage, Commit: commit, Success: true}
+	for _, step := range steps {
+		var name, status string
+		var ms int64
+		nameStatus, duration, _ := strings.Cut(step, ":")
+		name, status, _ = strings.Cut(nameStatus, "=")
+		fmt.Sscan(duration, &ms)
+		if status == "error" {
+			record.Success = false
+		}
+		record.Steps = append(record.Steps, HistoryStep{Name: name, Status: status, DurationMS: ms})
+		record.DurationMS += ms
+	}
+	return record
+}
+
+func TestHistory_AppendRead(t *testing.T) {
+	stateDir := t.TempDir()
+	if records, err := ReadHistory(stateDir); err != nil || records != nil {
+		t.Fatalf("ReadHistory() without history = %v, %v", records, err)
+	}
+
+	stage := testStageResult()
+	stage.Steps[0].Variant = "${{ os == 'linux' }}"
+	stage.Steps[2].ExitCode = 2
+	first := NewHistoryRecord(stage, "run-1", GitCommit{Hash: "abc123", Dirty: true})
+	if err := AppendHistory(stateDir, first); err != nil {
+		t.Fatalf("AppendHistory() error = %v", err)
+	}
+	// A record cut short by a crash is skipped
+	path := filepath.Join(stateDir, HistoryDir, historyFile)
+	file, _ := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	file.WriteString(`{"stage":"release","ste` + "\n")
+	file.Close()
+	if err := AppendHistory(stateDir, historyRecord("ci", "def456", "build=ok:10")); err != nil {
+		t.Fatalf("AppendHistory() error = %v", err)
+	}
+
+	records, err := ReadHistory(stateDir)
+	if err != nil || len(records) != 2 {
+		t.Fatalf("ReadHistory() = %+v, %v", records, err)
+	}
+	got := records[0]
+	if got.RunID != "run-1" || got.Stage != "release" || got.Commit != "abc123" || !got.Dirty || got.Success || got.Duration() != 3*time.Second {
+		t.Errorf("record = %+v", got)
+	}
+	want := []HistoryStep{
+		{Name: "build", Status: "ok", DurationMS: 1500, Variant: "${{ os == 'linux' }}"},
+		{Name: "lint", Status: "warn"},
+		{Name: "test", Status: "error", ExitCode: 2},
+		{Name: "publish", Status: "skipped"},
+	}
+	if !reflect.DeepEqual(got.Steps, want) {
+		t.Errorf("steps = %+v, want %+v", got.Steps, want)
+	}
+}
+
+func TestComputeStageStats(t *testing.T) {
+	var records []HistoryRecord
+	for i := 1; i <= 20; i++ {
+		status := "ok"
+		if i%5 == 0 {
+			status = "error"
+		}
+		records = append(records, historyRecord("ci", "c1", fmt.Sprintf("build=ok:%d", i*10), fmt.Sprintf("test=%s:100", status), "deploy=skipped:0"))
+	}
+	records = append(records, historyRecord("release", "c1", "build=error:5000"))
+
+	stats := ComputeStageStats(records, "ci", 5)
+	if stats.Runs != 20 || stats.Failures != 4 {
+		t.Errorf("stage stats = %+v", stats)
+	}
+	if len(stats.Steps) != 2 {
+		t.Fatalf("steps = %+v, skipped steps should not count", stats.Steps)
+	}
+	build, test := stats.Steps[0], stats.Steps[1]
+	if build.Name != "build" || build.Runs != 20 || build.P50 != 100*time.Millisecond || build.P95 != 190*time.Millisecond {
+		t.Errorf("build = %+v", build)
+	}
+	if test.Failures != 4 || test.FailureRate() != 0.2 || test.P50 != 100*time.Millisecond {
+		t.Errorf("test = %+v", test)
+	}
+	// The last 5 runs against the 5 before them
+	if want := (Trend{Recent: 180 * time.Millisecond, Previous: 130 * time.Millisecond, Runs: 5}); build.Trend != want || build.Trend.String() != "+38%" {
+		t.Errorf("build trend = %+v (%s), want %+v", build.Trend, build.Trend, want)
+	}
+	if stats.Trend.Recent != 280*time.Millisecond || stats.Trend.Previous != 230*time.Millisecond {
+		t.Errorf("stage trend = %+v", stats.Trend)
+	}
+	if trend := ComputeStageStats(records[:5], "ci", 5).Steps[0].Trend; trend.Runs != 0 || trend.String() != "-" {
+		t.Errorf("trend without earlier runs = %+v (%s)", trend, trend)
+	}
+
+	var out bytes.Buffer
+	FormatStageStats(&out, stats)
+	for _, want := range []string{
+		"Stage ci: 20 runs, 4 failed (20%)",
+		"Trend: p50 280ms over the last 5 runs, 230ms over the 5 before (+22%)",
+		"STEP", "test   20    4       20%",
+		"build  20    0       0%            100ms  190ms  +38%",
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("output missing %q:\n%s", want, out.String())
+		}
+	}
+}
+
+func TestPruneHistory(t *testing.T) {
+	stateDir := t.TempDir()
+	for i := 1; i <= 6; i++ {
+		if err := AppendHistory(stateDir, historyRecord("ci", fmt.Sprintf("c%d", i), "build=ok:1")); err != nil {
+			t.Fatalf("AppendHistory() error = %v", err)
+		}
+	}
+	path := filepath.Join(stateDir, HistoryDir, historyFile)
+
+	// Pruning waits until the history grows a quarter past the limit
+	if err := pruneHistory(path, 5); err != nil {
+		t.Fatalf("pruneHistory() error = %v", err)
+	}
+	if records, _ := ReadHistory(stateDir); len(records) != 6 {
+		t.Errorf("got %d records, want all 6 kept", len(records))
+	}
+	if err := pruneHistory(path, 4); err != nil {
+		t.Fatalf("pruneHistory() error = %v", err)
+	}
+	records, err := ReadHistory(stateDir)
+	if err != nil || len(records) != 4 || records[0].Commit != "c3" || records[3].Commit != "c6" {
+		t.Errorf("ReadHistory() = %+v, %v, want the last 4 records", records, err)
+	}
+}
+
+func TestPercentile(t *testing.T) {
+	durations := []time.Duration{5, 1, 4, 2, 3}
+	for p, want := range map[int]time.Duration{0: 1, 50: 3, 80: 4, 95: 5, 100: 5} {
+		if got := percentile(durations, p); got != want {
+			t.Errorf("percentile(%d) = %d, want %d", p, got, want)
+		}
+	}
+	if percentile(nil, 50) != 0 {
+		t.Error("percentile of no durations should be 0")
+	}
+}
+
+func TestFindFlakySteps(t *testing.T) {
+	dirty := historyRecord("ci", "c1", "lint=error:1")
+	dirty.Dirty = true
+	records := []HistoryRecord{
+		historyRecord("ci", "c1", "test=ok:1", "lint=ok:1", "e2e=error:1"),
+		historyRecord("ci", "c1", "test=error:1", "lint=ok:1", "e2e=error:1"),
+		dirty,
+		historyRecord("ci", "c2", "test=error:1", "lint=ok:1"),
+		historyRecord("ci", "c1", "test=ok:1", "lint=warn:1", "e2e=skipped:0"),
+		historyRecord("ci", "c2", "test=ok:1", "lint=ok:1"),
+		historyRecord("ci", "", "lint=error:1"),
+	}
+
+	flaky := FindFlakySteps(records)
+	want := []FlakyStep{
+		{Stage: "ci", Step: "test", Commit: "c1", Passes: 2, Failures: 1, Flips: 2},
+		{Stage: "ci", Step: "test", Commit: "c2", Passes: 1, Failures: 1, Flips: 1},
+	}
+	if !reflect.DeepEqual(flaky, want) {
+		t.Errorf("FindFlakySteps() = %+v, want %+v", flaky, want)
+	}
+}
+
+func TestSimpleRunner_History(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("history tests use a POSIX shell")
+	}
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not available")
+	}
+	dir := t.TempDir()
+	for _, args := range [][]string{
+		{"init", "-q"},
+		{"-c", "user.name=test", "-c", "user.email=test@example.com", "commit", "-q", "--allow-empty", "-m", "initial"},
+	} {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = dir
+		if output, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("git %v: %v\n%s", args, err, output)
+		}
+	}
+	head := CurrentGitCommit(context.Background(), dir)
+	if len(head.Hash) != 40 || head.Dirty {
+		t.Fatalf("CurrentGitCommit() = %+v", head)
+	}
+
+	config, err := LoadConfigFromBytes([]byte(`project:
+  name: test
+actions:
+  - name: build
+    run: "true"
+  - name: test
+    run: exit 7
+stages:
+  ci:
+    steps:
+      - action: build
+      - action: test
+        require: [build]
+`))
+	if err != nil {
+		t.Fatalf("LoadConfigFromBytes() error = %v", err)
+	}
+	opts := DefaultSimpleRunOptions()
+	opts.WorkingDir = dir
+	opts.Output = io.Discard
+	opts.ErrorOutput = io.Discard
+	opts.RunLogs = true
+	opts.History = true
+	if err := NewSimpleRunner(config, opts).RunStage(context.Background(), "ci"); err == nil {
+		t.Fatal("RunStage() should fail")
+	}
+
+	records, err := ReadHistory(filepath.Join(dir, StateDir))
+	if err != nil || len(records) != 1 {
+		t.Fatalf("ReadHistory() = %+v, %v", records, err)
+	}
+	record := records[0]
+	run, _ := FindRun(filepath.Join(dir, StateDir), "latest")
+	if record.Stage != "ci" || record.Success || record.Commit != head.Hash || record.RunID != run.ID {
+		t.Errorf("record = %+v, want commit %s and run %s", record, head.Hash, run.ID)
+	}
+	if len(record.Steps) != 2 || record.Steps[0].Status != "ok" || record.Steps[1].Status != "error" || record.Steps[1].ExitCode != 7 {
+		t.Errorf("steps = %+v", record.Steps)
+	}
+
+	// Outside a repository no commit is recorded
+	if commit := CurrentGitCommit(context.Background(), t.TempDir()); commit != (GitCommit{}) {
+		t.Errorf("CurrentGitCommit() outside a repository = %+v", commit)
+	}
+}
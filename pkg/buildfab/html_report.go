@@ -0,0 +1,305 @@
+package buildfab
+
+import (
+	_ "embed"
+	"fmt"
+	"html/template"
+	"io"
+	"math"
+	"time"
+)
+
+//go:embed templates/report.html
+var htmlReportTemplate string
+
+// Layout of the HTML report charts, in SVG units
+const (
+	timelineWidth   = 1000
+	timelineLane    = 28
+	timelineAxis    = 24
+	graphNodeWidth  = 170
+	graphNodeHeight = 34
+	graphColumn     = 230
+	graphRow        = 52
+)
+
+// htmlReport is the data of the HTML report template
+type htmlReport struct {
+	Generated string
+	Stages    []htmlStage
+}
+
+type htmlStage struct {
+	Name     string
+	Success  bool
+	Duration string
+	Counts   map[string]int
+	Steps    []htmlStep
+	Timeline htmlTimeline
+	Graph    htmlGraph
+}
+
+type htmlStep struct {
+	Name     string
+	Status   string
+	Duration string
+	Start    string // Offset from the start of the stage
+	End      string
+	Requires []string
+	Message  string
+	Output   string
+}
+
+type htmlTimeline struct {
+	Height int
+	Ticks  []htmlTick
+	Bars   []htmlBar
+}
+
+type htmlTick struct {
+	X     float64
+	Label string
+}
+
+type htmlBar struct {
+	Name   string
+	Status string
+	X, Y   float64
+	Width  float64
+	Title  string
+}
+
+type htmlGraph struct {
+	Width, Height int
+	Nodes         []htmlNode
+	Edges         []htmlEdge
+}
+
+type htmlNode struct {
+	Name   string
+	Status string
+	X, Y   int
+}
+
+type htmlEdge struct {
+	Path string
+}
+
+// WriteHTMLReport writes stage results as a self-contained HTML page with a
+// timeline of the steps across parallel lanes, the dependency graph, status
+// colours and the collapsible output of each step
+func WriteHTMLReport(w io.Writer, stages []StageResult) error {
+	tmpl, err := template.New("report").Parse(htmlReportTemplate)
+	if err != nil {
+		return err
+	}
+	report := htmlReport{Generated: time.Now().Format(time.RFC3339)}
+	for _, stage := range stages {
+		report.Stages = append(report.Stages, newHTMLStage(stage))
+	}
+	return tmpl.Execute(w, report)
+}
+
+// newHTMLStage lays out the timeline and graph of a stage
+func newHTMLStage(stage StageResult) htmlStage {
+	origin, total := timelineBounds(stage)
+	result := htmlStage{
+		Name:     stage.StageName,
+		Success:  stage.Success,
+		Duration: formatReportDuration(stage.Duration),
+		Counts:   map[string]int{},
+	}
+	for _, step := range stage.Steps {
+		result.Counts[step.Status.String()]++
+		s := htmlStep{
+			Name:     step.StepName,
+			Status:   step.Status.String(),
+			Duration: formatReportDuration(step.Duration),
+			Requires: step.Requires,
+			Output:   step.Output,
+		}
+		if step.Status != StepStatusOK {
+			s.Message = step.failureText()
+		}
+		if !step.Start.IsZero() {
+			s.Start = "+" + formatReportDuration(step.Start.Sub(origin))
+			s.End = "+" + formatReportDuration(step.End.Sub(origin))
+		}
+		result.Steps = append(result.Steps, s)
+	}
+	result.Timeline = layoutTimeline(stage.Steps, origin, total)
+	result.Graph = layoutGraph(stage.Steps)
+	return result
+}
+
+// timelineBounds returns the origin and length of the stage timeline
+func timelineBounds(stage StageResult) (time.Time, time.Duration) {
+	origin := stage.Start
+	var end time.Time
+	for _, step := range stage.Steps {
+		if step.Start.IsZero() {
+			continue
+		}
+		if origin.IsZero() || step.Start.Before(origin) {
+			origin = step.Start
+		}
+		if step.End.After(end) {
+			end = step.End
+		}
+	}
+	total := end.Sub(origin)
+	if stage.Duration > total {
+		total = stage.Duration
+	}
+	if total <= 0 {
+		total = time.Millisecond
+	}
+	return origin, total
+}
+
+// layoutTimeline places the steps that ran on lanes, so the lanes show the
+// parallelism of the run
+func layoutTimeline(steps []StepResult, origin time.Time, total time.Duration) htmlTimeline {
+	var timeline htmlTimeline
+	scale := func(t time.Time) float64 {
+		return math.Round(float64(t.Sub(origin))/float64(total)*timelineWidth*10) / 10
+	}
+	started := sortedByStart(steps)
+	lanes, count := assignLanes(started)
+	for i, step := range started {
+		lane := lanes[i]
+		width := math.Round((scale(step.End)-scale(step.Start))*10) / 10
+		if width < 2 {
+			width = 2
+		}
+		timeline.Bars = append(timeline.Bars, htmlBar{
+			Name:   step.StepName,
+			Status: step.Status.String(),
+			X:      scale(step.Start),
+			Y:      float64(timelineAxis + lane*timelineLane),
+			Width:  width,
+			Title: fmt.Sprintf("%s: %s, +%s to +%s (%s)", step.StepName, step.Status,
+				formatReportDuration(step.Start.Sub(origin)), formatReportDuration(step.End.Sub(origin)), formatReportDuration(step.Duration)),
+		})
+	}
+	timeline.Height = timelineAxis + count*timelineLane + 4
+	for i := 0; i <= 4; i++ {
+		timeline.Ticks = append(timeline.Ticks, htmlTick{
+			X:     float64(i) * timelineWidth / 4,
+			Label: formatReportDuration(total * time.Duration(i) / 4),
+		})
+	}
+	return timeline
+}
+
+// assignLanes places steps sorted by start time on lanes: each step takes the
+// first lane free at its start. It returns the lane of each step and the
+// number of lanes.
+func assignLanes(started []StepResult) ([]int, int) {
+	lanes := make([]int, len(started))
+	var laneEnds []time.Time
+	for i, step := range started {
+		lane := -1
+		for j, end := range laneEnds {
+			if !end.After(step.Start) {
+				lane = j
+				break
+			}
+		}
+		if lane < 0 {
+			lane = len(laneEnds)
+			laneEnds = append(laneEnds, time.Time{})
+		}
+		laneEnds[lane] = step.End
+		lanes[i] = lane
+	}
+	return lanes, len(laneEnds)
+}
+
+// sortedByStart returns the steps that ran, by start time
+func sortedByStart(steps []StepResult) []StepResult {
+	var started []StepResult
+	for _, step := range steps {
+		if !step.Start.IsZero() {
+			started = append(started, step)
+		}
+	}
+	// Insertion sort keeps declaration order for equal start times
+	for i := 1; i < len(started); i++ {
+		for j := i; j > 0 && started[j].Start.Before(started[j-1].Start); j-- {
+			started[j], started[j-1] = started[j-1], started[j]
+		}
+	}
+	return started
+}
+
+// layoutGraph places the steps in columns by dependency depth, in
+// declaration order within a column
+func layoutGraph(steps []StepResult) htmlGraph {
+	index := make(map[string]int, len(steps))
+	for i, step := range steps {
+		index[step.StepName] = i
+	}
+	depth := make([]int, len(steps))
+	var visit func(i int, seen map[int]bool) int
+	visit = func(i int, seen map[int]bool) int {
+		if seen[i] {
+			return depth[i]
+		}
+		seen[i] = true
+		for _, dep := range steps[i].Requires {
+			if j, ok := index[dep]; ok && visit(j, seen)+1 > depth[i] {
+				depth[i] = depth[j] + 1
+			}
+		}
+		return depth[i]
+	}
+	seen := map[int]bool{}
+	for i := range steps {
+		visit(i, seen)
+	}
+
+	var graph htmlGraph
+	rows := map[int]int{}
+	positions := make([][2]int, len(steps))
+	for i, step := range steps {
+		x := 10 + depth[i]*graphColumn
+		y := 10 + rows[depth[i]]*graphRow
+		rows[depth[i]]++
+		positions[i] = [2]int{x, y}
+		graph.Nodes = append(graph.Nodes, htmlNode{Name: step.StepName, Status: step.Status.String(), X: x, Y: y})
+		if x+graphNodeWidth+10 > graph.Width {
+			graph.Width = x + graphNodeWidth + 10
+		}
+		if y+graphNodeHeight+10 > graph.Height {
+			graph.Height = y + graphNodeHeight + 10
+		}
+	}
+	for i, step := range steps {
+		for _, dep := range step.Requires {
+			j, ok := index[dep]
+			if !ok {
+				continue
+			}
+			x1, y1 := positions[j][0]+graphNodeWidth, positions[j][1]+graphNodeHeight/2
+			x2, y2 := positions[i][0], positions[i][1]+graphNodeHeight/2
+			mid := (x1 + x2) / 2
+			graph.Edges = append(graph.Edges, htmlEdge{
+				Path: fmt.Sprintf("M%d %d C%d %d, %d %d, %d %d", x1, y1, mid, y1, mid, y2, x2-6, y2),
+			})
+		}
+	}
+	return graph
+}
+
+// formatReportDuration rounds a duration for display
+func formatReportDuration(d time.Duration) string {
+	switch {
+	case d >= time.Minute:
+		return d.Round(time.Second).String()
+	case d >= time.Second:
+		return d.Round(10 * time.Millisecond).String()
+	default:
+		return d.Round(time.Millisecond).String()
+	}
+}
@@ -0,0 +1,134 @@
+package buildfab
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLayoutTimeline_Lanes(t *testing.T) {
+	origin := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	at := func(start, end int) (time.Time, time.Time) {
+		return origin.Add(time.Duration(start) * time.Second), origin.Add(time.Duration(end) * time.Second)
+	}
+	step := func(name string, start, end int) StepResult {
+		s, e := at(start, end)
+		return StepResult{StepName: name, Status: StepStatusOK, Start: s, End: e, Duration: e.Sub(s)}
+	}
+	steps := []StepResult{
+		step("lint", 0, 4),
+		step("build", 0, 2),
+		step("test", 2, 4), // Reuses the lane of build
+		step("package", 4, 8),
+		{StepName: "publish", Status: StepStatusSkipped},
+	}
+	timeline := layoutTimeline(steps, origin, 8*time.Second)
+	if len(timeline.Bars) != 4 {
+		t.Fatalf("bars = %+v, skipped steps should not be on the timeline", timeline.Bars)
+	}
+	lanes := map[string]float64{}
+	for _, bar := range timeline.Bars {
+		lanes[bar.Name] = bar.Y
+	}
+	if lanes["lint"] == lanes["build"] || lanes["build"] != lanes["test"] || lanes["package"] != lanes["lint"] {
+		t.Errorf("lanes = %v", lanes)
+	}
+	if timeline.Height != timelineAxis+2*timelineLane+4 {
+		t.Errorf("height = %d, want two lanes", timeline.Height)
+	}
+	if bar := timeline.Bars[3]; bar.Name != "package" || bar.X != 500 || bar.Width != 500 {
+		t.Errorf("package bar = %+v", bar)
+	}
+}
+
+func TestLayoutGraph_Depth(t *testing.T) {
+	graph := layoutGraph([]StepResult{
+		{StepName: "deploy", Requires: []string{"test", "build"}},
+		{StepName: "build"},
+		{StepName: "test", Requires: []string{"build"}},
+		{StepName: "lint"},
+	})
+	columns := map[string]int{}
+	for _, node := range graph.Nodes {
+		columns[node.Name] = (node.X - 10) / graphColumn
+	}
+	if columns["build"] != 0 || columns["lint"] != 0 || columns["test"] != 1 || columns["deploy"] != 2 {
+		t.Errorf("columns = %v", columns)
+	}
+	if len(graph.Edges) != 3 {
+		t.Errorf("edges = %d, want 3", len(graph.Edges))
+	}
+}
+
+func TestWriteHTMLReport(t *testing.T) {
+	stage := testStageResult()
+	start := time.Now()
+	stage.Start = start
+	stage.Steps[0].Start, stage.Steps[0].End = start, start.Add(1500*time.Millisecond)
+	stage.Steps[0].Output = "<script>alert(1)</script>"
+	stage.Steps[2].Start, stage.Steps[2].End = start.Add(time.Second), start.Add(3*time.Second)
+	stage.Steps[3].Requires = []string{"test"}
+
+	var buf bytes.Buffer
+	if err := WriteHTMLReport(&buf, []StageResult{stage}); err != nil {
+		t.Fatalf("WriteHTMLReport() error = %v", err)
+	}
+	report := buf.String()
+	for _, want := range []string{
+		"Stage release in 3s",
+		`<rect class="ok" x="0" y="24" width="500"`,
+		`<rect class="error"`,
+		`class="edge"`,
+		"&lt;script&gt;alert(1)&lt;/script&gt;",
+		"<details open><summary>Output</summary>",
+	} {
+		if !strings.Contains(report, want) {
+			t.Errorf("report missing %q", want)
+		}
+	}
+	if strings.Contains(report, "<script>") || strings.Contains(report, "<link") || strings.Contains(report, " src=") {
+		t.Error("report should be self-contained and escape output")
+	}
+}
+
+func TestRunner_ResultsRecordStartTimes(t *testing.T) {
+	config, err := LoadConfigFromBytes([]byte(`project:
+  name: test
+actions:
+  - name: first
+    run: sleep 0.1
+  - name: second
+    run: "true"
+stages:
+  test:
+    steps:
+      - action: first
+      - action: second
+        require: [first]
+`))
+	if err != nil {
+		t.Fatalf("LoadConfigFromBytes() error = %v", err)
+	}
+	opts := DefaultRunOptions()
+	opts.WorkingDir = t.TempDir()
+	opts.StepCallback = &MockStepCallback{}
+	runner := NewRunner(config, opts)
+	start := time.Now()
+	if err := runner.RunStage(context.Background(), "test"); err != nil {
+		t.Fatalf("RunStage() error = %v", err)
+	}
+	stage, _ := config.GetStage("test")
+	result := NewStageResult(&stage, "test", runner.Results(), start, time.Since(start), nil)
+	first, second := result.Steps[0], result.Steps[1]
+	if first.Start.Before(start) || first.End.Sub(first.Start) != first.Duration {
+		t.Errorf("first = %v to %v (%s)", first.Start, first.End, first.Duration)
+	}
+	if second.Start.Before(first.End) {
+		t.Errorf("second started at %v before first ended at %v", second.Start, first.End)
+	}
+	if len(second.Requires) != 1 || second.Requires[0] != "first" {
+		t.Errorf("second requires %v", second.Requires)
+	}
+}
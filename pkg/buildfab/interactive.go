@@ -0,0 +1,179 @@
+package buildfab
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+)
+
+// runStepModes runs steps with confirm:, background: or interactive: set. It
+// reports false when the action should run normally.
+func (r *Runner) runStepModes(ctx context.Context, action Action, node *DAGNode) (Result, bool, error) {
+	if err := r.confirmStep(ctx, node); err != nil {
+		return Result{Status: StatusError, Message: err.Error()}, true, err
+	}
+	if node.Step.Background {
+		result, err := r.runServiceForDAG(ctx, action, node)
+		return result, true, err
+	}
+	if node.Step.Interactive {
+		result, err := r.runInteractiveForDAG(ctx, action, node)
+		return result, true, err
+	}
+	return Result{}, false, nil
+}
+
+// interactiveRunningLocked reports whether an interactive step is executing
+func interactiveRunningLocked(dag map[string]*DAGNode, completed map[string]bool, executing map[string]bool) bool {
+	for nodeName, node := range dag {
+		if node.Step.Interactive && executing[nodeName] && !completed[nodeName] {
+			return true
+		}
+	}
+	return false
+}
+
+// runInteractiveForDAG runs a step with exclusive access to the terminal. The
+// command gets a pseudo-terminal where the platform supports it, while the
+// output of other steps is held back until it exits.
+func (r *Runner) runInteractiveForDAG(ctx context.Context, action Action, node *DAGNode) (Result, error) {
+	if action.Run == "" {
+		err := fmt.Errorf("interactive step %s requires a run command", action.Name)
+		return Result{Status: StatusError, Message: err.Error()}, err
+	}
+	input := r.opts.Stdin
+	if input == nil {
+		if !isInteractive() {
+			err := fmt.Errorf("interactive step %s requires a terminal", action.Name)
+			return Result{Status: StatusError, Message: err.Error()}, err
+		}
+		input = os.Stdin
+	}
+
+	cmd, cleanup, err := r.newActionCommand(ctx, action, node.scope)
+	if err != nil {
+		return Result{Status: StatusError, Message: err.Error()}, err
+	}
+	defer cleanup()
+	cmd.Env = terminalEnv(cmd.Env)
+
+	// One interactive step or prompt at a time; other steps keep running and
+	// their output is shown once the step exits
+	r.terminalWaiting.Add(1)
+	r.terminalMu.Lock()
+	r.terminalWaiting.Add(-1)
+	defer r.terminalMu.Unlock()
+	r.gate.pause()
+	defer r.gate.resume()
+
+	// The step writes past the gate, it holds back the output of other steps
+	var output io.Writer = os.Stdout
+	if r.opts.Output != nil {
+		output = r.opts.Output
+	}
+	output = NewMaskingWriter(output, r.masker)
+	fmt.Fprintf(output, "\n⌨️  %s (interactive)\n", action.Name)
+	err = runOnTerminal(cmd, inputPumpFor(input), input, output)
+	if err != nil {
+		if ctx.Err() != nil {
+			return Result{Status: StatusError, Message: ctx.Err().Error()}, ctx.Err()
+		}
+		var exitErr *exec.ExitError
+		if !errors.As(err, &exitErr) {
+			err = fmt.Errorf("failed to run interactive step: %w", err)
+		}
+		return Result{Status: StatusError, Message: r.reproMessage(action, node.scope)}, err
+	}
+	return Result{Status: StatusOK, Message: "interactive step completed"}, nil
+}
+
+// terminalEnv adds the host TERM to a process environment without one, so
+// programs on the terminal know its capabilities
+func terminalEnv(env []string) []string {
+	term := os.Getenv("TERM")
+	if term == "" || env == nil {
+		return env
+	}
+	for _, kv := range env {
+		if strings.HasPrefix(kv, "TERM=") {
+			return env
+		}
+	}
+	return append(env, "TERM="+term)
+}
+
+// inputPump is the only reader of an input such as stdin. Data goes to the
+// attached sink, an interactive step or a TerminalPrompter, so a reader left
+// behind by a finished step or prompt does not steal keystrokes from the next
+// one. Input without a sink is dropped.
+type inputPump struct {
+	src     io.Reader
+	once    sync.Once
+	mu      sync.Mutex
+	sink    io.Writer
+	started bool          // The pump reads src, nothing else may
+	done    chan struct{} // Closed when the input is exhausted
+}
+
+var (
+	inputPumpsMu sync.Mutex
+	inputPumps   = map[io.Reader]*inputPump{}
+)
+
+// inputPumpFor returns the pump of an input, shared by all runners
+func inputPumpFor(src io.Reader) *inputPump {
+	inputPumpsMu.Lock()
+	defer inputPumpsMu.Unlock()
+	p, ok := inputPumps[src]
+	if !ok {
+		p = &inputPump{src: src, done: make(chan struct{})}
+		inputPumps[src] = p
+	}
+	return p
+}
+
+// attach sends input to w until the returned function is called
+func (p *inputPump) attach(w io.Writer) (detach func()) {
+	p.mu.Lock()
+	p.sink = w
+	p.started = true
+	p.mu.Unlock()
+	p.once.Do(func() { go p.run() })
+	return func() {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		if p.sink == w {
+			p.sink = nil
+		}
+	}
+}
+
+// running reports whether the pump has started reading its input
+func (p *inputPump) running() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.started
+}
+
+func (p *inputPump) run() {
+	buf := make([]byte, 4096)
+	for {
+		n, err := p.src.Read(buf)
+		if n > 0 {
+			p.mu.Lock()
+			if p.sink != nil {
+				p.sink.Write(buf[:n])
+			}
+			p.mu.Unlock()
+		}
+		if err != nil {
+			close(p.done)
+			return
+		}
+	}
+}
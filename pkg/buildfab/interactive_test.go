@@ -0,0 +1,270 @@
+package buildfab
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// lockedBuffer is a bytes.Buffer safe for concurrent writes
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// runInteractiveStage runs the test stage of content in a temporary directory
+func runInteractiveStage(t *testing.T, content string, stdin string) (string, string, error) {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		t.Skip("interactive tests use a POSIX shell")
+	}
+	config, err := LoadConfigFromBytes([]byte(content))
+	if err != nil {
+		t.Fatalf("LoadConfigFromBytes() error = %v", err)
+	}
+	if err := config.Validate(); err != nil {
+		t.Fatalf("Validate() error = %v", err)
+	}
+	dir := t.TempDir()
+	output := &lockedBuffer{}
+	opts := DefaultRunOptions()
+	opts.WorkingDir = dir
+	opts.Output = output
+	opts.ErrorOutput = output
+	if stdin != "" {
+		opts.Stdin = strings.NewReader(stdin)
+	}
+	err = NewRunner(config, opts).RunStage(context.Background(), "test")
+	return dir, output.String(), err
+}
+
+func TestInteractiveStep_Terminal(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("pseudo-terminals are only used on Linux")
+	}
+	if _, err := os.Stat("/dev/ptmx"); err != nil {
+		t.Skip("no pseudo-terminal support")
+	}
+	_, output, err := runInteractiveStage(t, `project:
+  name: test
+actions:
+  - name: login
+    run: |
+      test -t 0 && test -t 1 || exit 1
+      read name
+      echo "hello $name"
+stages:
+  test:
+    steps:
+      - action: login
+        interactive: true
+`, "world\n")
+	if err != nil {
+		t.Fatalf("RunStage() error = %v, output %q", err, output)
+	}
+	if !strings.Contains(output, "hello world") {
+		t.Errorf("output = %q, want the answer read from the terminal", output)
+	}
+}
+
+func TestInteractiveStep_RequiresTerminal(t *testing.T) {
+	t.Setenv("CI", "true")
+	dir, _, err := runInteractiveStage(t, `project:
+  name: test
+actions:
+  - name: login
+    run: touch login.done
+stages:
+  test:
+    steps:
+      - action: login
+        interactive: true
+`, "")
+	if err == nil || !strings.Contains(err.Error(), "requires a terminal") {
+		t.Fatalf("RunStage() error = %v, want a terminal error", err)
+	}
+	if exists(dir, "login.done") {
+		t.Error("interactive step should not run without a terminal")
+	}
+}
+
+func TestInteractiveStep_OneAtATime(t *testing.T) {
+	// Both steps fail if they hold the lock directory at the same time
+	dir, output, err := runInteractiveStage(t, `project:
+  name: test
+actions:
+  - name: first
+    run: mkdir lock && sleep 0.3 && rmdir lock && touch first.done
+  - name: second
+    run: mkdir lock && sleep 0.3 && rmdir lock && touch second.done
+  - name: build
+    run: touch build.done
+stages:
+  test:
+    steps:
+      - action: first
+        interactive: true
+      - action: second
+        interactive: true
+      - action: build
+`, "\n")
+	if err != nil {
+		t.Fatalf("RunStage() error = %v, output %q", err, output)
+	}
+	for _, name := range []string{"first.done", "second.done", "build.done"} {
+		if !exists(dir, name) {
+			t.Errorf("%s missing", name)
+		}
+	}
+}
+
+func TestGetReadyStepsLocked_OneInteractive(t *testing.T) {
+	dag := map[string]*DAGNode{
+		"first":  {Step: Step{Action: "first", Interactive: true}},
+		"second": {Step: Step{Action: "second", Interactive: true}},
+		"build":  {Step: Step{Action: "build"}},
+	}
+	r := &Runner{opts: &RunOptions{MaxParallel: 3}}
+	completed, failed, executing := map[string]bool{}, map[string]bool{}, map[string]bool{}
+
+	ready := r.getReadyStepsLocked(dag, completed, failed, executing)
+	interactive := 0
+	for _, name := range ready {
+		if dag[name].Step.Interactive {
+			interactive++
+			executing[name] = true
+		}
+	}
+	if len(ready) != 2 || interactive != 1 {
+		t.Fatalf("ready = %v, want build and one interactive step", ready)
+	}
+
+	executing["build"] = true
+	if ready := r.getReadyStepsLocked(dag, completed, failed, executing); len(ready) != 0 {
+		t.Errorf("ready = %v while an interactive step executes", ready)
+	}
+	for name := range executing {
+		completed[name] = true
+	}
+	if ready := r.getReadyStepsLocked(dag, completed, failed, executing); len(ready) != 1 {
+		t.Errorf("ready = %v, want the second interactive step", ready)
+	}
+}
+
+func TestValidate_InteractiveSteps(t *testing.T) {
+	tests := []struct {
+		name   string
+		action string
+		step   string
+		want   string
+	}{
+		{"background", "login", "interactive: true\n        background: true", "both background and interactive"},
+		{"built-in action", "check", "interactive: true", "interactive step requires a run action"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config, err := LoadConfigFromBytes([]byte(`project:
+  name: test
+actions:
+  - name: login
+    run: gh auth login
+  - name: check
+    uses: git@untracked
+stages:
+  test:
+    steps:
+      - action: ` + tt.action + `
+        ` + tt.step + `
+`))
+			if err != nil {
+				t.Fatalf("LoadConfigFromBytes() error = %v", err)
+			}
+			if err := config.Validate(); err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("Validate() error = %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestInteractiveStep_ThenConfirm(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("interactive tests use a POSIX shell")
+	}
+	config, err := LoadConfigFromBytes([]byte(`project:
+  name: test
+actions:
+  - name: login
+    run: read name && echo "hello $name"
+  - name: deploy
+    run: touch deploy.done
+stages:
+  test:
+    steps:
+      - action: login
+        interactive: true
+      - action: deploy
+        require: [login]
+        confirm: "Deploy?"
+`))
+	if err != nil {
+		t.Fatalf("LoadConfigFromBytes() error = %v", err)
+	}
+
+	// The answer is typed once the question is shown, after the interactive
+	// step started reading stdin
+	stdin, typing := io.Pipe()
+	defer typing.Close()
+	asked := make(chan struct{})
+	var once sync.Once
+	promptOutput := writerFunc(func(p []byte) (int, error) {
+		once.Do(func() { close(asked) })
+		return len(p), nil
+	})
+	go func() {
+		io.WriteString(typing, "world\n")
+		<-asked
+		io.WriteString(typing, "y\n")
+	}()
+
+	dir := t.TempDir()
+	output := &lockedBuffer{}
+	opts := DefaultRunOptions()
+	opts.WorkingDir = dir
+	opts.Output = output
+	opts.ErrorOutput = output
+	opts.Stdin = stdin
+	opts.Prompter = &TerminalPrompter{Input: stdin, Output: promptOutput}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := NewRunner(config, opts).RunStage(ctx, "test"); err != nil {
+		t.Fatalf("RunStage() error = %v, output %q", err, output.String())
+	}
+	if !strings.Contains(output.String(), "hello world") || !exists(dir, "deploy.done") {
+		t.Errorf("both steps should get their input, output %q", output.String())
+	}
+}
+
+// writerFunc adapts a function to io.Writer
+type writerFunc func(p []byte) (int, error)
+
+func (f writerFunc) Write(p []byte) (int, error) {
+	return f(p)
+}
@@ -0,0 +1,83 @@
+package buildfab
+
+import (
+	"encoding/json"
+	"io"
+	"time"
+)
+
+// jsonReport is the document written by WriteJSONReport
+type jsonReport struct {
+	Stages []jsonStage `json:"stages"`
+}
+
+type jsonStage struct {
+	Name     string     `json:"name"`
+	Success  bool       `json:"success"`
+	Start    string     `json:"start,omitempty"`
+	Duration float64    `json:"duration"` // Seconds
+	Error    string     `json:"error,omitempty"`
+	Steps    []jsonStep `json:"steps"`
+}
+
+type jsonStep struct {
+	Name        string       `json:"name"`
+	Status      string       `json:"status"`
+	Start       string       `json:"start,omitempty"`
+	Duration    float64      `json:"duration"` // Seconds
+	Requires    []string     `json:"requires,omitempty"`
+	Variant     string       `json:"variant,omitempty"`
+	ExitCode    int          `json:"exit_code,omitempty"`
+	Message     string       `json:"message,omitempty"`
+	Output      string       `json:"output,omitempty"`
+	Diagnostics []Diagnostic `json:"diagnostics,omitempty"`
+}
+
+// jsonTime formats a time for JSON reports, empty for the zero time
+func jsonTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Format(time.RFC3339Nano)
+}
+
+// WriteJSONReport writes stage results as JSON for tools: each stage with
+// its steps in declaration order, their captured output and the diagnostics
+// extracted by problem matchers
+func WriteJSONReport(w io.Writer, stages []StageResult) error {
+	report := jsonReport{Stages: []jsonStage{}}
+	for _, stage := range stages {
+		s := jsonStage{
+			Name:     stage.StageName,
+			Success:  stage.Success,
+			Start:    jsonTime(stage.Start),
+			Duration: stage.Duration.Seconds(),
+			Steps:    []jsonStep{},
+		}
+		if stage.Error != nil {
+			s.Error = stage.Error.Error()
+		}
+		for _, step := range stage.Steps {
+			message := ""
+			if step.Status != StepStatusOK {
+				message = step.failureText()
+			}
+			s.Steps = append(s.Steps, jsonStep{
+				Name:        step.StepName,
+				Status:      step.Status.String(),
+				Start:       jsonTime(step.Start),
+				Duration:    step.Duration.Seconds(),
+				Requires:    step.Requires,
+				Variant:     step.Variant,
+				ExitCode:    step.ExitCode,
+				Message:     message,
+				Output:      step.Output,
+				Diagnostics: step.Diagnostics,
+			})
+		}
+		report.Stages = append(report.Stages, s)
+	}
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(report)
+}
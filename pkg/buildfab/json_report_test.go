@@ -0,0 +1,38 @@
+package buildfab
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+)
+
+func TestWriteJSONReport(t *testing.T) {
+	stage := testStageResult()
+	stage.Steps[2].ExitCode = 1
+	stage.Steps[2].Diagnostics = []Diagnostic{{File: "x_test.go", Line: 12, Severity: DiagnosticError, Message: "bad", Matcher: "go"}}
+	var buf bytes.Buffer
+	if err := WriteJSONReport(&buf, []StageResult{stage}); err != nil {
+		t.Fatalf("WriteJSONReport() error = %v", err)
+	}
+
+	var report jsonReport
+	if err := json.Unmarshal(buf.Bytes(), &report); err != nil {
+		t.Fatalf("invalid JSON: %v\n%s", err, buf.String())
+	}
+	if len(report.Stages) != 1 || report.Stages[0].Name != "release" || report.Stages[0].Duration != 3 || len(report.Stages[0].Steps) != 4 {
+		t.Fatalf("report = %+v", report)
+	}
+	build, test := report.Stages[0].Steps[0], report.Stages[0].Steps[2]
+	if build.Status != "ok" || build.Duration != 1.5 || build.Message != "" || build.Output != "compiling\ndone\n" {
+		t.Errorf("build = %+v", build)
+	}
+	if test.Status != "error" || test.ExitCode != 1 || test.Message != "failed, to check run:\n  go test ./..." {
+		t.Errorf("test = %+v", test)
+	}
+	if len(test.Diagnostics) != 1 || test.Diagnostics[0] != stage.Steps[2].Diagnostics[0] {
+		t.Errorf("diagnostics = %+v", test.Diagnostics)
+	}
+	if !bytes.Contains(buf.Bytes(), []byte(`"file": "x_test.go"`)) {
+		t.Errorf("report should use lowercase keys:\n%s", buf.String())
+	}
+}
@@ -0,0 +1,363 @@
+package buildfab
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// Renderers of the steps of a stage run, see SimpleRunOptions.UI
+const (
+	UIOrdered  = "ordered"  // Steps in declaration order, the output of one step at a time
+	UITTY      = "tty"      // Live block of the running steps on a terminal
+	UIPrefixed = "prefixed" // Lines of all steps as they are written, prefixed with the step name
+)
+
+// liveRefreshInterval is the time between redraws of the live block
+const liveRefreshInterval = 100 * time.Millisecond
+
+// liveDefaultWidth is the width of the live block when the terminal width is unknown
+const liveDefaultWidth = 80
+
+// spinnerFrames are the frames of the spinner of running steps
+var spinnerFrames = []string{"⠋", "⠙", "⠹", "⠸", "⠼", "⠴", "⠦", "⠧", "⠇", "⠏"}
+
+// ansiEscape matches terminal escape sequences in step output
+var ansiEscape = regexp.MustCompile(`\x1b\[[0-9;?]*[ -/]*[@-~]|\x1b\][^\x07\x1b]*(\x07|\x1b\\)`)
+
+// ResolveUI returns the renderer used for ui. The live tty display needs the
+// output and error output on a terminal that can move the cursor, otherwise
+// the run falls back to ordered output. Prefixed output works on any output.
+func ResolveUI(ui string, output, errorOutput io.Writer) string {
+	switch ui {
+	case UITTY:
+		if supportsLiveDisplay(output) && supportsLiveDisplay(errorOutput) {
+			return UITTY
+		}
+		return UIOrdered
+	case UIPrefixed:
+		return UIPrefixed
+	default:
+		return UIOrdered
+	}
+}
+
+// colorsEnabled reports whether renderers may color their output, which
+// NO_COLOR and TERM=dumb turn off
+func colorsEnabled() bool {
+	return os.Getenv("NO_COLOR") == "" && os.Getenv("TERM") != "dumb"
+}
+
+// supportsLiveDisplay reports whether w is a terminal that can move the cursor
+func supportsLiveDisplay(w io.Writer) bool {
+	f, ok := w.(*os.File)
+	return ok && isTerminalFile(f) && os.Getenv("TERM") != "dumb"
+}
+
+// columnsWidth returns the width in $COLUMNS, or the default width
+func columnsWidth() int {
+	if n, err := strconv.Atoi(os.Getenv("COLUMNS")); err == nil && n > 0 {
+		return n
+	}
+	return liveDefaultWidth
+}
+
+// fileWidth returns a function reading the width of the terminal f, with
+// $COLUMNS as fallback
+func fileWidth(f *os.File) func() int {
+	return func() int {
+		if width := terminalWidth(f); width > 0 {
+			return width
+		}
+		return columnsWidth()
+	}
+}
+
+// terminalUser is implemented by step callbacks that draw on the terminal
+// and stand aside while a prompt or interactive step uses it
+type terminalUser interface {
+	suspendTerminal()
+	resumeTerminal()
+}
+
+// LiveStepCallback implements StepCallback with a live block pinned at the
+// bottom of the terminal. The block shows every running step with a spinner,
+// its elapsed time and last output line, while the results of completed
+// steps scroll above it. In verbose mode the output of a step is printed
+// with its result, so the output of parallel steps doesn't interleave.
+type LiveStepCallback struct {
+	mu        sync.Mutex
+	out       io.Writer
+	order     map[string]int // Declaration order of the steps
+	verbose   bool
+	color     bool                  // Colored output, off with NO_COLOR
+	width     func() int            // Terminal width
+	messages  *OrderedOutputManager // Formats result messages like ordered output
+	running   map[string]*liveStep
+	results   []StepResult
+	drawn     int // Lines of the live block on the terminal
+	frame     int
+	suspended bool // The terminal is used by a prompt or interactive step
+	stopped   bool
+	stop      chan struct{}
+	done      chan struct{}
+	now       func() time.Time
+}
+
+// liveStep is a running step in the live block
+type liveStep struct {
+	start  time.Time
+	last   string   // Last non-empty output line
+	output []string // Output shown with the result in verbose mode
+}
+
+// NewLiveStepCallback creates a live step callback drawing on errorOutput.
+// Start begins redrawing the spinners and Stop removes the live block.
+func NewLiveStepCallback(steps []Step, verbose bool, errorOutput io.Writer, config *Config) *LiveStepCallback {
+	order := make(map[string]int, len(steps))
+	for i, step := range steps {
+		order[step.Action] = i
+	}
+	messages := NewOrderedOutputManager(steps, verbose, false, errorOutput, config)
+	return &LiveStepCallback{
+		out:      errorOutput,
+		order:    order,
+		verbose:  verbose,
+		color:    colorsEnabled(),
+		width:    columnsWidth,
+		messages: messages,
+		running:  make(map[string]*liveStep),
+		now:      time.Now,
+	}
+}
+
+// Start starts redrawing the live block; Stop must be called when the run ends
+func (l *LiveStepCallback) Start() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.stop != nil || l.stopped {
+		return
+	}
+	l.stop, l.done = make(chan struct{}), make(chan struct{})
+	go l.refresh(l.stop, l.done)
+}
+
+// refresh redraws the live block until stop is closed
+func (l *LiveStepCallback) refresh(stop, done chan struct{}) {
+	defer close(done)
+	ticker := time.NewTicker(liveRefreshInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			l.mu.Lock()
+			l.frame++
+			l.redrawLocked()
+			l.mu.Unlock()
+		}
+	}
+}
+
+// Stop stops redrawing and removes the live block. Results of steps
+// completed afterwards, such as skipped steps, are still printed.
+func (l *LiveStepCallback) Stop() {
+	l.mu.Lock()
+	stop, done := l.stop, l.done
+	l.stop = nil
+	l.mu.Unlock()
+	if stop != nil {
+		close(stop)
+		<-done
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	io.WriteString(l.out, l.clearLocked())
+	l.stopped = true
+}
+
+// OnStepStart adds the step to the live block
+func (l *LiveStepCallback) OnStepStart(ctx context.Context, stepName string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.running[stepName] = &liveStep{start: l.now()}
+	l.redrawLocked()
+}
+
+// OnStepComplete prints the result of the step above the live block
+func (l *LiveStepCallback) OnStepComplete(ctx context.Context, stepName string, status StepStatus, message string, duration time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	step := l.running[stepName]
+	delete(l.running, stepName)
+	l.results = append(l.results, StepResult{
+		StepName: stepName,
+		Status:   status,
+		Duration: duration,
+	})
+	l.messages.stepData[stepName] = &StepOutputData{Completed: true, Status: status, Message: message}
+	message = l.messages.enhanceMessage(stepName, status, message) + formatExecutionTime(status, duration)
+
+	var b strings.Builder
+	b.WriteString(l.clearLocked())
+	if l.verbose && step != nil && len(step.output) > 0 {
+		fmt.Fprintf(&b, "  💻 %s\n", stepName)
+		for _, line := range step.output {
+			fmt.Fprintf(&b, "    %s\n", line)
+		}
+	}
+	icon, color := statusIcon(status)
+	fmt.Fprintf(&b, "  %s %s %s\n", l.paint(color, icon), stepName, message)
+	if !l.suspended && !l.stopped {
+		b.WriteString(l.blockLocked())
+	}
+	io.WriteString(l.out, b.String())
+}
+
+// OnStepOutput records the last output line of the step, and its output for
+// verbose mode. It is drawn on the next refresh.
+func (l *LiveStepCallback) OnStepOutput(ctx context.Context, stepName string, output string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	step := l.running[stepName]
+	if step == nil {
+		return
+	}
+	for _, line := range strings.Split(strings.TrimSuffix(output, "\n"), "\n") {
+		if l.verbose {
+			step.output = append(step.output, line)
+		}
+		if text := displayLine(line); text != "" {
+			step.last = text
+		}
+	}
+}
+
+// OnStepError is a no-op, errors are shown with the step result
+func (l *LiveStepCallback) OnStepError(ctx context.Context, stepName string, err error) {}
+
+// GetResults returns the collected step results
+func (l *LiveStepCallback) GetResults() []StepResult {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	results := make([]StepResult, len(l.results))
+	copy(results, l.results)
+	return results
+}
+
+// suspendTerminal removes the live block while the terminal is used by others
+func (l *LiveStepCallback) suspendTerminal() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	io.WriteString(l.out, l.clearLocked())
+	l.suspended = true
+}
+
+// resumeTerminal draws the live block again
+func (l *LiveStepCallback) resumeTerminal() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.suspended = false
+	l.redrawLocked()
+}
+
+// redrawLocked replaces the live block on the terminal in a single write
+func (l *LiveStepCallback) redrawLocked() {
+	if l.suspended || l.stopped {
+		return
+	}
+	io.WriteString(l.out, l.clearLocked()+l.blockLocked())
+}
+
+// clearLocked returns the sequence erasing the live block, which ends at the
+// start of the line below it
+func (l *LiveStepCallback) clearLocked() string {
+	if l.drawn == 0 {
+		return ""
+	}
+	drawn := l.drawn
+	l.drawn = 0
+	return fmt.Sprintf("\r\033[%dA\033[J", drawn)
+}
+
+// blockLocked returns the live block: a line per running step in declaration
+// order, cut to the terminal width so no line wraps
+func (l *LiveStepCallback) blockLocked() string {
+	names := make([]string, 0, len(l.running))
+	for name := range l.running {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		if l.order[names[i]] != l.order[names[j]] {
+			return l.order[names[i]] < l.order[names[j]]
+		}
+		return names[i] < names[j]
+	})
+
+	width := l.width()
+	if width <= 0 {
+		width = liveDefaultWidth
+	}
+	spinner := spinnerFrames[l.frame%len(spinnerFrames)]
+	var b strings.Builder
+	for _, name := range names {
+		step := l.running[name]
+		elapsed := l.now().Sub(step.start).Truncate(time.Second).String()
+		prefix := fmt.Sprintf("  %s %s %s", spinner, name, elapsed)
+		line := prefix
+		if step.last != "" {
+			line += "  " + step.last
+		}
+		line = truncateLine(line, width-1)
+		if strings.HasPrefix(line, prefix) {
+			fmt.Fprintf(&b, "  %s %s %s%s\n", l.paint(colorCyan, spinner), name, l.paint(colorGray, elapsed), line[len(prefix):])
+		} else {
+			b.WriteString(line + "\n")
+		}
+	}
+	l.drawn = len(names)
+	return b.String()
+}
+
+// paint colors s unless colors are off
+func (l *LiveStepCallback) paint(color, s string) string {
+	if !l.color {
+		return s
+	}
+	return color + s + colorReset
+}
+
+// displayLine returns an output line as shown in the live block: the text
+// after the last carriage return, which progress bars redraw, without
+// escape sequences and tabs
+func displayLine(line string) string {
+	line = strings.TrimRight(line, "\r")
+	if i := strings.LastIndex(line, "\r"); i >= 0 {
+		line = line[i+1:]
+	}
+	line = ansiEscape.ReplaceAllString(line, "")
+	return strings.TrimSpace(strings.ReplaceAll(line, "\t", " "))
+}
+
+// truncateLine cuts s to width runes, ending in an ellipsis when cut
+func truncateLine(s string, width int) string {
+	if width <= 0 {
+		return ""
+	}
+	if utf8.RuneCountInString(s) <= width {
+		return s
+	}
+	runes := []rune(s)
+	return string(runes[:width-1]) + "…"
+}
@@ -0,0 +1,262 @@
+package buildfab
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestLiveCallback returns a live callback without colors on a 40 column
+// terminal and a function advancing its clock
+func newTestLiveCallback(out io.Writer, verbose bool, steps ...string) (*LiveStepCallback, func(time.Duration)) {
+	var stageSteps []Step
+	for _, name := range steps {
+		stageSteps = append(stageSteps, Step{Action: name})
+	}
+	l := NewLiveStepCallback(stageSteps, verbose, out, nil)
+	l.color = false
+	l.width = func() int { return 40 }
+	now := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+	l.now = func() time.Time { return now }
+	return l, func(d time.Duration) { now = now.Add(d) }
+}
+
+// redraw draws the next frame of the live block
+func (l *LiveStepCallback) redraw() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.frame++
+	l.redrawLocked()
+}
+
+// wantWritten checks the output written since the last check
+func wantWritten(t *testing.T, out *bytes.Buffer, want string) {
+	t.Helper()
+	if got := out.String(); got != want {
+		t.Errorf("written = %q, want %q", got, want)
+	}
+	out.Reset()
+}
+
+func TestLiveStepCallback(t *testing.T) {
+	var out bytes.Buffer
+	l, advance := newTestLiveCallback(&out, false, "build", "test", "deploy")
+	ctx := context.Background()
+
+	l.OnStepStart(ctx, "test")
+	wantWritten(t, &out, "  ⠋ test 0s\n")
+	// Running steps are drawn in declaration order
+	l.OnStepStart(ctx, "build")
+	wantWritten(t, &out, "\r\033[1A\033[J  ⠋ build 0s\n  ⠋ test 0s\n")
+
+	l.OnStepOutput(ctx, "build", "compiling \033[32mok\033[0m\n50%\r100%\n")
+	l.OnStepOutput(ctx, "test", strings.Repeat("x", 100))
+	advance(12 * time.Second)
+	l.redraw()
+	wantWritten(t, &out, "\r\033[2A\033[J  ⠙ build 12s  100%\n  ⠙ test 12s  "+strings.Repeat("x", 24)+"…\n")
+
+	l.OnStepComplete(ctx, "build", StepStatusOK, "executed successfully", 2*time.Second)
+	wantWritten(t, &out, "\r\033[2A\033[J  ✓ build executed successfully - in '2s'\n  ⠙ test 12s  "+strings.Repeat("x", 24)+"…\n")
+	l.OnStepComplete(ctx, "test", StepStatusError, "command failed: exit status 1", time.Second)
+	wantWritten(t, &out, "\r\033[1A\033[J  ✗ test to check run:\n      test\n")
+
+	// After Stop results are printed without the live block
+	l.OnStepStart(ctx, "deploy")
+	out.Reset()
+	l.Stop()
+	wantWritten(t, &out, "\r\033[1A\033[J")
+	l.OnStepComplete(ctx, "deploy", StepStatusSkipped, "skipped (dependency failed)", 0)
+	if !strings.HasPrefix(out.String(), "  → deploy skipped (dependency failed") || strings.Contains(out.String(), "⠙") {
+		t.Errorf("written after Stop = %q", out.String())
+	}
+
+	results := l.GetResults()
+	if len(results) != 3 || results[0].StepName != "build" || results[1].Status != StepStatusError || results[2].Status != StepStatusSkipped {
+		t.Errorf("results = %+v", results)
+	}
+}
+
+func TestLiveStepCallback_VerboseOutput(t *testing.T) {
+	var out bytes.Buffer
+	l, _ := newTestLiveCallback(&out, true, "lint", "test")
+	ctx := context.Background()
+	l.OnStepStart(ctx, "lint")
+	l.OnStepStart(ctx, "test")
+	l.OnStepOutput(ctx, "lint", "lint 1")
+	l.OnStepOutput(ctx, "test", "test 1")
+	l.OnStepOutput(ctx, "lint", "lint 2")
+	out.Reset()
+
+	// The output of a step is printed together with its result
+	l.OnStepComplete(ctx, "lint", StepStatusWarn, "2 issues", time.Second)
+	wantWritten(t, &out, "\r\033[2A\033[J  💻 lint\n    lint 1\n    lint 2\n  ! lint 2 issues\n  ⠋ test 0s  test 1\n")
+}
+
+func TestLiveStepCallback_Suspend(t *testing.T) {
+	var out bytes.Buffer
+	l, _ := newTestLiveCallback(&out, false, "build", "login")
+	ctx := context.Background()
+	gate := &outputGate{terminal: l}
+	l.OnStepStart(ctx, "build")
+	out.Reset()
+
+	// The block is removed while a prompt or interactive step uses the terminal
+	gate.pause()
+	wantWritten(t, &out, "\r\033[1A\033[J")
+	l.OnStepStart(ctx, "login")
+	l.redraw()
+	wantWritten(t, &out, "")
+	gate.do(func() { l.OnStepComplete(ctx, "login", StepStatusOK, "interactive step completed", time.Second) })
+	wantWritten(t, &out, "")
+
+	gate.resume()
+	wantWritten(t, &out, "  ✓ login interactive step completed - in '1s'\n  ⠙ build 0s\n")
+}
+
+func TestLiveStepCallback_Colors(t *testing.T) {
+	t.Setenv("NO_COLOR", "1")
+	if NewLiveStepCallback(nil, false, io.Discard, nil).color {
+		t.Error("NO_COLOR should turn colors off")
+	}
+	t.Setenv("NO_COLOR", "")
+	t.Setenv("TERM", "xterm")
+	var out bytes.Buffer
+	l := NewLiveStepCallback([]Step{{Action: "build"}}, false, &out, nil)
+	if !l.color {
+		t.Fatal("colors should be on without NO_COLOR")
+	}
+	l.OnStepStart(context.Background(), "build")
+	if !strings.Contains(out.String(), colorCyan+"⠋"+colorReset+" build ") {
+		t.Errorf("written = %q, want a colored spinner", out.String())
+	}
+}
+
+func TestLiveStepCallback_Refresh(t *testing.T) {
+	var out lockedBuffer
+	l := NewLiveStepCallback([]Step{{Action: "build"}}, false, &out, nil)
+	l.OnStepStart(context.Background(), "build")
+	l.Start()
+	time.Sleep(3 * liveRefreshInterval)
+	l.Stop()
+	if !strings.Contains(out.String(), "⠙") {
+		t.Errorf("written = %q, want the spinner to turn", out.String())
+	}
+	if !strings.HasSuffix(out.String(), "\r\033[1A\033[J") {
+		t.Errorf("written = %q, want the block removed on Stop", out.String())
+	}
+}
+
+func TestDisplayLine(t *testing.T) {
+	tests := map[string]string{
+		"plain":                       "plain",
+		"  indented\t text  ":         "indented  text",
+		"\033[1;31merror\033[0m: bad": "error: bad",
+		"10%\r50%\r100%\r":            "100%",
+		"done\r":                      "done",
+		"\033]0;title\007shown":       "shown",
+	}
+	for line, want := range tests {
+		if got := displayLine(line); got != want {
+			t.Errorf("displayLine(%q) = %q, want %q", line, got, want)
+		}
+	}
+	if got := truncateLine("héllo wörld", 6); got != "héllo…" {
+		t.Errorf("truncateLine() = %q", got)
+	}
+	if got := truncateLine("short", 6); got != "short" {
+		t.Errorf("truncateLine() = %q", got)
+	}
+}
+
+func TestResolveUI(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	defer w.Close()
+	for _, tt := range []struct {
+		ui     string
+		output io.Writer
+		want   string
+	}{
+		{"", &bytes.Buffer{}, UIOrdered},
+		{UIOrdered, w, UIOrdered},
+		{UITTY, &bytes.Buffer{}, UIOrdered},
+		{UITTY, w, UIOrdered},
+		{UIPrefixed, &bytes.Buffer{}, UIPrefixed},
+		{"fancy", w, UIOrdered},
+	} {
+		if got := ResolveUI(tt.ui, tt.output, tt.output); got != tt.want {
+			t.Errorf("ResolveUI(%q, %T) = %q, want %q", tt.ui, tt.output, got, tt.want)
+		}
+	}
+}
+
+func TestRunner_StreamOutput(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("stream tests use a POSIX shell")
+	}
+	config, err := LoadConfigFromBytes([]byte(`project:
+  name: test
+actions:
+  - name: build
+    run: echo one; echo two >&2
+stages:
+  ci:
+    steps:
+      - action: build
+`))
+	if err != nil {
+		t.Fatalf("LoadConfigFromBytes() error = %v", err)
+	}
+	callback := &MockStepCallback{}
+	opts := &RunOptions{WorkingDir: t.TempDir(), StreamOutput: true, StepCallback: callback, Output: io.Discard, ErrorOutput: io.Discard}
+	if err := NewRunner(config, opts).RunStage(context.Background(), "ci"); err != nil {
+		t.Fatalf("RunStage() error = %v", err)
+	}
+	lines := map[string]bool{}
+	for _, call := range callback.OnStepOutputCalls {
+		lines[call.Output] = true
+	}
+	if len(callback.OnStepOutputCalls) != 2 || !lines["one"] || !lines["two"] {
+		t.Errorf("output calls = %+v, want each line without verbose", callback.OnStepOutputCalls)
+	}
+}
+
+func TestSimpleRunner_UIFallback(t *testing.T) {
+	config, err := LoadConfigFromBytes([]byte(`project:
+  name: test
+actions:
+  - name: build
+    run: echo building
+stages:
+  ci:
+    steps:
+      - action: build
+`))
+	if err != nil {
+		t.Fatalf("LoadConfigFromBytes() error = %v", err)
+	}
+	var out bytes.Buffer
+	opts := DefaultSimpleRunOptions()
+	opts.WorkingDir = t.TempDir()
+	opts.Output = &out
+	opts.ErrorOutput = &out
+	opts.UI = UITTY
+	runner := NewSimpleRunner(config, opts)
+	if runner.ui != UIOrdered {
+		t.Fatalf("ui = %q, want ordered output without a terminal", runner.ui)
+	}
+	if err := runner.RunStage(context.Background(), "ci"); err != nil {
+		t.Fatalf("RunStage() error = %v", err)
+	}
+	if strings.Contains(out.String(), "\033[J") || !strings.Contains(out.String(), "build") {
+		t.Errorf("output = %q, want ordered output", out.String())
+	}
+}
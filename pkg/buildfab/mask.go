@@ -0,0 +1,169 @@
+package buildfab
+
+import (
+	"context"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SecretMask replaces secret values in all output
+const SecretMask = "***"
+
+// minSecretLength is the shortest value that gets masked; shorter values would
+// garble unrelated output
+const minSecretLength = 3
+
+// Masker redacts secret values from text. It is safe for concurrent use and a
+// nil Masker masks nothing.
+type Masker struct {
+	mu       sync.RWMutex
+	values   map[string]bool
+	replacer *strings.Replacer
+}
+
+// NewMasker creates a masker for the given secret values
+func NewMasker(values ...string) *Masker {
+	m := &Masker{values: make(map[string]bool)}
+	m.Add(values...)
+	return m
+}
+
+// Add registers additional secret values. Multi-line values are also masked
+// line by line so they are redacted from streamed output.
+func (m *Masker) Add(values ...string) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	changed := false
+	add := func(v string) {
+		v = strings.TrimSpace(v)
+		if len(v) < minSecretLength || m.values[v] {
+			return
+		}
+		m.values[v] = true
+		changed = true
+	}
+	for _, value := range values {
+		add(value)
+		if strings.Contains(value, "\n") {
+			for _, line := range strings.Split(value, "\n") {
+				add(line)
+			}
+		}
+	}
+	if !changed {
+		return
+	}
+
+	// Replace longer values first so overlapping secrets are fully masked
+	sorted := make([]string, 0, len(m.values))
+	for v := range m.values {
+		sorted = append(sorted, v)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		if len(sorted[i]) != len(sorted[j]) {
+			return len(sorted[i]) > len(sorted[j])
+		}
+		return sorted[i] < sorted[j]
+	})
+	pairs := make([]string, 0, len(sorted)*2)
+	for _, v := range sorted {
+		pairs = append(pairs, v, SecretMask)
+	}
+	m.replacer = strings.NewReplacer(pairs...)
+}
+
+// Mask returns text with every secret value replaced by SecretMask
+func (m *Masker) Mask(text string) string {
+	if m == nil {
+		return text
+	}
+	m.mu.RLock()
+	replacer := m.replacer
+	m.mu.RUnlock()
+	if replacer == nil {
+		return text
+	}
+	return replacer.Replace(text)
+}
+
+// MaskError returns an error whose message has secret values masked
+func (m *Masker) MaskError(err error) error {
+	if err == nil || m == nil {
+		return err
+	}
+	masked := m.Mask(err.Error())
+	if masked == err.Error() {
+		return err
+	}
+	return &maskedError{err: err, message: masked}
+}
+
+// maskedError hides secrets in an error message while keeping the error chain
+type maskedError struct {
+	err     error
+	message string
+}
+
+func (e *maskedError) Error() string {
+	return e.message
+}
+
+func (e *maskedError) Unwrap() error {
+	return e.err
+}
+
+// maskingWriter masks secrets in everything written through it
+type maskingWriter struct {
+	w      io.Writer
+	masker *Masker
+}
+
+// NewMaskingWriter returns a writer that masks secret values before writing to w
+func NewMaskingWriter(w io.Writer, masker *Masker) io.Writer {
+	if w == nil {
+		return nil
+	}
+	return &maskingWriter{w: w, masker: masker}
+}
+
+func (w *maskingWriter) Write(p []byte) (int, error) {
+	if _, err := io.WriteString(w.w, w.masker.Mask(string(p))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// maskingStepCallback masks secrets in everything passed to a StepCallback
+type maskingStepCallback struct {
+	next   StepCallback
+	masker *Masker
+}
+
+func (c *maskingStepCallback) OnStepStart(ctx context.Context, stepName string) {
+	c.next.OnStepStart(ctx, stepName)
+}
+
+func (c *maskingStepCallback) OnStepComplete(ctx context.Context, stepName string, status StepStatus, message string, duration time.Duration) {
+	c.next.OnStepComplete(ctx, stepName, status, c.masker.Mask(message), duration)
+}
+
+func (c *maskingStepCallback) OnStepOutput(ctx context.Context, stepName string, output string) {
+	c.next.OnStepOutput(ctx, stepName, c.masker.Mask(output))
+}
+
+func (c *maskingStepCallback) OnStepError(ctx context.Context, stepName string, err error) {
+	c.next.OnStepError(ctx, stepName, c.masker.MaskError(err))
+}
+
+func (c *maskingStepCallback) OnStepDiagnostics(ctx context.Context, stepName string, diagnostics []Diagnostic) {
+	if next, ok := c.next.(StepDiagnosticsCallback); ok {
+		next.OnStepDiagnostics(ctx, stepName, diagnostics)
+	}
+}
@@ -0,0 +1,119 @@
+package buildfab
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestMasker(t *testing.T) {
+	masker := NewMasker("secret-value", "ab", "", "secret")
+	masker.Add("multi\nline-secret")
+
+	tests := []struct {
+		name     string
+		input    string
+		expected string
+	}{
+		{name: "single value", input: "token is secret-value", expected: "token is ***"},
+		{name: "longest match first", input: "secret-value and secret", expected: "*** and ***"},
+		{name: "short values ignored", input: "ab", expected: "ab"},
+		{name: "multi-line value by line", input: "line-secret", expected: "***"},
+		{name: "no secrets", input: "plain output", expected: "plain output"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := masker.Mask(tt.input); got != tt.expected {
+				t.Errorf("Mask(%q) = %q, want %q", tt.input, got, tt.expected)
+			}
+		})
+	}
+
+	var nilMasker *Masker
+	if got := nilMasker.Mask("secret-value"); got != "secret-value" {
+		t.Errorf("nil Masker changed text: %q", got)
+	}
+}
+
+func TestMaskerMaskError(t *testing.T) {
+	masker := NewMasker("hunter22")
+	base := errors.New("login failed with hunter22")
+
+	err := masker.MaskError(base)
+	if err.Error() != "login failed with ***" {
+		t.Errorf("MaskError() = %q", err.Error())
+	}
+	if !errors.Is(err, base) {
+		t.Error("MaskError() must keep the error chain")
+	}
+	if masker.MaskError(nil) != nil {
+		t.Error("MaskError(nil) must return nil")
+	}
+}
+
+func TestMaskingWriter(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewMaskingWriter(&buf, NewMasker("hunter22"))
+
+	n, err := w.Write([]byte("password: hunter22\n"))
+	if err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	if n != len("password: hunter22\n") {
+		t.Errorf("Write() = %d, want length of input", n)
+	}
+	if buf.String() != "password: ***\n" {
+		t.Errorf("output = %q", buf.String())
+	}
+}
+
+func TestRunStageMasksSecrets(t *testing.T) {
+	config, err := LoadConfigFromBytes([]byte(`
+project:
+  name: test
+secrets: [API_TOKEN]
+env:
+  API_TOKEN: tok-12345
+actions:
+  - name: leak
+    run: |
+      echo "token=$API_TOKEN"
+      echo "stderr=$API_TOKEN" >&2
+  - name: fail
+    run: echo "bad $API_TOKEN"; exit 1
+stages:
+  test:
+    steps:
+      - action: leak
+      - action: fail
+        require: [leak]
+`))
+	if err != nil {
+		t.Fatalf("LoadConfigFromBytes() error = %v", err)
+	}
+
+	var stdout, stderr bytes.Buffer
+	opts := &SimpleRunOptions{
+		Verbose:     true,
+		Variables:   map[string]string{},
+		WorkingDir:  ".",
+		Output:      &stdout,
+		ErrorOutput: &stderr,
+		MaxParallel: 2,
+	}
+	runErr := NewSimpleRunner(config, opts).RunStage(context.Background(), "test")
+	if runErr == nil {
+		t.Fatal("RunStage() expected error from failing step")
+	}
+
+	all := stdout.String() + stderr.String() + runErr.Error()
+	if strings.Contains(all, "tok-12345") {
+		t.Errorf("secret leaked into output:\n%s", all)
+	}
+	if !strings.Contains(all, "token=***") {
+		t.Errorf("expected masked output, got:\n%s", all)
+	}
+}
@@ -303,24 +303,7 @@ func (o *OrderedOutputManager) showStepResult(stepName string, status StepStatus
 	executionTime := formatExecutionTime(status, duration)
 	enhancedMessage += executionTime
 	
-	var icon, color string
-	switch status {
-	case StepStatusOK:
-		icon = "✓"
-		color = colorGreen
-	case StepStatusWarn:
-		icon = "!"
-		color = colorYellow
-	case StepStatusError:
-		icon = "✗"
-		color = colorRed
-	case StepStatusSkipped:
-		icon = "→"
-		color = colorGray
-	default:
-		icon = "?"
-		color = colorGray
-	}
+	icon, color := statusIcon(status)
 	
 	if o.verbose {
 		// In verbose mode, just print the result
@@ -331,6 +314,22 @@ func (o *OrderedOutputManager) showStepResult(stepName string, status StepStatus
 	}
 }
 
+// statusIcon returns the icon and color of a step status in step result lines
+func statusIcon(status StepStatus) (string, string) {
+	switch status {
+	case StepStatusOK:
+		return "✓", colorGreen
+	case StepStatusWarn:
+		return "!", colorYellow
+	case StepStatusError:
+		return "✗", colorRed
+	case StepStatusSkipped:
+		return "→", colorGray
+	default:
+		return "?", colorGray
+	}
+}
+
 // OrderedStepCallback implements StepCallback interface using the ordered output manager
 type OrderedStepCallback struct {
 	manager *OrderedOutputManager
@@ -519,6 +518,9 @@ func (o *OrderedOutputManager) extractCommand(stepName, message string) string {
 			// Add 6 spaces indentation
 			alignedLines = append(alignedLines, "      "+trimmedLine)
 		}
+		if cdLine := reproDirLine(message); cdLine != "" {
+			alignedLines = append([]string{"      " + cdLine}, alignedLines...)
+		}
 		return strings.Join(alignedLines, "\n")
 	}
 	
@@ -526,6 +528,21 @@ func (o *OrderedOutputManager) extractCommand(stepName, message string) string {
 	return fmt.Sprintf("      %s", stepName)
 }
 
+// reproDirLine returns the "cd <dir>" line that follows "to check run:" in a
+// failure message, or an empty string when the action ran in the current directory
+func reproDirLine(message string) string {
+	lines := strings.Split(message, "\n")
+	for i, line := range lines {
+		if strings.Contains(line, "to check run:") && i+1 < len(lines) {
+			next := strings.TrimSpace(lines[i+1])
+			if strings.HasPrefix(next, "cd ") {
+				return next
+			}
+		}
+	}
+	return ""
+}
+
 // extractFailedDependency tries to determine which dependency failed
 func (o *OrderedOutputManager) extractFailedDependency(stepName string) string {
 	// Look through results to find failed dependencies
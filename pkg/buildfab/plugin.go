@@ -0,0 +1,302 @@
+package buildfab
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Plugin naming and protocol constants
+const (
+	PluginPrefix          = "buildfab-action-" // Executable name prefix of action plugins
+	PluginNamespace       = "plugin@"          // uses: prefix of plugin actions
+	PluginsDir            = "plugins"          // Project plugin directory, relative to the configuration file
+	PluginProtocolVersion = 1                  // Version sent in every plugin request
+)
+
+// pluginDescribeTimeout bounds how long a plugin may take to describe itself
+const pluginDescribeTimeout = 5 * time.Second
+
+// PluginRequest is written as a single JSON object to a plugin's stdin
+type PluginRequest struct {
+	Protocol   int               `json:"protocol"`
+	Command    string            `json:"command"` // "describe" or "run"
+	Action     string            `json:"action,omitempty"`
+	Inputs     map[string]string `json:"inputs,omitempty"`
+	WorkingDir string            `json:"working_dir,omitempty"`
+	Variables  map[string]string `json:"variables,omitempty"`
+}
+
+// PluginMessage is one JSON line written by a plugin to stdout.
+//
+// Message types:
+//   - describe: Description of the action
+//   - log:      Message, on Stream "stdout" (default) or "stderr"
+//   - output:   Name and Value of an action output
+//   - result:   Status ("ok", "warn" or "error") and Message
+type PluginMessage struct {
+	Type        string `json:"type"`
+	Description string `json:"description,omitempty"`
+	Stream      string `json:"stream,omitempty"`
+	Message     string `json:"message,omitempty"`
+	Name        string `json:"name,omitempty"`
+	Value       string `json:"value,omitempty"`
+	Status      string `json:"status,omitempty"`
+}
+
+// PluginAction runs an external buildfab-action-<name> executable
+type PluginAction struct {
+	Name string // Plugin name without prefix
+	Path string // Path to the executable
+
+	once        sync.Once
+	description string
+}
+
+// NewPluginAction creates an action for the plugin executable at path
+func NewPluginAction(name, path string) *PluginAction {
+	return &PluginAction{Name: name, Path: path}
+}
+
+func (p *PluginAction) Run(ctx context.Context) (Result, error) {
+	return p.RunWithContext(ctx, NewActionContext(nil))
+}
+
+func (p *PluginAction) RunWithContext(ctx context.Context, actx *ActionContext) (Result, error) {
+	workingDir := actx.WorkingDir
+	if abs, err := filepath.Abs(workingDir); err == nil {
+		workingDir = abs
+	}
+	request := PluginRequest{
+		Protocol:   PluginProtocolVersion,
+		Command:    "run",
+		Action:     actx.Name,
+		Inputs:     actx.Inputs,
+		WorkingDir: workingDir,
+		Variables:  actx.Variables,
+	}
+
+	var result *PluginMessage
+	err := p.exec(ctx, actx, request, func(msg PluginMessage) {
+		switch msg.Type {
+		case "log":
+			if msg.Stream == "stderr" {
+				fmt.Fprintln(actx.Stderr, msg.Message)
+			} else {
+				fmt.Fprintln(actx.Stdout, msg.Message)
+			}
+		case "output":
+			actx.Outputs.Set(msg.Name, msg.Value)
+		case "result":
+			m := msg
+			result = &m
+		}
+	})
+
+	if err != nil {
+		message := fmt.Sprintf("plugin %s failed: %v", p.Name, err)
+		if result != nil && result.Message != "" {
+			message = result.Message
+		}
+		return Result{
+			Status:  StatusError,
+			Message: message,
+		}, fmt.Errorf("plugin %s failed: %w", p.Name, err)
+	}
+	if result == nil {
+		return Result{
+			Status:  StatusOK,
+			Message: fmt.Sprintf("plugin %s completed", p.Name),
+		}, nil
+	}
+
+	switch result.Status {
+	case "", "ok":
+		return Result{Status: StatusOK, Message: result.Message}, nil
+	case "warn":
+		return Result{Status: StatusWarn, Message: result.Message}, nil
+	case "error":
+		return Result{
+			Status:  StatusError,
+			Message: result.Message,
+		}, fmt.Errorf("plugin %s: %s", p.Name, result.Message)
+	default:
+		return Result{
+			Status:  StatusError,
+			Message: fmt.Sprintf("plugin %s returned unknown status %q", p.Name, result.Status),
+		}, fmt.Errorf("plugin %s returned unknown status %q", p.Name, result.Status)
+	}
+}
+
+// Description asks the plugin to describe itself. The answer is cached; a
+// plugin that fails to answer is described by its path.
+func (p *PluginAction) Description() string {
+	p.once.Do(func() {
+		p.description = fmt.Sprintf("External plugin %s", p.Path)
+
+		ctx, cancel := context.WithTimeout(context.Background(), pluginDescribeTimeout)
+		defer cancel()
+		request := PluginRequest{Protocol: PluginProtocolVersion, Command: "describe"}
+		var description string
+		err := p.exec(ctx, NewActionContext(nil), request, func(msg PluginMessage) {
+			if msg.Type == "describe" && msg.Description != "" {
+				description = msg.Description
+			}
+		})
+		if err == nil && description != "" {
+			p.description = description
+		}
+	})
+	return p.description
+}
+
+// exec runs the plugin with a request on stdin and passes every stdout message
+// to handle. Lines that are not JSON messages are treated as log lines and
+// stderr is forwarded to the action's Stderr.
+func (p *PluginAction) exec(ctx context.Context, actx *ActionContext, request PluginRequest, handle func(PluginMessage)) error {
+	payload, err := json.Marshal(request)
+	if err != nil {
+		return fmt.Errorf("failed to encode request: %w", err)
+	}
+
+	cmd := actx.Command(ctx, p.Path)
+	cmd.Stdin = bytes.NewReader(append(payload, '\n'))
+	cmd.Stderr = actx.Stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	scanner := bufio.NewScanner(stdout)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		var msg PluginMessage
+		if strings.HasPrefix(strings.TrimSpace(line), "{") && json.Unmarshal([]byte(line), &msg) == nil && msg.Type != "" {
+			handle(msg)
+			continue
+		}
+		handle(PluginMessage{Type: "log", Message: line})
+	}
+	scanErr := scanner.Err()
+	if scanErr != nil {
+		// Drain the rest so the plugin does not block on a full pipe
+		io.Copy(io.Discard, stdout)
+	}
+
+	if err := cmd.Wait(); err != nil {
+		return err
+	}
+	return scanErr
+}
+
+// PluginSearchPath returns the directories searched for plugins: the project
+// plugins directory followed by PATH
+func PluginSearchPath(config *Config) []string {
+	var dirs []string
+	if config != nil && config.baseDir != "" {
+		dirs = append(dirs, filepath.Join(config.baseDir, PluginsDir))
+	}
+	return append(dirs, filepath.SplitList(os.Getenv("PATH"))...)
+}
+
+// DiscoverPlugins finds buildfab-action-<name> executables in dirs. When a
+// name exists in several directories the first one wins.
+func DiscoverPlugins(dirs []string) []*PluginAction {
+	var plugins []*PluginAction
+	seen := make(map[string]bool)
+	for _, dir := range dirs {
+		if dir == "" {
+			continue
+		}
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			continue
+		}
+		for _, entry := range entries {
+			name, ok := pluginName(entry.Name())
+			if !ok || seen[name] || entry.IsDir() {
+				continue
+			}
+			path := filepath.Join(dir, entry.Name())
+			if !isExecutable(path) {
+				continue
+			}
+			seen[name] = true
+			plugins = append(plugins, NewPluginAction(name, path))
+		}
+	}
+	return plugins
+}
+
+// pluginName extracts the plugin name from an executable file name
+func pluginName(fileName string) (string, bool) {
+	if !strings.HasPrefix(fileName, PluginPrefix) {
+		return "", false
+	}
+	name := strings.TrimPrefix(fileName, PluginPrefix)
+	if runtime.GOOS == "windows" {
+		ext := strings.ToLower(filepath.Ext(name))
+		if ext != ".exe" && ext != ".bat" && ext != ".cmd" {
+			return "", false
+		}
+		name = strings.TrimSuffix(name, filepath.Ext(name))
+	}
+	return name, name != ""
+}
+
+// isExecutable reports whether path is a regular file that can be executed
+func isExecutable(path string) bool {
+	info, err := os.Stat(path)
+	if err != nil || !info.Mode().IsRegular() {
+		return false
+	}
+	if runtime.GOOS == "windows" {
+		return true
+	}
+	return info.Mode().Perm()&0111 != 0
+}
+
+// DiscoverPluginsOnUse makes the plugins in dirs available as plugin@<name>,
+// discovering them the first time a plugin@ action is looked up or the
+// actions are listed, so runs without plugins don't scan PATH. Registered
+// names take precedence.
+func (r *DefaultActionRegistry) DiscoverPluginsOnUse(dirs []string) {
+	r.pluginDirs = dirs
+}
+
+// discoveredPlugins returns the plugins of the search path, discovering them
+// on the first call
+func (r *DefaultActionRegistry) discoveredPlugins() map[string]ActionRunner {
+	r.pluginsOnce.Do(func() {
+		r.plugins = make(map[string]ActionRunner)
+		for _, plugin := range DiscoverPlugins(r.pluginDirs) {
+			r.plugins[PluginNamespace+plugin.Name] = plugin
+		}
+	})
+	return r.plugins
+}
+
+// RegisterPlugins registers discovered plugins as plugin@<name>. Names that
+// are already registered are left alone.
+func (r *DefaultActionRegistry) RegisterPlugins(dirs []string) {
+	for _, plugin := range DiscoverPlugins(dirs) {
+		name := PluginNamespace + plugin.Name
+		if _, exists := r.actions[name]; exists {
+			continue
+		}
+		r.Register(name, plugin)
+	}
+}
@@ -0,0 +1,182 @@
+package buildfab
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// testPluginScript answers describe requests and echoes the "who" input on run
+const testPluginScript = `#!/bin/sh
+read -r request
+case "$request" in
+*'"command":"describe"'*)
+  echo '{"type":"describe","description":"Greet someone"}'
+  ;;
+*)
+  who=$(printf '%s' "$request" | sed -n 's/.*"who":"\([^"]*\)".*/\1/p')
+  echo "plain line"
+  echo '{"type":"log","message":"hello '"$who"'"}'
+  echo '{"type":"log","stream":"stderr","message":"careful"}'
+  echo '{"type":"output","name":"greeted","value":"'"$who"'"}'
+  if [ "$who" = "nobody" ]; then
+    echo '{"type":"result","status":"error","message":"nobody to greet"}'
+    exit 1
+  fi
+  echo '{"type":"result","status":"warn","message":"greeted '"$who"'"}'
+  ;;
+esac
+`
+
+// writeTestPlugin writes an executable plugin script into dir
+func writeTestPlugin(t *testing.T, dir, name, script string) string {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		t.Skip("shell script plugins are not supported on windows")
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatalf("failed to create plugin dir: %v", err)
+	}
+	path := filepath.Join(dir, PluginPrefix+name)
+	if err := os.WriteFile(path, []byte(script), 0755); err != nil {
+		t.Fatalf("failed to write plugin: %v", err)
+	}
+	return path
+}
+
+func TestDiscoverPlugins(t *testing.T) {
+	first := t.TempDir()
+	second := t.TempDir()
+	path := writeTestPlugin(t, first, "greet", testPluginScript)
+	writeTestPlugin(t, second, "greet", "#!/bin/sh\n")
+	writeTestPlugin(t, second, "other", "#!/bin/sh\n")
+	if err := os.WriteFile(filepath.Join(second, PluginPrefix+"noexec"), []byte("#!/bin/sh\n"), 0644); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+
+	plugins := DiscoverPlugins([]string{"", filepath.Join(first, "missing"), first, second})
+	names := make(map[string]string)
+	for _, plugin := range plugins {
+		names[plugin.Name] = plugin.Path
+	}
+	if len(names) != 2 {
+		t.Errorf("DiscoverPlugins() found %v, want greet and other", names)
+	}
+	if names["greet"] != path {
+		t.Errorf("greet plugin = %q, want first directory %q", names["greet"], path)
+	}
+	if _, found := names["noexec"]; found {
+		t.Error("non-executable files should not be discovered")
+	}
+
+	registry := NewDefaultActionRegistry()
+	registry.RegisterPlugins([]string{first})
+	if _, exists := registry.GetRunner("plugin@greet"); !exists {
+		t.Error("plugin@greet should be registered")
+	}
+	if got := registry.ListActions()["plugin@greet"]; got != "Greet someone" {
+		t.Errorf("plugin description = %q, want Greet someone", got)
+	}
+}
+
+func TestDiscoverPluginsOnUse(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "plugins")
+	registry := NewDefaultActionRegistry()
+	registry.DiscoverPluginsOnUse([]string{dir})
+
+	// Built-in actions don't discover plugins, the first plugin@ lookup does
+	if _, exists := registry.GetRunner("git@branch"); !exists || registry.plugins != nil {
+		t.Fatalf("built-in lookup should not discover plugins, got %v", registry.plugins)
+	}
+	writeTestPlugin(t, dir, "greet", testPluginScript)
+	if _, exists := registry.GetRunner("plugin@greet"); !exists {
+		t.Fatal("plugin@greet should be discovered on first use")
+	}
+	writeTestPlugin(t, dir, "later", "#!/bin/sh\n")
+	if _, exists := registry.ListActions()["plugin@later"]; exists {
+		t.Error("plugins should be discovered once")
+	}
+}
+
+func TestPluginActionRun(t *testing.T) {
+	path := writeTestPlugin(t, t.TempDir(), "greet", testPluginScript)
+	plugin := NewPluginAction("greet", path)
+
+	var stdout, stderr strings.Builder
+	actx := NewActionContext(map[string]string{"who": "world"})
+	actx.Stdout = &stdout
+	actx.Stderr = &stderr
+	result, err := plugin.RunWithContext(context.Background(), actx)
+	if err != nil {
+		t.Fatalf("RunWithContext() error = %v", err)
+	}
+	if result.Status != StatusWarn || result.Message != "greeted world" {
+		t.Errorf("result = %+v, want warn with plugin message", result)
+	}
+	if got := stdout.String(); got != "plain line\nhello world\n" {
+		t.Errorf("stdout = %q", got)
+	}
+	if got := stderr.String(); got != "careful\n" {
+		t.Errorf("stderr = %q", got)
+	}
+	if value, _ := actx.Outputs.Get("greeted"); value != "world" {
+		t.Errorf("output greeted = %q, want world", value)
+	}
+
+	actx = NewActionContext(map[string]string{"who": "nobody"})
+	result, err = plugin.RunWithContext(context.Background(), actx)
+	if err == nil {
+		t.Fatal("RunWithContext() expected error for failing plugin")
+	}
+	if result.Status != StatusError || result.Message != "nobody to greet" {
+		t.Errorf("result = %+v, want error with plugin message", result)
+	}
+}
+
+func TestPluginDescriptionFallback(t *testing.T) {
+	path := writeTestPlugin(t, t.TempDir(), "broken", "#!/bin/sh\nexit 3\n")
+	plugin := NewPluginAction("broken", path)
+	if got := plugin.Description(); !strings.Contains(got, path) {
+		t.Errorf("Description() = %q, want fallback with path", got)
+	}
+}
+
+func TestRunStageProjectPlugin(t *testing.T) {
+	dir := t.TempDir()
+	writeTestPlugin(t, filepath.Join(dir, PluginsDir), "greet", testPluginScript)
+	configPath := filepath.Join(dir, ".project.yml")
+	content := `
+project:
+  name: test
+actions:
+  - name: greet
+    uses: plugin@greet
+    with:
+      who: team
+stages:
+  test:
+    steps:
+      - action: greet
+`
+	if err := os.WriteFile(configPath, []byte(content), 0644); err != nil {
+		t.Fatalf("failed to write config: %v", err)
+	}
+	config, err := LoadConfig(configPath)
+	if err != nil {
+		t.Fatalf("LoadConfig() error = %v", err)
+	}
+
+	runner := NewRunner(config, DefaultRunOptions())
+	if _, listed := runner.ListBuiltInActions()["plugin@greet"]; !listed {
+		t.Error("project plugin should be listed with built-in actions")
+	}
+	if err := runner.RunStage(context.Background(), "test"); err != nil {
+		t.Fatalf("RunStage() error = %v", err)
+	}
+	if got := runner.StepOutputs("greet")["greeted"]; got != "team" {
+		t.Errorf("StepOutputs(greet) = %q, want team", got)
+	}
+}
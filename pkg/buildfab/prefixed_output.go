@@ -0,0 +1,135 @@
+package buildfab
+
+import (
+	"context"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// prefixTimeFormat is the format of the timestamps of prefixed lines
+const prefixTimeFormat = "15:04:05.000"
+
+// prefixColors are the colors of step prefixes, assigned in declaration order.
+// Red is left for errors.
+var prefixColors = []string{
+	"\033[36m", // cyan
+	"\033[35m", // magenta
+	"\033[34m", // blue
+	"\033[33m", // yellow
+	"\033[32m", // green
+	"\033[96m", // bright cyan
+	"\033[95m", // bright magenta
+	"\033[94m", // bright blue
+}
+
+// PrefixedStepCallback implements StepCallback by writing every line of
+// every step as soon as it arrives, prefixed with the step name, instead of
+// holding output back to keep declaration order. Each call is written with
+// a single write under a lock, so lines of parallel steps never mix.
+type PrefixedStepCallback struct {
+	mu         sync.Mutex
+	out        io.Writer
+	prefixes   map[string]string // Padded, colored prefix of each step
+	width      int               // Width of the longest prefix
+	color      bool              // Colored prefixes, off with NO_COLOR
+	timestamps bool
+	messages   *OrderedOutputManager // Formats result messages like ordered output
+	results    []StepResult
+	now        func() time.Time
+}
+
+// NewPrefixedStepCallback creates a prefixed step callback writing to
+// errorOutput, with the time of each line when timestamps is set
+func NewPrefixedStepCallback(steps []Step, timestamps bool, errorOutput io.Writer, config *Config) *PrefixedStepCallback {
+	c := &PrefixedStepCallback{
+		out:        errorOutput,
+		prefixes:   make(map[string]string, len(steps)),
+		color:      colorsEnabled(),
+		timestamps: timestamps,
+		messages:   NewOrderedOutputManager(steps, false, false, errorOutput, config),
+		now:        time.Now,
+	}
+	for _, step := range steps {
+		if width := len(step.Action) + 2; width > c.width {
+			c.width = width
+		}
+	}
+	for i, step := range steps {
+		c.prefixes[step.Action] = c.prefix(step.Action, prefixColors[i%len(prefixColors)])
+	}
+	return c
+}
+
+// prefix returns the prefix of a step, padded to align the lines of all steps
+func (c *PrefixedStepCallback) prefix(stepName, color string) string {
+	label := "[" + stepName + "]"
+	padding := ""
+	if len(label) < c.width {
+		padding = strings.Repeat(" ", c.width-len(label))
+	}
+	if c.color {
+		label = color + label + colorReset
+	}
+	return label + padding
+}
+
+// OnStepStart writes the start of the step
+func (c *PrefixedStepCallback) OnStepStart(ctx context.Context, stepName string) {
+	c.write(stepName, "started")
+}
+
+// OnStepComplete writes the result of the step
+func (c *PrefixedStepCallback) OnStepComplete(ctx context.Context, stepName string, status StepStatus, message string, duration time.Duration) {
+	c.mu.Lock()
+	c.results = append(c.results, StepResult{
+		StepName: stepName,
+		Status:   status,
+		Duration: duration,
+	})
+	c.messages.stepData[stepName] = &StepOutputData{Completed: true, Status: status, Message: message}
+	message = c.messages.enhanceMessage(stepName, status, message) + formatExecutionTime(status, duration)
+	c.mu.Unlock()
+
+	icon, color := statusIcon(status)
+	if c.color {
+		icon = color + icon + colorReset
+	}
+	c.write(stepName, icon+" "+message)
+}
+
+// OnStepOutput writes the output lines of the step
+func (c *PrefixedStepCallback) OnStepOutput(ctx context.Context, stepName string, output string) {
+	c.write(stepName, strings.TrimSuffix(output, "\n"))
+}
+
+// OnStepError is a no-op, errors are shown with the step result
+func (c *PrefixedStepCallback) OnStepError(ctx context.Context, stepName string, err error) {}
+
+// GetResults returns the collected step results
+func (c *PrefixedStepCallback) GetResults() []StepResult {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	results := make([]StepResult, len(c.results))
+	copy(results, c.results)
+	return results
+}
+
+// write writes each line of text with the prefix of the step in one write
+func (c *PrefixedStepCallback) write(stepName, text string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	prefix, ok := c.prefixes[stepName]
+	if !ok {
+		prefix = c.prefix(stepName, prefixColors[0])
+	}
+	if c.timestamps {
+		prefix = c.now().Format(prefixTimeFormat) + " " + prefix
+	}
+	var b strings.Builder
+	for _, line := range strings.Split(text, "\n") {
+		b.WriteString(prefix + " " + line + "\n")
+	}
+	io.WriteString(c.out, b.String())
+}
@@ -0,0 +1,176 @@
+package buildfab
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"regexp"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPrefixedStepCallback(t *testing.T) {
+	t.Setenv("NO_COLOR", "1")
+	var out bytes.Buffer
+	c := NewPrefixedStepCallback([]Step{{Action: "build"}, {Action: "lint-all"}}, true, &out, nil)
+	c.now = func() time.Time { return time.Date(2025, 1, 1, 12, 0, 1, 500e6, time.UTC) }
+	ctx := context.Background()
+
+	c.OnStepStart(ctx, "build")
+	c.OnStepOutput(ctx, "build", "compiling")
+	c.OnStepOutput(ctx, "lint-all", "first\nsecond\n")
+	c.OnStepComplete(ctx, "build", StepStatusOK, "executed successfully", 2*time.Second)
+	c.OnStepComplete(ctx, "lint-all", StepStatusError, "command failed: exit status 1", time.Second)
+
+	want := strings.Join([]string{
+		"12:00:01.500 [build]    started",
+		"12:00:01.500 [build]    compiling",
+		"12:00:01.500 [lint-all] first",
+		"12:00:01.500 [lint-all] second",
+		"12:00:01.500 [build]    ✓ executed successfully - in '2s'",
+		"12:00:01.500 [lint-all] ✗ to check run:",
+		"12:00:01.500 [lint-all]       lint-all",
+	}, "\n") + "\n"
+	if out.String() != want {
+		t.Errorf("output =\n%s\nwant\n%s", out.String(), want)
+	}
+	if results := c.GetResults(); len(results) != 2 || results[1].Status != StepStatusError {
+		t.Errorf("results = %+v", results)
+	}
+}
+
+func TestPrefixedStepCallback_Colors(t *testing.T) {
+	t.Setenv("NO_COLOR", "")
+	t.Setenv("TERM", "xterm")
+	var out bytes.Buffer
+	c := NewPrefixedStepCallback([]Step{{Action: "build"}, {Action: "test"}}, false, &out, nil)
+	c.OnStepOutput(context.Background(), "test", "ok")
+	if want := prefixColors[1] + "[test]" + colorReset + "  ok\n"; out.String() != want {
+		t.Errorf("output = %q, want %q", out.String(), want)
+	}
+}
+
+func TestPrefixedStepCallback_LineAtomicity(t *testing.T) {
+	t.Setenv("NO_COLOR", "1")
+	var steps []Step
+	for i := 0; i < 8; i++ {
+		steps = append(steps, Step{Action: fmt.Sprintf("s%d", i)})
+	}
+	var out bytes.Buffer
+	c := NewPrefixedStepCallback(steps, false, &out, nil)
+	var wg sync.WaitGroup
+	for _, step := range steps {
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				c.OnStepOutput(context.Background(), name, fmt.Sprintf("%s line %d\n%s line %d.1", name, i, name, i))
+			}
+		}(step.Action)
+	}
+	wg.Wait()
+
+	line := regexp.MustCompile(`^\[(s\d)\] (s\d) line \d+(\.1)?$`)
+	lines := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+	if len(lines) != 8*200*2 {
+		t.Fatalf("got %d lines, want %d", len(lines), 8*200*2)
+	}
+	for _, l := range lines {
+		if m := line.FindStringSubmatch(l); m == nil || m[1] != m[2] {
+			t.Fatalf("mixed line %q", l)
+		}
+	}
+}
+
+func TestStreamLines(t *testing.T) {
+	long := strings.Repeat("x", 200*1024)
+	huge := strings.Repeat("y", 2*maxStreamLine+10)
+	input := "first\r\n\n" + long + "\n" + huge + "\nno newline"
+
+	var lines []string
+	if err := streamLines(strings.NewReader(input), func(line string) { lines = append(lines, line) }); err != nil {
+		t.Fatalf("streamLines() error = %v", err)
+	}
+	if len(lines) != 7 {
+		t.Fatalf("got %d lines, want 7", len(lines))
+	}
+	if lines[0] != "first" || lines[1] != "" || lines[2] != long || lines[6] != "no newline" {
+		t.Errorf("lines = %.20q", lines)
+	}
+	// Lines over the limit are emitted in parts
+	if lines[3]+lines[4]+lines[5] != huge || len(lines[3]) != maxStreamLine {
+		t.Errorf("parts of the huge line have lengths %d, %d, %d", len(lines[3]), len(lines[4]), len(lines[5]))
+	}
+}
+
+func TestRunner_StreamLongLines(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("stream tests use a POSIX shell")
+	}
+	config, err := LoadConfigFromBytes([]byte(`project:
+  name: test
+actions:
+  - name: build
+    run: head -c 100000 /dev/zero | tr '\0' x; echo; printf done
+stages:
+  ci:
+    steps:
+      - action: build
+`))
+	if err != nil {
+		t.Fatalf("LoadConfigFromBytes() error = %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	callback := &MockStepCallback{}
+	opts := &RunOptions{WorkingDir: t.TempDir(), Verbose: true, StepCallback: callback, Output: io.Discard, ErrorOutput: io.Discard}
+	if err := NewRunner(config, opts).RunStage(ctx, "ci"); err != nil {
+		t.Fatalf("RunStage() error = %v", err)
+	}
+	calls := callback.OnStepOutputCalls
+	if len(calls) != 2 || calls[0].Output != strings.Repeat("x", 100000) || calls[1].Output != "done" {
+		t.Errorf("got %d output calls, want the long line and the line without newline", len(calls))
+	}
+}
+
+func TestSimpleRunner_PrefixedUI(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("prefixed output tests use a POSIX shell")
+	}
+	t.Setenv("NO_COLOR", "1")
+	config, err := LoadConfigFromBytes([]byte(`project:
+  name: test
+actions:
+  - name: build
+    run: echo building
+  - name: test
+    run: echo testing
+stages:
+  ci:
+    steps:
+      - action: build
+      - action: test
+`))
+	if err != nil {
+		t.Fatalf("LoadConfigFromBytes() error = %v", err)
+	}
+	var out bytes.Buffer
+	opts := DefaultSimpleRunOptions()
+	opts.WorkingDir = t.TempDir()
+	opts.Verbose = true
+	opts.Output = &out
+	opts.ErrorOutput = &out
+	opts.UI = UIPrefixed
+	if err := NewSimpleRunner(config, opts).RunStage(context.Background(), "ci"); err != nil {
+		t.Fatalf("RunStage() error = %v", err)
+	}
+	for _, want := range []string{"[build] started\n", "[build] building\n", "[test]  testing\n", "[test]  ✓ executed successfully"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("output missing %q:\n%s", want, out.String())
+		}
+	}
+}
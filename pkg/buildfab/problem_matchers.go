@@ -0,0 +1,291 @@
+package buildfab
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Diagnostic severities
+const (
+	DiagnosticError   = "error"
+	DiagnosticWarning = "warning"
+)
+
+// maxDiagnostics bounds the diagnostics extracted from the output of a step
+const maxDiagnostics = 100
+
+// summaryDiagnostics is the number of diagnostics of a failed step shown in
+// the failure summary
+const summaryDiagnostics = 5
+
+// ProblemMatcher extracts diagnostics from the output of failed steps. The
+// regular expression is matched against each output line and its named
+// groups file, line, col, message, severity and code fill the diagnostic.
+type ProblemMatcher struct {
+	Name     string `yaml:"name"`
+	Regex    string `yaml:"regex"`              // Regular expression with at least a message group
+	Severity string `yaml:"severity,omitempty"` // error (default) or warning, when the regex has no severity group
+}
+
+// Diagnostic is a problem reported by a tool, extracted from step output
+type Diagnostic struct {
+	File     string `json:"file,omitempty"`
+	Line     int    `json:"line,omitempty"`
+	Col      int    `json:"col,omitempty"`
+	Severity string `json:"severity"` // DiagnosticError or DiagnosticWarning
+	Message  string `json:"message"`
+	Code     string `json:"code,omitempty"` // Rule or check reporting the problem
+	Matcher  string `json:"matcher"`
+}
+
+// String formats the diagnostic like compilers do: file:line:col: message
+func (d Diagnostic) String() string {
+	var b strings.Builder
+	if d.File != "" {
+		b.WriteString(d.File)
+		if d.Line > 0 {
+			fmt.Fprintf(&b, ":%d", d.Line)
+			if d.Col > 0 {
+				fmt.Fprintf(&b, ":%d", d.Col)
+			}
+		}
+		b.WriteString(": ")
+	}
+	if d.Severity == DiagnosticWarning {
+		b.WriteString("warning: ")
+	}
+	b.WriteString(d.Message)
+	if d.Code != "" {
+		fmt.Fprintf(&b, " (%s)", d.Code)
+	}
+	return b.String()
+}
+
+// BuiltinProblemMatchers are the matchers available to every project, in the
+// order they are tried on a line
+var BuiltinProblemMatchers = []ProblemMatcher{
+	{
+		Name:  "golangci-lint",
+		Regex: `^(?P<file>[^\s:][^:]*\.go):(?P<line>\d+)(?::(?P<col>\d+))?: (?P<message>.+) \((?P<code>[\w-]+)\)$`,
+	},
+	{
+		Name:  "go",
+		Regex: `^(?:vet: )?(?P<file>[^\s:][^:]*\.go):(?P<line>\d+)(?::(?P<col>\d+))?: (?P<message>.+)$`,
+	},
+	{
+		Name:  "gcc",
+		Regex: `^(?P<file>[^\s:][^:]*):(?P<line>\d+):(?P<col>\d+): (?P<severity>(?:fatal )?error|warning): (?P<message>.+)$`,
+	},
+	{
+		Name:  "cmake",
+		Regex: `^CMake (?P<severity>Error|Warning)(?: \(dev\))? at (?P<file>[^:]+):(?P<line>\d+) \((?P<message>[^)]+)\):?$`,
+	},
+}
+
+// compiledMatcher is a problem matcher with its compiled regular expression
+type compiledMatcher struct {
+	ProblemMatcher
+	re *regexp.Regexp
+}
+
+// compile compiles the regular expression of the matcher
+func (m ProblemMatcher) compile() (compiledMatcher, error) {
+	re, err := regexp.Compile(m.Regex)
+	if err != nil {
+		return compiledMatcher{}, fmt.Errorf("problem matcher %s: invalid regex: %w", m.Name, err)
+	}
+	if re.SubexpIndex("message") < 0 {
+		return compiledMatcher{}, fmt.Errorf("problem matcher %s: regex must have a message group", m.Name)
+	}
+	return compiledMatcher{ProblemMatcher: m, re: re}, nil
+}
+
+// validate checks the regular expression and severity of the matcher
+func (m ProblemMatcher) validate() error {
+	if _, err := m.compile(); err != nil {
+		return err
+	}
+	if m.Severity != "" && m.Severity != DiagnosticError && m.Severity != DiagnosticWarning {
+		return fmt.Errorf("problem matcher %s: invalid severity %q (must be '%s' or '%s')", m.Name, m.Severity, DiagnosticError, DiagnosticWarning)
+	}
+	return nil
+}
+
+// validateProblemMatchers checks the problem_matchers section and the
+// matchers selected by actions
+func (c *Config) validateProblemMatchers() error {
+	names := make(map[string]bool)
+	for _, matcher := range BuiltinProblemMatchers {
+		names[matcher.Name] = true
+	}
+	defined := make(map[string]bool)
+	for i, matcher := range c.ProblemMatchers {
+		if matcher.Name == "" {
+			return fmt.Errorf("problem matcher %d must have a name", i+1)
+		}
+		if defined[matcher.Name] {
+			return fmt.Errorf("duplicate problem matcher: %s", matcher.Name)
+		}
+		defined[matcher.Name] = true
+		names[matcher.Name] = true
+		if err := matcher.validate(); err != nil {
+			return err
+		}
+	}
+	for _, action := range c.Actions {
+		for _, name := range action.ProblemMatchers {
+			if !names[name] {
+				return fmt.Errorf("action %s references unknown problem matcher: %s", action.Name, name)
+			}
+		}
+	}
+	return nil
+}
+
+// problemMatchers returns the matchers of an action: the ones it names, or
+// all project and built-in matchers when it names none. Project matchers
+// replace built-in matchers of the same name and are tried first.
+func (c *Config) problemMatchers(action Action) []compiledMatcher {
+	all := append([]ProblemMatcher(nil), c.ProblemMatchers...)
+	for _, builtin := range BuiltinProblemMatchers {
+		overridden := false
+		for _, matcher := range c.ProblemMatchers {
+			overridden = overridden || matcher.Name == builtin.Name
+		}
+		if !overridden {
+			all = append(all, builtin)
+		}
+	}
+	selected := make(map[string]bool, len(action.ProblemMatchers))
+	for _, name := range action.ProblemMatchers {
+		selected[name] = true
+	}
+	var matchers []compiledMatcher
+	for _, matcher := range all {
+		if len(selected) > 0 && !selected[matcher.Name] {
+			continue
+		}
+		// Invalid matchers are reported by Validate
+		if compiled, err := matcher.compile(); err == nil {
+			matchers = append(matchers, compiled)
+		}
+	}
+	return matchers
+}
+
+// ExtractDiagnostics matches each output line against the matchers, the first
+// matching matcher of a line wins. Duplicates are dropped and at most
+// maxDiagnostics are returned.
+func ExtractDiagnostics(output string, matchers []ProblemMatcher) []Diagnostic {
+	var compiled []compiledMatcher
+	for _, matcher := range matchers {
+		if m, err := matcher.compile(); err == nil {
+			compiled = append(compiled, m)
+		}
+	}
+	return extractDiagnostics(output, compiled)
+}
+
+// extractDiagnostics extracts the diagnostics of output with compiled matchers
+func extractDiagnostics(output string, matchers []compiledMatcher) []Diagnostic {
+	if len(matchers) == 0 {
+		return nil
+	}
+	var diagnostics []Diagnostic
+	seen := make(map[Diagnostic]bool)
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimRight(ansiEscape.ReplaceAllString(line, ""), "\r")
+		for _, matcher := range matchers {
+			diagnostic, ok := matcher.match(line)
+			if !ok {
+				continue
+			}
+			if !seen[diagnostic] {
+				seen[diagnostic] = true
+				diagnostics = append(diagnostics, diagnostic)
+			}
+			break
+		}
+		if len(diagnostics) == maxDiagnostics {
+			break
+		}
+	}
+	return diagnostics
+}
+
+// match returns the diagnostic of a line matching the matcher
+func (m compiledMatcher) match(line string) (Diagnostic, bool) {
+	groups := m.re.FindStringSubmatch(line)
+	if groups == nil {
+		return Diagnostic{}, false
+	}
+	group := func(name string) string {
+		if i := m.re.SubexpIndex(name); i >= 0 {
+			return strings.TrimSpace(groups[i])
+		}
+		return ""
+	}
+	diagnostic := Diagnostic{
+		File:     group("file"),
+		Message:  group("message"),
+		Code:     group("code"),
+		Severity: m.Severity,
+		Matcher:  m.Name,
+	}
+	if diagnostic.Message == "" {
+		return Diagnostic{}, false
+	}
+	diagnostic.Line, _ = strconv.Atoi(group("line"))
+	diagnostic.Col, _ = strconv.Atoi(group("col"))
+	if severity := strings.ToLower(group("severity")); severity != "" {
+		diagnostic.Severity = DiagnosticError
+		if strings.HasPrefix(severity, "warn") {
+			diagnostic.Severity = DiagnosticWarning
+		}
+	}
+	if diagnostic.Severity == "" {
+		diagnostic.Severity = DiagnosticError
+	}
+	return diagnostic, true
+}
+
+// stepDiagnostics returns the diagnostics of a failed or warned step, with
+// file paths relative to the current directory
+func (r *Runner) stepDiagnostics(action Action, scope *stepScope, result Result) []Diagnostic {
+	if result.Status == StatusOK || result.Output == "" {
+		return nil
+	}
+	diagnostics := extractDiagnostics(result.Output, r.config.problemMatchers(action))
+	dir, err := filepath.Abs(r.actionDir(scope))
+	for i, diagnostic := range diagnostics {
+		if diagnostic.File == "" || err != nil {
+			continue
+		}
+		file := diagnostic.File
+		if !filepath.IsAbs(file) {
+			file = filepath.Join(dir, file)
+		}
+		diagnostics[i].File = filepath.ToSlash(displayPath(file))
+	}
+	return diagnostics
+}
+
+// StepDiagnosticsCallback is implemented by step callbacks that show the
+// diagnostics of steps. OnStepDiagnostics is called before OnStepComplete.
+type StepDiagnosticsCallback interface {
+	OnStepDiagnostics(ctx context.Context, stepName string, diagnostics []Diagnostic)
+}
+
+// notifyDiagnostics passes the diagnostics of a step to the callback
+func (r *Runner) notifyDiagnostics(ctx context.Context, stepName string, diagnostics []Diagnostic) {
+	if len(diagnostics) == 0 {
+		return
+	}
+	if callback, ok := r.stepCallback.(StepDiagnosticsCallback); ok {
+		callback.OnStepDiagnostics(ctx, stepName, diagnostics)
+	}
+}
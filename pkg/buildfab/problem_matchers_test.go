@@ -0,0 +1,248 @@
+package buildfab
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBuiltinProblemMatchers(t *testing.T) {
+	tests := []struct {
+		line string
+		want Diagnostic
+	}{
+		{"./cmd/main.go:12:5: undefined: foo",
+			Diagnostic{File: "./cmd/main.go", Line: 12, Col: 5, Severity: DiagnosticError, Message: "undefined: foo", Matcher: "go"}},
+		{"vet: pkg/x.go:7:2: unreachable code",
+			Diagnostic{File: "pkg/x.go", Line: 7, Col: 2, Severity: DiagnosticError, Message: "unreachable code", Matcher: "go"}},
+		{"internal/api.go:40:9: Error return value is not checked (errcheck)",
+			Diagnostic{File: "internal/api.go", Line: 40, Col: 9, Severity: DiagnosticError, Message: "Error return value is not checked", Code: "errcheck", Matcher: "golangci-lint"}},
+		{"src/main.c:3:10: fatal error: missing.h: No such file or directory",
+			Diagnostic{File: "src/main.c", Line: 3, Col: 10, Severity: DiagnosticError, Message: "missing.h: No such file or directory", Matcher: "gcc"}},
+		{"lib/util.cpp:8:14: warning: unused variable 'x' [-Wunused-variable]",
+			Diagnostic{File: "lib/util.cpp", Line: 8, Col: 14, Severity: DiagnosticWarning, Message: "unused variable 'x' [-Wunused-variable]", Matcher: "gcc"}},
+		{"CMake Error at CMakeLists.txt:5 (add_executable):",
+			Diagnostic{File: "CMakeLists.txt", Line: 5, Severity: DiagnosticError, Message: "add_executable", Matcher: "cmake"}},
+		{"CMake Warning (dev) at cmake/deps.cmake:21 (find_package):",
+			Diagnostic{File: "cmake/deps.cmake", Line: 21, Severity: DiagnosticWarning, Message: "find_package", Matcher: "cmake"}},
+	}
+	for _, tt := range tests {
+		got := ExtractDiagnostics(tt.line, BuiltinProblemMatchers)
+		if len(got) != 1 || got[0] != tt.want {
+			t.Errorf("ExtractDiagnostics(%q) = %+v, want %+v", tt.line, got, tt.want)
+		}
+	}
+	for _, line := range []string{"ok  github.com/example/app 0.1s", "--- FAIL: TestX (0.00s)", "main.c:3: note: here", ""} {
+		if got := ExtractDiagnostics(line, BuiltinProblemMatchers); len(got) != 0 {
+			t.Errorf("ExtractDiagnostics(%q) = %+v, want none", line, got)
+		}
+	}
+}
+
+func TestExtractDiagnostics(t *testing.T) {
+	output := "# example/app\n\033[1mmain.go:3:1: bad\033[0m\r\nmain.go:3:1: bad\n"
+	for i := 0; i < maxDiagnostics+10; i++ {
+		output += fmt.Sprintf("gen.go:%d:1: x\n", i+1)
+	}
+	got := ExtractDiagnostics(output, BuiltinProblemMatchers)
+	if len(got) != maxDiagnostics {
+		t.Fatalf("got %d diagnostics, want %d", len(got), maxDiagnostics)
+	}
+	// Escape sequences are removed and duplicates dropped
+	if got[0].File != "main.go" || got[0].Message != "bad" || got[1].File != "gen.go" {
+		t.Errorf("diagnostics = %+v", got[:2])
+	}
+	if s := (Diagnostic{File: "a.go", Line: 1, Col: 2, Severity: DiagnosticWarning, Message: "m", Code: "vet"}).String(); s != "a.go:1:2: warning: m (vet)" {
+		t.Errorf("String() = %q", s)
+	}
+}
+
+func TestConfig_ProblemMatchers(t *testing.T) {
+	config, err := LoadConfigFromBytes([]byte(`project:
+  name: test
+problem_matchers:
+  - name: pytest
+    regex: '^(?P<file>[^:]+\.py):(?P<line>\d+): (?P<message>.+)$'
+  - name: go
+    regex: '^GO (?P<message>.+)$'
+    severity: warning
+actions:
+  - name: test
+    run: pytest
+    problem_matchers: [pytest]
+  - name: build
+    run: go build
+stages:
+  ci:
+    steps:
+      - action: test
+`))
+	if err != nil {
+		t.Fatalf("LoadConfigFromBytes() error = %v", err)
+	}
+	test, _ := config.GetAction("test")
+	if got := extractDiagnostics("tests/a.py:3: assert 1 == 2\nmain.go:1:1: bad", config.problemMatchers(test)); len(got) != 1 || got[0].Matcher != "pytest" || got[0].Line != 3 {
+		t.Errorf("test diagnostics = %+v, want only the pytest matcher", got)
+	}
+	// Project matchers replace built-in matchers of the same name
+	build, _ := config.GetAction("build")
+	got := extractDiagnostics("GO broken\nmain.go:1:1: bad\nx.c:1:2: error: e", config.problemMatchers(build))
+	if len(got) != 2 || got[0].Severity != DiagnosticWarning || got[0].Message != "broken" || got[1].Matcher != "gcc" {
+		t.Errorf("build diagnostics = %+v", got)
+	}
+}
+
+func TestConfig_ProblemMatchersValidation(t *testing.T) {
+	tests := map[string]string{
+		"invalid regex":     "problem_matchers:\n  - name: bad\n    regex: '('\n",
+		"no message group":  "problem_matchers:\n  - name: bad\n    regex: '^(?P<file>.+)$'\n",
+		"invalid severity":  "problem_matchers:\n  - name: bad\n    regex: '(?P<message>.+)'\n    severity: fatal\n",
+		"duplicate":         "problem_matchers:\n  - name: a\n    regex: '(?P<message>.+)'\n  - name: a\n    regex: '(?P<message>.+)'\n",
+		"unknown in action": "actions:\n  - name: b\n    run: make\n    problem_matchers: [rustc]\n",
+	}
+	for name, section := range tests {
+		data := "project:\n  name: test\n" + section
+		if !strings.Contains(section, "actions:") {
+			data += "actions:\n  - name: b\n    run: make\n"
+		}
+		data += "stages:\n  ci:\n    steps:\n      - action: b\n"
+		config, err := LoadConfigFromBytes([]byte(data))
+		if err != nil {
+			t.Fatalf("%s: LoadConfigFromBytes() error = %v", name, err)
+		}
+		if err := config.Validate(); err == nil {
+			t.Errorf("%s: Validate() should fail", name)
+		}
+	}
+}
+
+func TestRunner_Diagnostics(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("diagnostics tests use a POSIX shell")
+	}
+	config, err := LoadConfigFromBytes([]byte(`project:
+  name: test
+actions:
+  - name: build
+    run: |
+      echo 'src/main.go:3:5: undefined: foo'
+      echo 'src/main.go:4:1: missing return'
+      exit 2
+  - name: ok
+    run: "echo 'main.go:1:1: not a failure'"
+stages:
+  ci:
+    steps:
+      - action: build
+      - action: ok
+`))
+	if err != nil {
+		t.Fatalf("LoadConfigFromBytes() error = %v", err)
+	}
+	dir := t.TempDir()
+	callback := &diagnosticsCallback{diagnostics: map[string][]Diagnostic{}}
+	opts := &RunOptions{WorkingDir: dir, StepCallback: callback, Output: io.Discard, ErrorOutput: io.Discard}
+	runner := NewRunner(config, opts)
+	if err := runner.RunStage(context.Background(), "ci"); err == nil {
+		t.Fatal("RunStage() should fail")
+	}
+
+	// Files are resolved against the step's directory
+	want := filepath.ToSlash(displayPath(filepath.Join(dir, "src", "main.go")))
+	for _, result := range runner.Results() {
+		switch result.Name {
+		case "build":
+			if len(result.Diagnostics) != 2 || result.Diagnostics[0].File != want || result.Diagnostics[1].Line != 4 {
+				t.Errorf("build diagnostics = %+v", result.Diagnostics)
+			}
+		case "ok":
+			if len(result.Diagnostics) != 0 {
+				t.Errorf("successful steps have no diagnostics, got %+v", result.Diagnostics)
+			}
+		}
+	}
+	if len(callback.diagnostics["build"]) != 2 || len(callback.diagnostics) != 1 {
+		t.Errorf("callback diagnostics = %+v", callback.diagnostics)
+	}
+}
+
+// diagnosticsCallback records the diagnostics passed to a step callback
+type diagnosticsCallback struct {
+	MockStepCallback
+	diagnostics map[string][]Diagnostic
+}
+
+func (c *diagnosticsCallback) OnStepDiagnostics(ctx context.Context, stepName string, diagnostics []Diagnostic) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.diagnostics[stepName] = diagnostics
+}
+
+func TestSimpleRunner_DiagnosticsSummary(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("diagnostics tests use a POSIX shell")
+	}
+	config, err := LoadConfigFromBytes([]byte(`project:
+  name: test
+actions:
+  - name: compile
+    run: |
+      for i in 1 2 3 4 5 6 7; do echo "main.c:$i:1: error: e$i"; done
+      exit 1
+stages:
+  ci:
+    steps:
+      - action: compile
+`))
+	if err != nil {
+		t.Fatalf("LoadConfigFromBytes() error = %v", err)
+	}
+	var out, errOut bytes.Buffer
+	opts := DefaultSimpleRunOptions()
+	opts.WorkingDir = t.TempDir()
+	opts.Output = &out
+	opts.ErrorOutput = &errOut
+	opts.CI = CIGitHub
+	opts.Reports = []ReportSpec{{Format: ReportJSON, Path: filepath.Join(opts.WorkingDir, "report.json")}}
+	if err := NewSimpleRunner(config, opts).RunStage(context.Background(), "ci"); err == nil {
+		t.Fatal("RunStage() should fail")
+	}
+
+	file := filepath.ToSlash(displayPath(filepath.Join(opts.WorkingDir, "main.c")))
+	summary := out.String()[strings.Index(out.String(), "🔍 Problems:"):]
+	if !strings.Contains(summary, file+":5:1: e5\n") || strings.Contains(summary, "main.c:6:1") || !strings.Contains(summary, "... and 2 more") {
+		t.Errorf("summary =\n%s", summary)
+	}
+	if !strings.Contains(errOut.String(), "::error file="+githubEscapeProperty(file)+",line=7,col=1,title=compile::e7\n") {
+		t.Errorf("error output should annotate the diagnostics:\n%s", errOut.String())
+	}
+	report, err := os.ReadFile(opts.Reports[0].Path)
+	if err != nil || !strings.Contains(string(report), `"message": "e7"`) {
+		t.Errorf("report = %s, %v", report, err)
+	}
+}
+
+func TestCIStepCallback_Diagnostics(t *testing.T) {
+	var out bytes.Buffer
+	c := NewCIStepCallback(CIGitHub, &MockStepCallback{}, &out, "").(*CIStepCallback)
+	ctx := context.Background()
+	var diagnostics []Diagnostic
+	for i := 0; i < ciDiagnostics+2; i++ {
+		diagnostics = append(diagnostics, Diagnostic{File: "a.go", Line: i + 1, Severity: DiagnosticWarning, Message: "m", Code: "lint"})
+	}
+	c.OnStepDiagnostics(ctx, "lint", diagnostics)
+	c.OnStepComplete(ctx, "lint", StepStatusOK, "executed successfully", time.Second)
+	if n := strings.Count(out.String(), "::warning file=a.go,"); n != ciDiagnostics {
+		t.Errorf("got %d annotations, want %d:\n%s", n, ciDiagnostics, out.String())
+	}
+	if !strings.HasPrefix(out.String(), "::warning file=a.go,line=1,title=lint (lint)::m\n") {
+		t.Errorf("output = %q", out.String())
+	}
+}
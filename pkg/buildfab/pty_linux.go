@@ -0,0 +1,156 @@
+//go:build linux
+
+package buildfab
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// ptyDrainTimeout bounds the wait for output after the command exits, in case
+// a process it left behind keeps the terminal open
+const ptyDrainTimeout = time.Second
+
+// runOnTerminal runs cmd on a new pseudo-terminal. Input from the pump is
+// written to the terminal and its output copied to output. When the input is
+// a terminal it is switched to raw mode, so keys like Ctrl-C reach the
+// command, and its size is copied.
+func runOnTerminal(cmd *exec.Cmd, pump *inputPump, input io.Reader, output io.Writer) error {
+	master, slave, err := openPTY()
+	if err != nil {
+		return err
+	}
+	defer master.Close()
+
+	if f, ok := input.(*os.File); ok {
+		if size, err := ioctlWinsize(f.Fd(), syscall.TIOCGWINSZ, nil); err == nil {
+			ioctlWinsize(master.Fd(), syscall.TIOCSWINSZ, size)
+		}
+		if restore, err := makeRaw(f.Fd()); err == nil {
+			defer restore()
+		}
+	}
+
+	cmd.Stdin = slave
+	cmd.Stdout = slave
+	cmd.Stderr = slave
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true, Setctty: true, Ctty: 0}
+	err = cmd.Start()
+	slave.Close()
+	if err != nil {
+		return err
+	}
+
+	copied := make(chan struct{})
+	go func() {
+		// Reading fails with EIO once no process has the terminal open
+		io.Copy(output, master)
+		close(copied)
+	}()
+	exited := make(chan struct{})
+	detach := pump.attach(master)
+	go func() {
+		select {
+		case <-pump.done:
+			// End of input is end of file on the terminal
+			master.Write([]byte{4})
+		case <-exited:
+		}
+	}()
+
+	err = cmd.Wait()
+	close(exited)
+	detach()
+	select {
+	case <-copied:
+	case <-time.After(ptyDrainTimeout):
+	}
+	return err
+}
+
+// openPTY opens a new pseudo-terminal pair
+func openPTY() (*os.File, *os.File, error) {
+	master, err := os.OpenFile("/dev/ptmx", os.O_RDWR|syscall.O_NOCTTY|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open pseudo-terminal: %w", err)
+	}
+	var unlock int32
+	if err := ioctl(master.Fd(), syscall.TIOCSPTLCK, unsafe.Pointer(&unlock)); err != nil {
+		master.Close()
+		return nil, nil, fmt.Errorf("failed to unlock pseudo-terminal: %w", err)
+	}
+	var n uint32
+	if err := ioctl(master.Fd(), syscall.TIOCGPTN, unsafe.Pointer(&n)); err != nil {
+		master.Close()
+		return nil, nil, fmt.Errorf("failed to get pseudo-terminal number: %w", err)
+	}
+	slave, err := os.OpenFile(fmt.Sprintf("/dev/pts/%d", n), os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		master.Close()
+		return nil, nil, fmt.Errorf("failed to open pseudo-terminal: %w", err)
+	}
+	return master, slave, nil
+}
+
+// makeRaw puts a terminal in raw mode and returns a function restoring it
+func makeRaw(fd uintptr) (func(), error) {
+	var old syscall.Termios
+	if err := ioctl(fd, syscall.TCGETS, unsafe.Pointer(&old)); err != nil {
+		return nil, err
+	}
+	raw := old
+	raw.Iflag &^= syscall.IGNBRK | syscall.BRKINT | syscall.PARMRK | syscall.ISTRIP | syscall.INLCR | syscall.IGNCR | syscall.ICRNL | syscall.IXON
+	raw.Oflag &^= syscall.OPOST
+	raw.Lflag &^= syscall.ECHO | syscall.ECHONL | syscall.ICANON | syscall.ISIG | syscall.IEXTEN
+	raw.Cflag &^= syscall.CSIZE | syscall.PARENB
+	raw.Cflag |= syscall.CS8
+	raw.Cc[syscall.VMIN] = 1
+	raw.Cc[syscall.VTIME] = 0
+	if err := ioctl(fd, syscall.TCSETS, unsafe.Pointer(&raw)); err != nil {
+		return nil, err
+	}
+	return func() { ioctl(fd, syscall.TCSETS, unsafe.Pointer(&old)) }, nil
+}
+
+// winsize is the terminal size structure of TIOCGWINSZ
+type winsize struct {
+	Rows, Cols, X, Y uint16
+}
+
+// ioctlWinsize gets or sets the size of a terminal
+func ioctlWinsize(fd uintptr, request uintptr, size *winsize) (*winsize, error) {
+	if size == nil {
+		size = &winsize{}
+	}
+	if err := ioctl(fd, request, unsafe.Pointer(size)); err != nil {
+		return nil, err
+	}
+	return size, nil
+}
+
+func ioctl(fd, request uintptr, arg unsafe.Pointer) error {
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, request, uintptr(arg)); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// isTerminalFile reports whether f is a terminal
+func isTerminalFile(f *os.File) bool {
+	var termios syscall.Termios
+	return ioctl(f.Fd(), syscall.TCGETS, unsafe.Pointer(&termios)) == nil
+}
+
+// terminalWidth returns the number of columns of the terminal f, 0 when unknown
+func terminalWidth(f *os.File) int {
+	size, err := ioctlWinsize(f.Fd(), syscall.TIOCGWINSZ, nil)
+	if err != nil {
+		return 0
+	}
+	return int(size.Cols)
+}
@@ -0,0 +1,46 @@
+//go:build !linux
+
+package buildfab
+
+import (
+	"io"
+	"os"
+	"os/exec"
+)
+
+// runOnTerminal runs cmd with the terminal input and output. Without
+// pseudo-terminal support the command inherits the process's terminal when
+// the input is stdin not yet read by the input pump, otherwise it reads the
+// input through a pipe.
+func runOnTerminal(cmd *exec.Cmd, pump *inputPump, input io.Reader, output io.Writer) error {
+	if input == os.Stdin && !pump.running() {
+		cmd.Stdin = os.Stdin
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		return cmd.Run()
+	}
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	cmd.Stdout = output
+	cmd.Stderr = output
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	detach := pump.attach(stdin)
+	err = cmd.Wait()
+	detach()
+	return err
+}
+
+// isTerminalFile reports whether f is a terminal
+func isTerminalFile(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// terminalWidth returns the number of columns of the terminal f, 0 when unknown
+func terminalWidth(f *os.File) int {
+	return 0
+}
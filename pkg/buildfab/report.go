@@ -0,0 +1,322 @@
+package buildfab
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Report formats supported by --report
+const (
+	ReportJUnit    = "junit"
+	ReportMarkdown = "markdown"
+	ReportHTML     = "html"
+	ReportJSON     = "json"
+)
+
+// markdownOutputLines is the number of output lines of a failed step shown
+// in a Markdown report
+const markdownOutputLines = 50
+
+// ReportSpec is a report to write after a run, given as format=path
+type ReportSpec struct {
+	Format string
+	Path   string
+}
+
+// ParseReportSpec parses a format=path report specification
+func ParseReportSpec(spec string) (ReportSpec, error) {
+	format, path, ok := strings.Cut(spec, "=")
+	if !ok || path == "" {
+		return ReportSpec{}, fmt.Errorf("invalid report %q, expected format=path", spec)
+	}
+	switch format {
+	case ReportJUnit, ReportMarkdown, ReportHTML, ReportJSON:
+	default:
+		return ReportSpec{}, fmt.Errorf("unknown report format %q (supported: %s, %s, %s, %s)", format, ReportJUnit, ReportMarkdown, ReportHTML, ReportJSON)
+	}
+	return ReportSpec{Format: format, Path: path}, nil
+}
+
+// WriteReport writes the report to its path, creating parent directories.
+// A Markdown report to $GITHUB_STEP_SUMMARY is appended, as GitHub expects.
+func WriteReport(spec ReportSpec, stages []StageResult) error {
+	if dir := filepath.Dir(spec.Path); dir != "." {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return fmt.Errorf("failed to create report directory: %w", err)
+		}
+	}
+	flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if spec.Format == ReportMarkdown && spec.Path == os.Getenv("GITHUB_STEP_SUMMARY") {
+		flags = os.O_WRONLY | os.O_CREATE | os.O_APPEND
+	}
+	file, err := os.OpenFile(spec.Path, flags, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to create %s report: %w", spec.Format, err)
+	}
+	switch spec.Format {
+	case ReportJUnit:
+		err = WriteJUnitReport(file, stages)
+	case ReportMarkdown:
+		err = WriteMarkdownReport(file, stages)
+	case ReportHTML:
+		err = WriteHTMLReport(file, stages)
+	case ReportJSON:
+		err = WriteJSONReport(file, stages)
+	default:
+		err = fmt.Errorf("unknown report format %q", spec.Format)
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write %s report %s: %w", spec.Format, spec.Path, err)
+	}
+	return nil
+}
+
+// NewStageResult builds the result of a stage run started at start from the
+// runner results, with steps in declaration order. Steps without a result did
+// not run and are reported as skipped.
+func NewStageResult(stage *Stage, stageName string, results []Result, start time.Time, duration time.Duration, err error) StageResult {
+	byName := make(map[string]Result, len(results))
+	for _, result := range results {
+		byName[result.Name] = result
+	}
+	stageResult := StageResult{StageName: stageName, Success: err == nil, Start: start, Duration: duration, Error: err}
+	for _, step := range stage.Steps {
+		result, ok := byName[step.Action]
+		if !ok {
+			stageResult.Steps = append(stageResult.Steps, StepResult{
+				StepName:   step.Action,
+				ActionName: step.Action,
+				Status:     StepStatusSkipped,
+				Requires:   step.Require,
+				Message:    "skipped (not run)",
+			})
+			continue
+		}
+		var end time.Time
+		if !result.Start.IsZero() {
+			end = result.Start.Add(result.Duration)
+		}
+		stageResult.Steps = append(stageResult.Steps, StepResult{
+			StepName:    step.Action,
+			ActionName:  step.Action,
+			Status:      stepStatusOf(result.Status),
+			Start:       result.Start,
+			End:         end,
+			Duration:    result.Duration,
+			Requires:    step.Require,
+			Variant:     result.Variant,
+			ExitCode:    result.ExitCode,
+			Output:      result.Output,
+			Message:     result.Message,
+			Error:       result.Error,
+			Diagnostics: result.Diagnostics,
+		})
+	}
+	return stageResult
+}
+
+// stepStatusOf converts a runner status to a step status
+func stepStatusOf(status Status) StepStatus {
+	switch status {
+	case StatusOK:
+		return StepStatusOK
+	case StatusWarn:
+		return StepStatusWarn
+	case StatusError:
+		return StepStatusError
+	case StatusSkipped:
+		return StepStatusSkipped
+	case StatusRunning:
+		return StepStatusRunning
+	default:
+		return StepStatusPending
+	}
+}
+
+// failureText returns the message describing a failed or warned step
+func (s StepResult) failureText() string {
+	if s.Message != "" {
+		return s.Message
+	}
+	if s.Error != nil {
+		return s.Error.Error()
+	}
+	return s.Status.String()
+}
+
+type junitTestSuites struct {
+	XMLName  xml.Name         `xml:"testsuites"`
+	Tests    int              `xml:"tests,attr"`
+	Failures int              `xml:"failures,attr"`
+	Skipped  int              `xml:"skipped,attr"`
+	Time     string           `xml:"time,attr"`
+	Suites   []junitTestSuite `xml:"testsuite"`
+}
+
+type junitTestSuite struct {
+	Name     string          `xml:"name,attr"`
+	Tests    int             `xml:"tests,attr"`
+	Failures int             `xml:"failures,attr"`
+	Skipped  int             `xml:"skipped,attr"`
+	Time     string          `xml:"time,attr"`
+	Cases    []junitTestCase `xml:"testcase"`
+}
+
+type junitTestCase struct {
+	Name      string        `xml:"name,attr"`
+	Classname string        `xml:"classname,attr"`
+	Time      string        `xml:"time,attr"`
+	Failure   *junitMessage `xml:"failure,omitempty"`
+	Skipped   *junitMessage `xml:"skipped,omitempty"`
+	SystemOut string        `xml:"system-out,omitempty"`
+	SystemErr string        `xml:"system-err,omitempty"`
+}
+
+type junitMessage struct {
+	Message string `xml:"message,attr"`
+	Type    string `xml:"type,attr,omitempty"`
+	Text    string `xml:",chardata"`
+}
+
+// junitSeconds formats a duration as JUnit seconds
+func junitSeconds(d time.Duration) string {
+	return fmt.Sprintf("%.3f", d.Seconds())
+}
+
+// firstLine returns the first line of a message for attributes
+func firstLine(s string) string {
+	line, _, _ := strings.Cut(strings.TrimSpace(s), "\n")
+	return line
+}
+
+// WriteJUnitReport writes stage results as JUnit XML: each stage is a test
+// suite and each step a test case. Failed steps are failures, skipped steps
+// are skipped, warnings pass with the message in system-err and captured
+// output is attached as system-out.
+func WriteJUnitReport(w io.Writer, stages []StageResult) error {
+	report := junitTestSuites{}
+	var total time.Duration
+	for _, stage := range stages {
+		suite := junitTestSuite{Name: stage.StageName, Time: junitSeconds(stage.Duration)}
+		for _, step := range stage.Steps {
+			testCase := junitTestCase{
+				Name:      step.StepName,
+				Classname: stage.StageName,
+				Time:      junitSeconds(step.Duration),
+				SystemOut: step.Output,
+			}
+			switch step.Status {
+			case StepStatusError:
+				text := step.failureText()
+				testCase.Failure = &junitMessage{Message: firstLine(text), Type: "error", Text: text}
+				suite.Failures++
+			case StepStatusSkipped:
+				testCase.Skipped = &junitMessage{Message: step.failureText()}
+				suite.Skipped++
+			case StepStatusWarn:
+				testCase.SystemErr = step.failureText()
+			}
+			suite.Cases = append(suite.Cases, testCase)
+		}
+		suite.Tests = len(suite.Cases)
+		report.Suites = append(report.Suites, suite)
+		report.Tests += suite.Tests
+		report.Failures += suite.Failures
+		report.Skipped += suite.Skipped
+		total += stage.Duration
+	}
+	report.Time = junitSeconds(total)
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	encoder := xml.NewEncoder(w)
+	encoder.Indent("", "  ")
+	if err := encoder.Encode(report); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
+
+// markdownStatus returns the icon and label of a status for Markdown reports
+func markdownStatus(status StepStatus) string {
+	switch status {
+	case StepStatusOK:
+		return "✅ ok"
+	case StepStatusWarn:
+		return "⚠️ warn"
+	case StepStatusError:
+		return "❌ error"
+	case StepStatusSkipped:
+		return "⏭️ skipped"
+	default:
+		return status.String()
+	}
+}
+
+// markdownCell escapes text for a Markdown table cell
+func markdownCell(s string) string {
+	s = strings.ReplaceAll(s, "|", "\\|")
+	return strings.ReplaceAll(s, "\n", " ")
+}
+
+// WriteMarkdownReport writes stage results as a Markdown summary for pull
+// requests or $GITHUB_STEP_SUMMARY: a table of steps per stage and the
+// messages and last output lines of failed steps
+func WriteMarkdownReport(w io.Writer, stages []StageResult) error {
+	var b strings.Builder
+	for _, stage := range stages {
+		counts := map[StepStatus]int{}
+		for _, step := range stage.Steps {
+			counts[step.Status]++
+		}
+		result := "✅ succeeded"
+		if !stage.Success {
+			result = "❌ failed"
+		}
+		fmt.Fprintf(&b, "## %s `%s` in %s\n\n", result, stage.StageName, stage.Duration.Round(time.Millisecond))
+		fmt.Fprintf(&b, "%d ok, %d warn, %d error, %d skipped\n\n",
+			counts[StepStatusOK], counts[StepStatusWarn], counts[StepStatusError], counts[StepStatusSkipped])
+		b.WriteString("| Step | Status | Duration | Message |\n")
+		b.WriteString("|------|--------|----------|---------|\n")
+		for _, step := range stage.Steps {
+			message := ""
+			if step.Status != StepStatusOK {
+				message = firstLine(step.failureText())
+			}
+			fmt.Fprintf(&b, "| %s | %s | %s | %s |\n", markdownCell(step.StepName), markdownStatus(step.Status),
+				step.Duration.Round(time.Millisecond), markdownCell(message))
+		}
+		b.WriteString("\n")
+
+		for _, step := range stage.Steps {
+			if step.Status != StepStatusError {
+				continue
+			}
+			fmt.Fprintf(&b, "<details><summary>❌ %s</summary>\n\n", step.StepName)
+			fmt.Fprintf(&b, "```\n%s\n```\n", strings.TrimRight(step.failureText(), "\n"))
+			if output := strings.TrimRight(step.Output, "\n"); output != "" {
+				lines := strings.Split(output, "\n")
+				if len(lines) > markdownOutputLines {
+					fmt.Fprintf(&b, "\nLast %d of %d output lines:\n\n", markdownOutputLines, len(lines))
+					lines = lines[len(lines)-markdownOutputLines:]
+				} else {
+					b.WriteString("\nOutput:\n\n")
+				}
+				fmt.Fprintf(&b, "```\n%s\n```\n", strings.Join(lines, "\n"))
+			}
+			b.WriteString("\n</details>\n\n")
+		}
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
@@ -0,0 +1,174 @@
+package buildfab
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testStageResult returns a stage with a step of each status
+func testStageResult() StageResult {
+	return StageResult{
+		StageName: "release",
+		Duration:  3 * time.Second,
+		Steps: []StepResult{
+			{StepName: "build", Status: StepStatusOK, Duration: 1500 * time.Millisecond, Output: "compiling\ndone\n"},
+			{StepName: "lint", Status: StepStatusWarn, Message: "2 issues | style"},
+			{StepName: "test", Status: StepStatusError, Message: "failed, to check run:\n  go test ./...", Output: "--- FAIL: TestX\n"},
+			{StepName: "publish", Status: StepStatusSkipped, Message: "skipped (dependency failed: test)"},
+		},
+	}
+}
+
+func TestWriteJUnitReport(t *testing.T) {
+	var buf bytes.Buffer
+	if err := WriteJUnitReport(&buf, []StageResult{testStageResult()}); err != nil {
+		t.Fatalf("WriteJUnitReport() error = %v", err)
+	}
+	if !strings.HasPrefix(buf.String(), xml.Header) {
+		t.Errorf("report should start with the XML header:\n%s", buf.String())
+	}
+
+	var report junitTestSuites
+	if err := xml.Unmarshal(buf.Bytes(), &report); err != nil {
+		t.Fatalf("invalid XML: %v\n%s", err, buf.String())
+	}
+	if report.Tests != 4 || report.Failures != 1 || report.Skipped != 1 || len(report.Suites) != 1 {
+		t.Fatalf("report = %+v", report)
+	}
+	suite := report.Suites[0]
+	if suite.Name != "release" || suite.Time != "3.000" {
+		t.Errorf("suite = %s %s", suite.Name, suite.Time)
+	}
+	build, lint, test, publish := suite.Cases[0], suite.Cases[1], suite.Cases[2], suite.Cases[3]
+	if build.Time != "1.500" || build.SystemOut != "compiling\ndone\n" || build.Failure != nil {
+		t.Errorf("build = %+v", build)
+	}
+	if lint.Failure != nil || lint.SystemErr != "2 issues | style" {
+		t.Errorf("warning should pass with the message in system-err, got %+v", lint)
+	}
+	if test.Failure == nil || test.Failure.Message != "failed, to check run:" || !strings.Contains(test.Failure.Text, "go test ./...") {
+		t.Errorf("test failure = %+v", test.Failure)
+	}
+	if publish.Skipped == nil || !strings.Contains(publish.Skipped.Message, "dependency failed") {
+		t.Errorf("publish skipped = %+v", publish.Skipped)
+	}
+}
+
+func TestWriteMarkdownReport(t *testing.T) {
+	stage := testStageResult()
+	var output strings.Builder
+	for i := 1; i <= markdownOutputLines+10; i++ {
+		fmt.Fprintf(&output, "line %d\n", i)
+	}
+	stage.Steps[2].Output = output.String()
+
+	var buf bytes.Buffer
+	if err := WriteMarkdownReport(&buf, []StageResult{stage}); err != nil {
+		t.Fatalf("WriteMarkdownReport() error = %v", err)
+	}
+	report := buf.String()
+	for _, want := range []string{
+		"## ❌ failed `release` in 3s",
+		"1 ok, 1 warn, 1 error, 1 skipped",
+		"| build | ✅ ok | 1.5s |  |",
+		"| lint | ⚠️ warn | 0s | 2 issues \\| style |",
+		"<details><summary>❌ test</summary>",
+		fmt.Sprintf("Last %d of %d output lines", markdownOutputLines, markdownOutputLines+10),
+		fmt.Sprintf("line %d\n```", markdownOutputLines+10),
+	} {
+		if !strings.Contains(report, want) {
+			t.Errorf("report missing %q:\n%s", want, report)
+		}
+	}
+	if strings.Contains(report, "line 10\n") {
+		t.Error("only the last output lines should be shown")
+	}
+}
+
+func TestParseReportSpec(t *testing.T) {
+	spec, err := ParseReportSpec("junit=reports/buildfab.xml")
+	if err != nil || spec != (ReportSpec{Format: ReportJUnit, Path: "reports/buildfab.xml"}) {
+		t.Errorf("ParseReportSpec() = %+v, %v", spec, err)
+	}
+	for _, invalid := range []string{"junit", "junit=", "pdf=out.pdf"} {
+		if _, err := ParseReportSpec(invalid); err == nil {
+			t.Errorf("ParseReportSpec(%q) should fail", invalid)
+		}
+	}
+}
+
+func TestSimpleRunner_Reports(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("report tests use a POSIX shell")
+	}
+	config, err := LoadConfigFromBytes([]byte(`project:
+  name: test
+actions:
+  - name: build
+    run: echo building; echo warning >&2
+  - name: test
+    run: 'echo "--- FAIL: TestX"; exit 1'
+  - name: publish
+    run: "true"
+stages:
+  release:
+    steps:
+      - action: build
+      - action: test
+        require: [build]
+      - action: publish
+        require: [test]
+`))
+	if err != nil {
+		t.Fatalf("LoadConfigFromBytes() error = %v", err)
+	}
+	dir := t.TempDir()
+	junitPath := filepath.Join(dir, "reports", "junit.xml")
+	markdownPath := filepath.Join(dir, "summary.md")
+	for _, verbose := range []bool{false, true} {
+		t.Run(fmt.Sprintf("verbose=%v", verbose), func(t *testing.T) {
+			opts := DefaultSimpleRunOptions()
+			opts.WorkingDir = dir
+			opts.Verbose = verbose
+			opts.Output = io.Discard
+			opts.ErrorOutput = io.Discard
+			opts.Reports = []ReportSpec{{Format: ReportJUnit, Path: junitPath}, {Format: ReportMarkdown, Path: markdownPath}}
+			if err := NewSimpleRunner(config, opts).RunStage(context.Background(), "release"); err == nil {
+				t.Fatal("RunStage() should fail")
+			}
+
+			data, err := os.ReadFile(junitPath)
+			if err != nil {
+				t.Fatalf("junit report: %v", err)
+			}
+			var report junitTestSuites
+			if err := xml.Unmarshal(data, &report); err != nil {
+				t.Fatalf("invalid XML: %v", err)
+			}
+			if report.Tests != 3 || report.Failures != 1 || report.Skipped != 1 {
+				t.Fatalf("report = %+v", report)
+			}
+			cases := report.Suites[0].Cases
+			if cases[0].Name != "build" || !strings.Contains(cases[0].SystemOut, "building") || !strings.Contains(cases[0].SystemOut, "warning") {
+				t.Errorf("build = %+v, want captured stdout and stderr", cases[0])
+			}
+			if cases[1].Failure == nil || !strings.Contains(cases[1].SystemOut, "--- FAIL: TestX") {
+				t.Errorf("test = %+v", cases[1])
+			}
+
+			markdown, err := os.ReadFile(markdownPath)
+			if err != nil || !strings.Contains(string(markdown), "| publish | ⏭️ skipped |") {
+				t.Errorf("markdown report = %s, %v", markdown, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,575 @@
+package buildfab
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// RunsDir is the directory in the state directory holding the step logs of
+// each run, in a directory named after the run ID
+const RunsDir = "runs"
+
+// Stream tags of step log lines
+const (
+	StreamStdout = "stdout"
+	StreamStderr = "stderr"
+	StreamStatus = "status" // Lines written by buildfab, such as the step result
+)
+
+// Run states recorded in run.json
+const (
+	RunRunning = "running"
+	RunOK      = "ok"
+	RunFailed  = "failed"
+	RunAborted = "aborted" // Read for running runs whose process is gone, killed or crashed
+)
+
+const (
+	defaultKeepRuns   = 20
+	runInfoFile       = "run.json"
+	runIDFormat       = "20060102-150405.000"
+	runLogTimeFormat  = "2006-01-02T15:04:05.000Z07:00"
+	runFollowInterval = 200 * time.Millisecond
+)
+
+// LogPolicy configures how many runs are kept in .buildfab/runs. Older runs
+// are pruned when a new run starts.
+type LogPolicy struct {
+	KeepRuns int    `yaml:"keep_runs,omitempty"` // Number of runs kept (default: 20)
+	MaxAge   string `yaml:"max_age,omitempty"`   // Runs older than this duration are removed, e.g. 168h
+}
+
+// validate checks the retention values
+func (p LogPolicy) validate() error {
+	if p.KeepRuns < 0 {
+		return fmt.Errorf("logs keep_runs must not be negative, got %d", p.KeepRuns)
+	}
+	if p.MaxAge != "" {
+		if age, err := time.ParseDuration(p.MaxAge); err != nil || age <= 0 {
+			return fmt.Errorf("invalid logs max_age %q", p.MaxAge)
+		}
+	}
+	return nil
+}
+
+// keepRuns returns the number of runs to keep
+func (p LogPolicy) keepRuns() int {
+	if p.KeepRuns == 0 {
+		return defaultKeepRuns
+	}
+	return p.KeepRuns
+}
+
+// maxAge returns the age after which runs are removed, zero for no limit
+func (p LogPolicy) maxAge() time.Duration {
+	age, _ := time.ParseDuration(p.MaxAge)
+	return age
+}
+
+// RunInfo describes a run, stored as run.json in its directory
+type RunInfo struct {
+	ID     string     `json:"id"`
+	Stage  string     `json:"stage"`
+	Status string     `json:"status"`
+	Start  time.Time  `json:"start"`
+	End    *time.Time `json:"end,omitempty"`
+	PID    int        `json:"pid,omitempty"` // Process running the stage
+
+	dir string
+}
+
+// Dir returns the directory of the run
+func (i RunInfo) Dir() string {
+	return i.dir
+}
+
+// RunLog writes the step logs of a run to .buildfab/runs/<run-id>/<step>.log.
+// Each line has a timestamp and a stream tag, and secrets are masked. A nil
+// RunLog writes nothing.
+type RunLog struct {
+	info   RunInfo
+	masker *Masker
+
+	mu    sync.Mutex
+	steps map[string]*StepLog
+}
+
+// NewRunLog creates the directory of a new run of a stage in the state
+// directory. Run IDs are the start time, so they sort chronologically.
+func NewRunLog(stateDir, stage string, masker *Masker) (*RunLog, error) {
+	runsDir := filepath.Join(stateDir, RunsDir)
+	if err := os.MkdirAll(runsDir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create runs directory: %w", err)
+	}
+	start := time.Now()
+	id := start.Format(runIDFormat)
+	dir := filepath.Join(runsDir, id)
+	for n := 2; ; n++ {
+		err := os.Mkdir(dir, 0755)
+		if err == nil {
+			break
+		}
+		if !os.IsExist(err) {
+			return nil, fmt.Errorf("failed to create run directory: %w", err)
+		}
+		id = fmt.Sprintf("%s-%d", start.Format(runIDFormat), n)
+		dir = filepath.Join(runsDir, id)
+	}
+	l := &RunLog{
+		info:   RunInfo{ID: id, Stage: stage, Status: RunRunning, Start: start, PID: os.Getpid(), dir: dir},
+		masker: masker,
+		steps:  make(map[string]*StepLog),
+	}
+	if err := l.writeInfo(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// ID returns the run ID
+func (l *RunLog) ID() string {
+	return l.info.ID
+}
+
+// Dir returns the directory of the run
+func (l *RunLog) Dir() string {
+	return l.info.dir
+}
+
+// Step returns the log of a step, creating it on first use. It returns nil
+// when the log cannot be created; logs never fail a run.
+func (l *RunLog) Step(name string) *StepLog {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if step, ok := l.steps[name]; ok {
+		return step
+	}
+	file, err := os.OpenFile(filepath.Join(l.info.dir, sanitizeFileName(name)+".log"), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		l.steps[name] = nil
+		return nil
+	}
+	step := &StepLog{file: file, masker: l.masker}
+	l.steps[name] = step
+	return step
+}
+
+// Close closes the step logs and records the end and outcome of the run
+func (l *RunLog) Close(success bool) error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	for _, step := range l.steps {
+		step.Close()
+	}
+	end := time.Now()
+	l.info.End = &end
+	l.info.Status = RunFailed
+	if success {
+		l.info.Status = RunOK
+	}
+	l.mu.Unlock()
+	return l.writeInfo()
+}
+
+// writeInfo writes run.json, through a rename so readers never see it partial
+func (l *RunLog) writeInfo() error {
+	data, err := json.MarshalIndent(l.info, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(l.info.dir, runInfoFile)
+	if err := os.WriteFile(path+".tmp", append(data, '\n'), 0644); err != nil {
+		return fmt.Errorf("failed to write run info: %w", err)
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// StepLog is the log file of a step. Lines are written whole, so output of
+// concurrent streams interleaves by line. A nil StepLog writes nothing.
+type StepLog struct {
+	mu      sync.Mutex
+	file    *os.File
+	masker  *Masker
+	writers []*streamWriter
+	closed  bool
+}
+
+// Line writes a line of a stream with the current time
+func (s *StepLog) Line(stream, text string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.writeLocked(stream, text)
+}
+
+func (s *StepLog) writeLocked(stream, text string) {
+	if s.closed {
+		return
+	}
+	fmt.Fprintf(s.file, "%s %s %s\n", time.Now().Format(runLogTimeFormat), stream, s.masker.Mask(strings.TrimSuffix(text, "\r")))
+}
+
+// Writer returns a writer splitting its input into lines of a stream. An
+// incomplete last line is written when the log is closed.
+func (s *StepLog) Writer(stream string) io.Writer {
+	if s == nil {
+		return io.Discard
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	w := &streamWriter{log: s, stream: stream}
+	s.writers = append(s.writers, w)
+	return w
+}
+
+// Finish writes the result of the step and the error it failed with
+func (s *StepLog) Finish(result Result, err error) {
+	if s == nil {
+		return
+	}
+	line := fmt.Sprintf("%s in %s", stepStatusOf(result.Status), formatReportDuration(result.Duration))
+	if result.Variant != "" {
+		line += fmt.Sprintf(" (variant %s)", result.Variant)
+	}
+	if err != nil {
+		line += ": " + err.Error()
+	} else if result.Status != StatusOK && result.Message != "" {
+		line += ": " + firstLine(result.Message)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.flushLocked()
+	s.writeLocked(StreamStatus, line)
+}
+
+// Close writes incomplete lines and closes the file
+func (s *StepLog) Close() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return
+	}
+	s.flushLocked()
+	s.closed = true
+	s.file.Close()
+}
+
+func (s *StepLog) flushLocked() {
+	for _, w := range s.writers {
+		if len(w.partial) > 0 {
+			s.writeLocked(w.stream, string(w.partial))
+			w.partial = nil
+		}
+	}
+}
+
+// streamWriter splits writes into log lines
+type streamWriter struct {
+	log     *StepLog
+	stream  string
+	partial []byte
+}
+
+func (w *streamWriter) Write(p []byte) (int, error) {
+	w.log.mu.Lock()
+	defer w.log.mu.Unlock()
+	data := append(w.partial, p...)
+	for {
+		i := bytes.IndexByte(data, '\n')
+		if i < 0 {
+			break
+		}
+		w.log.writeLocked(w.stream, string(data[:i]))
+		data = data[i+1:]
+	}
+	w.partial = append([]byte(nil), data...)
+	return len(p), nil
+}
+
+// startStepLog writes the start of a step to its log in the run log, if any
+func (r *Runner) startStepLog(name string) {
+	r.opts.RunLog.Step(name).Line(StreamStatus, "started")
+}
+
+// finishStepLog writes the result of a step to its log and closes it
+func (r *Runner) finishStepLog(name string, result Result, err error) {
+	step := r.opts.RunLog.Step(name)
+	step.Finish(result, err)
+	step.Close()
+}
+
+// ListRuns returns the runs in the state directory, oldest first
+func ListRuns(stateDir string) ([]RunInfo, error) {
+	entries, err := os.ReadDir(filepath.Join(stateDir, RunsDir))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var runs []RunInfo
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		dir := filepath.Join(stateDir, RunsDir, entry.Name())
+		info, err := readRunInfo(dir)
+		if err != nil {
+			// Keep runs without run.json so they can still be read and pruned
+			info = RunInfo{ID: entry.Name(), dir: dir}
+			if stat, err := entry.Info(); err == nil {
+				info.Start = stat.ModTime()
+			}
+		}
+		runs = append(runs, info)
+	}
+	sort.SliceStable(runs, func(i, j int) bool { return runs[i].ID < runs[j].ID })
+	return runs, nil
+}
+
+// FormatRunTable prints runs as a table
+func FormatRunTable(w io.Writer, runs []RunInfo) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "RUN\tSTAGE\tSTATUS\tSTARTED\tDURATION")
+	for _, run := range runs {
+		duration := "-"
+		if run.End != nil {
+			duration = formatReportDuration(run.End.Sub(run.Start))
+		}
+		status := run.Status
+		if status == "" {
+			status = "unknown"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", run.ID, run.Stage, status, run.Start.Format("2006-01-02 15:04:05"), duration)
+	}
+	tw.Flush()
+}
+
+// readRunInfo reads the run.json of a run directory. A running run whose
+// process no longer exists is reported as RunAborted; runs recorded without
+// a pid are taken as still running.
+func readRunInfo(dir string) (RunInfo, error) {
+	data, err := os.ReadFile(filepath.Join(dir, runInfoFile))
+	if err != nil {
+		return RunInfo{}, err
+	}
+	var info RunInfo
+	if err := json.Unmarshal(data, &info); err != nil {
+		return RunInfo{}, fmt.Errorf("invalid run info in %s: %w", dir, err)
+	}
+	info.dir = dir
+	if info.Status == RunRunning && info.PID > 0 && !processAlive(info.PID) {
+		info.Status = RunAborted
+	}
+	return info, nil
+}
+
+// FindRun returns the run with the given ID, or the latest run when the ID
+// is empty or "latest"
+func FindRun(stateDir, id string) (RunInfo, error) {
+	runs, err := ListRuns(stateDir)
+	if err != nil {
+		return RunInfo{}, err
+	}
+	if len(runs) == 0 {
+		return RunInfo{}, fmt.Errorf("no runs recorded in %s", filepath.Join(stateDir, RunsDir))
+	}
+	if id == "" || id == "latest" {
+		return runs[len(runs)-1], nil
+	}
+	for _, run := range runs {
+		if run.ID == id {
+			return run, nil
+		}
+	}
+	return RunInfo{}, fmt.Errorf("run not found: %s", id)
+}
+
+// PruneRuns removes the runs beyond the newest keep runs and the runs older
+// than maxAge, if it is not zero. The run named current and runs whose
+// process is still running, in another buildfab, are never removed.
+func PruneRuns(stateDir string, keep int, maxAge time.Duration, current string) ([]string, error) {
+	runs, err := ListRuns(stateDir)
+	if err != nil {
+		return nil, err
+	}
+	var removed []string
+	for i, run := range runs {
+		if run.ID == current || run.Status == RunRunning {
+			continue
+		}
+		tooMany := len(runs)-i > keep
+		tooOld := maxAge > 0 && time.Since(run.Start) > maxAge
+		if !tooMany && !tooOld {
+			continue
+		}
+		if err := os.RemoveAll(run.dir); err != nil {
+			return removed, fmt.Errorf("failed to remove run %s: %w", run.ID, err)
+		}
+		removed = append(removed, run.ID)
+	}
+	return removed, nil
+}
+
+// StepLogs returns the step names of a run, in the order the steps started
+func (i RunInfo) StepLogs() ([]string, error) {
+	paths, err := filepath.Glob(filepath.Join(i.dir, "*.log"))
+	if err != nil {
+		return nil, err
+	}
+	type stepStart struct {
+		name  string
+		start string
+	}
+	var steps []stepStart
+	for _, path := range paths {
+		steps = append(steps, stepStart{name: strings.TrimSuffix(filepath.Base(path), ".log"), start: firstLogTime(path)})
+	}
+	sort.SliceStable(steps, func(a, b int) bool { return steps[a].start < steps[b].start })
+	names := make([]string, len(steps))
+	for n, step := range steps {
+		names[n] = step.name
+	}
+	return names, nil
+}
+
+// firstLogTime returns the timestamp of the first line of a log
+func firstLogTime(path string) string {
+	file, err := os.Open(path)
+	if err != nil {
+		return ""
+	}
+	defer file.Close()
+	line, _ := bufio.NewReader(file).ReadString('\n')
+	timestamp, _, _ := strings.Cut(line, " ")
+	return timestamp
+}
+
+// WriteRunLogs writes the log of a step of a run, or the logs of all its
+// steps in start order under a header per step
+func WriteRunLogs(w io.Writer, run RunInfo, step string) error {
+	if step != "" {
+		return copyStepLog(w, run, step)
+	}
+	steps, err := run.StepLogs()
+	if err != nil {
+		return err
+	}
+	for i, name := range steps {
+		if i > 0 {
+			fmt.Fprintln(w)
+		}
+		fmt.Fprintf(w, "==> %s <==\n", name)
+		if err := copyStepLog(w, run, name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copyStepLog copies a step log to w
+func copyStepLog(w io.Writer, run RunInfo, step string) error {
+	file, err := os.Open(filepath.Join(run.dir, sanitizeFileName(step)+".log"))
+	if os.IsNotExist(err) {
+		return fmt.Errorf("no log for step %s in run %s", step, run.ID)
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = io.Copy(w, file)
+	return err
+}
+
+// FollowRunLogs writes the log of a step of a run, or the logs of all its
+// steps with the step name as prefix, as they grow until the run ends, its
+// process is gone or ctx is done
+func FollowRunLogs(ctx context.Context, w io.Writer, run RunInfo, step string) error {
+	offsets := map[string]int64{}
+	partial := map[string][]byte{}
+	poll := func() error {
+		names := []string{step}
+		if step == "" {
+			var err error
+			if names, err = run.StepLogs(); err != nil {
+				return err
+			}
+		}
+		for _, name := range names {
+			data, err := readFrom(filepath.Join(run.dir, sanitizeFileName(name)+".log"), offsets[name])
+			if err != nil {
+				return err
+			}
+			offsets[name] += int64(len(data))
+			data = append(partial[name], data...)
+			i := bytes.LastIndexByte(data, '\n')
+			partial[name] = append([]byte(nil), data[i+1:]...)
+			if i < 0 {
+				continue
+			}
+			for _, line := range strings.SplitAfter(string(data[:i+1]), "\n") {
+				if line == "" {
+					continue
+				}
+				if step == "" {
+					fmt.Fprintf(w, "[%s] ", name)
+				}
+				io.WriteString(w, line)
+			}
+		}
+		return nil
+	}
+	for {
+		// Read the state before the logs, so the last lines of a run that
+		// ends in between are still written
+		info, infoErr := readRunInfo(run.dir)
+		if err := poll(); err != nil {
+			return err
+		}
+		if infoErr != nil || info.Status != RunRunning {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(runFollowInterval):
+		}
+	}
+}
+
+// readFrom reads a file from an offset, returning nothing for missing files
+func readFrom(path string, offset int64) ([]byte, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return io.ReadAll(file)
+}
@@ -0,0 +1,313 @@
+package buildfab
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+// logLine matches a step log line: timestamp, stream and text
+var logLine = regexp.MustCompile(`^\d{4}-\d\d-\d\dT\d\d:\d\d:\d\d\.\d{3}(Z|[+-]\d\d:\d\d) (stdout|stderr|status) (.*)$`)
+
+// readStepLog returns the stream and text of the lines of a step log
+func readStepLog(t *testing.T, dir, step string) []string {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join(dir, step+".log"))
+	if err != nil {
+		t.Fatalf("step log %s: %v", step, err)
+	}
+	var lines []string
+	for _, line := range strings.Split(strings.TrimSuffix(string(data), "\n"), "\n") {
+		m := logLine.FindStringSubmatch(line)
+		if m == nil {
+			t.Fatalf("malformed log line %q", line)
+		}
+		lines = append(lines, m[2]+" "+m[3])
+	}
+	return lines
+}
+
+func TestRunLog(t *testing.T) {
+	stateDir := t.TempDir()
+	runLog, err := NewRunLog(stateDir, "ci", NewMasker("hunter2"))
+	if err != nil {
+		t.Fatalf("NewRunLog() error = %v", err)
+	}
+	other, err := NewRunLog(stateDir, "ci", nil)
+	if err != nil || other.ID() == runLog.ID() {
+		t.Fatalf("runs started at once should get distinct IDs: %v, %v", other, err)
+	}
+
+	step := runLog.Step("build/linux")
+	if runLog.Step("build/linux") != step {
+		t.Error("Step() should return the open log of a step")
+	}
+	step.Line(StreamStatus, "started")
+	stdout, stderr := step.Writer(StreamStdout), step.Writer(StreamStderr)
+	fmt.Fprint(stdout, "compiling with hunter2\nlinking")
+	fmt.Fprint(stderr, "warning: unused\r\n")
+	fmt.Fprint(stdout, " done\nno newline")
+	step.Finish(Result{Status: StatusError, Duration: 1500 * time.Millisecond, Variant: "${{ os == 'linux' }}"}, errors.New("command failed: exit status 2"))
+	if err := runLog.Close(false); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+
+	want := []string{
+		"status started",
+		"stdout compiling with ***",
+		"stderr warning: unused",
+		"stdout linking done",
+		"stdout no newline",
+		"status error in 1.5s (variant ${{ os == 'linux' }}): command failed: exit status 2",
+	}
+	if lines := readStepLog(t, runLog.Dir(), "build_linux"); !reflect.DeepEqual(lines, want) {
+		t.Errorf("log lines = %q, want %q", lines, want)
+	}
+
+	run, err := FindRun(stateDir, runLog.ID())
+	if err != nil || run.Stage != "ci" || run.Status != RunFailed || run.End == nil {
+		t.Errorf("FindRun() = %+v, %v", run, err)
+	}
+	if latest, err := FindRun(stateDir, "latest"); err != nil || latest.ID != other.ID() || latest.Status != RunRunning {
+		t.Errorf("latest run = %+v, %v, want the running second run", latest, err)
+	}
+	if _, err := FindRun(stateDir, "20000101-000000.000"); err == nil {
+		t.Error("FindRun() should fail for an unknown run")
+	}
+
+	// A nil run log writes nothing
+	var none *RunLog
+	none.Step("x").Line(StreamStdout, "ignored")
+	fmt.Fprint(none.Step("x").Writer(StreamStdout), "ignored\n")
+	if err := none.Close(true); err != nil {
+		t.Errorf("nil Close() error = %v", err)
+	}
+}
+
+func TestPruneRuns(t *testing.T) {
+	stateDir := t.TempDir()
+	ids := []string{"20250101-100000.000", "20250102-100000.000", "20250103-100000.000", "20250104-100000.000"}
+	for _, id := range ids {
+		if err := os.MkdirAll(filepath.Join(stateDir, RunsDir, id), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The current run is kept even when it is the oldest
+	removed, err := PruneRuns(stateDir, 2, 0, ids[0])
+	if err != nil || !reflect.DeepEqual(removed, []string{ids[1]}) {
+		t.Fatalf("PruneRuns() = %v, %v", removed, err)
+	}
+	runs, _ := ListRuns(stateDir)
+	if len(runs) != 3 || runs[0].ID != ids[0] || runs[2].ID != ids[3] {
+		t.Errorf("runs = %+v", runs)
+	}
+
+	// Runs without run.json are dated by their directory
+	old := time.Now().Add(-48 * time.Hour)
+	os.Chtimes(filepath.Join(stateDir, RunsDir, ids[2]), old, old)
+	removed, err = PruneRuns(stateDir, 10, 24*time.Hour, ids[0])
+	if err != nil || !reflect.DeepEqual(removed, []string{ids[2]}) {
+		t.Errorf("PruneRuns() by age = %v, %v", removed, err)
+	}
+
+	// Runs of live processes are kept, runs of dead ones are pruned
+	live := writeRunInfo(t, stateDir, RunInfo{ID: "20240101-100000.000", Status: RunRunning, PID: os.Getpid()})
+	dead := writeRunInfo(t, stateDir, RunInfo{ID: "20240102-100000.000", Status: RunRunning, PID: deadPID})
+	removed, err = PruneRuns(stateDir, 1, 0, ids[3])
+	if err != nil || !reflect.DeepEqual(removed, []string{dead.ID, ids[0]}) {
+		t.Errorf("PruneRuns() with live runs = %v, %v", removed, err)
+	}
+	if _, err := FindRun(stateDir, live.ID); err != nil {
+		t.Errorf("live run should be kept: %v", err)
+	}
+}
+
+func TestLogPolicyValidate(t *testing.T) {
+	for _, policy := range []LogPolicy{{}, {KeepRuns: 5, MaxAge: "168h"}} {
+		if err := policy.validate(); err != nil {
+			t.Errorf("%+v: %v", policy, err)
+		}
+	}
+	for _, policy := range []LogPolicy{{KeepRuns: -1}, {MaxAge: "7d"}, {MaxAge: "-1h"}} {
+		if err := policy.validate(); err == nil {
+			t.Errorf("%+v should be invalid", policy)
+		}
+	}
+	if (LogPolicy{}).keepRuns() != defaultKeepRuns {
+		t.Error("keep_runs should default to 20")
+	}
+}
+
+func TestWriteRunLogs(t *testing.T) {
+	stateDir := t.TempDir()
+	runLog, err := NewRunLog(stateDir, "ci", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	runLog.Step("lint").Line(StreamStdout, "lint output")
+	time.Sleep(2 * time.Millisecond)
+	runLog.Step("build").Line(StreamStdout, "build output")
+	runLog.Close(true)
+	run, _ := FindRun(stateDir, "")
+
+	var all bytes.Buffer
+	if err := WriteRunLogs(&all, run, ""); err != nil {
+		t.Fatalf("WriteRunLogs() error = %v", err)
+	}
+	if !regexp.MustCompile(`(?s)^==> lint <==\n.*lint output\n\n==> build <==\n.*build output\n$`).MatchString(all.String()) {
+		t.Errorf("logs should be in start order:\n%s", all.String())
+	}
+
+	var one bytes.Buffer
+	if err := WriteRunLogs(&one, run, "build"); err != nil || strings.Contains(one.String(), "lint") || !strings.Contains(one.String(), "build output") {
+		t.Errorf("step log = %q, %v", one.String(), err)
+	}
+	if err := WriteRunLogs(io.Discard, run, "missing"); err == nil {
+		t.Error("WriteRunLogs() should fail for a step without a log")
+	}
+}
+
+func TestFollowRunLogs(t *testing.T) {
+	stateDir := t.TempDir()
+	runLog, err := NewRunLog(stateDir, "ci", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	run, _ := FindRun(stateDir, "")
+
+	var out lockedBuffer
+	done := make(chan error, 1)
+	go func() {
+		done <- FollowRunLogs(context.Background(), &out, run, "")
+	}()
+
+	build := runLog.Step("build")
+	build.Line(StreamStdout, "first")
+	time.Sleep(3 * runFollowInterval)
+	if !strings.Contains(out.String(), "[build] ") || !strings.Contains(out.String(), "stdout first") {
+		t.Errorf("followed output = %q, want the first line while running", out.String())
+	}
+	fmt.Fprint(build.Writer(StreamStderr), "last")
+	runLog.Close(true)
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("FollowRunLogs() error = %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("FollowRunLogs() should return when the run ends")
+	}
+	if !strings.Contains(out.String(), "[build] ") || !strings.HasSuffix(out.String(), "stderr last\n") {
+		t.Errorf("followed output = %q, want the lines written before the run ended", out.String())
+	}
+
+	// A run left running by a killed process has ended too
+	killed := writeRunInfo(t, stateDir, RunInfo{ID: "20250101-100000.000", Stage: "ci", Status: RunRunning, PID: deadPID})
+	if run, err := FindRun(stateDir, killed.ID); err != nil || run.Status != RunAborted {
+		t.Fatalf("FindRun() = %+v, %v, want an aborted run", run, err)
+	}
+	go func() {
+		done <- FollowRunLogs(context.Background(), io.Discard, killed, "")
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("FollowRunLogs() should return for a run whose process is gone")
+	}
+}
+
+// deadPID is a process ID beyond the range of live processes
+const deadPID = 1 << 30
+
+// writeRunInfo writes the run.json of a run and returns the run
+func writeRunInfo(t *testing.T, stateDir string, info RunInfo) RunInfo {
+	t.Helper()
+	info.dir = filepath.Join(stateDir, RunsDir, info.ID)
+	if err := os.MkdirAll(info.dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	data, _ := json.Marshal(info)
+	if err := os.WriteFile(filepath.Join(info.dir, runInfoFile), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return info
+}
+
+func TestSimpleRunner_RunLogs(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("run log tests use a POSIX shell")
+	}
+	config, err := LoadConfigFromBytes([]byte(`project:
+  name: test
+secrets: [TOKEN]
+env:
+  TOKEN: s3cr3t-value
+logs:
+  keep_runs: 2
+actions:
+  - name: build
+    run: echo "building with $TOKEN"; echo warning >&2
+  - name: test
+    run: echo testing; exit 3
+stages:
+  ci:
+    steps:
+      - action: build
+      - action: test
+        require: [build]
+`))
+	if err != nil {
+		t.Fatalf("LoadConfigFromBytes() error = %v", err)
+	}
+	if err := config.Validate(); err != nil {
+		t.Fatalf("Validate() error = %v", err)
+	}
+	dir := t.TempDir()
+	stateDir := filepath.Join(dir, StateDir)
+	for i, verbose := range []bool{false, true, false} {
+		t.Run(fmt.Sprintf("run %d verbose=%v", i, verbose), func(t *testing.T) {
+			opts := DefaultSimpleRunOptions()
+			opts.WorkingDir = dir
+			opts.Verbose = verbose
+			opts.Output = io.Discard
+			opts.ErrorOutput = io.Discard
+			opts.RunLogs = true
+			if err := NewSimpleRunner(config, opts).RunStage(context.Background(), "ci"); err == nil {
+				t.Fatal("RunStage() should fail")
+			}
+
+			run, err := FindRun(stateDir, "latest")
+			if err != nil || run.Stage != "ci" || run.Status != RunFailed {
+				t.Fatalf("run = %+v, %v", run, err)
+			}
+			build := strings.Join(readStepLog(t, run.Dir(), "build"), "\n")
+			for _, want := range []string{"status started", "stdout building with ***", "stderr warning", "status ok in "} {
+				if !strings.Contains(build, want) {
+					t.Errorf("build log missing %q:\n%s", want, build)
+				}
+			}
+			test := readStepLog(t, run.Dir(), "test")
+			if last := test[len(test)-1]; !strings.HasPrefix(last, "status error in ") || !strings.HasSuffix(last, "exit status 3") {
+				t.Errorf("test log = %q, want the exit status", test)
+			}
+		})
+	}
+
+	runs, err := ListRuns(stateDir)
+	if err != nil || len(runs) != 2 {
+		t.Errorf("runs = %+v, %v, want the 2 kept by keep_runs", runs, err)
+	}
+}
@@ -0,0 +1,91 @@
+package buildfab
+
+import (
+	"runtime"
+	"sort"
+	"time"
+)
+
+// defaultStepEstimate is the expected duration of steps when no step of the
+// stage has recorded durations, so longer chains of steps still go first
+const defaultStepEstimate = time.Second
+
+// HistoryDurations returns the median duration of each step of a stage in
+// the history, for RunOptions.StepDurations
+func HistoryDurations(records []HistoryRecord, stage string) map[string]time.Duration {
+	stats := ComputeStageStats(records, stage, 0)
+	durations := make(map[string]time.Duration, len(stats.Steps))
+	for _, step := range stats.Steps {
+		durations[step.Name] = step.P50
+	}
+	return durations
+}
+
+// slots returns the number of steps that may run at once
+func (r *Runner) slots() int {
+	if r.opts.MaxParallel > 0 {
+		return r.opts.MaxParallel
+	}
+	return runtime.NumCPU()
+}
+
+// prioritizeDAG sets the priority of each node to the expected length of the
+// longest path from the start of the node to the end of the stage, its
+// upward rank. Starting the ready nodes with the longest remaining path first
+// keeps the critical path moving when there are more ready nodes than slots.
+func (r *Runner) prioritizeDAG(dag map[string]*DAGNode) {
+	estimate := r.stepEstimate(dag)
+	done := make(map[string]bool, len(dag))
+	var rank func(name string) time.Duration
+	rank = func(name string) time.Duration {
+		node := dag[name]
+		if done[name] {
+			return node.priority
+		}
+		var longest time.Duration
+		for _, dependent := range node.Dependents {
+			if length := rank(dependent); length > longest {
+				longest = length
+			}
+		}
+		node.priority = estimate(name) + longest
+		done[name] = true
+		return node.priority
+	}
+	for name := range dag {
+		rank(name)
+	}
+}
+
+// stepEstimate returns the expected duration of a step: its recorded
+// duration, or the median of the recorded durations of the other steps
+func (r *Runner) stepEstimate(dag map[string]*DAGNode) func(name string) time.Duration {
+	var known []time.Duration
+	for name := range dag {
+		if d, ok := r.opts.StepDurations[name]; ok {
+			known = append(known, d)
+		}
+	}
+	fallback := defaultStepEstimate
+	if len(known) > 0 {
+		fallback = percentile(known, 50)
+	}
+	return func(name string) time.Duration {
+		if d, ok := r.opts.StepDurations[name]; ok {
+			return d
+		}
+		return fallback
+	}
+}
+
+// sortByPriority orders node names by priority, highest first, and by
+// declaration order for equal priorities
+func sortByPriority(dag map[string]*DAGNode, names []string) {
+	sort.Slice(names, func(i, j int) bool {
+		a, b := dag[names[i]], dag[names[j]]
+		if a.priority != b.priority {
+			return a.priority > b.priority
+		}
+		return a.order < b.order
+	})
+}
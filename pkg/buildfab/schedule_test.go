@@ -0,0 +1,246 @@
+package buildfab
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+// scheduleDAG builds the DAG of the ci stage of a config with the given step
+// durations
+func scheduleDAG(t *testing.T, yaml string, maxParallel int, durations map[string]time.Duration) (*Runner, map[string]*DAGNode) {
+	t.Helper()
+	config, err := LoadConfigFromBytes([]byte(yaml))
+	if err != nil {
+		t.Fatalf("LoadConfigFromBytes() error = %v", err)
+	}
+	r := NewRunner(config, &RunOptions{MaxParallel: maxParallel, StepDurations: durations, Output: io.Discard, ErrorOutput: io.Discard})
+	stage, _ := config.GetStage("ci")
+	dag, err := r.buildDAG(&stage)
+	if err != nil {
+		t.Fatalf("buildDAG() error = %v", err)
+	}
+	return r, dag
+}
+
+const scheduleConfig = `project:
+  name: test
+actions:
+  - name: lint
+    run: "true"
+  - name: docs
+    run: "true"
+  - name: compile
+    run: "true"
+  - name: test
+    run: "true"
+stages:
+  ci:
+    steps:
+      - action: lint
+      - action: docs
+      - action: compile
+      - action: test
+        require: [compile]
+`
+
+func TestPrioritizeDAG(t *testing.T) {
+	_, dag := scheduleDAG(t, scheduleConfig, 2, map[string]time.Duration{
+		"lint": time.Second, "compile": 10 * time.Second, "test": 20 * time.Second,
+	})
+	// docs has no recorded duration and gets the median of the others
+	want := map[string]time.Duration{"lint": time.Second, "docs": 10 * time.Second, "compile": 30 * time.Second, "test": 20 * time.Second}
+	for name, priority := range want {
+		if got := dag[name].priority; got != priority {
+			t.Errorf("priority of %s = %s, want %s", name, got, priority)
+		}
+	}
+
+	// Without history the longest chain goes first
+	_, dag = scheduleDAG(t, scheduleConfig, 2, nil)
+	if dag["compile"].priority != 2*defaultStepEstimate || dag["lint"].priority != defaultStepEstimate {
+		t.Errorf("priorities without history = compile %s, lint %s", dag["compile"].priority, dag["lint"].priority)
+	}
+}
+
+func TestGetReadyStepsLocked_CriticalPathFirst(t *testing.T) {
+	durations := map[string]time.Duration{"lint": time.Second, "docs": time.Second, "compile": 10 * time.Second, "test": 20 * time.Second}
+	r, dag := scheduleDAG(t, scheduleConfig, 2, durations)
+	// Map iteration order must not change the pick
+	for i := 0; i < 50; i++ {
+		ready := r.getReadyStepsLocked(dag, map[string]bool{}, map[string]bool{}, map[string]bool{})
+		if !reflect.DeepEqual(ready, []string{"compile", "lint"}) {
+			t.Fatalf("ready = %v, want compile and lint", ready)
+		}
+	}
+
+	// Equal priorities keep the declaration order
+	r, dag = scheduleDAG(t, scheduleConfig, 1, map[string]time.Duration{"lint": time.Second, "docs": time.Second, "compile": time.Second, "test": 0})
+	if ready := r.getReadyStepsLocked(dag, map[string]bool{}, map[string]bool{}, map[string]bool{}); !reflect.DeepEqual(ready, []string{"lint"}) {
+		t.Errorf("ready = %v, want lint", ready)
+	}
+}
+
+func TestGetReadyStepsLocked_Slots(t *testing.T) {
+	r, dag := scheduleDAG(t, scheduleConfig, 2, nil)
+	completed, failed, executing := map[string]bool{}, map[string]bool{}, map[string]bool{}
+
+	executing["compile"] = true
+	if ready := r.getReadyStepsLocked(dag, completed, failed, executing); !reflect.DeepEqual(ready, []string{"lint"}) {
+		t.Errorf("ready = %v, want lint in the one free slot", ready)
+	}
+	executing["lint"] = true
+	if ready := r.getReadyStepsLocked(dag, completed, failed, executing); len(ready) != 0 {
+		t.Errorf("ready = %v, want none while all slots are taken", ready)
+	}
+
+	// A step waiting for a confirmation or the terminal doesn't take a slot
+	r.terminalWaiting.Add(1)
+	if ready := r.getReadyStepsLocked(dag, completed, failed, executing); len(ready) != 1 {
+		t.Errorf("ready = %v, want one step in the slot of the waiting step", ready)
+	}
+	r.terminalWaiting.Add(-1)
+
+	// A step skipped for a failed dependency doesn't need a slot
+	completed["compile"], executing["compile"] = true, false
+	failed["compile"] = true
+	executing["docs"] = true
+	if ready := r.getReadyStepsLocked(dag, completed, failed, executing); !reflect.DeepEqual(ready, []string{"test"}) {
+		t.Errorf("ready = %v, want test to be skipped", ready)
+	}
+}
+
+// simulateMakespan runs the scheduler on simulated time and returns the time
+// at which the last step ends
+func simulateMakespan(r *Runner, dag map[string]*DAGNode, durations map[string]time.Duration) time.Duration {
+	completed, failed, executing := map[string]bool{}, map[string]bool{}, map[string]bool{}
+	ends := map[string]time.Duration{}
+	var now time.Duration
+	for len(completed) < len(dag) {
+		for _, name := range r.getReadyStepsLocked(dag, completed, failed, executing) {
+			executing[name] = true
+			ends[name] = now + durations[name]
+		}
+		// Advance to the next step to end
+		next := time.Duration(-1)
+		for name, end := range ends {
+			if !completed[name] && (next < 0 || end < next) {
+				next = end
+			}
+		}
+		now = next
+		for name, end := range ends {
+			if !completed[name] && end == now {
+				completed[name], executing[name] = true, false
+			}
+		}
+	}
+	return now
+}
+
+func TestSchedule_Makespan(t *testing.T) {
+	yaml := `project:
+  name: test
+actions:
+  - name: lint
+    run: "true"
+  - name: docs
+    run: "true"
+  - name: vet
+    run: "true"
+  - name: build
+    run: "true"
+  - name: package
+    run: "true"
+  - name: publish
+    run: "true"
+stages:
+  ci:
+    steps:
+      - action: lint
+      - action: docs
+      - action: vet
+      - action: build
+      - action: package
+        require: [build]
+      - action: publish
+        require: [package]
+`
+	durations := map[string]time.Duration{
+		"lint": 2 * time.Second, "docs": 2 * time.Second, "vet": 2 * time.Second,
+		"build": 6 * time.Second, "package": 6 * time.Second, "publish": 2 * time.Second,
+	}
+	r, dag := scheduleDAG(t, yaml, 2, durations)
+	if got := simulateMakespan(r, dag, durations); got != 14*time.Second {
+		t.Errorf("critical path first makespan = %s, want 14s", got)
+	}
+
+	// Declaration order starts build last and waits for it
+	for _, node := range dag {
+		node.priority = 0
+	}
+	if got := simulateMakespan(r, dag, durations); got != 16*time.Second {
+		t.Errorf("declaration order makespan = %s, want 16s", got)
+	}
+}
+
+func TestRunner_ScheduleOrder(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("schedule tests use a POSIX shell")
+	}
+	dir := t.TempDir()
+	config, err := LoadConfigFromBytes([]byte(`project:
+  name: test
+actions:
+  - name: lint
+    run: echo lint >> order
+  - name: docs
+    run: echo docs >> order
+  - name: compile
+    run: echo compile >> order
+  - name: test
+    run: echo test >> order
+stages:
+  ci:
+    steps:
+      - action: lint
+      - action: docs
+      - action: compile
+      - action: test
+        require: [compile]
+`))
+	if err != nil {
+		t.Fatalf("LoadConfigFromBytes() error = %v", err)
+	}
+	durations := map[string]time.Duration{"lint": time.Second, "docs": 2 * time.Second, "compile": 10 * time.Second, "test": 20 * time.Second}
+	for _, callback := range []StepCallback{nil, &MockStepCallback{}} {
+		os.Remove(filepath.Join(dir, "order"))
+		opts := &RunOptions{MaxParallel: 1, WorkingDir: dir, StepDurations: durations, StepCallback: callback, Output: io.Discard, ErrorOutput: io.Discard}
+		if err := NewRunner(config, opts).RunStage(context.Background(), "ci"); err != nil {
+			t.Fatalf("RunStage() error = %v", err)
+		}
+		data, _ := os.ReadFile(filepath.Join(dir, "order"))
+		if got := strings.Fields(string(data)); !reflect.DeepEqual(got, []string{"compile", "test", "docs", "lint"}) {
+			t.Errorf("callback %v: order = %v, want the critical path first", callback != nil, got)
+		}
+	}
+}
+
+func TestHistoryDurations(t *testing.T) {
+	records := []HistoryRecord{
+		historyRecord("ci", "c1", "build=ok:100", "test=error:40", "deploy=skipped:0"),
+		historyRecord("ci", "c1", "build=ok:300", "test=ok:60"),
+		historyRecord("ci", "c1", "build=ok:200"),
+		historyRecord("release", "c1", "build=ok:9000"),
+	}
+	want := map[string]time.Duration{"build": 200 * time.Millisecond, "test": 40 * time.Millisecond}
+	if got := HistoryDurations(records, "ci"); !reflect.DeepEqual(got, want) {
+		t.Errorf("HistoryDurations() = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,245 @@
+package buildfab
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// stepScope holds the variables and environment resolved for a single step.
+//
+// Variables are used for ${{ }} interpolation, conditions and variant selection.
+// Env contains only the values that are exported to the step's process.
+type stepScope struct {
+	Variables  map[string]string
+	Env        map[string]string
+	Secrets    []string          // Values that must be masked in all output
+	WorkingDir string            // Resolved working directory, empty to use RunOptions.WorkingDir
+	Shell      string            // Default shell for actions that do not set one
+	Inputs     map[string]string // Step with: inputs, merged over the action's inputs
+}
+
+// resolveStepScope resolves variables and environment for an action executed as
+// part of a stage step. Any of stage, step and action may be nil.
+//
+// Precedence (highest first): CLI > step > action > stage > project > platform.
+// Within a level, inline vars and env override values from that level's env
+// files. Env file values are available both for interpolation and in the
+// environment. CLI env files rank just below CLI variables, and cliSecrets
+// names the vars and env entries of any level masked in output.
+func resolveStepScope(config *Config, stage *Stage, step *Step, action *Action, cliVariables map[string]string, cliEnvFilePaths, cliSecrets []string) (*stepScope, error) {
+	varLayers := []map[string]string{GetPlatformVariablesMap()}
+	envLayers := []map[string]string{}
+	secretNames := make(map[string]bool)
+	var secretValues []string
+
+	addLevel := func(files EnvFiles, baseDir string, vars, env map[string]string, secrets []string) error {
+		if len(files) > 0 {
+			loaded, fileSecrets, err := files.load(baseDir)
+			if err != nil {
+				return fmt.Errorf("failed to load env file: %w", err)
+			}
+			varLayers = append(varLayers, loaded)
+			envLayers = append(envLayers, loaded)
+			secretValues = append(secretValues, fileSecrets...)
+		}
+		varLayers = append(varLayers, vars)
+		envLayers = append(envLayers, env)
+		for _, name := range secrets {
+			secretNames[name] = true
+		}
+		return nil
+	}
+
+	baseDir := ""
+	if config != nil {
+		baseDir = config.baseDir
+		if err := addLevel(config.EnvFile, baseDir, config.Vars, config.Env, config.Secrets); err != nil {
+			return nil, err
+		}
+	}
+	if stage != nil {
+		if err := addLevel(stage.EnvFile, baseDir, stage.Vars, stage.Env, stage.Secrets); err != nil {
+			return nil, err
+		}
+	}
+	if action != nil {
+		if err := addLevel(action.EnvFile, baseDir, action.Vars, action.Env, action.Secrets); err != nil {
+			return nil, err
+		}
+	}
+	if step != nil {
+		if err := addLevel(nil, baseDir, step.Vars, step.Env, step.Secrets); err != nil {
+			return nil, err
+		}
+	}
+	if len(cliEnvFilePaths) > 0 || len(cliSecrets) > 0 {
+		if err := addLevel(cliEnvFiles(cliEnvFilePaths), "", nil, nil, cliSecrets); err != nil {
+			return nil, err
+		}
+	}
+	varLayers = append(varLayers, cliOverrides(cliVariables))
+
+	variables, err := ResolveVariables(varLayers...)
+	if err != nil {
+		return nil, err
+	}
+
+	env := make(map[string]string)
+	for _, layer := range envLayers {
+		for k, v := range layer {
+			env[k] = v
+		}
+	}
+	env, err = InterpolateEnv(env, variables)
+	if err != nil {
+		return nil, err
+	}
+
+	for name := range secretNames {
+		if v, ok := variables[name]; ok {
+			secretValues = append(secretValues, v)
+		}
+		if v, ok := env[name]; ok {
+			secretValues = append(secretValues, v)
+		}
+	}
+
+	workingDir, err := resolveWorkingDir(config, stage, step, action, variables)
+	if err != nil {
+		return nil, err
+	}
+
+	shell := ""
+	if config != nil {
+		shell = config.Defaults.Shell
+	}
+	if stage != nil && stage.Defaults.Shell != "" {
+		shell = stage.Defaults.Shell
+	}
+
+	var inputs map[string]string
+	if step != nil {
+		inputs = step.With
+	}
+
+	return &stepScope{
+		Variables:  variables,
+		Env:        env,
+		Secrets:    secretValues,
+		WorkingDir: workingDir,
+		Shell:      shell,
+		Inputs:     inputs,
+	}, nil
+}
+
+// resolveWorkingDir picks the most specific working directory of project
+// defaults, stage defaults, stage, action and step, interpolates it and makes
+// it relative to the configuration file
+func resolveWorkingDir(config *Config, stage *Stage, step *Step, action *Action, variables map[string]string) (string, error) {
+	dir := ""
+	baseDir := ""
+	if config != nil {
+		dir = config.Defaults.WorkingDir
+		baseDir = config.baseDir
+	}
+	candidates := []string{}
+	if stage != nil {
+		candidates = append(candidates, stage.Defaults.WorkingDir, stage.WorkingDir)
+	}
+	if action != nil {
+		candidates = append(candidates, action.WorkingDir)
+	}
+	if step != nil {
+		candidates = append(candidates, step.WorkingDir)
+	}
+	for _, candidate := range candidates {
+		if candidate != "" {
+			dir = candidate
+		}
+	}
+	if dir == "" {
+		return "", nil
+	}
+
+	dir, err := InterpolateVariables(dir, variables)
+	if err != nil {
+		return "", fmt.Errorf("failed to interpolate working_dir: %w", err)
+	}
+	return resolveConfigPath(baseDir, dir), nil
+}
+
+// resolveConfigPath makes a relative path relative to baseDir. Paths that
+// start with a ${{ }} reference are left alone until they are interpolated.
+func resolveConfigPath(baseDir, path string) string {
+	if baseDir == "" || path == "" || filepath.IsAbs(path) || strings.HasPrefix(path, "${{") {
+		return path
+	}
+	return filepath.Join(baseDir, path)
+}
+
+// displayPath returns path relative to the current directory when it is
+// inside it, for shorter reproduction hints
+func displayPath(path string) string {
+	cwd, err := os.Getwd()
+	if err != nil || !filepath.IsAbs(path) {
+		return path
+	}
+	if rel, err := filepath.Rel(cwd, path); err == nil && !strings.HasPrefix(rel, "..") {
+		return rel
+	}
+	return path
+}
+
+// resolveScope resolves the scope of a step and registers its secrets with the
+// runner's masker
+func (r *Runner) resolveScope(stage *Stage, step *Step, action *Action) (*stepScope, error) {
+	scope, err := resolveStepScope(r.config, stage, step, action, r.opts.Variables, r.opts.EnvFiles, r.opts.Secrets)
+	if err != nil {
+		return nil, err
+	}
+	r.masker.Add(scope.Secrets...)
+	return scope, nil
+}
+
+// cliOverrides returns the command line variables that actually override
+// something. RunOptions.Variables is pre-populated with platform variables, and
+// those copies must not shadow project, stage or step definitions.
+func cliOverrides(variables map[string]string) map[string]string {
+	platform := GetPlatformVariablesMap()
+	overrides := make(map[string]string, len(variables))
+	for k, v := range variables {
+		if pv, isPlatform := platform[k]; isPlatform && pv == v {
+			continue
+		}
+		overrides[k] = v
+	}
+	return overrides
+}
+
+// validateScopes checks that variables resolve without cycles at every level
+// a step can see, in the order resolveStepScope layers them: project, stage,
+// action, step
+func (c *Config) validateScopes() error {
+	if _, err := ResolveVariables(c.Vars); err != nil {
+		return fmt.Errorf("invalid project vars: %w", err)
+	}
+	for _, action := range c.Actions {
+		if _, err := ResolveVariables(c.Vars, action.Vars); err != nil {
+			return fmt.Errorf("invalid vars in action %s: %w", action.Name, err)
+		}
+	}
+	for stageName, stage := range c.Stages {
+		if _, err := ResolveVariables(c.Vars, stage.Vars); err != nil {
+			return fmt.Errorf("invalid vars in stage %s: %w", stageName, err)
+		}
+		for _, step := range stage.Steps {
+			action, _ := c.GetAction(step.Action)
+			if _, err := ResolveVariables(c.Vars, stage.Vars, action.Vars, step.Vars); err != nil {
+				return fmt.Errorf("invalid vars in step %s of stage %s: %w", step.Action, stageName, err)
+			}
+		}
+	}
+	return nil
+}
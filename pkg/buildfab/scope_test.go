@@ -0,0 +1,267 @@
+package buildfab
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestResolveStepScopePrecedence(t *testing.T) {
+	config := &Config{
+		Vars: map[string]string{"level": "project", "project_only": "p", "arch": "custom"},
+		Env:  map[string]string{"LEVEL": "project"},
+	}
+	stage := &Stage{
+		Vars: map[string]string{"level": "stage"},
+		Env:  map[string]string{"LEVEL": "stage", "STAGE_ONLY": "${{ project_only }}"},
+	}
+	action := &Action{
+		Name: "build",
+		Vars: map[string]string{"level": "action"},
+		Env:  map[string]string{"LEVEL": "action"},
+	}
+	step := &Step{
+		Action: "build",
+		Vars:   map[string]string{"level": "step"},
+		Env:    map[string]string{"LEVEL": "${{ level }}"},
+	}
+
+	tests := []struct {
+		name          string
+		stage         *Stage
+		step          *Step
+		action        *Action
+		cli           map[string]string
+		expectedLevel string
+	}{
+		{name: "project only", expectedLevel: "project"},
+		{name: "stage overrides project", stage: stage, expectedLevel: "stage"},
+		{name: "action overrides stage", stage: stage, action: action, expectedLevel: "action"},
+		{name: "step overrides action", stage: stage, step: step, action: action, expectedLevel: "step"},
+		{name: "cli overrides step", stage: stage, step: step, action: action, cli: map[string]string{"level": "cli"}, expectedLevel: "cli"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			scope, err := resolveStepScope(config, tt.stage, tt.step, tt.action, tt.cli, nil, nil)
+			if err != nil {
+				t.Fatalf("resolveStepScope() error = %v", err)
+			}
+			if scope.Variables["level"] != tt.expectedLevel {
+				t.Errorf("level = %q, want %q", scope.Variables["level"], tt.expectedLevel)
+			}
+		})
+	}
+
+	scope, err := resolveStepScope(config, stage, step, action, nil, nil, nil)
+	if err != nil {
+		t.Fatalf("resolveStepScope() error = %v", err)
+	}
+	if scope.Env["LEVEL"] != "step" {
+		t.Errorf("Env[LEVEL] = %q, want %q", scope.Env["LEVEL"], "step")
+	}
+	if scope.Env["STAGE_ONLY"] != "p" {
+		t.Errorf("Env[STAGE_ONLY] = %q, want %q", scope.Env["STAGE_ONLY"], "p")
+	}
+	if _, exported := scope.Env["project_only"]; exported {
+		t.Error("vars must not be exported to the environment")
+	}
+	// Project vars override platform variables
+	if scope.Variables["arch"] != "custom" {
+		t.Errorf("arch = %q, want %q", scope.Variables["arch"], "custom")
+	}
+	// Platform variables copied into CLI variables must not shadow project vars
+	scope, err = resolveStepScope(config, nil, nil, nil, AddPlatformVariables(nil), nil, nil)
+	if err != nil {
+		t.Fatalf("resolveStepScope() error = %v", err)
+	}
+	if scope.Variables["arch"] != "custom" {
+		t.Errorf("arch with platform CLI variables = %q, want %q", scope.Variables["arch"], "custom")
+	}
+}
+
+func TestValidateScopesCycle(t *testing.T) {
+	config := &Config{
+		Vars:    map[string]string{"a": "${{ b }}", "b": "${{ a }}"},
+		Actions: []Action{{Name: "test", Run: "true"}},
+	}
+	config.Project.Name = "test"
+
+	err := config.Validate()
+	if err == nil || !strings.Contains(err.Error(), "cycle detected") {
+		t.Errorf("Validate() error = %v, want cycle detected", err)
+	}
+
+	// A cycle only visible once stage and action vars are combined
+	config = &Config{
+		Actions: []Action{{Name: "test", Run: "true", Vars: map[string]string{"b": "${{ a }}"}}},
+		Stages: map[string]Stage{"ci": {
+			Vars:  map[string]string{"a": "${{ b }}"},
+			Steps: []Step{{Action: "test"}},
+		}},
+	}
+	config.Project.Name = "test"
+
+	err = config.Validate()
+	if err == nil || !strings.Contains(err.Error(), "step test of stage ci") || !strings.Contains(err.Error(), "cycle detected") {
+		t.Errorf("Validate() error = %v, want cycle detected in step test of stage ci", err)
+	}
+}
+
+func TestRunStageScopedVarsAndEnv(t *testing.T) {
+	config, err := LoadConfigFromBytes([]byte(`
+project:
+  name: test
+vars:
+  greeting: hello
+env:
+  PROJECT_ENV: project
+actions:
+  - name: show
+    vars:
+      target: "${{ greeting }}-world"
+    run: echo "${{ target }}:$PROJECT_ENV:$STEP_ENV:${greeting:-unset}"
+stages:
+  test:
+    steps:
+      - action: show
+        env:
+          STEP_ENV: step
+`))
+	if err != nil {
+		t.Fatalf("LoadConfigFromBytes() error = %v", err)
+	}
+
+	callback := &MockStepCallback{}
+	opts := DefaultRunOptions()
+	opts.Verbose = true
+	opts.StepCallback = callback
+
+	runner := NewRunner(config, opts)
+	if err := runner.RunStage(context.Background(), "test"); err != nil {
+		t.Fatalf("RunStage() error = %v", err)
+	}
+
+	var output []string
+	for _, call := range callback.OnStepOutputCalls {
+		output = append(output, call.Output)
+	}
+	if got := strings.Join(output, "\n"); !strings.Contains(got, "hello-world:project:step:unset") {
+		t.Errorf("output = %q, want it to contain %q", got, "hello-world:project:step:unset")
+	}
+}
+
+func TestResolveWorkingDir(t *testing.T) {
+	config := &Config{baseDir: "/repo"}
+	config.Defaults.WorkingDir = "project"
+
+	tests := []struct {
+		name     string
+		stage    *Stage
+		action   *Action
+		step     *Step
+		vars     map[string]string
+		expected string
+	}{
+		{name: "project default", expected: "/repo/project"},
+		{name: "stage default", stage: &Stage{Defaults: Defaults{WorkingDir: "stage-default"}}, expected: "/repo/stage-default"},
+		{name: "stage overrides stage default", stage: &Stage{WorkingDir: "stage", Defaults: Defaults{WorkingDir: "stage-default"}}, expected: "/repo/stage"},
+		{name: "action overrides stage", stage: &Stage{WorkingDir: "stage"}, action: &Action{WorkingDir: "services/foo"}, expected: "/repo/services/foo"},
+		{name: "step overrides action", action: &Action{WorkingDir: "services/foo"}, step: &Step{WorkingDir: "services/bar"}, expected: "/repo/services/bar"},
+		{name: "absolute path", action: &Action{WorkingDir: "/abs"}, expected: "/abs"},
+		{name: "interpolated", action: &Action{WorkingDir: "services/${{ service }}"}, vars: map[string]string{"service": "baz"}, expected: "/repo/services/baz"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, err := resolveWorkingDir(config, tt.stage, tt.step, tt.action, tt.vars)
+			if err != nil {
+				t.Fatalf("resolveWorkingDir() error = %v", err)
+			}
+			if dir != tt.expected {
+				t.Errorf("resolveWorkingDir() = %q, want %q", dir, tt.expected)
+			}
+		})
+	}
+
+	dir, err := resolveWorkingDir(&Config{}, nil, nil, &Action{}, nil)
+	if err != nil || dir != "" {
+		t.Errorf("resolveWorkingDir() without settings = %q, %v, want empty", dir, err)
+	}
+}
+
+func TestRunStageWorkingDirAndShellDefaults(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "services", "foo"), 0755); err != nil {
+		t.Fatalf("failed to create service dir: %v", err)
+	}
+	configPath := filepath.Join(dir, ".project.yml")
+	content := `
+project:
+  name: test
+defaults:
+  shell: sh
+actions:
+  - name: where
+    working_dir: services/foo
+    run: echo "dir=$(pwd)"
+  - name: fail
+    working_dir: services/foo
+    run: "false"
+stages:
+  test:
+    defaults:
+      shell: bash
+    steps:
+      - action: where
+      - action: fail
+        require: [where]
+`
+	if err := os.WriteFile(configPath, []byte(content), 0644); err != nil {
+		t.Fatalf("failed to write config: %v", err)
+	}
+	config, err := LoadConfig(configPath)
+	if err != nil {
+		t.Fatalf("LoadConfig() error = %v", err)
+	}
+
+	callback := &MockStepCallback{}
+	opts := DefaultRunOptions()
+	opts.StepCallback = callback
+
+	// Run from another directory: working_dir is relative to the config file
+	if err := NewRunner(config, opts).RunStage(context.Background(), "test"); err == nil {
+		t.Fatal("RunStage() expected error from failing step")
+	}
+
+	serviceDir, _ := filepath.EvalSymlinks(filepath.Join(dir, "services", "foo"))
+	var output []string
+	for _, call := range callback.OnStepOutputCalls {
+		output = append(output, call.Output)
+	}
+	if got := strings.Join(output, "\n"); !strings.Contains(got, "dir="+serviceDir) && !strings.Contains(got, "dir="+filepath.Join(dir, "services", "foo")) {
+		t.Errorf("output = %q, want it to run in %s", got, serviceDir)
+	}
+
+	var failMessage string
+	for _, call := range callback.OnStepCompleteCalls {
+		if call.StepName == "fail" {
+			failMessage = call.Message
+		}
+	}
+	if !strings.Contains(failMessage, "to check run:") || !strings.Contains(failMessage, "cd ") || !strings.Contains(failMessage, filepath.Join("services", "foo")) {
+		t.Errorf("failure message = %q, want reproduction hint with directory", failMessage)
+	}
+
+	stage, _ := config.GetStage("test")
+	action, _ := config.GetAction("where")
+	scope, err := resolveStepScope(config, &stage, &stage.Steps[0], &action, nil, nil, nil)
+	if err != nil {
+		t.Fatalf("resolveStepScope() error = %v", err)
+	}
+	if scope.Shell != "bash" {
+		t.Errorf("stage default shell = %q, want bash", scope.Shell)
+	}
+}
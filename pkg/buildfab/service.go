@@ -0,0 +1,387 @@
+package buildfab
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// StateDir is the directory, next to the configuration file, where buildfab
+// keeps files produced by runs such as service logs
+const StateDir = ".buildfab"
+
+const (
+	defaultReadyTimeout  = 30 * time.Second
+	defaultReadyInterval = 500 * time.Millisecond
+	serviceStopTimeout   = 5 * time.Second
+	serviceLogTailLines  = 20
+)
+
+// ReadyProbe describes when a background step is ready. All configured
+// probes must pass; a step without probes is ready once started.
+type ReadyProbe struct {
+	TCP      string `yaml:"tcp,omitempty"`      // Port or host:port accepting connections
+	HTTP     string `yaml:"http,omitempty"`     // URL answering with a 2xx status
+	Log      string `yaml:"log,omitempty"`      // Regular expression matching a line of the service output
+	Command  string `yaml:"command,omitempty"`  // Command exiting with status 0
+	Timeout  string `yaml:"timeout,omitempty"`  // Time to wait for readiness (default: 30s)
+	Interval string `yaml:"interval,omitempty"` // Time between probe attempts (default: 500ms)
+}
+
+// validate checks the probe durations, address and regular expression
+func (p *ReadyProbe) validate() error {
+	for _, d := range []struct{ name, value string }{{"timeout", p.Timeout}, {"interval", p.Interval}} {
+		if d.value == "" {
+			continue
+		}
+		if duration, err := time.ParseDuration(d.value); err != nil || duration <= 0 {
+			return fmt.Errorf("invalid ready %s %q", d.name, d.value)
+		}
+	}
+	if p.TCP != "" {
+		if _, _, err := net.SplitHostPort(tcpProbeAddress(p.TCP)); err != nil {
+			return fmt.Errorf("invalid ready tcp address %q: %w", p.TCP, err)
+		}
+	}
+	if p.Log != "" {
+		if _, err := regexp.Compile(p.Log); err != nil {
+			return fmt.Errorf("invalid ready log pattern %q: %w", p.Log, err)
+		}
+	}
+	return nil
+}
+
+// durations returns the probe timeout and interval with defaults applied
+func (p *ReadyProbe) durations() (time.Duration, time.Duration) {
+	timeout, interval := defaultReadyTimeout, defaultReadyInterval
+	if p == nil {
+		return timeout, interval
+	}
+	if d, err := time.ParseDuration(p.Timeout); err == nil && d > 0 {
+		timeout = d
+	}
+	if d, err := time.ParseDuration(p.Interval); err == nil && d > 0 {
+		interval = d
+	}
+	return timeout, interval
+}
+
+// describe returns a short description of the probes for messages
+func (p *ReadyProbe) describe() string {
+	if p == nil {
+		return "started"
+	}
+	var probes []string
+	if p.TCP != "" {
+		probes = append(probes, "tcp "+tcpProbeAddress(p.TCP))
+	}
+	if p.HTTP != "" {
+		probes = append(probes, "http "+p.HTTP)
+	}
+	if p.Log != "" {
+		probes = append(probes, fmt.Sprintf("log /%s/", p.Log))
+	}
+	if p.Command != "" {
+		probes = append(probes, "command "+p.Command)
+	}
+	if len(probes) == 0 {
+		return "started"
+	}
+	return strings.Join(probes, ", ")
+}
+
+// tcpProbeAddress returns host:port for a probe, a bare port means localhost
+func tcpProbeAddress(address string) string {
+	if !strings.Contains(address, ":") {
+		return net.JoinHostPort("127.0.0.1", address)
+	}
+	return address
+}
+
+// logMatcher is a writer that reports whether a line matching a pattern was written
+type logMatcher struct {
+	mu      sync.Mutex
+	pattern *regexp.Regexp
+	partial []byte
+	matched bool
+}
+
+func (m *logMatcher) Write(p []byte) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.matched {
+		return len(p), nil
+	}
+	m.partial = append(m.partial, p...)
+	for {
+		i := bytes.IndexByte(m.partial, '\n')
+		if i < 0 {
+			break
+		}
+		if m.pattern.Match(bytes.TrimRight(m.partial[:i], "\r")) {
+			m.matched = true
+			m.partial = nil
+			return len(p), nil
+		}
+		m.partial = m.partial[i+1:]
+	}
+	// A partial line may already be the ready message, e.g. a prompt without newline
+	if m.pattern.Match(m.partial) {
+		m.matched = true
+		m.partial = nil
+	}
+	return len(p), nil
+}
+
+func (m *logMatcher) Matched() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.matched
+}
+
+// service is a background step process running until the end of the stage
+type service struct {
+	name    string
+	cmd     *exec.Cmd
+	logPath string
+	logFile *os.File
+	cleanup func()
+	done    chan struct{} // Closed when the process has exited
+	err     error         // Exit error, valid once done is closed
+}
+
+// stop terminates the service's process group, waiting for a graceful exit
+// before killing it
+func (s *service) stop() {
+	// Signal the group even when the shell has exited, its children may still run
+	terminateProcessGroup(s.cmd)
+	select {
+	case <-s.done:
+	case <-time.After(serviceStopTimeout):
+	}
+	killProcessGroup(s.cmd)
+	<-s.done
+	s.logFile.Close()
+	s.cleanup()
+}
+
+// stateDir returns the state directory of the project
+func (r *Runner) stateDir() string {
+	return projectStateDir(r.config, r.opts.WorkingDir)
+}
+
+// projectStateDir returns the state directory next to the configuration
+// file, or in the working directory for configurations not loaded from a file
+func projectStateDir(config *Config, workingDir string) string {
+	return filepath.Join(projectDir(config, workingDir), StateDir)
+}
+
+// projectDir returns the directory of the configuration file, or the working
+// directory for configurations not loaded from a file
+func projectDir(config *Config, workingDir string) string {
+	if config != nil && config.baseDir != "" {
+		return config.baseDir
+	}
+	return workingDir
+}
+
+// serviceLogPath returns the log file of a background step
+func (r *Runner) serviceLogPath(name string) string {
+	return filepath.Join(r.stateDir(), "services", sanitizeFileName(name)+".log")
+}
+
+// sanitizeFileName replaces characters that are not safe in file names
+func sanitizeFileName(name string) string {
+	return strings.Map(func(c rune) rune {
+		if c == '/' || c == '\\' || c == ':' || c == '*' || c == '?' || c == '"' || c == '<' || c == '>' || c == '|' || c == ' ' {
+			return '_'
+		}
+		return c
+	}, name)
+}
+
+// runServiceForDAG starts a background step and waits until its ready probe
+// passes. The process keeps running for dependent steps and is stopped by
+// stopServices at the end of the stage. Output goes to the service log file.
+func (r *Runner) runServiceForDAG(ctx context.Context, action Action, node *DAGNode) (Result, error) {
+	if action.Run == "" {
+		err := fmt.Errorf("background step %s requires a run command", action.Name)
+		return Result{Status: StatusError, Message: err.Error()}, err
+	}
+
+	// The service outlives the step, so it is not bound to the step context
+	cmd, cleanup, err := r.newActionCommand(context.Background(), action, node.scope)
+	if err != nil {
+		return Result{Status: StatusError, Message: err.Error()}, err
+	}
+	logPath := r.serviceLogPath(action.Name)
+	if err := os.MkdirAll(filepath.Dir(logPath), 0755); err != nil {
+		cleanup()
+		return Result{Status: StatusError, Message: err.Error()}, err
+	}
+	logFile, err := os.Create(logPath)
+	if err != nil {
+		cleanup()
+		return Result{Status: StatusError, Message: err.Error()}, err
+	}
+
+	probe := node.Step.Ready
+	var matcher *logMatcher
+	output := NewMaskingWriter(logFile, r.masker)
+	if probe != nil && probe.Log != "" {
+		matcher = &logMatcher{pattern: regexp.MustCompile(probe.Log)}
+		output = io.MultiWriter(output, matcher)
+	}
+	cmd.Stdout = output
+	cmd.Stderr = output
+	// Do not wait for output of children that outlive the service process
+	cmd.WaitDelay = time.Second
+	setProcessGroup(cmd)
+
+	if err := cmd.Start(); err != nil {
+		logFile.Close()
+		cleanup()
+		return Result{Status: StatusError, Message: r.reproMessage(action, node.scope)}, fmt.Errorf("failed to start service: %w", err)
+	}
+	svc := &service{name: action.Name, cmd: cmd, logPath: logPath, logFile: logFile, cleanup: cleanup, done: make(chan struct{})}
+	go func() {
+		svc.err = cmd.Wait()
+		close(svc.done)
+	}()
+	r.servicesMu.Lock()
+	r.services = append(r.services, svc)
+	r.servicesMu.Unlock()
+
+	if err := r.waitServiceReady(ctx, svc, probe, matcher); err != nil {
+		message := fmt.Sprintf("service %s %v", action.Name, err)
+		if tail := logTail(logPath, serviceLogTailLines); tail != "" {
+			message += ", last output:\n" + tail
+		}
+		message += "\n" + r.reproMessage(action, node.scope)
+		return Result{Status: StatusError, Message: r.masker.Mask(message)}, fmt.Errorf("service %s %w", action.Name, err)
+	}
+
+	message := fmt.Sprintf("service %s ready (%s), pid %d, logs: %s", action.Name, probe.describe(), cmd.Process.Pid, displayPath(logPath))
+	if r.stepCallback != nil && r.opts.Verbose {
+		r.stepCallback.OnStepOutput(ctx, action.Name, message)
+	}
+	return Result{Status: StatusOK, Message: message}, nil
+}
+
+// waitServiceReady polls the ready probes until they all pass, the service
+// exits, the timeout expires or the context is cancelled
+func (r *Runner) waitServiceReady(ctx context.Context, svc *service, probe *ReadyProbe, matcher *logMatcher) error {
+	if probe == nil {
+		return nil
+	}
+	timeout, interval := probe.durations()
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if r.probeReady(ctx, svc, probe, matcher, interval) {
+			return nil
+		}
+		select {
+		case <-svc.done:
+			if svc.err != nil {
+				return fmt.Errorf("exited before it was ready: %v", svc.err)
+			}
+			return fmt.Errorf("exited before it was ready")
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-deadline.C:
+			return fmt.Errorf("not ready after %s (waiting for %s)", timeout, probe.describe())
+		case <-ticker.C:
+		}
+	}
+}
+
+// probeReady runs each configured probe once and reports whether all passed
+func (r *Runner) probeReady(ctx context.Context, svc *service, probe *ReadyProbe, matcher *logMatcher, interval time.Duration) bool {
+	attempt := interval
+	if attempt < time.Second {
+		attempt = time.Second
+	}
+	if matcher != nil && !matcher.Matched() {
+		return false
+	}
+	if probe.TCP != "" {
+		conn, err := net.DialTimeout("tcp", tcpProbeAddress(probe.TCP), attempt)
+		if err != nil {
+			return false
+		}
+		conn.Close()
+	}
+	if probe.HTTP != "" {
+		client := &http.Client{Timeout: attempt}
+		resp, err := client.Get(probe.HTTP)
+		if err != nil {
+			return false
+		}
+		resp.Body.Close()
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			return false
+		}
+	}
+	if probe.Command != "" {
+		shell, args, cleanup, err := prepareShellCommand("", probe.Command)
+		if err != nil {
+			return false
+		}
+		defer cleanup()
+		probeCtx, cancel := context.WithTimeout(ctx, attempt*5)
+		defer cancel()
+		cmd := exec.CommandContext(probeCtx, shell, args...)
+		cmd.Dir = svc.cmd.Dir
+		cmd.Env = svc.cmd.Env
+		if cmd.Run() != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// stopServices stops the background steps started during the stage, most
+// recently started first
+func (r *Runner) stopServices() {
+	r.servicesMu.Lock()
+	services := r.services
+	r.services = nil
+	r.servicesMu.Unlock()
+
+	for i := len(services) - 1; i >= 0; i-- {
+		services[i].stop()
+		if r.opts.Debug {
+			fmt.Fprintf(r.errorOutput, "Stopped service %s, logs: %s\n", services[i].name, displayPath(services[i].logPath))
+		}
+	}
+}
+
+// logTail returns the last lines of a log file, indented for messages
+func logTail(path string, lines int) string {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+	all := splitLines(string(data))
+	if len(all) > lines {
+		all = all[len(all)-lines:]
+	}
+	for i, line := range all {
+		all[i] = "  " + line
+	}
+	return strings.Join(all, "\n")
+}
@@ -0,0 +1,244 @@
+package buildfab
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// runServiceStage loads content as the project configuration in a temporary
+// directory and runs its test stage
+func runServiceStage(t *testing.T, content string) (string, error) {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		t.Skip("service tests use a POSIX shell")
+	}
+	dir := t.TempDir()
+	configPath := filepath.Join(dir, ".project.yml")
+	if err := os.WriteFile(configPath, []byte(content), 0644); err != nil {
+		t.Fatalf("failed to write config: %v", err)
+	}
+	config, err := LoadConfig(configPath)
+	if err != nil {
+		t.Fatalf("LoadConfig() error = %v", err)
+	}
+	var output bytes.Buffer
+	opts := DefaultRunOptions()
+	opts.Output = &output
+	opts.ErrorOutput = &output
+	opts.WorkingDir = dir
+	return dir, NewRunner(config, opts).RunStage(context.Background(), "test")
+}
+
+// processRunning reports whether a process exists and is not a zombie
+func processRunning(t *testing.T, pid int) bool {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join("/proc", strconv.Itoa(pid), "stat"))
+	if err != nil {
+		return false
+	}
+	fields := strings.Fields(string(data[bytes.LastIndexByte(data, ')')+1:]))
+	return len(fields) > 0 && fields[0] != "Z"
+}
+
+// processExited waits up to timeout for a process to exit. The signal sent
+// when a service stops is delivered asynchronously, so the process may still
+// be shutting down right after the stage returns.
+func processExited(t *testing.T, pid int, timeout time.Duration) bool {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for processRunning(t, pid) {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return true
+}
+
+func readPid(t *testing.T, path string) int {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read %s: %v", path, err)
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		t.Fatalf("invalid pid in %s: %q", path, data)
+	}
+	return pid
+}
+
+func TestBackgroundStep_LogProbe(t *testing.T) {
+	dir, err := runServiceStage(t, `project:
+  name: test
+actions:
+  - name: server
+    run: |
+      sleep 30 &
+      echo $! > child.pid
+      sleep 0.2
+      echo "server listening"
+      wait
+  - name: client
+    run: kill -0 $(cat child.pid) && touch client.ok
+stages:
+  test:
+    steps:
+      - action: server
+        background: true
+        ready:
+          log: "listening$"
+          timeout: 10s
+      - action: client
+        require: [server]
+`)
+	if err != nil {
+		t.Fatalf("RunStage() error = %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "client.ok")); err != nil {
+		t.Error("dependent step should run while the service is running")
+	}
+	if _, err := os.Stat("/proc/self/stat"); err == nil {
+		if pid := readPid(t, filepath.Join(dir, "child.pid")); !processExited(t, pid, 2*time.Second) {
+			t.Errorf("service child process %d still running after the stage", pid)
+		}
+	}
+	data, err := os.ReadFile(filepath.Join(dir, StateDir, "services", "server.log"))
+	if err != nil || !strings.Contains(string(data), "server listening") {
+		t.Errorf("service log = %q, %v", data, err)
+	}
+}
+
+func TestBackgroundStep_TCPAndHTTPProbes(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+	address := strings.TrimPrefix(server.URL, "http://")
+
+	start := time.Now()
+	_, err := runServiceStage(t, `project:
+  name: test
+actions:
+  - name: db
+    run: sleep 30
+  - name: tests
+    run: "true"
+stages:
+  test:
+    steps:
+      - action: db
+        background: true
+        ready:
+          tcp: "`+address+`"
+          http: "`+server.URL+`/health"
+          command: "true"
+      - action: tests
+        require: [db]
+`)
+	if err != nil {
+		t.Fatalf("RunStage() error = %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Errorf("stage took %s, the service should be stopped with SIGTERM", elapsed)
+	}
+}
+
+func TestBackgroundStep_Failures(t *testing.T) {
+	tests := []struct {
+		name  string
+		run   string
+		ready string
+		want  string
+	}{
+		{"exits early", "echo boom; exit 3", "log: never", "exited before it was ready"},
+		{"timeout", "sleep 30", "command: \"false\"\n          timeout: 300ms\n          interval: 50ms", "not ready after 300ms"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, err := runServiceStage(t, `project:
+  name: test
+actions:
+  - name: server
+    run: "`+tt.run+`"
+  - name: client
+    run: touch client.ran
+stages:
+  test:
+    steps:
+      - action: server
+        background: true
+        ready:
+          `+tt.ready+`
+      - action: client
+        require: [server]
+`)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("RunStage() error = %v, want %q", err, tt.want)
+			}
+			if _, err := os.Stat(filepath.Join(dir, "client.ran")); err == nil {
+				t.Error("dependent step should not run when the service is not ready")
+			}
+		})
+	}
+}
+
+func TestValidate_BackgroundSteps(t *testing.T) {
+	tests := []struct {
+		name string
+		step string
+		want string
+	}{
+		{"ready without background", "ready: {tcp: \"8080\"}", "ready without background"},
+		{"built-in action", "background: true", "requires a run action"},
+		{"invalid timeout", "background: true\n        ready: {tcp: \"8080\", timeout: soon}", "invalid ready timeout"},
+		{"invalid pattern", "background: true\n        ready: {log: \"(\"}", "invalid ready log pattern"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			action := "server"
+			if tt.name == "built-in action" {
+				action = "check"
+			}
+			config, err := LoadConfigFromBytes([]byte(`project:
+  name: test
+actions:
+  - name: server
+    run: ./server
+  - name: check
+    uses: git@untracked
+stages:
+  test:
+    steps:
+      - action: ` + action + `
+        ` + tt.step + `
+`))
+			if err != nil {
+				t.Fatalf("LoadConfigFromBytes() error = %v", err)
+			}
+			if err := config.Validate(); err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("Validate() error = %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestLogMatcher(t *testing.T) {
+	matcher := &logMatcher{pattern: regexp.MustCompile(`^ready on \d+$`)}
+	matcher.Write([]byte("starting\nready on "))
+	if matcher.Matched() {
+		t.Fatal("partial line should not match yet")
+	}
+	matcher.Write([]byte("8080\nmore output\n"))
+	if !matcher.Matched() {
+		t.Error("line split across writes should match")
+	}
+}
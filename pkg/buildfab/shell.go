@@ -0,0 +1,224 @@
+package buildfab
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// ScriptPlaceholder marks where the script file path goes in a shell template
+const ScriptPlaceholder = "{0}"
+
+// ShellPreset describes how a named shell or interpreter runs a run block
+type ShellPreset struct {
+	Command    string   // Executable name
+	InlineArgs []string // Arguments before a single-line command; nil to always use a script file
+	ScriptArgs []string // Arguments for script file execution, containing ScriptPlaceholder
+	Ext        string   // Script file extension
+}
+
+// shellPresets maps shell names accepted by shell: to their invocation
+var shellPresets = map[string]ShellPreset{
+	"sh":         {Command: "sh", InlineArgs: []string{"-euc"}, ScriptArgs: []string{"-eu", ScriptPlaceholder}, Ext: ".sh"},
+	"bash":       {Command: "bash", InlineArgs: []string{"-euc"}, ScriptArgs: []string{"-eu", ScriptPlaceholder}, Ext: ".sh"},
+	"zsh":        {Command: "zsh", InlineArgs: []string{"-euc"}, ScriptArgs: []string{"-eu", ScriptPlaceholder}, Ext: ".sh"},
+	"fish":       {Command: "fish", InlineArgs: []string{"-c"}, ScriptArgs: []string{ScriptPlaceholder}, Ext: ".fish"},
+	"pwsh":       {Command: "pwsh", InlineArgs: []string{"-NoProfile", "-Command"}, ScriptArgs: []string{"-NoProfile", "-NonInteractive", "-File", ScriptPlaceholder}, Ext: ".ps1"},
+	"powershell": {Command: "powershell", InlineArgs: []string{"-NoProfile", "-Command"}, ScriptArgs: []string{"-NoProfile", "-NonInteractive", "-File", ScriptPlaceholder}, Ext: ".ps1"},
+	"cmd":        {Command: "cmd", InlineArgs: []string{"/C"}, ScriptArgs: []string{"/D", "/E:ON", "/V:OFF", "/S", "/C", "CALL", ScriptPlaceholder}, Ext: ".cmd"},
+	"python":     {Command: "python", ScriptArgs: []string{ScriptPlaceholder}, Ext: ".py"},
+	"python3":    {Command: "python3", ScriptArgs: []string{ScriptPlaceholder}, Ext: ".py"},
+	"node":       {Command: "node", ScriptArgs: []string{ScriptPlaceholder}, Ext: ".js"},
+	"go":         {Command: "go", ScriptArgs: []string{"run", ScriptPlaceholder}, Ext: ".go"},
+}
+
+// ShellPresets returns the names of the built-in shell presets
+func ShellPresets() []string {
+	names := make([]string, 0, len(shellPresets))
+	for name := range shellPresets {
+		names = append(names, name)
+	}
+	return names
+}
+
+// shellInvocation is a resolved shell: either a preset or a template
+type shellInvocation struct {
+	command    string
+	inlineArgs []string
+	scriptArgs []string
+	ext        string
+}
+
+// parseShell resolves a shell: value. A bare name selects a preset (unknown
+// names get sh-style flags); anything with arguments is a template where
+// ScriptPlaceholder is replaced with the script path, or the path is appended.
+func parseShell(shell string) (shellInvocation, error) {
+	shell = strings.TrimSpace(shell)
+	if shell == "" {
+		return defaultShell(), nil
+	}
+
+	fields, err := splitShellTemplate(shell)
+	if err != nil {
+		return shellInvocation{}, err
+	}
+
+	name := strings.TrimSuffix(filepath.Base(fields[0]), ".exe")
+	preset, known := shellPresets[name]
+
+	if len(fields) == 1 {
+		if !known {
+			preset = shellPresets["sh"]
+		}
+		return shellInvocation{
+			command:    fields[0],
+			inlineArgs: preset.InlineArgs,
+			scriptArgs: preset.ScriptArgs,
+			ext:        preset.Ext,
+		}, nil
+	}
+
+	// Templates always run a script file
+	args := fields[1:]
+	hasPlaceholder := false
+	for _, arg := range args {
+		if strings.Contains(arg, ScriptPlaceholder) {
+			hasPlaceholder = true
+			break
+		}
+	}
+	if !hasPlaceholder {
+		args = append(args, ScriptPlaceholder)
+	}
+	return shellInvocation{command: fields[0], scriptArgs: args, ext: preset.Ext}, nil
+}
+
+// defaultShell returns the platform default shell
+func defaultShell() shellInvocation {
+	name := "sh"
+	if runtime.GOOS == "windows" {
+		// Default Windows shell: bash (Git Bash), falling back to cmd
+		name = "cmd"
+		if _, err := exec.LookPath("bash.exe"); err == nil {
+			name = "bash"
+		}
+	}
+	preset := shellPresets[name]
+	return shellInvocation{command: preset.Command, inlineArgs: preset.InlineArgs, scriptArgs: preset.ScriptArgs, ext: preset.Ext}
+}
+
+// splitShellTemplate splits a template into fields, honouring single and double quotes
+func splitShellTemplate(template string) ([]string, error) {
+	var fields []string
+	var current strings.Builder
+	inField := false
+	var quote rune
+	for _, c := range template {
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			} else {
+				current.WriteRune(c)
+			}
+		case c == '\'' || c == '"':
+			quote = c
+			inField = true
+		case c == ' ' || c == '\t':
+			if inField {
+				fields = append(fields, current.String())
+				current.Reset()
+				inField = false
+			}
+		default:
+			current.WriteRune(c)
+			inField = true
+		}
+	}
+	if quote != 0 {
+		return nil, fmt.Errorf("unterminated quote in shell template %q", template)
+	}
+	if inField {
+		fields = append(fields, current.String())
+	}
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("empty shell template")
+	}
+	return fields, nil
+}
+
+// useScript reports whether run is executed from a script file
+func (s shellInvocation) useScript(run string) bool {
+	return s.inlineArgs == nil || strings.Contains(strings.TrimRight(run, "\n"), "\n")
+}
+
+// lookPath checks the shell executable exists, adding .exe on Windows
+func (s shellInvocation) lookPath() (string, error) {
+	command := s.command
+	if runtime.GOOS == "windows" && !strings.HasSuffix(command, ".exe") {
+		command = command + ".exe"
+	}
+	if _, err := exec.LookPath(command); err != nil {
+		return "", fmt.Errorf("shell '%s' not found in PATH. Please install it or use a different shell", s.command)
+	}
+	return command, nil
+}
+
+// prepareShellCommand returns the command and arguments that execute run with
+// shell. Script files are written to a temporary file that cleanup removes.
+func prepareShellCommand(shell, run string) (string, []string, func(), error) {
+	noop := func() {}
+	invocation, err := parseShell(shell)
+	if err != nil {
+		return "", nil, noop, err
+	}
+	command, err := invocation.lookPath()
+	if err != nil {
+		return "", nil, noop, err
+	}
+
+	if !invocation.useScript(run) {
+		return command, append(append([]string{}, invocation.inlineArgs...), run), noop, nil
+	}
+
+	file, err := os.CreateTemp("", "buildfab-*"+invocation.ext)
+	if err != nil {
+		return "", nil, noop, fmt.Errorf("failed to create script file: %w", err)
+	}
+	cleanup := func() { os.Remove(file.Name()) }
+	if _, err := file.WriteString(run); err != nil {
+		file.Close()
+		cleanup()
+		return "", nil, noop, fmt.Errorf("failed to write script file: %w", err)
+	}
+	if err := file.Close(); err != nil {
+		cleanup()
+		return "", nil, noop, fmt.Errorf("failed to write script file: %w", err)
+	}
+
+	args := make([]string, len(invocation.scriptArgs))
+	for i, arg := range invocation.scriptArgs {
+		args[i] = strings.ReplaceAll(arg, ScriptPlaceholder, file.Name())
+	}
+	return command, args, cleanup, nil
+}
+
+// describeShellCommand returns the command line that would execute run, for
+// dry-run output. Script file invocations show the placeholder and the script.
+func describeShellCommand(shell, run string) (string, error) {
+	invocation, err := parseShell(shell)
+	if err != nil {
+		return "", err
+	}
+	command, err := invocation.lookPath()
+	if err != nil {
+		return "", err
+	}
+	if !invocation.useScript(run) {
+		return command + " " + strings.Join(append(append([]string{}, invocation.inlineArgs...), run), " "), nil
+	}
+	return command + " " + strings.Join(invocation.scriptArgs, " ") + "\n" + run, nil
+}
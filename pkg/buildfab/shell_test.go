@@ -0,0 +1,144 @@
+package buildfab
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+func TestParseShell(t *testing.T) {
+	tests := []struct {
+		name       string
+		shell      string
+		command    string
+		inlineArgs []string
+		scriptArgs []string
+		ext        string
+	}{
+		{name: "bash preset", shell: "bash", command: "bash", inlineArgs: []string{"-euc"}, scriptArgs: []string{"-eu", "{0}"}, ext: ".sh"},
+		{name: "fish has no -e", shell: "fish", command: "fish", inlineArgs: []string{"-c"}, scriptArgs: []string{"{0}"}, ext: ".fish"},
+		{name: "cmd preset", shell: "cmd", command: "cmd", inlineArgs: []string{"/C"}, scriptArgs: []string{"/D", "/E:ON", "/V:OFF", "/S", "/C", "CALL", "{0}"}, ext: ".cmd"},
+		{name: "interpreter preset", shell: "python3", command: "python3", scriptArgs: []string{"{0}"}, ext: ".py"},
+		{name: "preset by path", shell: "/usr/local/bin/bash", command: "/usr/local/bin/bash", inlineArgs: []string{"-euc"}, scriptArgs: []string{"-eu", "{0}"}, ext: ".sh"},
+		{name: "unknown shell uses sh flags", shell: "dash", command: "dash", inlineArgs: []string{"-euc"}, scriptArgs: []string{"-eu", "{0}"}, ext: ".sh"},
+		{name: "template", shell: "bash --noprofile --norc -eo pipefail {0}", command: "bash", scriptArgs: []string{"--noprofile", "--norc", "-eo", "pipefail", "{0}"}, ext: ".sh"},
+		{name: "template without placeholder", shell: "go run", command: "go", scriptArgs: []string{"run", "{0}"}, ext: ".go"},
+		{name: "quoted template", shell: `cmd /C "CALL {0}"`, command: "cmd", scriptArgs: []string{"/C", "CALL {0}"}, ext: ".cmd"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseShell(tt.shell)
+			if err != nil {
+				t.Fatalf("parseShell() error = %v", err)
+			}
+			if got.command != tt.command {
+				t.Errorf("command = %q, want %q", got.command, tt.command)
+			}
+			if strings.Join(got.inlineArgs, " ") != strings.Join(tt.inlineArgs, " ") || (got.inlineArgs == nil) != (tt.inlineArgs == nil) {
+				t.Errorf("inlineArgs = %q, want %q", got.inlineArgs, tt.inlineArgs)
+			}
+			if strings.Join(got.scriptArgs, "|") != strings.Join(tt.scriptArgs, "|") {
+				t.Errorf("scriptArgs = %q, want %q", got.scriptArgs, tt.scriptArgs)
+			}
+			if got.ext != tt.ext {
+				t.Errorf("ext = %q, want %q", got.ext, tt.ext)
+			}
+		})
+	}
+
+	if _, err := parseShell(`bash "-c`); err == nil {
+		t.Error("expected error for unterminated quote")
+	}
+}
+
+func TestPrepareShellCommand(t *testing.T) {
+	if _, err := exec.LookPath("bash"); err != nil {
+		t.Skip("bash not available")
+	}
+
+	// Single-line run with a preset is passed inline
+	command, args, cleanup, err := prepareShellCommand("bash", "echo hello")
+	if err != nil {
+		t.Fatalf("prepareShellCommand() error = %v", err)
+	}
+	cleanup()
+	if command != "bash" || strings.Join(args, " ") != "-euc echo hello" {
+		t.Errorf("inline command = %s %q", command, args)
+	}
+
+	// Multi-line run uses a script file that cleanup removes
+	_, args, cleanup, err = prepareShellCommand("bash", "echo one\necho two\n")
+	if err != nil {
+		t.Fatalf("prepareShellCommand() error = %v", err)
+	}
+	script := args[len(args)-1]
+	if !strings.HasSuffix(script, ".sh") {
+		t.Errorf("script file %q should have .sh extension", script)
+	}
+	content, err := os.ReadFile(script)
+	if err != nil || string(content) != "echo one\necho two\n" {
+		t.Errorf("script content = %q, %v", content, err)
+	}
+	cleanup()
+	if _, err := os.Stat(script); !os.IsNotExist(err) {
+		t.Errorf("script file %q should be removed by cleanup", script)
+	}
+
+	if _, _, _, err := prepareShellCommand("no-such-shell-buildfab", "true"); err == nil {
+		t.Error("expected error for missing shell")
+	}
+}
+
+func TestRunActionShellTemplates(t *testing.T) {
+	if _, err := exec.LookPath("bash"); err != nil {
+		t.Skip("bash not available")
+	}
+
+	tests := []struct {
+		name    string
+		shell   string
+		run     string
+		wantErr bool
+		output  string
+	}{
+		{name: "pipefail template fails on pipeline error", shell: "bash --noprofile --norc -eo pipefail {0}", run: "false | true", wantErr: true},
+		{name: "preset ignores pipeline error", shell: "bash", run: "false | true"},
+		{name: "multi-line preset", shell: "bash", run: "echo first\necho second", output: "second"},
+		{name: "multi-line stops on error", shell: "sh", run: "false\necho unreachable", wantErr: true},
+	}
+	if _, err := exec.LookPath("python3"); err == nil {
+		tests = append(tests, struct {
+			name    string
+			shell   string
+			run     string
+			wantErr bool
+			output  string
+		}{name: "python interpreter", shell: "python3", run: "print('from ' + 'python')", output: "from python"})
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := &Config{Actions: []Action{{Name: "script", Shell: tt.shell, Run: tt.run}}}
+			callback := &MockStepCallback{}
+			opts := DefaultRunOptions()
+			opts.StepCallback = callback
+
+			err := NewRunner(config, opts).RunAction(context.Background(), "script")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("RunAction() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.output != "" {
+				var output []string
+				for _, call := range callback.OnStepOutputCalls {
+					output = append(output, call.Output)
+				}
+				if got := strings.Join(output, "\n"); !strings.Contains(got, tt.output) {
+					t.Errorf("output = %q, want it to contain %q", got, tt.output)
+				}
+			}
+		})
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"path/filepath"
 	"runtime"
 	"strings"
 	"time"
@@ -39,6 +40,10 @@ type SimpleRunner struct {
 	config   *Config
 	opts     *SimpleRunOptions
 	registry ActionRegistry
+	masker   *Masker
+	ui       string     // Renderer of stage runs resolved for the outputs
+	ci       string     // CI provider of groups and annotations
+	width    func() int // Width of the terminal of the live display
 }
 
 // SimpleRunOptions configures simple stage execution
@@ -54,6 +59,17 @@ type SimpleRunOptions struct {
 	ErrorOutput io.Writer         // Error output writer (default: os.Stderr)
 	Only        []string          // Only run steps matching these labels
 	WithRequires bool             // Include required dependencies when running single step
+	EnvFiles    []string          // Additional dotenv files loaded with the highest precedence, masked with the secret: prefix
+	Secrets     []string          // Names of vars and env entries masked in output, including Variables
+	AssumeYes   bool              // Approve confirm steps without prompting
+	Prompter    Prompter          // Asks confirm questions (default: the terminal)
+	Reports     []ReportSpec      // Reports written after a stage run
+	TracePath   string            // Chrome trace written after a stage run
+	RunLogs     bool              // Write step logs of stage runs to .buildfab/runs/<run-id>
+	History     bool              // Record stage runs in .buildfab/history
+	UI          string            // Renderer of stage runs: UIOrdered (default), UITTY or UIPrefixed
+	Timestamps  bool              // Prefix lines with their time in UIPrefixed output
+	CI          string            // CI provider of step groups and annotations: CIAuto, CIGitHub, CIGitLab or CITeamCity (default: none)
 }
 
 // DefaultSimpleRunOptions returns default simple run options
@@ -81,10 +97,31 @@ func NewSimpleRunner(config *Config, opts *SimpleRunOptions) *SimpleRunner {
 	if opts == nil {
 		opts = DefaultSimpleRunOptions()
 	}
+	
+	// Mask secrets in everything the runner prints, including step summaries
+	masker := NewMasker()
+	maskedOpts := *opts
+	maskedOpts.Output = NewMaskingWriter(opts.Output, masker)
+	maskedOpts.ErrorOutput = NewMaskingWriter(opts.ErrorOutput, masker)
+	
+	// Runners share the registry, plugins are discovered once when used
+	registry := NewDefaultActionRegistry()
+	registry.DiscoverPluginsOnUse(PluginSearchPath(config))
+	
+	// The terminal is detected on the outputs before masking wraps them
+	width := columnsWidth
+	if f, ok := opts.ErrorOutput.(*os.File); ok {
+		width = fileWidth(f)
+	}
+	
 	return &SimpleRunner{
 		config:   config,
-		opts:     opts,
-		registry: NewDefaultActionRegistry(),
+		opts:     &maskedOpts,
+		registry: registry,
+		masker:   masker,
+		ui:       ResolveUI(opts.UI, opts.Output, opts.ErrorOutput),
+		ci:       ResolveCI(opts.CI),
+		width:    width,
 	}
 }
 
@@ -97,7 +134,7 @@ func (r *SimpleRunner) RunStage(ctx context.Context, stageName string) error {
 
 	// Handle dry-run mode differently
 	if r.opts.DryRun {
-		return r.executeStageDryRun(ctx, stageName, stage.Steps)
+		return r.executeStageDryRun(ctx, stageName, &stage)
 	}
 
 	// Print stage start message
@@ -106,8 +143,44 @@ func (r *SimpleRunner) RunStage(ctx context.Context, stageName string) error {
 	// Start timing the stage execution
 	stageStart := time.Now()
 
-	// Create ordered step callback to collect results with proper ordering
-	stepCallback := NewOrderedStepCallback(stage.Steps, r.opts.Verbose, r.opts.Debug, r.opts.ErrorOutput, r.config)
+	// Create the step callback of the UI to show and collect results
+	var stepCallback stageStepCallback
+	var live *LiveStepCallback
+	switch r.ui {
+	case UITTY:
+		live = NewLiveStepCallback(stage.Steps, r.opts.Verbose, r.opts.ErrorOutput, r.config)
+		live.width = r.width
+		live.Start()
+		stepCallback = live
+	case UIPrefixed:
+		stepCallback = NewPrefixedStepCallback(stage.Steps, r.opts.Timestamps, r.opts.ErrorOutput, r.config)
+	default:
+		stepCallback = NewOrderedStepCallback(stage.Steps, r.opts.Verbose, r.opts.Debug, r.opts.ErrorOutput, r.config)
+	}
+	
+	// CI groups and annotations decorate the callback of the UI
+	runCallback := StepCallback(stepCallback)
+	if r.ci != CINone {
+		configFile := ""
+		if _, err := os.Stat(r.opts.ConfigPath); err == nil {
+			configFile = r.opts.ConfigPath
+		}
+		runCallback = NewCIStepCallback(r.ci, stepCallback, r.opts.ErrorOutput, configFile)
+	}
+	
+	// Logs are best effort, a failure to write them doesn't fail the stage
+	var runLog *RunLog
+	if r.opts.RunLogs {
+		runLog = r.startRunLog(stageName)
+	}
+	
+	// Recorded durations let the scheduler start the longest paths first
+	var stepDurations map[string]time.Duration
+	if r.opts.History {
+		if records, err := ReadHistory(projectStateDir(r.config, r.opts.WorkingDir)); err == nil {
+			stepDurations = HistoryDurations(records, stageName)
+		}
+	}
 
 	// Convert to complex options for internal executor
 	complexOpts := &RunOptions{
@@ -122,11 +195,29 @@ func (r *SimpleRunner) RunStage(ctx context.Context, stageName string) error {
 		ErrorOutput:  r.opts.ErrorOutput,
 		Only:         r.opts.Only,
 		WithRequires: r.opts.WithRequires,
-		StepCallback: stepCallback,
+		EnvFiles:     r.opts.EnvFiles,
+		Secrets:      r.opts.Secrets,
+		AssumeYes:    r.opts.AssumeYes,
+		Prompter:     r.opts.Prompter,
+		RunLog:       runLog,
+		StepDurations: stepDurations,
+		StreamOutput: live != nil || r.ci != CINone,
+		masker:       r.masker,
+		StepCallback: runCallback,
 	}
 
-	runner := NewRunner(r.config, complexOpts)
+	runner := NewRunnerWithRegistry(r.config, complexOpts, r.registry)
 	err := runner.RunStage(ctx, stageName)
+	if ci, ok := runCallback.(*CIStepCallback); ok {
+		// Output of steps still running when the stage was cancelled
+		ci.Flush()
+	}
+	if live != nil {
+		live.Stop()
+	}
+	if closeErr := runLog.Close(err == nil && ctx.Err() == nil); closeErr != nil {
+		fmt.Fprintf(r.opts.ErrorOutput, "Warning: %v\n", closeErr)
+	}
 	
 	// Calculate stage execution duration
 	stageDuration := time.Since(stageStart)
@@ -149,16 +240,68 @@ func (r *SimpleRunner) RunStage(ctx context.Context, stageName string) error {
 	terminated := ctx.Err() != nil
 	success := err == nil && !terminated
 	
+	// Reports and diagnostics use the runner results, which include captured output
+	stageResult := NewStageResult(&stage, stageName, runner.Results(), stageStart, stageDuration, err)
+	
 	// Print summary with termination handling
 	if terminated {
 		r.printTerminatedSummary(stageName, results, stageDuration)
 	} else {
 		r.printSummary(stageName, success, results, stageDuration)
+		r.printDiagnostics(stageResult.Steps)
+	}
+	
+	for _, spec := range r.opts.Reports {
+		if reportErr := WriteReport(spec, []StageResult{stageResult}); reportErr != nil {
+			fmt.Fprintf(r.opts.ErrorOutput, "Error: %v\n", reportErr)
+			if err == nil {
+				err = reportErr
+			}
+		}
+	}
+	if r.opts.History {
+		runID := ""
+		if runLog != nil {
+			runID = runLog.ID()
+		}
+		commit := CurrentGitCommit(context.Background(), projectDir(r.config, r.opts.WorkingDir))
+		if historyErr := AppendHistory(projectStateDir(r.config, r.opts.WorkingDir), NewHistoryRecord(stageResult, runID, commit)); historyErr != nil {
+			fmt.Fprintf(r.opts.ErrorOutput, "Warning: %v\n", historyErr)
+		}
+	}
+	if r.opts.TracePath != "" {
+		if traceErr := WriteTrace(r.opts.TracePath, []StageResult{stageResult}); traceErr != nil {
+			fmt.Fprintf(r.opts.ErrorOutput, "Error: %v\n", traceErr)
+			if err == nil {
+				err = traceErr
+			}
+		}
 	}
 	
 	return err
 }
 
+// stageStepCallback is a step callback collecting the results of a stage run
+type stageStepCallback interface {
+	StepCallback
+	GetResults() []StepResult
+}
+
+// startRunLog creates the log directory of a stage run and prunes old runs
+// by the logs: retention policy
+func (r *SimpleRunner) startRunLog(stageName string) *RunLog {
+	stateDir := projectStateDir(r.config, r.opts.WorkingDir)
+	runLog, err := NewRunLog(stateDir, stageName, r.masker)
+	if err != nil {
+		fmt.Fprintf(r.opts.ErrorOutput, "Warning: step logs disabled: %v\n", err)
+		return nil
+	}
+	if _, err := PruneRuns(stateDir, r.config.Logs.keepRuns(), r.config.Logs.maxAge(), runLog.ID()); err != nil {
+		fmt.Fprintf(r.opts.ErrorOutput, "Warning: %v\n", err)
+	}
+	return runLog
+}
+
 // RunAction executes a specific action with automatic output handling
 func (r *SimpleRunner) RunAction(ctx context.Context, actionName string) error {
 	// Print action header
@@ -186,10 +329,15 @@ func (r *SimpleRunner) RunAction(ctx context.Context, actionName string) error {
 		ErrorOutput:  r.opts.ErrorOutput,
 		Only:         r.opts.Only,
 		WithRequires: r.opts.WithRequires,
+		EnvFiles:     r.opts.EnvFiles,
+		Secrets:      r.opts.Secrets,
+		AssumeYes:    r.opts.AssumeYes,
+		Prompter:     r.opts.Prompter,
+		masker:       r.masker,
 		StepCallback: stepCallback,
 	}
 
-	runner := NewRunner(r.config, complexOpts)
+	runner := NewRunnerWithRegistry(r.config, complexOpts, r.registry)
 	err := runner.RunAction(ctx, actionName)
 	
 	// Get collected results
@@ -265,6 +413,11 @@ func (r *SimpleRunner) RunStageStep(ctx context.Context, stageName, stepName str
 		ErrorOutput:  r.opts.ErrorOutput,
 		Only:         r.opts.Only,
 		WithRequires: r.opts.WithRequires,
+		EnvFiles:     r.opts.EnvFiles,
+		Secrets:      r.opts.Secrets,
+		AssumeYes:    r.opts.AssumeYes,
+		Prompter:     r.opts.Prompter,
+		masker:       r.masker,
 		StepCallback: &SimpleStepCallback{
 			verbose: r.opts.Verbose,
 			debug:   r.opts.Debug,
@@ -274,7 +427,7 @@ func (r *SimpleRunner) RunStageStep(ctx context.Context, stageName, stepName str
 		},
 	}
 
-	runner := NewRunner(r.config, complexOpts)
+	runner := NewRunnerWithRegistry(r.config, complexOpts, r.registry)
 	return runner.RunStageStep(ctx, stageName, stepName)
 }
 
@@ -497,6 +650,9 @@ func (c *SimpleStepCallback) extractCommand(stepName, message string) string {
 				// Add 6 spaces indentation
 				alignedLines = append(alignedLines, "      "+trimmedLine)
 			}
+			if cdLine := reproDirLine(message); cdLine != "" {
+				alignedLines = append([]string{"      " + cdLine}, alignedLines...)
+			}
 			return strings.Join(alignedLines, "\n")
 		}
 	
@@ -761,8 +917,35 @@ func (r *SimpleRunner) printSummary(stageName string, success bool, results []St
 	}
 }
 
+// printDiagnostics prints the first diagnostics of each failed step
+func (r *SimpleRunner) printDiagnostics(steps []StepResult) {
+	header := false
+	for _, step := range steps {
+		if step.Status != StepStatusError || len(step.Diagnostics) == 0 {
+			continue
+		}
+		if !header {
+			fmt.Fprintf(r.opts.Output, "\n🔍 Problems:\n")
+			header = true
+		}
+		fmt.Fprintf(r.opts.Output, "   %s✗%s %s\n", colorRed, colorReset, step.StepName)
+		shown := step.Diagnostics
+		if len(shown) > summaryDiagnostics {
+			shown = shown[:summaryDiagnostics]
+		}
+		for _, diagnostic := range shown {
+			fmt.Fprintf(r.opts.Output, "      %s\n", diagnostic)
+		}
+		if more := len(step.Diagnostics) - len(shown); more > 0 {
+			fmt.Fprintf(r.opts.Output, "      ... and %d more\n", more)
+		}
+	}
+}
+
 // executeStageDryRun simulates stage execution for dry-run mode
-func (r *SimpleRunner) executeStageDryRun(ctx context.Context, stageName string, steps []Step) error {
+func (r *SimpleRunner) executeStageDryRun(ctx context.Context, stageName string, stage *Stage) error {
+	steps := stage.Steps
+	
 	// Print stage header
 	fmt.Fprintf(r.opts.Output, "▶️  Dry run stage: %s\n\n", stageName)
 	
@@ -773,8 +956,16 @@ func (r *SimpleRunner) executeStageDryRun(ctx context.Context, stageName string,
 	
 	// Process each step
 	for _, step := range steps {
+		// Resolve variables visible to this step
+		action, _ := r.config.GetAction(step.Action)
+		scope, err := resolveStepScope(r.config, stage, &step, &action, r.opts.Variables, r.opts.EnvFiles, r.opts.Secrets)
+		if err != nil {
+			return fmt.Errorf("failed to resolve variables for step %s: %w", step.Action, err)
+		}
+		r.masker.Add(scope.Secrets...)
+		
 		// Check if step should be executed based on conditions
-		shouldExecute, err := r.shouldExecuteStepByCondition(ctx, step)
+		shouldExecute, err := r.shouldExecuteStepByCondition(ctx, step, scope.Variables)
 		if err != nil {
 			return fmt.Errorf("failed to evaluate step condition: %w", err)
 		}
@@ -825,7 +1016,7 @@ func (r *SimpleRunner) executeStageDryRun(ctx context.Context, stageName string,
 			}
 		} else {
 			// Simulate custom action execution
-			err := r.runActionInternalDryRun(ctx, action)
+			err := r.runActionInternalDryRun(ctx, action, scope)
 			if err != nil {
 				if r.opts.Verbose {
 					fmt.Fprintf(r.opts.Output, "  ✗ %s would fail (%v)\n", step.Action, err)
@@ -848,14 +1039,14 @@ func (r *SimpleRunner) executeStageDryRun(ctx context.Context, stageName string,
 }
 
 // shouldExecuteStepByCondition determines if a step should be executed based on its if condition
-func (r *SimpleRunner) shouldExecuteStepByCondition(ctx context.Context, step Step) (bool, error) {
+func (r *SimpleRunner) shouldExecuteStepByCondition(ctx context.Context, step Step, variables map[string]string) (bool, error) {
 	// If no if condition is specified, execute the step
 	if step.If == "" {
 		return true, nil
 	}
 	
 	// Evaluate the if condition using the expression evaluator
-	shouldExecute, err := evaluateCondition(step.If, r.opts.Variables)
+	shouldExecute, err := evaluateCondition(step.If, variables)
 	if err != nil {
 		return false, fmt.Errorf("failed to evaluate if condition for step %s: %w", step.Action, err)
 	}
@@ -864,9 +1055,9 @@ func (r *SimpleRunner) shouldExecuteStepByCondition(ctx context.Context, step St
 }
 
 // runActionInternalDryRun simulates action execution for dry-run mode
-func (r *SimpleRunner) runActionInternalDryRun(ctx context.Context, action Action) error {
+func (r *SimpleRunner) runActionInternalDryRun(ctx context.Context, action Action, scope *stepScope) error {
 	// Select variant if action has variants
-	variant, err := action.SelectVariant(r.opts.Variables)
+	variant, err := action.SelectVariant(scope.Variables)
 	if err != nil {
 		return err
 	}
@@ -884,6 +1075,7 @@ func (r *SimpleRunner) runActionInternalDryRun(ctx context.Context, action Actio
 			Run:   variant.Run,
 			Uses:  variant.Uses,
 			Shell: variant.Shell,
+			With:  mergeInputs(action.With, variant.With),
 		}
 	}
 	
@@ -891,7 +1083,7 @@ func (r *SimpleRunner) runActionInternalDryRun(ctx context.Context, action Actio
 		return r.runBuiltInActionDryRun(ctx, effectiveAction)
 	}
 	
-	return r.runCustomActionDryRun(ctx, effectiveAction)
+	return r.runCustomActionDryRun(ctx, effectiveAction, scope)
 }
 
 // runBuiltInActionDryRun simulates built-in action execution for dry-run mode
@@ -916,26 +1108,29 @@ func (r *SimpleRunner) runBuiltInActionDryRun(ctx context.Context, action Action
 }
 
 // runCustomActionDryRun simulates custom action execution for dry-run mode
-func (r *SimpleRunner) runCustomActionDryRun(ctx context.Context, action Action) error {
+func (r *SimpleRunner) runCustomActionDryRun(ctx context.Context, action Action, scope *stepScope) error {
 	if action.Run == "" {
 		return fmt.Errorf("action %s has no run command", action.Name)
 	}
 	
 	// Interpolate variables in the action
-	interpolatedAction, err := InterpolateAction(action, r.opts.Variables)
+	interpolatedAction, err := InterpolateAction(action, scope.Variables)
 	if err != nil {
 		return fmt.Errorf("failed to interpolate variables in action %s: %w", action.Name, err)
 	}
 	
-	// Get shell command info
-	shell, shellArgs, err := getShellCommand(action.Shell)
+	// Build the full command
+	commandStr, err := describeShellCommand(actionShell(action, scope), interpolatedAction.Run)
 	if err != nil {
 		return fmt.Errorf("shell configuration error for action %s: %w", action.Name, err)
 	}
-	
-	// Build the full command
-	fullCommand := append(shellArgs, interpolatedAction.Run)
-	commandStr := shell + " " + strings.Join(fullCommand, " ")
+	if scope.WorkingDir != "" {
+		dir := scope.WorkingDir
+		if !filepath.IsAbs(dir) && r.opts.WorkingDir != "" {
+			dir = filepath.Join(r.opts.WorkingDir, dir)
+		}
+		commandStr = fmt.Sprintf("cd %s && %s", displayPath(dir), commandStr)
+	}
 	
 	// Print what would be executed if verbose mode is enabled
 	if r.opts.Verbose {
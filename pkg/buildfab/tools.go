@@ -0,0 +1,485 @@
+package buildfab
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// Tool check states
+const (
+	ToolFound    = "found"    // Tool found and satisfies the version constraint
+	ToolMissing  = "missing"  // Tool not found on PATH
+	ToolOutdated = "outdated" // Tool version does not satisfy the constraint
+	ToolUnknown  = "unknown"  // Tool found but its version could not be determined
+)
+
+// defaultToolRegex extracts the first dotted version number from probe output
+const defaultToolRegex = `(\d+\.\d+(?:\.\d+)?)`
+
+// toolProbeTimeout bounds how long a version probe may run
+const toolProbeTimeout = 10 * time.Second
+
+// ToolRequirement declares a tool the project needs
+type ToolRequirement struct {
+	Name     string `yaml:"name"`               // Executable name
+	Version  string `yaml:"version,omitempty"`  // Version constraint such as ">=1.22 <2", "^2.0" or "1.x"
+	Probe    string `yaml:"probe,omitempty"`    // Command printing the version (default: <name> --version)
+	Regex    string `yaml:"regex,omitempty"`    // Regular expression extracting the version from probe output
+	Install  string `yaml:"install,omitempty"`  // Install hint shown when the tool is missing or outdated
+	Optional bool   `yaml:"optional,omitempty"` // Report but do not fail when missing or outdated
+}
+
+// ToolStatus is the result of checking a tool requirement
+type ToolStatus struct {
+	Tool    ToolRequirement
+	Path    string // Resolved executable path
+	Version string // Version reported by the probe
+	State   string // ToolFound, ToolMissing, ToolOutdated or ToolUnknown
+	Detail  string // Reason for states other than ToolFound
+}
+
+// Failed reports whether the status fails a required tool
+func (s ToolStatus) Failed() bool {
+	return s.State != ToolFound && !s.Tool.Optional
+}
+
+// validateTools checks the tools section
+func (c *Config) validateTools() error {
+	names := make(map[string]bool)
+	for i, tool := range c.Tools {
+		if tool.Name == "" {
+			return fmt.Errorf("tool %d must have a name", i+1)
+		}
+		if names[tool.Name] {
+			return fmt.Errorf("duplicate tool: %s", tool.Name)
+		}
+		names[tool.Name] = true
+		if err := tool.validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validate checks the version constraint and regular expression
+func (t ToolRequirement) validate() error {
+	if _, err := parseVersionConstraint(t.Version); err != nil {
+		return fmt.Errorf("tool %s: %w", t.Name, err)
+	}
+	if t.Regex != "" {
+		if _, err := regexp.Compile(t.Regex); err != nil {
+			return fmt.Errorf("tool %s: invalid regex: %w", t.Name, err)
+		}
+	}
+	return nil
+}
+
+// CheckTools checks every tool, running probes in the context's directory and environment
+func CheckTools(ctx context.Context, actx *ActionContext, tools []ToolRequirement) []ToolStatus {
+	statuses := make([]ToolStatus, len(tools))
+	for i, tool := range tools {
+		statuses[i] = CheckTool(ctx, actx, tool)
+	}
+	return statuses
+}
+
+// CheckTool looks a tool up on PATH, probes its version and checks the constraint
+func CheckTool(ctx context.Context, actx *ActionContext, tool ToolRequirement) ToolStatus {
+	status := ToolStatus{Tool: tool}
+	if err := tool.validate(); err != nil {
+		status.State = ToolUnknown
+		status.Detail = err.Error()
+		return status
+	}
+
+	path, err := exec.LookPath(tool.Name)
+	if err != nil {
+		status.State = ToolMissing
+		status.Detail = "not found in PATH"
+		return status
+	}
+	status.Path = path
+
+	probe := tool.Probe
+	if probe == "" {
+		probe = tool.Name + " --version"
+	}
+	fields, err := splitShellTemplate(probe)
+	if err != nil {
+		status.State = ToolUnknown
+		status.Detail = err.Error()
+		return status
+	}
+	probeCtx, cancel := context.WithTimeout(ctx, toolProbeTimeout)
+	defer cancel()
+	// Some tools print their version on stderr
+	output, err := actx.Command(probeCtx, fields[0], fields[1:]...).CombinedOutput()
+	if err != nil && len(output) == 0 {
+		if tool.Version == "" {
+			status.State = ToolFound
+			return status
+		}
+		status.State = ToolUnknown
+		status.Detail = fmt.Sprintf("%s failed: %v", probe, err)
+		return status
+	}
+
+	expr := tool.Regex
+	if expr == "" {
+		expr = defaultToolRegex
+	}
+	match := regexp.MustCompile(expr).FindStringSubmatch(string(output))
+	if match != nil {
+		status.Version = match[0]
+		if len(match) > 1 {
+			status.Version = match[1]
+		}
+	}
+
+	if tool.Version == "" {
+		status.State = ToolFound
+		return status
+	}
+	if status.Version == "" {
+		status.State = ToolUnknown
+		status.Detail = fmt.Sprintf("no version in output of %s", probe)
+		return status
+	}
+
+	constraint, _ := parseVersionConstraint(tool.Version)
+	ok, err := constraint.check(status.Version)
+	switch {
+	case err != nil:
+		status.State = ToolUnknown
+		status.Detail = err.Error()
+	case !ok:
+		status.State = ToolOutdated
+		status.Detail = fmt.Sprintf("%s does not satisfy %s", status.Version, tool.Version)
+	default:
+		status.State = ToolFound
+	}
+	return status
+}
+
+// FormatToolTable writes a table of tool statuses
+func FormatToolTable(w io.Writer, statuses []ToolStatus) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "TOOL\tREQUIRED\tFOUND\tSTATUS")
+	for _, s := range statuses {
+		required := s.Tool.Version
+		if required == "" {
+			required = "any"
+		}
+		found := s.Version
+		if found == "" {
+			found = "-"
+		}
+		state := s.State
+		if s.Tool.Optional && s.State != ToolFound {
+			state += " (optional)"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", s.Tool.Name, required, found, state)
+	}
+	tw.Flush()
+}
+
+// toolProblems describes tools that are not found, with install hints
+func toolProblems(statuses []ToolStatus) (failed []string, optional []string) {
+	for _, s := range statuses {
+		if s.State == ToolFound {
+			continue
+		}
+		problem := fmt.Sprintf("%s: %s", s.Tool.Name, s.State)
+		if s.Detail != "" {
+			problem += " (" + s.Detail + ")"
+		}
+		if s.Tool.Install != "" {
+			problem += ", install: " + s.Tool.Install
+		}
+		if s.Tool.Optional {
+			optional = append(optional, problem)
+		} else {
+			failed = append(failed, problem)
+		}
+	}
+	return failed, optional
+}
+
+// ToolRequireAction checks required tools.
+// Inputs: tools - names from the project tools: section (default: all), or
+// name, version, probe, regex and install to check a single tool inline.
+type ToolRequireAction struct{}
+
+func (a *ToolRequireAction) Run(ctx context.Context) (Result, error) {
+	return a.RunWithContext(ctx, NewActionContext(nil))
+}
+
+func (a *ToolRequireAction) RunWithContext(ctx context.Context, actx *ActionContext) (Result, error) {
+	tools, err := requiredTools(actx)
+	if err != nil {
+		return errorResult(err)
+	}
+	if len(tools) == 0 {
+		return Result{Status: StatusOK, Message: "No tools required"}, nil
+	}
+
+	statuses := CheckTools(ctx, actx, tools)
+	FormatToolTable(actx.Stdout, statuses)
+
+	failed, optional := toolProblems(statuses)
+	if len(failed) > 0 {
+		return Result{
+			Status:  StatusError,
+			Message: failureMessage("Missing or outdated tools", failed, "buildfab doctor"),
+		}, fmt.Errorf("%d required tools missing or outdated", len(failed))
+	}
+	if len(optional) > 0 {
+		return Result{
+			Status:  StatusWarn,
+			Message: failureMessage("Optional tools missing or outdated", optional, ""),
+		}, nil
+	}
+	return Result{
+		Status:  StatusOK,
+		Message: fmt.Sprintf("All %d tools found", len(tools)),
+	}, nil
+}
+
+func (a *ToolRequireAction) Description() string {
+	return "Check required tools and versions"
+}
+
+// requiredTools returns the tools selected by the action inputs
+func requiredTools(actx *ActionContext) ([]ToolRequirement, error) {
+	if name := actx.Input("name", ""); name != "" {
+		return []ToolRequirement{{
+			Name:    name,
+			Version: actx.Input("version", ""),
+			Probe:   actx.Input("probe", ""),
+			Regex:   actx.Input("regex", ""),
+			Install: actx.Input("install", ""),
+		}}, nil
+	}
+
+	var configured []ToolRequirement
+	if actx.Config != nil {
+		configured = actx.Config.Tools
+	}
+	names := actx.InputList("tools")
+	if len(names) == 0 {
+		return configured, nil
+	}
+
+	var tools []ToolRequirement
+	for _, name := range names {
+		found := false
+		for _, tool := range configured {
+			if tool.Name == name {
+				tools = append(tools, tool)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("tool %s is not defined in the tools section", name)
+		}
+	}
+	return tools, nil
+}
+
+// versionComparator compares a version with a bound
+type versionComparator struct {
+	op    string
+	bound [3]int
+}
+
+// versionConstraint is a list of alternatives (||), each a list of
+// comparators that must all hold
+type versionConstraint [][]versionComparator
+
+// parseVersionConstraint parses a semver range. Supported forms: comparisons
+// (>=, <=, >, <, =, !=), caret (^1.2), tilde (~1.2.3) and wildcards (1.x, 1.2.*,
+// or a partial version). Comparators are separated by spaces or commas,
+// alternatives by ||. An empty constraint matches every version.
+func parseVersionConstraint(s string) (versionConstraint, error) {
+	var constraint versionConstraint
+	if strings.TrimSpace(s) == "" {
+		return constraint, nil
+	}
+	for _, alternative := range strings.Split(s, "||") {
+		var comparators []versionComparator
+		for _, term := range strings.FieldsFunc(alternative, func(r rune) bool { return r == ' ' || r == ',' }) {
+			parsed, err := parseVersionTerm(term)
+			if err != nil {
+				return nil, fmt.Errorf("invalid version constraint %q: %w", s, err)
+			}
+			comparators = append(comparators, parsed...)
+		}
+		if len(comparators) == 0 {
+			return nil, fmt.Errorf("invalid version constraint %q: empty alternative", s)
+		}
+		constraint = append(constraint, comparators)
+	}
+	return constraint, nil
+}
+
+// parseVersionTerm parses one comparator term into comparators
+func parseVersionTerm(term string) ([]versionComparator, error) {
+	op := ""
+	for _, prefix := range []string{">=", "<=", "!=", "==", ">", "<", "=", "^", "~"} {
+		if strings.HasPrefix(term, prefix) {
+			op = prefix
+			break
+		}
+	}
+	numbers, parts, err := parseVersionNumbers(strings.TrimPrefix(term, op))
+	if err != nil {
+		return nil, err
+	}
+	if parts == 0 {
+		return []versionComparator{{">=", numbers}}, nil
+	}
+
+	upper := func(level int) [3]int {
+		switch level {
+		case 0:
+			return [3]int{numbers[0] + 1, 0, 0}
+		case 1:
+			return [3]int{numbers[0], numbers[1] + 1, 0}
+		default:
+			return [3]int{numbers[0], numbers[1], numbers[2] + 1}
+		}
+	}
+
+	switch op {
+	case "^":
+		level := 0
+		if numbers[0] == 0 && parts > 1 {
+			level = 1
+			if numbers[1] == 0 && parts > 2 {
+				level = 2
+			}
+		}
+		return []versionComparator{{">=", numbers}, {"<", upper(level)}}, nil
+	case "~":
+		level := 1
+		if parts == 1 {
+			level = 0
+		}
+		return []versionComparator{{">=", numbers}, {"<", upper(level)}}, nil
+	case "", "=", "==":
+		if parts < 3 {
+			return []versionComparator{{">=", numbers}, {"<", upper(parts - 1)}}, nil
+		}
+		return []versionComparator{{"=", numbers}}, nil
+	default:
+		return []versionComparator{{op, numbers}}, nil
+	}
+}
+
+// parseVersionNumbers parses a possibly partial version such as v1.2, 1.x or
+// 1.2.3-rc1 and returns the numbers and how many were given. Wildcards end
+// the version; prerelease and build suffixes are ignored.
+func parseVersionNumbers(s string) ([3]int, int, error) {
+	var numbers [3]int
+	s = strings.TrimPrefix(strings.TrimSpace(s), "v")
+	if i := strings.IndexAny(s, "-+~_ "); i >= 0 {
+		s = s[:i]
+	}
+	if s == "" {
+		return numbers, 0, fmt.Errorf("missing version")
+	}
+	parts := strings.Split(s, ".")
+	if len(parts) > 3 {
+		parts = parts[:3]
+	}
+	count := 0
+	for i, part := range parts {
+		if part == "x" || part == "X" || part == "*" {
+			break
+		}
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return numbers, 0, fmt.Errorf("invalid version %q", s)
+		}
+		numbers[i] = n
+		count++
+	}
+	if count == 0 {
+		// A bare wildcard matches everything
+		return numbers, 0, nil
+	}
+	return numbers, count, nil
+}
+
+// check reports whether version satisfies the constraint
+func (c versionConstraint) check(version string) (bool, error) {
+	if len(c) == 0 {
+		return true, nil
+	}
+	numbers, parts, err := parseVersionNumbers(version)
+	if err != nil || parts == 0 {
+		return false, fmt.Errorf("invalid version %q", version)
+	}
+	for _, alternative := range c {
+		ok := true
+		for _, comparator := range alternative {
+			if !comparator.matches(numbers) {
+				ok = false
+				break
+			}
+		}
+		if ok {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// matches applies the comparator to a version
+func (c versionComparator) matches(v [3]int) bool {
+	cmp := 0
+	for i := 0; i < 3 && cmp == 0; i++ {
+		switch {
+		case v[i] < c.bound[i]:
+			cmp = -1
+		case v[i] > c.bound[i]:
+			cmp = 1
+		}
+	}
+	switch c.op {
+	case ">=":
+		return cmp >= 0
+	case "<=":
+		return cmp <= 0
+	case ">":
+		return cmp > 0
+	case "<":
+		return cmp < 0
+	case "!=":
+		return cmp != 0
+	default:
+		return cmp == 0
+	}
+}
+
+// CheckTools checks the project's tools section in the project directory and
+// environment, as tool@require would
+func (r *Runner) CheckTools(ctx context.Context) ([]ToolStatus, error) {
+	scope, err := r.resolveScope(nil, nil, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve variables: %w", err)
+	}
+	actx, err := r.newActionContext(Action{Name: "tool@require", Uses: "tool@require"}, scope)
+	if err != nil {
+		return nil, err
+	}
+	return CheckTools(ctx, actx, r.config.Tools), nil
+}
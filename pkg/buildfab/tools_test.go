@@ -0,0 +1,135 @@
+package buildfab
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestVersionConstraint(t *testing.T) {
+	tests := []struct {
+		constraint string
+		version    string
+		want       bool
+	}{
+		{"", "1.0.0", true},
+		{">=1.22", "1.22.0", true},
+		{">=1.22", "1.21.9", false},
+		{">=1.22 <2", "1.23.1", true},
+		{">=1.22, <2", "2.0.0", false},
+		{"^1.2.3", "1.9.0", true},
+		{"^1.2.3", "2.0.0", false},
+		{"^0.2.3", "0.2.9", true},
+		{"^0.2.3", "0.3.0", false},
+		{"~1.2.3", "1.2.9", true},
+		{"~1.2.3", "1.3.0", false},
+		{"1.x", "1.5.2", true},
+		{"1.x", "2.0.0", false},
+		{"1.2", "1.2.7", true},
+		{"=1.2.3", "1.2.3", true},
+		{"!=1.2.3", "1.2.3", false},
+		{"<1 || >=3", "3.1", true},
+		{"<1 || >=3", "2.0", false},
+		{"*", "0.0.1", true},
+		{">=2.0", "v2.1.0-rc1", true},
+	}
+	for _, tt := range tests {
+		constraint, err := parseVersionConstraint(tt.constraint)
+		if err != nil {
+			t.Errorf("parseVersionConstraint(%q) error = %v", tt.constraint, err)
+			continue
+		}
+		got, err := constraint.check(tt.version)
+		if err != nil || got != tt.want {
+			t.Errorf("%q check(%q) = %v, %v, want %v", tt.constraint, tt.version, got, err, tt.want)
+		}
+	}
+
+	for _, invalid := range []string{">=abc", "1.2 ||", ">="} {
+		if _, err := parseVersionConstraint(invalid); err == nil {
+			t.Errorf("parseVersionConstraint(%q) expected error", invalid)
+		}
+	}
+}
+
+func TestCheckTool(t *testing.T) {
+	actx := NewActionContext(nil)
+	ctx := context.Background()
+
+	status := CheckTool(ctx, actx, ToolRequirement{Name: "sh", Probe: "sh -c 'echo version 5.2.15'", Version: ">=5"})
+	if status.State != ToolFound || status.Version != "5.2.15" || status.Path == "" {
+		t.Errorf("sh status = %+v, want found 5.2.15", status)
+	}
+
+	status = CheckTool(ctx, actx, ToolRequirement{Name: "sh", Probe: "sh -c 'echo release-7'", Regex: `release-(\d+)`, Version: "<7"})
+	if status.State != ToolOutdated || status.Version != "7" {
+		t.Errorf("sh status = %+v, want outdated 7", status)
+	}
+
+	status = CheckTool(ctx, actx, ToolRequirement{Name: "sh", Probe: "sh -c 'echo none'", Version: ">=1"})
+	if status.State != ToolUnknown {
+		t.Errorf("sh status = %+v, want unknown", status)
+	}
+
+	status = CheckTool(ctx, actx, ToolRequirement{Name: "buildfab-missing-tool"})
+	if status.State != ToolMissing || !status.Failed() {
+		t.Errorf("missing tool status = %+v, want failed missing", status)
+	}
+	status.Tool.Optional = true
+	if status.Failed() {
+		t.Error("optional missing tool should not fail")
+	}
+}
+
+func TestToolRequireAction(t *testing.T) {
+	config := &Config{Tools: []ToolRequirement{
+		{Name: "sh", Probe: "sh -c 'echo 5.0.0'", Version: ">=5"},
+		{Name: "buildfab-missing-tool", Install: "brew install missing"},
+		{Name: "buildfab-optional-tool", Optional: true},
+	}}
+
+	var out strings.Builder
+	actx := NewActionContext(map[string]string{"tools": "sh, buildfab-optional-tool"})
+	actx.Config = config
+	actx.Stdout = &out
+	result, err := (&ToolRequireAction{}).RunWithContext(context.Background(), actx)
+	if err != nil || result.Status != StatusWarn {
+		t.Errorf("optional tool should warn, got %+v, %v", result, err)
+	}
+	if !strings.Contains(out.String(), "TOOL") || !strings.Contains(out.String(), "5.0.0") {
+		t.Errorf("table = %q", out.String())
+	}
+
+	actx = NewActionContext(nil)
+	actx.Config = config
+	result, err = (&ToolRequireAction{}).RunWithContext(context.Background(), actx)
+	if err == nil || !strings.Contains(result.Message, "buildfab-missing-tool: missing") || !strings.Contains(result.Message, "brew install missing") {
+		t.Errorf("missing tool should fail with install hint, got %+v", result)
+	}
+
+	actx = NewActionContext(map[string]string{"name": "sh", "probe": "sh -c 'echo 1.0'", "version": "^1"})
+	if result, err := (&ToolRequireAction{}).RunWithContext(context.Background(), actx); err != nil || result.Status != StatusOK {
+		t.Errorf("inline tool should pass, got %+v, %v", result, err)
+	}
+
+	actx = NewActionContext(map[string]string{"tools": "undefined"})
+	actx.Config = config
+	if _, err := (&ToolRequireAction{}).RunWithContext(context.Background(), actx); err == nil {
+		t.Error("undefined tool name should fail")
+	}
+}
+
+func TestValidateTools(t *testing.T) {
+	config := &Config{Tools: []ToolRequirement{{Name: "go", Version: ">=1.22"}, {Name: "go"}}}
+	if err := config.validateTools(); err == nil || !strings.Contains(err.Error(), "duplicate tool") {
+		t.Errorf("validateTools() = %v, want duplicate error", err)
+	}
+	config = &Config{Tools: []ToolRequirement{{Name: "go", Version: ">=one"}}}
+	if err := config.validateTools(); err == nil {
+		t.Error("validateTools() expected invalid constraint error")
+	}
+	config = &Config{Tools: []ToolRequirement{{Name: "go", Regex: "("}}}
+	if err := config.validateTools(); err == nil {
+		t.Error("validateTools() expected invalid regex error")
+	}
+}
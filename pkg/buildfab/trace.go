@@ -0,0 +1,341 @@
+package buildfab
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// traceCategory is the category of step events in traces
+const traceCategory = "step"
+
+// Trace is a Chrome Trace Event file, readable by chrome://tracing and Perfetto
+type Trace struct {
+	TraceEvents     []TraceEvent `json:"traceEvents"`
+	DisplayTimeUnit string       `json:"displayTimeUnit,omitempty"`
+}
+
+// TraceEvent is a trace event. Steps are complete ("X") events with times in
+// microseconds, stages are processes and concurrent slots are threads.
+type TraceEvent struct {
+	Name string     `json:"name"`
+	Cat  string     `json:"cat,omitempty"`
+	Ph   string     `json:"ph"`
+	Ts   int64      `json:"ts"`
+	Dur  int64      `json:"dur,omitempty"`
+	Pid  int        `json:"pid"`
+	Tid  int        `json:"tid"`
+	Args *TraceArgs `json:"args,omitempty"`
+}
+
+// TraceArgs holds the arguments of step and metadata events
+type TraceArgs struct {
+	Name     string   `json:"name,omitempty"` // Process or thread name of metadata events
+	Action   string   `json:"action,omitempty"`
+	Variant  string   `json:"variant,omitempty"`
+	Status   string   `json:"status,omitempty"`
+	Requires []string `json:"requires,omitempty"`
+}
+
+// NewTrace builds a trace of stage results. Each stage is a process and each
+// step that ran a complete event on the first slot free at its start.
+func NewTrace(stages []StageResult) *Trace {
+	trace := &Trace{TraceEvents: []TraceEvent{}, DisplayTimeUnit: "ms"}
+	var origin time.Time
+	for _, stage := range stages {
+		for _, step := range stage.Steps {
+			if !step.Start.IsZero() && (origin.IsZero() || step.Start.Before(origin)) {
+				origin = step.Start
+			}
+		}
+	}
+	for i, stage := range stages {
+		pid := i + 1
+		trace.TraceEvents = append(trace.TraceEvents, TraceEvent{
+			Name: "process_name", Ph: "M", Pid: pid, Args: &TraceArgs{Name: "stage " + stage.StageName},
+		})
+		started := sortedByStart(stage.Steps)
+		lanes, count := assignLanes(started)
+		for slot := 1; slot <= count; slot++ {
+			trace.TraceEvents = append(trace.TraceEvents, TraceEvent{
+				Name: "thread_name", Ph: "M", Pid: pid, Tid: slot, Args: &TraceArgs{Name: fmt.Sprintf("slot %d", slot)},
+			})
+		}
+		for j, step := range started {
+			trace.TraceEvents = append(trace.TraceEvents, TraceEvent{
+				Name: step.StepName,
+				Cat:  traceCategory,
+				Ph:   "X",
+				Ts:   step.Start.Sub(origin).Microseconds(),
+				Dur:  step.Duration.Microseconds(),
+				Pid:  pid,
+				Tid:  lanes[j] + 1,
+				Args: &TraceArgs{
+					Action:   step.ActionName,
+					Variant:  step.Variant,
+					Status:   step.Status.String(),
+					Requires: step.Requires,
+				},
+			})
+		}
+	}
+	return trace
+}
+
+// WriteTrace writes a trace of stage results to a file, creating parent
+// directories
+func WriteTrace(path string, stages []StageResult) error {
+	data, err := json.MarshalIndent(NewTrace(stages), "", " ")
+	if err != nil {
+		return err
+	}
+	if dir := filepath.Dir(path); dir != "." {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return fmt.Errorf("failed to create trace directory: %w", err)
+		}
+	}
+	if err := os.WriteFile(path, append(data, '\n'), 0644); err != nil {
+		return fmt.Errorf("failed to write trace: %w", err)
+	}
+	return nil
+}
+
+// ReadTrace reads a trace in the object or the array form of the format
+func ReadTrace(r io.Reader) (*Trace, error) {
+	data, err := io.ReadAll(bufio.NewReader(r))
+	if err != nil {
+		return nil, err
+	}
+	trace := &Trace{}
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '[' {
+		err = json.Unmarshal(trimmed, &trace.TraceEvents)
+	} else {
+		err = json.Unmarshal(data, trace)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid trace: %w", err)
+	}
+	return trace, nil
+}
+
+// TraceAnalysis is the analysis of the steps of a stage in a trace
+type TraceAnalysis struct {
+	Stage          string
+	Wall           time.Duration // From the first step start to the last step end
+	Busy           time.Duration // Sum of the step durations
+	Slots          int           // Concurrent slots used
+	CriticalPath   []string      // Longest chain of dependent steps
+	CriticalLength time.Duration
+	Steps          []TraceStepAnalysis // In start order
+}
+
+// Parallelism returns the average number of steps running at once
+func (a TraceAnalysis) Parallelism() float64 {
+	if a.Wall <= 0 {
+		return 0
+	}
+	return float64(a.Busy) / float64(a.Wall)
+}
+
+// Utilisation returns the share of the slot time spent running steps
+func (a TraceAnalysis) Utilisation() float64 {
+	if a.Slots == 0 {
+		return 0
+	}
+	return a.Parallelism() / float64(a.Slots)
+}
+
+// TraceStepAnalysis is the timing of a step in a trace. Slack is how much
+// longer the step could take without making the critical path longer.
+type TraceStepAnalysis struct {
+	Name          string
+	Start         time.Duration // Offset from the first step start
+	Duration      time.Duration
+	EarliestStart time.Duration // When all its dependencies could have finished
+	Slack         time.Duration
+	Critical      bool
+}
+
+// AnalyzeTrace computes per stage the critical path through the step DAG,
+// using the recorded durations and the requires of each step, the
+// parallelism and the slack of each step
+func AnalyzeTrace(trace *Trace) []TraceAnalysis {
+	type stageEvents struct {
+		name   string
+		events []TraceEvent
+	}
+	var stages []*stageEvents
+	byPid := map[int]*stageEvents{}
+	stageOf := func(pid int) *stageEvents {
+		if s, ok := byPid[pid]; ok {
+			return s
+		}
+		s := &stageEvents{name: fmt.Sprintf("process %d", pid)}
+		byPid[pid] = s
+		stages = append(stages, s)
+		return s
+	}
+	for _, event := range trace.TraceEvents {
+		switch {
+		case event.Ph == "M" && event.Name == "process_name" && event.Args != nil:
+			stageOf(event.Pid).name = strings.TrimPrefix(event.Args.Name, "stage ")
+		case event.Ph == "X" && (event.Cat == traceCategory || event.Cat == ""):
+			s := stageOf(event.Pid)
+			s.events = append(s.events, event)
+		}
+	}
+
+	var analyses []TraceAnalysis
+	for _, s := range stages {
+		if len(s.events) > 0 {
+			analyses = append(analyses, analyzeStageEvents(s.name, s.events))
+		}
+	}
+	return analyses
+}
+
+// analyzeStageEvents analyzes the step events of one stage
+func analyzeStageEvents(stage string, events []TraceEvent) TraceAnalysis {
+	sort.SliceStable(events, func(i, j int) bool { return events[i].Ts < events[j].Ts })
+	micro := func(us int64) time.Duration { return time.Duration(us) * time.Microsecond }
+
+	index := make(map[string]int, len(events))
+	for i, event := range events {
+		index[event.Name] = i
+	}
+	deps := make([][]int, len(events))
+	dependents := make([][]int, len(events))
+	for i, event := range events {
+		if event.Args == nil {
+			continue
+		}
+		for _, name := range event.Args.Requires {
+			if j, ok := index[name]; ok && j != i {
+				deps[i] = append(deps[i], j)
+				dependents[j] = append(dependents[j], i)
+			}
+		}
+	}
+
+	// Earliest finish of each step when it starts as soon as its
+	// dependencies finish
+	analysis := TraceAnalysis{Stage: stage}
+	first, last := events[0].Ts, int64(0)
+	slots := map[int]bool{}
+	finish := make([]time.Duration, len(events))
+	earliest := make([]time.Duration, len(events))
+	state := make([]int, len(events)) // 0 new, 1 visiting, 2 done
+	var order []int
+	var visit func(i int)
+	visit = func(i int) {
+		if state[i] != 0 {
+			return
+		}
+		state[i] = 1
+		for _, j := range deps[i] {
+			visit(j)
+			if state[j] == 2 && finish[j] > earliest[i] {
+				earliest[i] = finish[j]
+			}
+		}
+		finish[i] = earliest[i] + micro(events[i].Dur)
+		state[i] = 2
+		order = append(order, i)
+	}
+	for i, event := range events {
+		visit(i)
+		analysis.Busy += micro(event.Dur)
+		slots[event.Tid] = true
+		if end := event.Ts + event.Dur; end > last {
+			last = end
+		}
+	}
+	analysis.Wall = micro(last - first)
+	analysis.Slots = len(slots)
+
+	end := 0
+	for i := range events {
+		if finish[i] > finish[end] {
+			end = i
+		}
+	}
+	analysis.CriticalLength = finish[end]
+
+	// Latest finish without delaying the critical path, in reverse
+	// dependency order
+	latest := make([]time.Duration, len(events))
+	for k := len(order) - 1; k >= 0; k-- {
+		i := order[k]
+		latest[i] = analysis.CriticalLength
+		for _, m := range dependents[i] {
+			if start := latest[m] - micro(events[m].Dur); start < latest[i] {
+				latest[i] = start
+			}
+		}
+	}
+
+	// Follow the dependency that finished last back from the end
+	critical := map[int]bool{}
+	for i := end; ; {
+		critical[i] = true
+		analysis.CriticalPath = append([]string{events[i].Name}, analysis.CriticalPath...)
+		next := -1
+		for _, j := range deps[i] {
+			if finish[j] == earliest[i] && (next < 0 || j < next) {
+				next = j
+			}
+		}
+		if next < 0 || earliest[i] == 0 {
+			break
+		}
+		i = next
+	}
+
+	for i, event := range events {
+		analysis.Steps = append(analysis.Steps, TraceStepAnalysis{
+			Name:          event.Name,
+			Start:         micro(event.Ts - first),
+			Duration:      micro(event.Dur),
+			EarliestStart: earliest[i],
+			Slack:         latest[i] - finish[i],
+			Critical:      critical[i],
+		})
+	}
+	return analysis
+}
+
+// FormatTraceAnalysis prints trace analyses with a table of steps
+func FormatTraceAnalysis(w io.Writer, analyses []TraceAnalysis) {
+	for i, a := range analyses {
+		if i > 0 {
+			fmt.Fprintln(w)
+		}
+		fmt.Fprintf(w, "Stage %s: wall time %s, critical path %s", a.Stage, formatReportDuration(a.Wall), formatReportDuration(a.CriticalLength))
+		if a.Wall > 0 {
+			fmt.Fprintf(w, " (%.0f%% of wall time)", float64(a.CriticalLength)/float64(a.Wall)*100)
+		}
+		fmt.Fprintln(w)
+		fmt.Fprintf(w, "Parallelism: %.2f steps on average over %d slots, %.0f%% utilisation\n", a.Parallelism(), a.Slots, a.Utilisation()*100)
+		fmt.Fprintf(w, "Critical path: %s\n\n", strings.Join(a.CriticalPath, " → "))
+
+		tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "STEP\tSTART\tDURATION\tSLACK\tPATH")
+		for _, step := range a.Steps {
+			mark := ""
+			if step.Critical {
+				mark = "critical"
+			}
+			fmt.Fprintf(tw, "%s\t+%s\t%s\t%s\t%s\n", step.Name, formatReportDuration(step.Start),
+				formatReportDuration(step.Duration), formatReportDuration(step.Slack), mark)
+		}
+		tw.Flush()
+	}
+}
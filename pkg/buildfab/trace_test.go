@@ -0,0 +1,200 @@
+package buildfab
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testTraceStage returns a stage where lint and compile run in parallel and
+// test waits for compile, which takes longest
+func testTraceStage() StageResult {
+	origin := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+	step := func(name string, start, duration time.Duration, requires ...string) StepResult {
+		return StepResult{
+			StepName:   name,
+			ActionName: name,
+			Status:     StepStatusOK,
+			Start:      origin.Add(start),
+			End:        origin.Add(start + duration),
+			Duration:   duration,
+			Requires:   requires,
+		}
+	}
+	stage := StageResult{StageName: "ci", Success: true, Start: origin, Duration: 5 * time.Second}
+	stage.Steps = []StepResult{
+		step("lint", 0, time.Second),
+		step("compile", 0, 2*time.Second),
+		step("test", 2*time.Second, 3*time.Second, "compile"),
+		step("docs", time.Second, time.Second, "lint"),
+		{StepName: "publish", ActionName: "publish", Status: StepStatusSkipped, Requires: []string{"test"}},
+	}
+	stage.Steps[1].Variant = "${{ os == 'linux' }}"
+	return stage
+}
+
+func TestNewTrace(t *testing.T) {
+	trace := NewTrace([]StageResult{testTraceStage()})
+
+	var process string
+	threads := map[int]string{}
+	steps := map[string]TraceEvent{}
+	for _, event := range trace.TraceEvents {
+		switch {
+		case event.Name == "process_name":
+			process = event.Args.Name
+		case event.Name == "thread_name":
+			threads[event.Tid] = event.Args.Name
+		case event.Ph == "X":
+			steps[event.Name] = event
+		}
+	}
+	if process != "stage ci" {
+		t.Errorf("process name = %q", process)
+	}
+	if len(threads) != 2 || threads[1] != "slot 1" || threads[2] != "slot 2" {
+		t.Errorf("threads = %v, want two slots", threads)
+	}
+	if len(steps) != 4 {
+		t.Fatalf("step events = %v, skipped steps should have none", steps)
+	}
+	compile := steps["compile"]
+	if compile.Ts != 0 || compile.Dur != 2000000 || compile.Cat != "step" {
+		t.Errorf("compile = %+v", compile)
+	}
+	if compile.Args.Action != "compile" || compile.Args.Variant != "${{ os == 'linux' }}" || compile.Args.Status != "ok" {
+		t.Errorf("compile args = %+v", compile.Args)
+	}
+	if steps["lint"].Tid == compile.Tid || steps["docs"].Tid != steps["lint"].Tid {
+		t.Errorf("parallel steps should use separate slots and docs reuse lint's: %+v", steps)
+	}
+	if test := steps["test"]; test.Ts != 2000000 || !reflect.DeepEqual(test.Args.Requires, []string{"compile"}) {
+		t.Errorf("test = %+v", test)
+	}
+}
+
+func TestReadTrace(t *testing.T) {
+	data, err := json.Marshal(NewTrace([]StageResult{testTraceStage()}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	trace, err := ReadTrace(bytes.NewReader(data))
+	if err != nil || len(trace.TraceEvents) != 7 {
+		t.Fatalf("ReadTrace() = %+v, %v", trace, err)
+	}
+
+	// The array form has only the events
+	trace, err = ReadTrace(strings.NewReader(`[{"name":"a","ph":"X","ts":0,"dur":10,"pid":1,"tid":1}]`))
+	if err != nil || len(trace.TraceEvents) != 1 || trace.TraceEvents[0].Dur != 10 {
+		t.Errorf("ReadTrace() array = %+v, %v", trace, err)
+	}
+
+	if _, err := ReadTrace(strings.NewReader("not json")); err == nil {
+		t.Error("ReadTrace() should reject invalid JSON")
+	}
+}
+
+func TestAnalyzeTrace(t *testing.T) {
+	analyses := AnalyzeTrace(NewTrace([]StageResult{testTraceStage()}))
+	if len(analyses) != 1 {
+		t.Fatalf("analyses = %+v", analyses)
+	}
+	a := analyses[0]
+	if a.Stage != "ci" || a.Wall != 5*time.Second || a.Busy != 7*time.Second || a.Slots != 2 {
+		t.Errorf("analysis = %+v", a)
+	}
+	if !reflect.DeepEqual(a.CriticalPath, []string{"compile", "test"}) || a.CriticalLength != 5*time.Second {
+		t.Errorf("critical path = %v (%s)", a.CriticalPath, a.CriticalLength)
+	}
+	if a.Parallelism() != 1.4 || a.Utilisation() != 0.7 {
+		t.Errorf("parallelism = %v, utilisation = %v", a.Parallelism(), a.Utilisation())
+	}
+
+	slack := map[string]time.Duration{}
+	for _, step := range a.Steps {
+		slack[step.Name] = step.Slack
+		if step.Critical != (step.Slack == 0) {
+			t.Errorf("%s: critical = %v with slack %s", step.Name, step.Critical, step.Slack)
+		}
+	}
+	want := map[string]time.Duration{"compile": 0, "test": 0, "lint": 3 * time.Second, "docs": 3 * time.Second}
+	if !reflect.DeepEqual(slack, want) {
+		t.Errorf("slack = %v, want %v", slack, want)
+	}
+
+	var out bytes.Buffer
+	FormatTraceAnalysis(&out, analyses)
+	for _, line := range []string{
+		"Stage ci: wall time 5s, critical path 5s (100% of wall time)",
+		"Parallelism: 1.40 steps on average over 2 slots, 70% utilisation",
+		"Critical path: compile → test",
+		"STEP     START  DURATION  SLACK  PATH",
+		"test     +2s    3s        0s     critical",
+	} {
+		if !strings.Contains(out.String(), line) {
+			t.Errorf("output missing %q:\n%s", line, out.String())
+		}
+	}
+}
+
+func TestSimpleRunner_Trace(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("trace tests use a POSIX shell")
+	}
+	config, err := LoadConfigFromBytes([]byte(`project:
+  name: test
+actions:
+  - name: build
+    run: "true"
+  - name: test
+    variants:
+      - when: "true"
+        run: "true"
+stages:
+  ci:
+    steps:
+      - action: build
+      - action: test
+        require: [build]
+`))
+	if err != nil {
+		t.Fatalf("LoadConfigFromBytes() error = %v", err)
+	}
+	dir := t.TempDir()
+	path := filepath.Join(dir, "out", "trace.json")
+	opts := DefaultSimpleRunOptions()
+	opts.WorkingDir = dir
+	opts.Output = io.Discard
+	opts.ErrorOutput = io.Discard
+	opts.TracePath = path
+	if err := NewSimpleRunner(config, opts).RunStage(context.Background(), "ci"); err != nil {
+		t.Fatalf("RunStage() error = %v", err)
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("trace not written: %v", err)
+	}
+	defer file.Close()
+	trace, err := ReadTrace(file)
+	if err != nil {
+		t.Fatalf("ReadTrace() error = %v", err)
+	}
+	analyses := AnalyzeTrace(trace)
+	if len(analyses) != 1 || !reflect.DeepEqual(analyses[0].CriticalPath, []string{"build", "test"}) {
+		t.Fatalf("analyses = %+v", analyses)
+	}
+	for _, event := range trace.TraceEvents {
+		if event.Name == "test" && (event.Args == nil || event.Args.Variant != "true") {
+			t.Errorf("test event = %+v, want the chosen variant", event)
+		}
+	}
+}
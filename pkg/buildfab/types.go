@@ -10,6 +10,7 @@ type StageResult struct {
 	StageName string
 	Success   bool
 	Steps     []StepResult
+	Start     time.Time
 	Duration  time.Duration
 	Error     error
 }
@@ -19,9 +20,16 @@ type StepResult struct {
 	StepName   string
 	ActionName string
 	Status     StepStatus
+	Start      time.Time // Zero for steps that did not run
+	End        time.Time
 	Duration   time.Duration
+	Requires   []string // Steps this step depends on
+	Variant    string   // Condition of the variant that ran
+	ExitCode   int      // Exit code of a failed run command
 	Output     string
+	Message    string // Result or failure message
 	Error      error
+	Diagnostics []Diagnostic // Problems extracted from the output of a failed step
 }
 
 // StepStatus represents the execution status of a step
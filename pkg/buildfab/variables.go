@@ -80,3 +80,115 @@ func InterpolateStep(step Step, variables map[string]string) (Step, error) {
 	
 	return step, nil
 }
+
+// variableReferencePattern matches ${{ ... }} references inside variable values
+var variableReferencePattern = regexp.MustCompile(`\$\{\{\s*([^}]+?)\s*\}\}`)
+
+// identifierPattern matches bare identifiers used inside expressions
+var identifierPattern = regexp.MustCompile(`[A-Za-z_][A-Za-z0-9_.]*`)
+
+// ResolveVariables merges variable layers and resolves references between them.
+// Layers are given from lowest to highest precedence, so later layers override
+// earlier ones. A value may reference other variables (${{ name }}) or contain an
+// expression (${{ os == 'linux' }}); self-referential definitions are reported as
+// a *VariableError.
+func ResolveVariables(layers ...map[string]string) (map[string]string, error) {
+	raw := make(map[string]string)
+	for _, layer := range layers {
+		for k, v := range layer {
+			raw[k] = v
+		}
+	}
+	
+	resolver := &variableResolver{
+		raw:      raw,
+		resolved: make(map[string]string, len(raw)),
+		visiting: make(map[string]bool),
+	}
+	
+	for name := range raw {
+		if _, err := resolver.resolve(name, nil); err != nil {
+			return nil, err
+		}
+	}
+	
+	return resolver.resolved, nil
+}
+
+// variableResolver resolves variable values depth-first with cycle detection
+type variableResolver struct {
+	raw      map[string]string
+	resolved map[string]string
+	visiting map[string]bool
+}
+
+// resolve returns the fully interpolated value of a variable
+func (v *variableResolver) resolve(name string, path []string) (string, error) {
+	if value, done := v.resolved[name]; done {
+		return value, nil
+	}
+	
+	path = append(path, name)
+	if v.visiting[name] {
+		return "", &VariableError{
+			Variable: path[0],
+			Message:  fmt.Sprintf("cycle detected: %s", strings.Join(path, " -> ")),
+		}
+	}
+	v.visiting[name] = true
+	defer delete(v.visiting, name)
+	
+	raw := v.raw[name]
+	var resolveErr error
+	value := variableReferencePattern.ReplaceAllStringFunc(raw, func(match string) string {
+		if resolveErr != nil {
+			return match
+		}
+		expr := strings.TrimSpace(variableReferencePattern.FindStringSubmatch(match)[1])
+		
+		// Plain reference to another variable
+		if _, exists := v.raw[expr]; exists {
+			value, err := v.resolve(expr, path)
+			if err != nil {
+				resolveErr = err
+				return match
+			}
+			return value
+		}
+		
+		// Expression: resolve every referenced variable first, then evaluate
+		for _, ident := range identifierPattern.FindAllString(expr, -1) {
+			if _, exists := v.raw[ident]; exists {
+				if _, err := v.resolve(ident, path); err != nil {
+					resolveErr = err
+					return match
+				}
+			}
+		}
+		result, err := parseExpression(expr, NewExpressionContext(v.resolved))
+		if err != nil {
+			// Leave unknown references untouched, like InterpolateVariables does
+			return match
+		}
+		return toString(result)
+	})
+	if resolveErr != nil {
+		return "", resolveErr
+	}
+	
+	v.resolved[name] = value
+	return value, nil
+}
+
+// InterpolateEnv interpolates variables into environment values
+func InterpolateEnv(env map[string]string, variables map[string]string) (map[string]string, error) {
+	result := make(map[string]string, len(env))
+	for k, v := range env {
+		interpolated, err := InterpolateVariables(v, variables)
+		if err != nil {
+			return nil, fmt.Errorf("failed to interpolate environment variable %s: %w", k, err)
+		}
+		result[k] = interpolated
+	}
+	return result, nil
+}
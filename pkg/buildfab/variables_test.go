@@ -1,6 +1,7 @@
 package buildfab
 
 import (
+	"strings"
 	"testing"
 )
 
@@ -122,3 +123,98 @@ func TestInterpolateStep(t *testing.T) {
 		t.Errorf("InterpolateStep() If = %v, want linux == linux", interpolated.If)
 	}
 }
+
+func TestResolveVariables(t *testing.T) {
+	tests := []struct {
+		name     string
+		layers   []map[string]string
+		expected map[string]string
+	}{
+		{
+			name: "later layers override earlier ones",
+			layers: []map[string]string{
+				{"target": "project", "keep": "yes"},
+				{"target": "stage"},
+				{"target": "step"},
+			},
+			expected: map[string]string{"target": "step", "keep": "yes"},
+		},
+		{
+			name: "values reference other variables",
+			layers: []map[string]string{
+				{"name": "app", "output": "bin/${{ name }}-${{ suffix }}"},
+				{"suffix": "linux"},
+			},
+			expected: map[string]string{"name": "app", "suffix": "linux", "output": "bin/app-linux"},
+		},
+		{
+			name: "values contain expressions",
+			layers: []map[string]string{
+				{"target": "linux", "is_linux": "${{ target == 'linux' }}"},
+			},
+			expected: map[string]string{"target": "linux", "is_linux": "true"},
+		},
+		{
+			name: "unknown references are left untouched",
+			layers: []map[string]string{
+				{"value": "${{ undefined }}"},
+			},
+			expected: map[string]string{"value": "${{ undefined }}"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := ResolveVariables(tt.layers...)
+			if err != nil {
+				t.Fatalf("ResolveVariables() error = %v", err)
+			}
+			for k, v := range tt.expected {
+				if result[k] != v {
+					t.Errorf("ResolveVariables()[%s] = %q, want %q", k, result[k], v)
+				}
+			}
+		})
+	}
+}
+
+func TestResolveVariablesCycle(t *testing.T) {
+	tests := []map[string]string{
+		{"a": "${{ a }}"},
+		{"a": "${{ b }}", "b": "x-${{ a }}"},
+		{"a": "${{ b == 'x' }}", "b": "${{ a }}"},
+	}
+
+	for _, vars := range tests {
+		_, err := ResolveVariables(vars)
+		if err == nil {
+			t.Errorf("ResolveVariables(%v) expected cycle error", vars)
+			continue
+		}
+		varErr, ok := err.(*VariableError)
+		if !ok {
+			t.Errorf("ResolveVariables(%v) error type = %T, want *VariableError", vars, err)
+			continue
+		}
+		if !strings.Contains(varErr.Message, "cycle detected") {
+			t.Errorf("ResolveVariables(%v) error = %v, want cycle detected", vars, err)
+		}
+	}
+}
+
+func TestInterpolateEnv(t *testing.T) {
+	env := map[string]string{
+		"GOFLAGS": "-tags=${{ tags }}",
+		"PLAIN":   "value",
+	}
+	result, err := InterpolateEnv(env, map[string]string{"tags": "netgo"})
+	if err != nil {
+		t.Fatalf("InterpolateEnv() error = %v", err)
+	}
+	if result["GOFLAGS"] != "-tags=netgo" {
+		t.Errorf("InterpolateEnv()[GOFLAGS] = %q, want %q", result["GOFLAGS"], "-tags=netgo")
+	}
+	if result["PLAIN"] != "value" {
+		t.Errorf("InterpolateEnv()[PLAIN] = %q, want %q", result["PLAIN"], "value")
+	}
+}
@@ -0,0 +1,337 @@
+package buildfab
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/AlexBurnes/version-go/pkg/version"
+)
+
+// versionCorePattern matches the numeric major.minor.patch part of a version
+var versionCorePattern = regexp.MustCompile(`^(v?)(\d+)\.(\d+)\.(\d+)(.*)$`)
+
+// conventionalCommitPattern parses a conventional commit subject
+var conventionalCommitPattern = regexp.MustCompile(`^([a-zA-Z]+)(\(([^()]+)\))?(!)?: (.+)$`)
+
+// changelogSections maps conventional commit types to changelog sections, in output order
+var changelogSections = []struct {
+	title string
+	types []string
+}{
+	{"Added", []string{"feat"}},
+	{"Changed", []string{"refactor", "perf", "revert"}},
+	{"Fixed", []string{"fix"}},
+	{"Documentation", []string{"docs"}},
+}
+
+// readVersionFile reads and trims a version file relative to the action's directory
+func readVersionFile(actx *ActionContext, file string) (string, error) {
+	data, err := os.ReadFile(actx.Path(file))
+	if err != nil {
+		return "", fmt.Errorf("failed to read %s: %w", file, err)
+	}
+	current := strings.TrimSpace(string(data))
+	if current == "" {
+		return "", fmt.Errorf("%s is empty", file)
+	}
+	return current, nil
+}
+
+// bumpVersion returns the next version for part: major, minor, patch or
+// prerelease. The v prefix is kept. A patch bump of a prerelease releases it,
+// a prerelease bump increments the trailing number of the prerelease or starts
+// preid.1 on the next patch version.
+func bumpVersion(current, part, preid string) (string, error) {
+	parsed, err := version.Parse(current)
+	if err != nil {
+		return "", fmt.Errorf("invalid version %s: %w", current, err)
+	}
+	match := versionCorePattern.FindStringSubmatch(current)
+	if match == nil {
+		return "", fmt.Errorf("invalid version %s", current)
+	}
+	prefix, suffix := match[1], match[5]
+	major, minor, patch := parsed.Major, parsed.Minor, parsed.Patch
+	prerelease := parsed.Type.String() == "prerelease"
+
+	var next string
+	switch part {
+	case "major":
+		next = fmt.Sprintf("%s%d.0.0", prefix, major+1)
+	case "minor":
+		next = fmt.Sprintf("%s%d.%d.0", prefix, major, minor+1)
+	case "patch":
+		if prerelease {
+			next = fmt.Sprintf("%s%d.%d.%d", prefix, major, minor, patch)
+		} else {
+			next = fmt.Sprintf("%s%d.%d.%d", prefix, major, minor, patch+1)
+		}
+	case "prerelease":
+		if prerelease {
+			next = prefix + fmt.Sprintf("%d.%d.%d", major, minor, patch) + incrementTrailingNumber(suffix)
+			break
+		}
+		core := fmt.Sprintf("%s%d.%d.%d", prefix, major, minor, patch+1)
+		// Use the first separator the version parser reads as a prerelease
+		for _, sep := range []string{"-", "~"} {
+			candidate := core + sep + preid + ".1"
+			if v, err := version.Parse(candidate); err == nil && v.Type.String() == "prerelease" {
+				next = candidate
+				break
+			}
+		}
+		if next == "" {
+			return "", fmt.Errorf("cannot create a prerelease of %s with identifier %s", current, preid)
+		}
+	default:
+		return "", fmt.Errorf("invalid version part %q: must be major, minor, patch or prerelease", part)
+	}
+
+	parsedNext, err := version.Parse(next)
+	if err != nil {
+		return "", fmt.Errorf("bumped version %s is invalid: %w", next, err)
+	}
+	if version.Compare(parsedNext, parsed) <= 0 {
+		return "", fmt.Errorf("bumped version %s is not greater than %s", next, current)
+	}
+	return next, nil
+}
+
+// incrementTrailingNumber increments the number at the end of a prerelease
+// suffix, or appends .1 when there is none
+func incrementTrailingNumber(suffix string) string {
+	i := len(suffix)
+	for i > 0 && suffix[i-1] >= '0' && suffix[i-1] <= '9' {
+		i--
+	}
+	if i == len(suffix) {
+		return suffix + ".1"
+	}
+	n, _ := strconv.Atoi(suffix[i:])
+	return suffix[:i] + strconv.Itoa(n+1)
+}
+
+// VersionBumpAction bumps the version in the version file.
+// Inputs: part - major, minor, patch or prerelease (default: patch),
+// preid - prerelease identifier (default: rc), file - version file (default: VERSION).
+type VersionBumpAction struct{}
+
+func (a *VersionBumpAction) Run(ctx context.Context) (Result, error) {
+	return a.RunWithContext(ctx, NewActionContext(nil))
+}
+
+func (a *VersionBumpAction) RunWithContext(ctx context.Context, actx *ActionContext) (Result, error) {
+	file := actx.Input("file", "VERSION")
+	current, err := readVersionFile(actx, file)
+	if err != nil {
+		return errorResult(err)
+	}
+
+	next, err := bumpVersion(current, actx.Input("part", "patch"), actx.Input("preid", "rc"))
+	if err != nil {
+		return errorResult(err)
+	}
+	if err := os.WriteFile(actx.Path(file), []byte(next+"\n"), 0644); err != nil {
+		return errorResult(fmt.Errorf("failed to write %s: %w", file, err))
+	}
+
+	actx.Outputs.Set("previous", current)
+	actx.Outputs.Set("version", next)
+	return Result{
+		Status:  StatusOK,
+		Message: fmt.Sprintf("Version bumped from %s to %s", current, next),
+	}, nil
+}
+
+func (a *VersionBumpAction) Description() string {
+	return "Bump the version in the VERSION file"
+}
+
+// VersionTagAction creates an annotated git tag for the current version.
+// Inputs: tag - tag name (default: version from file), file - version file
+// (default: VERSION), message - tag message (default: Release <tag>),
+// sign - create a signed tag (default: false).
+type VersionTagAction struct{}
+
+func (a *VersionTagAction) Run(ctx context.Context) (Result, error) {
+	return a.RunWithContext(ctx, NewActionContext(nil))
+}
+
+func (a *VersionTagAction) RunWithContext(ctx context.Context, actx *ActionContext) (Result, error) {
+	tag := actx.Input("tag", "")
+	if tag == "" {
+		current, err := readVersionFile(actx, actx.Input("file", "VERSION"))
+		if err != nil {
+			return errorResult(err)
+		}
+		tag = current
+	}
+	if _, err := version.Parse(tag); err != nil {
+		return errorResult(fmt.Errorf("invalid version tag %s: %w", tag, err))
+	}
+
+	if _, err := runGit(ctx, actx, "rev-parse", "-q", "--verify", "refs/tags/"+tag); err == nil {
+		return Result{
+			Status:  StatusError,
+			Message: fmt.Sprintf("Tag %s already exists, to check run:\n      git show %s", tag, tag),
+		}, fmt.Errorf("tag %s already exists", tag)
+	}
+
+	args := []string{"tag", "-a", tag, "-m", actx.Input("message", "Release "+tag)}
+	if actx.InputBool("sign", false) {
+		args[1] = "-s"
+	}
+	if _, err := runGit(ctx, actx, args...); err != nil {
+		return errorResult(err)
+	}
+
+	actx.Outputs.Set("tag", tag)
+	return Result{
+		Status:  StatusOK,
+		Message: fmt.Sprintf("Created tag %s", tag),
+	}, nil
+}
+
+func (a *VersionTagAction) Description() string {
+	return "Create an annotated tag for the current version"
+}
+
+// VersionChangelogAction adds a changelog section generated from the
+// conventional commits since the last tag.
+// Inputs: file - changelog file (default: CHANGELOG.md), version - section
+// version (default: from version_file), version_file - version file (default:
+// VERSION), since - start ref (default: last tag), date - section date
+// (default: today), write - update the file, otherwise only print (default: true).
+type VersionChangelogAction struct{}
+
+func (a *VersionChangelogAction) Run(ctx context.Context) (Result, error) {
+	return a.RunWithContext(ctx, NewActionContext(nil))
+}
+
+func (a *VersionChangelogAction) RunWithContext(ctx context.Context, actx *ActionContext) (Result, error) {
+	release := actx.Input("version", "")
+	if release == "" {
+		current, err := readVersionFile(actx, actx.Input("version_file", "VERSION"))
+		if err != nil {
+			return errorResult(err)
+		}
+		release = current
+	}
+	if _, err := version.Parse(release); err != nil {
+		return errorResult(fmt.Errorf("invalid version %s: %w", release, err))
+	}
+	release = strings.TrimPrefix(release, "v")
+
+	since := actx.Input("since", "")
+	if since == "" {
+		since, _ = runGit(ctx, actx, "describe", "--tags", "--abbrev=0")
+	}
+	logArgs := []string{"log", "--no-merges", "--format=%s"}
+	if since != "" {
+		logArgs = append(logArgs, since+"..HEAD")
+	}
+	output, err := runGit(ctx, actx, logArgs...)
+	if err != nil {
+		return errorResult(err)
+	}
+
+	date := actx.Input("date", time.Now().Format("2006-01-02"))
+	section := changelogSection(release, date, splitLines(output))
+	fmt.Fprint(actx.Stdout, section)
+	actx.Outputs.Set("changelog", section)
+
+	if !actx.InputBool("write", true) {
+		return Result{Status: StatusOK, Message: fmt.Sprintf("Changelog for %s generated", release)}, nil
+	}
+
+	file := actx.Input("file", "CHANGELOG.md")
+	existing, err := os.ReadFile(actx.Path(file))
+	if err != nil && !os.IsNotExist(err) {
+		return errorResult(fmt.Errorf("failed to read %s: %w", file, err))
+	}
+	updated, err := insertChangelogSection(string(existing), release, section)
+	if err != nil {
+		return errorResult(fmt.Errorf("failed to update %s: %w", file, err))
+	}
+	if err := os.WriteFile(actx.Path(file), []byte(updated), 0644); err != nil {
+		return errorResult(fmt.Errorf("failed to write %s: %w", file, err))
+	}
+
+	return Result{
+		Status:  StatusOK,
+		Message: fmt.Sprintf("Changelog for %s added to %s", release, file),
+	}, nil
+}
+
+func (a *VersionChangelogAction) Description() string {
+	return "Generate a changelog section from conventional commits"
+}
+
+// changelogSection renders a Keep a Changelog section from commit subjects.
+// Commits that are not conventional, or whose type has no section, are left out.
+func changelogSection(release, date string, subjects []string) string {
+	entries := make(map[string][]string)
+	for _, subject := range subjects {
+		match := conventionalCommitPattern.FindStringSubmatch(subject)
+		if match == nil {
+			continue
+		}
+		commitType, scope, breaking, description := strings.ToLower(match[1]), match[3], match[4] == "!", match[5]
+		entry := description
+		if scope != "" {
+			entry = fmt.Sprintf("**%s**: %s", scope, entry)
+		}
+		if breaking {
+			entry = "**BREAKING**: " + entry
+		}
+		entries[commitType] = append(entries[commitType], entry)
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "## [%s] - %s\n", release, date)
+	for _, section := range changelogSections {
+		var lines []string
+		for _, commitType := range section.types {
+			lines = append(lines, entries[commitType]...)
+		}
+		if len(lines) == 0 {
+			continue
+		}
+		fmt.Fprintf(&b, "\n### %s\n", section.title)
+		for _, line := range lines {
+			fmt.Fprintf(&b, "- %s\n", line)
+		}
+	}
+	return b.String()
+}
+
+// insertChangelogSection inserts section before the first released version,
+// after any Unreleased section. An empty changelog gets a heading.
+func insertChangelogSection(changelog, release, section string) (string, error) {
+	if strings.TrimSpace(changelog) == "" {
+		return "# Changelog\n\n" + section, nil
+	}
+
+	lines := strings.SplitAfter(changelog, "\n")
+	for _, line := range lines {
+		if strings.HasPrefix(line, "## ["+release+"]") {
+			return "", fmt.Errorf("section for %s already exists", release)
+		}
+	}
+	for i, line := range lines {
+		if !strings.HasPrefix(line, "## [") || strings.HasPrefix(strings.ToLower(line), "## [unreleased]") {
+			continue
+		}
+		return strings.Join(lines[:i], "") + section + "\n" + strings.Join(lines[i:], ""), nil
+	}
+
+	if !strings.HasSuffix(changelog, "\n") {
+		changelog += "\n"
+	}
+	return changelog + "\n" + section, nil
+}
@@ -0,0 +1,136 @@
+package buildfab
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestBumpVersion(t *testing.T) {
+	tests := []struct {
+		current string
+		part    string
+		want    string
+		err     bool
+	}{
+		{"v1.2.3", "patch", "v1.2.4", false},
+		{"v1.2.3", "minor", "v1.3.0", false},
+		{"v1.2.3", "major", "v2.0.0", false},
+		{"1.2.3", "patch", "1.2.4", false},
+		{"v1.2.3", "prerelease", "v1.2.4-rc.1", false},
+		{"v1.2.4-rc.1", "prerelease", "v1.2.4-rc.2", false},
+		{"v1.2.4-rc", "prerelease", "v1.2.4-rc.1", false},
+		{"v1.2.4-rc.2", "patch", "v1.2.4", false},
+		{"v1.2.3", "huge", "", true},
+		{"not-a-version", "patch", "", true},
+	}
+	for _, tt := range tests {
+		got, err := bumpVersion(tt.current, tt.part, "rc")
+		if (err != nil) != tt.err || got != tt.want {
+			t.Errorf("bumpVersion(%q, %q) = %q, %v, want %q (error %v)", tt.current, tt.part, got, err, tt.want, tt.err)
+		}
+	}
+}
+
+func TestVersionBumpAction(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "VERSION"), []byte("v0.9.1\n"), 0644); err != nil {
+		t.Fatalf("failed to write VERSION: %v", err)
+	}
+
+	result, actx, err := runInRepo(t, &VersionBumpAction{}, dir, map[string]string{"part": "minor"})
+	if err != nil || result.Status != StatusOK {
+		t.Fatalf("RunWithContext() = %+v, %v", result, err)
+	}
+	data, _ := os.ReadFile(filepath.Join(dir, "VERSION"))
+	if string(data) != "v0.10.0\n" {
+		t.Errorf("VERSION = %q, want v0.10.0", data)
+	}
+	if previous, _ := actx.Outputs.Get("previous"); previous != "v0.9.1" {
+		t.Errorf("output previous = %q", previous)
+	}
+	if next, _ := actx.Outputs.Get("version"); next != "v0.10.0" {
+		t.Errorf("output version = %q", next)
+	}
+}
+
+func TestVersionTagAction(t *testing.T) {
+	dir := newTestRepo(t)
+	writeRepoFile(t, dir, "VERSION", "v1.0.0\n")
+
+	result, _, err := runInRepo(t, &VersionTagAction{}, dir, nil)
+	if err != nil || result.Status != StatusOK {
+		t.Fatalf("RunWithContext() = %+v, %v", result, err)
+	}
+	if got := gitCmd(t, dir, "cat-file", "-t", "v1.0.0"); got != "tag" {
+		t.Errorf("v1.0.0 object type = %q, want annotated tag", got)
+	}
+	if got := gitCmd(t, dir, "tag", "-l", "--format=%(contents:subject)", "v1.0.0"); got != "Release v1.0.0" {
+		t.Errorf("tag message = %q", got)
+	}
+
+	if _, _, err := runInRepo(t, &VersionTagAction{}, dir, nil); err == nil {
+		t.Error("existing tag should fail")
+	}
+	if _, _, err := runInRepo(t, &VersionTagAction{}, dir, map[string]string{"tag": "latest"}); err == nil {
+		t.Error("non-version tag should fail")
+	}
+}
+
+func TestVersionChangelogAction(t *testing.T) {
+	dir := newTestRepo(t)
+	gitCmd(t, dir, "tag", "v1.0.0")
+	gitCmd(t, dir, "commit", "-q", "--allow-empty", "-m", "feat(cli): add doctor command")
+	gitCmd(t, dir, "commit", "-q", "--allow-empty", "-m", "fix: handle empty VERSION")
+	gitCmd(t, dir, "commit", "-q", "--allow-empty", "-m", "refactor!: drop legacy runner")
+	gitCmd(t, dir, "commit", "-q", "--allow-empty", "-m", "chore: tidy")
+	gitCmd(t, dir, "commit", "-q", "--allow-empty", "-m", "Random message")
+	writeRepoFile(t, dir, "VERSION", "v1.1.0\n")
+	writeRepoFile(t, dir, "CHANGELOG.md", "# Changelog\n\n## [Unreleased]\n\n## [1.0.0] - 2026-01-01\n\n### Added\n- First release\n")
+
+	result, _, err := runInRepo(t, &VersionChangelogAction{}, dir, map[string]string{"date": "2026-02-03"})
+	if err != nil || result.Status != StatusOK {
+		t.Fatalf("RunWithContext() = %+v, %v", result, err)
+	}
+
+	data, _ := os.ReadFile(filepath.Join(dir, "CHANGELOG.md"))
+	want := `# Changelog
+
+## [Unreleased]
+
+## [1.1.0] - 2026-02-03
+
+### Added
+- **cli**: add doctor command
+
+### Changed
+- **BREAKING**: drop legacy runner
+
+### Fixed
+- handle empty VERSION
+
+## [1.0.0] - 2026-01-01
+
+### Added
+- First release
+`
+	if string(data) != want {
+		t.Errorf("CHANGELOG.md =\n%s\nwant\n%s", data, want)
+	}
+
+	if _, _, err := runInRepo(t, &VersionChangelogAction{}, dir, nil); err == nil || !strings.Contains(err.Error(), "already exists") {
+		t.Errorf("second run should fail for an existing section, got %v", err)
+	}
+}
+
+func TestInsertChangelogSection(t *testing.T) {
+	got, err := insertChangelogSection("", "1.0.0", "## [1.0.0] - today\n")
+	if err != nil || got != "# Changelog\n\n## [1.0.0] - today\n" {
+		t.Errorf("empty changelog = %q, %v", got, err)
+	}
+	got, err = insertChangelogSection("# Changelog\n\n## [Unreleased]\n- wip", "1.0.0", "## [1.0.0] - today\n")
+	if err != nil || got != "# Changelog\n\n## [Unreleased]\n- wip\n\n## [1.0.0] - today\n" {
+		t.Errorf("changelog without releases = %q, %v", got, err)
+	}
+}